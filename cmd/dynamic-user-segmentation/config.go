@@ -4,10 +4,14 @@ import (
 	"errors"
 	"fmt"
 	zap_logger "github.com/romandnk/dynamic-user-segmentation-service/internal/logger/zap"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_link"
+	s3_report_store "github.com/romandnk/dynamic-user-segmentation-service/internal/report_store/s3"
 	http_server "github.com/romandnk/dynamic-user-segmentation-service/internal/server/http"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/storage/postgres"
 	"github.com/spf13/viper"
 	"go.uber.org/zap/zapcore"
+	"net/netip"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -35,15 +39,55 @@ var (
 	ErrServerInvalidPort              = errors.New("invalid port (from 0 to 65535 inclusively)")
 	ErrServerInvalidReadTimeout       = errors.New("invalid read timeout (must be only positive)")
 	ErrServerInvalidWriteTimeout      = errors.New("invalid write timeout (must be only positive)")
-	ErrParseTicker                    = errors.New("invalid auto add ticker (format 1h2m3s)")
+	ErrServerInvalidPublicBaseURL     = errors.New("invalid public base url (http or https url, e.g. https://example.com)")
+	ErrServerInvalidTrustedProxy      = errors.New("invalid trusted proxy (ip or cidr, e.g. 10.0.0.1 or 10.0.0.0/8)")
+	ErrParseTicker                    = errors.New("invalid auto add ticker (positive, format 1h2m3s)")
+	ErrParseExpireTicker              = errors.New("invalid expire ticker (positive, format 1h2m3s)")
+	ErrParseSnapshotTicker            = errors.New("invalid snapshot ticker (positive, format 1h2m3s)")
+	ErrParseStatsRollupTicker         = errors.New("invalid stats rollup ticker (positive, format 1h2m3s)")
+	ErrParseWindowTicker              = errors.New("invalid window ticker (positive, format 1h2m3s)")
+	ErrParseReportTicker              = errors.New("invalid report ticker (positive, format 1h2m3s)")
+	ErrInvalidReportWorkers           = errors.New("report workers must be only positive")
+	ErrParseReportRetention           = errors.New("invalid report retention (format 1h2m3s)")
+	ErrInvalidReportRetention         = errors.New("report retention cannot be less than zero")
+	ErrParseReportCleanupTicker       = errors.New("invalid report cleanup ticker (positive, format 1h2m3s)")
+	ErrInvalidReportStoreType         = errors.New("invalid report store type (local, s3)")
+	ErrReportLinkParseTTL             = errors.New("invalid ttl (format 1h2m3s)")
+	ErrS3EmptyEndpoint                = errors.New("empty endpoint")
+	ErrS3EmptyBucket                  = errors.New("empty bucket")
+	ErrS3EmptyAccessKey               = errors.New("empty access key")
+	ErrS3EmptySecretKey               = errors.New("empty secret key")
+	ErrS3ParsePresignExpiry           = errors.New("invalid presign expiry (format 1h2m3s)")
+	ErrS3InvalidPresignExpiry         = errors.New("presign expiry cannot be less than zero")
+)
+
+const (
+	reportStoreLocal = "local"
+	reportStoreS3    = "s3"
 )
 
 type Config struct {
-	ZapLogger     zap_logger.Config
-	Postgres      postgres.Config
-	Server        http_server.Config
-	Ticker        time.Duration
+	ZapLogger    zap_logger.Config
+	Postgres     postgres.Config
+	Server       http_server.Config
+	Ticker       time.Duration
+	ExpireTicker time.Duration
+	// SnapshotTicker is how often snapshots of user segments are taken to rebuild them at a moment faster.
+	SnapshotTicker time.Duration
+	// StatsRollupTicker is how often operations of finished days are rolled up into daily stats of segments.
+	StatsRollupTicker time.Duration
+	// WindowTicker is how often window events are recorded for segments whose window opened or closed.
+	WindowTicker  time.Duration
+	ReportTicker  time.Duration
+	ReportWorkers int
+	// ReportRetention is how long reports are kept, zero keeps them forever.
+	ReportRetention     time.Duration
+	ReportCleanupTicker time.Duration
+	// ReportStore is where report files are kept, local (PathToReports) or s3 (S3).
+	ReportStore   string
 	PathToReports string
+	S3            s3_report_store.Config
+	ReportLink    report_link.Config
 }
 
 func NewConfig(configPath string) (*Config, error) {
@@ -74,18 +118,106 @@ func NewConfig(configPath string) (*Config, error) {
 
 	tickerStr := viper.GetString("auto_add_ticker")
 	ticker, err := time.ParseDuration(tickerStr)
-	if err != nil {
+	if err != nil || ticker <= 0 {
 		return nil, fmt.Errorf("auto add ticker: %w", ErrParseTicker)
 	}
 
+	expireTickerStr := viper.GetString("expire_ticker")
+	expireTicker, err := time.ParseDuration(expireTickerStr)
+	if err != nil || expireTicker <= 0 {
+		return nil, fmt.Errorf("expire ticker: %w", ErrParseExpireTicker)
+	}
+
+	snapshotTickerStr := viper.GetString("snapshot_ticker")
+	snapshotTicker, err := time.ParseDuration(snapshotTickerStr)
+	if err != nil || snapshotTicker <= 0 {
+		return nil, fmt.Errorf("snapshot ticker: %w", ErrParseSnapshotTicker)
+	}
+
+	statsRollupTickerStr := viper.GetString("stats_rollup_ticker")
+	statsRollupTicker, err := time.ParseDuration(statsRollupTickerStr)
+	if err != nil || statsRollupTicker <= 0 {
+		return nil, fmt.Errorf("stats rollup ticker: %w", ErrParseStatsRollupTicker)
+	}
+
+	windowTickerStr := viper.GetString("window_ticker")
+	windowTicker, err := time.ParseDuration(windowTickerStr)
+	if err != nil || windowTicker <= 0 {
+		return nil, fmt.Errorf("window ticker: %w", ErrParseWindowTicker)
+	}
+
+	reportTickerStr := viper.GetString("report_ticker")
+	reportTicker, err := time.ParseDuration(reportTickerStr)
+	if err != nil || reportTicker <= 0 {
+		return nil, fmt.Errorf("report ticker: %w", ErrParseReportTicker)
+	}
+
+	reportWorkers := viper.GetInt("report_workers")
+	if reportWorkers <= 0 {
+		return nil, fmt.Errorf("report workers: %w", ErrInvalidReportWorkers)
+	}
+
+	var reportRetention time.Duration
+	if reportRetentionStr := viper.GetString("report_retention"); reportRetentionStr != "" {
+		reportRetention, err = time.ParseDuration(reportRetentionStr)
+		if err != nil {
+			return nil, fmt.Errorf("report retention: %w", ErrParseReportRetention)
+		}
+		if reportRetention < 0 {
+			return nil, fmt.Errorf("report retention: %w", ErrInvalidReportRetention)
+		}
+	}
+
+	var reportCleanupTicker time.Duration
+	if reportRetention > 0 {
+		reportCleanupTickerStr := viper.GetString("report_cleanup_ticker")
+		reportCleanupTicker, err = time.ParseDuration(reportCleanupTickerStr)
+		if err != nil || reportCleanupTicker <= 0 {
+			return nil, fmt.Errorf("report cleanup ticker: %w", ErrParseReportCleanupTicker)
+		}
+	}
+
 	pathToReports := viper.GetString("path_to_reports")
 
+	reportStore := viper.GetString("report_store.type")
+	if reportStore == "" {
+		reportStore = reportStoreLocal
+	}
+
+	var s3Config s3_report_store.Config
+	switch reportStore {
+	case reportStoreLocal:
+	case reportStoreS3:
+		s3Config, err = newS3Config()
+		if err != nil {
+			return nil, fmt.Errorf("s3 report store: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("report store: %w", ErrInvalidReportStoreType)
+	}
+
+	reportLinkConfig, err := newReportLinkConfig()
+	if err != nil {
+		return nil, fmt.Errorf("report link: %w", err)
+	}
+
 	config := &Config{
-		ZapLogger:     zapLoggerConfig,
-		Postgres:      postgresConfig,
-		Server:        serverConfig,
-		Ticker:        ticker,
-		PathToReports: pathToReports,
+		ZapLogger:           zapLoggerConfig,
+		Postgres:            postgresConfig,
+		Server:              serverConfig,
+		Ticker:              ticker,
+		ExpireTicker:        expireTicker,
+		SnapshotTicker:      snapshotTicker,
+		StatsRollupTicker:   statsRollupTicker,
+		WindowTicker:        windowTicker,
+		ReportTicker:        reportTicker,
+		ReportWorkers:       reportWorkers,
+		ReportRetention:     reportRetention,
+		ReportCleanupTicker: reportCleanupTicker,
+		ReportStore:         reportStore,
+		PathToReports:       pathToReports,
+		S3:                  s3Config,
+		ReportLink:          reportLinkConfig,
 	}
 
 	return config, nil
@@ -256,11 +388,24 @@ func newServerConfig() (http_server.Config, error) {
 		return http_server.Config{}, fmt.Errorf("write timeout: %w", ErrServerParseWriteTimeout)
 	}
 
+	publicBaseURL := viper.GetString("server.public_base_url")
+
+	var trustedProxies []netip.Prefix
+	for _, proxy := range viper.GetStringSlice("server.trusted_proxies") {
+		prefix, err := parseTrustedProxy(proxy)
+		if err != nil {
+			return http_server.Config{}, fmt.Errorf("trusted proxies: %w", ErrServerInvalidTrustedProxy)
+		}
+		trustedProxies = append(trustedProxies, prefix)
+	}
+
 	cfg := http_server.Config{
-		Host:         host,
-		Port:         port,
-		ReadTimeout:  parsedReadTimeout,
-		WriteTimeout: parsedWriteTimeout,
+		Host:           host,
+		Port:           port,
+		ReadTimeout:    parsedReadTimeout,
+		WriteTimeout:   parsedWriteTimeout,
+		PublicBaseURL:  publicBaseURL,
+		TrustedProxies: trustedProxies,
 	}
 
 	err = validateServerConfig(cfg)
@@ -271,6 +416,25 @@ func newServerConfig() (http_server.Config, error) {
 	return cfg, nil
 }
 
+// parseTrustedProxy parses a cidr or a single ip address of a proxy.
+func parseTrustedProxy(proxy string) (netip.Prefix, error) {
+	proxy = strings.TrimSpace(proxy)
+	if strings.Contains(proxy, "/") {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
 func validateServerConfig(cfg http_server.Config) error {
 	if cfg.Host == "" {
 		return fmt.Errorf("host: %w", ErrServerEmptyHost)
@@ -284,6 +448,98 @@ func validateServerConfig(cfg http_server.Config) error {
 	if cfg.WriteTimeout <= 0 {
 		return fmt.Errorf("write timeout: %w", ErrServerInvalidWriteTimeout)
 	}
+	if cfg.PublicBaseURL != "" {
+		u, err := url.Parse(cfg.PublicBaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("public base url: %w", ErrServerInvalidPublicBaseURL)
+		}
+	}
 
 	return nil
 }
+
+func newS3Config() (s3_report_store.Config, error) {
+	endpoint := viper.GetString("report_store.s3.endpoint")
+	publicEndpoint := viper.GetString("report_store.s3.public_endpoint")
+	accessKey := viper.GetString("S3_ACCESS_KEY")
+	secretKey := viper.GetString("S3_SECRET_KEY")
+	bucket := viper.GetString("report_store.s3.bucket")
+	region := viper.GetString("report_store.s3.region")
+	useSSL := viper.GetBool("report_store.s3.use_ssl")
+	presignExpiry := viper.GetString("report_store.s3.presign_expiry")
+	var parsedPresignExpiry time.Duration
+	if presignExpiry != "" {
+		var err error
+		parsedPresignExpiry, err = time.ParseDuration(presignExpiry)
+		if err != nil {
+			return s3_report_store.Config{}, fmt.Errorf("presign expiry: %w", ErrS3ParsePresignExpiry)
+		}
+	}
+
+	cfg := s3_report_store.Config{
+		Endpoint:       endpoint,
+		PublicEndpoint: publicEndpoint,
+		AccessKey:      accessKey,
+		SecretKey:      secretKey,
+		Bucket:         bucket,
+		Region:         region,
+		UseSSL:         useSSL,
+		PresignExpiry:  parsedPresignExpiry,
+	}
+
+	err := validateS3Config(cfg)
+	if err != nil {
+		return s3_report_store.Config{}, err
+	}
+
+	return cfg, nil
+}
+
+func validateS3Config(cfg s3_report_store.Config) error {
+	if cfg.Endpoint == "" {
+		return fmt.Errorf("endpoint: %w", ErrS3EmptyEndpoint)
+	}
+	if cfg.Bucket == "" {
+		return fmt.Errorf("bucket: %w", ErrS3EmptyBucket)
+	}
+	if cfg.AccessKey == "" {
+		return fmt.Errorf("access key: %w", ErrS3EmptyAccessKey)
+	}
+	if cfg.SecretKey == "" {
+		return fmt.Errorf("secret key: %w", ErrS3EmptySecretKey)
+	}
+	if cfg.PresignExpiry < 0 {
+		return fmt.Errorf("presign expiry: %w", ErrS3InvalidPresignExpiry)
+	}
+
+	return nil
+}
+
+func newReportLinkConfig() (report_link.Config, error) {
+	// keys are comma separated, the first one signs links
+	var keys []string
+	for _, key := range strings.Split(viper.GetString("REPORT_LINK_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	ttl := viper.GetString("report_link.ttl")
+	parsedTTL, err := time.ParseDuration(ttl)
+	if err != nil {
+		return report_link.Config{}, fmt.Errorf("ttl: %w", ErrReportLinkParseTTL)
+	}
+
+	cfg := report_link.Config{
+		Keys: keys,
+		TTL:  parsedTTL,
+	}
+
+	// the signer validates keys and ttl
+	_, err = report_link.NewSigner(cfg)
+	if err != nil {
+		return report_link.Config{}, err
+	}
+
+	return cfg, nil
+}
@@ -4,6 +4,10 @@ import (
 	"context"
 	"flag"
 	zap_logger "github.com/romandnk/dynamic-user-segmentation-service/internal/logger/zap"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_link"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_store"
+	local_report_store "github.com/romandnk/dynamic-user-segmentation-service/internal/report_store/local"
+	s3_report_store "github.com/romandnk/dynamic-user-segmentation-service/internal/report_store/s3"
 	http_server "github.com/romandnk/dynamic-user-segmentation-service/internal/server/http"
 	v1 "github.com/romandnk/dynamic-user-segmentation-service/internal/server/http/v1"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/service"
@@ -55,11 +59,33 @@ func main() {
 
 	logg.Info("using postgres storage")
 
+	// initialize report store
+	var reportStore report_store.ReportStore
+	switch config.ReportStore {
+	case reportStoreS3:
+		reportStore, err = s3_report_store.NewStore(ctx, config.S3)
+	default:
+		reportStore, err = local_report_store.NewStore(config.PathToReports)
+	}
+	if err != nil {
+		logg.Error("error initializing report store", zap.String("error", err.Error()))
+		return
+	}
+
+	logg.Info("using report store", zap.String("type", config.ReportStore))
+
 	// initialize services
-	services := service.NewService(postgresStorage, config.PathToReports)
+	services := service.NewService(postgresStorage, reportStore, config.ReportRetention)
+
+	// initialize report link signer
+	linkSigner, err := report_link.NewSigner(config.ReportLink)
+	if err != nil {
+		logg.Error("error initializing report link signer", zap.String("error", err.Error()))
+		return
+	}
 
 	// initialize http handler
-	handler := v1.NewHandler(services, logg, config.PathToReports)
+	handler := v1.NewHandler(services, logg, reportStore, config.Server.PublicBaseURL, config.Server.TrustedProxies, linkSigner)
 
 	// initialize http server
 	server := http_server.NewServer(config.Server, handler.InitRoutes())
@@ -92,14 +118,157 @@ func main() {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				err := services.User.AutoAddSegments(ctx)
+				ran, err := services.User.AutoAddSegments(ctx)
+				if err != nil {
+					logg.Error("auto add segments failed", zap.String("error", err.Error()))
+					continue
+				}
+				if !ran {
+					logg.Info("auto add segments skipped, another instance holds the lock")
+					continue
+				}
+				logg.Info("auto add segments ran")
+			}
+		}
+	}()
+
+	expireTicker := time.NewTicker(config.ExpireTicker)
+	defer expireTicker.Stop()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-expireTicker.C:
+				err := services.User.DeleteExpiredSegments(ctx)
+				if err != nil {
+					logg.Error("delete expired segments", zap.String("error", err.Error()))
+				}
+			}
+		}
+	}()
+
+	// snapshots of user segments keep rebuilding segments of a user at a moment fast
+	snapshotTicker := time.NewTicker(config.SnapshotTicker)
+	defer snapshotTicker.Stop()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-snapshotTicker.C:
+				taken, err := services.Operations.SnapshotUserSegments(ctx)
+				if err != nil {
+					logg.Error("snapshot user segments", zap.String("error", err.Error()))
+				}
+				if taken > 0 {
+					logg.Info("took snapshots of user segments", zap.Int("count", taken))
+				}
+			}
+		}
+	}()
+
+	// daily stats of segments keep aggregating stats of a segment fast
+	statsRollupTicker := time.NewTicker(config.StatsRollupTicker)
+	defer statsRollupTicker.Stop()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-statsRollupTicker.C:
+				rolledUp, err := services.Segment.RollupSegmentStats(ctx)
+				if err != nil {
+					logg.Error("rollup segment stats", zap.String("error", err.Error()))
+				}
+				if rolledUp > 0 {
+					logg.Info("rolled up segment stats", zap.Int("days", rolledUp))
+				}
+			}
+		}
+	}()
+
+	// windows of segments open and close between ticks, so window events are recorded on the next one
+	windowTicker := time.NewTicker(config.WindowTicker)
+	defer windowTicker.Stop()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-windowTicker.C:
+				changed, err := services.Segment.ApplySegmentWindows(ctx)
 				if err != nil {
-					logg.Error("auto add segments", zap.String("error", err.Error()))
+					logg.Error("apply segment windows", zap.String("error", err.Error()))
+				}
+				if changed > 0 {
+					logg.Info("applied segment windows", zap.Int("segments", changed))
 				}
 			}
 		}
 	}()
 
+	// report workers generate queued reports, each of them drains the queue on its tick
+	for i := 0; i < config.ReportWorkers; i++ {
+		go func() {
+			reportTicker := time.NewTicker(config.ReportTicker)
+			defer reportTicker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-reportTicker.C:
+					for {
+						processed, err := services.Operations.ProcessReport(ctx)
+						if err != nil {
+							logg.Error("process report", zap.String("error", err.Error()))
+						}
+						if !processed {
+							break
+						}
+					}
+				}
+			}
+		}()
+	}
+
+	// report janitor removes expired reports, reports are kept forever without retention
+	if config.ReportRetention > 0 {
+		// reports created without expiry, e.g. before the retention was configured, expire by the retention
+		updated, err := services.Operations.SetMissingReportsExpiry(ctx)
+		if err != nil {
+			logg.Error("set missing reports expiry", zap.String("error", err.Error()))
+		}
+		if updated > 0 {
+			logg.Info("set missing reports expiry", zap.Int("count", updated))
+		}
+
+		reportCleanupTicker := time.NewTicker(config.ReportCleanupTicker)
+		defer reportCleanupTicker.Stop()
+
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-reportCleanupTicker.C:
+					deleted, err := services.Operations.DeleteExpiredReports(ctx)
+					if err != nil {
+						logg.Error("delete expired reports", zap.String("error", err.Error()))
+					}
+					if deleted > 0 {
+						logg.Info("deleted expired reports", zap.Int("count", deleted))
+					}
+				}
+			}
+		}()
+	}
+
 	// starting http server
 	if err := server.Start(); err != nil {
 		logg.Error("error dynamic user segmentation service", zap.String("error", err.Error()))
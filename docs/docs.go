@@ -15,23 +15,23 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/segments": {
+        "/exclusion_groups": {
             "post": {
                 "consumes": [
                     "application/json"
                 ],
                 "tags": [
-                    "segment"
+                    "exclusion group"
                 ],
-                "summary": "Create segment",
+                "summary": "Create exclusion group of segments, a user can have only one of them",
                 "parameters": [
                     {
-                        "description": "slug is a segment name, auto_add_percentage is a percentage of users who will have this segment",
+                        "description": "segments must exist and no user can have two of them",
                         "name": "input",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/v1.createSegmentBodyRequest"
+                            "$ref": "#/definitions/v1.createExclusionGroupBodyRequest"
                         }
                     }
                 ],
@@ -52,25 +52,63 @@ const docTemplate = `{
                         }
                     }
                 }
-            },
-            "delete": {
-                "consumes": [
-                    "application/json"
-                ],
+            }
+        },
+        "/exclusion_groups/{slug}": {
+            "get": {
                 "tags": [
-                    "segment"
+                    "exclusion group"
                 ],
-                "summary": "Delete segment",
+                "summary": "Get exclusion group with its segments",
                 "parameters": [
                     {
-                        "description": "slug-segment name to delete",
-                        "name": "input",
-                        "in": "body",
-                        "required": true,
+                        "type": "string",
+                        "description": "exclusion group slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/v1.deleteSegmentBodyRequest"
+                            "$ref": "#/definitions/v1.exclusionGroupResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
                         }
                     }
+                }
+            },
+            "delete": {
+                "tags": [
+                    "exclusion group"
+                ],
+                "summary": "Delete exclusion group, its segments stay with their users",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "exclusion group slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
                 ],
                 "responses": {
                     "200": {
@@ -82,6 +120,12 @@ const docTemplate = `{
                             "$ref": "#/definitions/v1.response"
                         }
                     },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
@@ -91,25 +135,100 @@ const docTemplate = `{
                 }
             }
         },
-        "/users": {
+        "/experiments": {
             "post": {
                 "consumes": [
                     "application/json"
                 ],
                 "tags": [
-                    "user"
+                    "experiment"
                 ],
-                "summary": "Add and delete user segments by his id",
+                "summary": "Create experiment with variant segments",
                 "parameters": [
                     {
-                        "description": "user segments to add and delete and his user id",
+                        "description": "variants are new segments, weight is a percentage of users in the variant (sum is at most 100)",
                         "name": "input",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/v1.addAndDeleteUserSegmentsBodyRequest"
+                            "$ref": "#/definitions/v1.createExperimentBodyRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/experiments/{slug}": {
+            "get": {
+                "tags": [
+                    "experiment"
+                ],
+                "summary": "Get experiment with its variants and their numbers of users",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "experiment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.experimentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
                         }
                     }
+                }
+            },
+            "delete": {
+                "tags": [
+                    "experiment"
+                ],
+                "summary": "Delete experiment, its variant segments stay with their users",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "experiment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
                 ],
                 "responses": {
                     "200": {
@@ -121,6 +240,12 @@ const docTemplate = `{
                             "$ref": "#/definitions/v1.response"
                         }
                     },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
@@ -130,32 +255,75 @@ const docTemplate = `{
                 }
             }
         },
-        "/users/active_segments": {
+        "/segments": {
+            "get": {
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Get segments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "slug prefix",
+                        "name": "prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "max number of segments (from 1 to 100, default 20)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "number of segments to skip",
+                        "name": "offset",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.getSegmentsBodyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            },
             "post": {
                 "consumes": [
                     "application/json"
                 ],
                 "tags": [
-                    "user"
+                    "segment"
                 ],
-                "summary": "Get active user segments",
+                "summary": "Create segment",
                 "parameters": [
                     {
-                        "description": "user id to get his segments",
+                        "description": "slug is a segment name, auto_add_percentage is a percentage of users who will have this segment, parent is an optional segment whose users only can have this one, rule is an optional condition over user attributes (e.g. country == \\",
                         "name": "input",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/v1.getActiveUserSegmentsBodyRequest"
+                            "$ref": "#/definitions/v1.createSegmentBodyRequest"
                         }
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "OK",
-                        "schema": {
-                            "$ref": "#/definitions/v1.getActiveUserSegmentsBodyResponse"
-                        }
+                    "201": {
+                        "description": "Created"
                     },
                     "400": {
                         "description": "Bad Request",
@@ -170,34 +338,29 @@ const docTemplate = `{
                         }
                     }
                 }
-            }
-        },
-        "/users/report": {
-            "post": {
+            },
+            "delete": {
                 "consumes": [
                     "application/json"
                 ],
                 "tags": [
-                    "operation"
+                    "segment"
                 ],
-                "summary": "Create a CSV file locally and return url to download a file",
+                "summary": "Delete segment",
                 "parameters": [
                     {
-                        "description": "date format year-month",
+                        "description": "slug-segment name to delete",
                         "name": "input",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/v1.createCSVRepostAndURLBodyRequest"
+                            "$ref": "#/definitions/v1.deleteSegmentBodyRequest"
                         }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "OK",
-                        "schema": {
-                            "$ref": "#/definitions/v1.createCSVRepostAndURLBodyResponse"
-                        }
+                        "description": "OK"
                     },
                     "400": {
                         "description": "Bad Request",
@@ -214,19 +377,72 @@ const docTemplate = `{
                 }
             }
         },
-        "/users/report/{id}": {
+        "/segments/{slug}": {
             "get": {
                 "tags": [
-                    "operation"
+                    "segment"
                 ],
-                "summary": "Get report CSV file to download",
+                "summary": "Get segment with its number of users",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "report id",
-                        "name": "input",
+                        "description": "segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.segmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Update segment auto add percentage, description and owner",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "segment slug",
+                        "name": "slug",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "description": "fields to change, trim_auto_added removes auto added users out of the lowered percentage",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/v1.updateSegmentBodyRequest"
+                        }
                     }
                 ],
                 "responses": {
@@ -239,6 +455,12 @@ const docTemplate = `{
                             "$ref": "#/definitions/v1.response"
                         }
                     },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
@@ -247,61 +469,1003 @@ const docTemplate = `{
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "v1.addAndDeleteUserSegmentsBodyRequest": {
-            "type": "object",
-            "properties": {
-                "segments_to_add": {
-                    "type": "array",
+        },
+        "/segments/{slug}/stats": {
+            "get": {
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Get segment size and its adds and deletes per day",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "first day (year-month-day, e.g. 2023-08-01)",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "last day inclusively (year-month-day, e.g. 2023-08-31), the last 30 days if both are empty",
+                        "name": "to",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.getSegmentStatsBodyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/users": {
+            "get": {
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Get users in segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "max number of users (from 1 to 1000, default 100)",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.getSegmentUsersBodyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/window_events": {
+            "get": {
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Get openings and closings of segment window",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.getSegmentWindowEventsBodyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/users": {
+            "post": {
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user"
+                ],
+                "summary": "Add and delete user segments by his id",
+                "parameters": [
+                    {
+                        "description": "user segments to add (slug or object with optional expires_at/ttl) and delete and his user id",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/v1.addAndDeleteUserSegmentsBodyRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/active_segments": {
+            "post": {
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user"
+                ],
+                "summary": "Get active user segments",
+                "parameters": [
+                    {
+                        "description": "user id to get his segments",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/v1.getActiveUserSegmentsBodyRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.getActiveUserSegmentsBodyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/bulk": {
+            "post": {
+                "description": "Accepts a JSON body, or a CSV (text/csv, one user id per line) or NDJSON (application/x-ndjson, {\"user_id\": 1} per line) upload with segments in query parameters.",
+                "consumes": [
+                    "application/json",
+                    "text/csv",
+                    "application/x-ndjson"
+                ],
+                "tags": [
+                    "user"
+                ],
+                "summary": "Add and delete segments of many users",
+                "parameters": [
+                    {
+                        "description": "user ids and their segments to add and delete",
+                        "name": "input",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/v1.bulkUpdateUserSegmentsBodyRequest"
+                        }
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "csv",
+                        "description": "segments to add for CSV and NDJSON uploads",
+                        "name": "segments_to_add",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "csv",
+                        "description": "segments to delete for CSV and NDJSON uploads",
+                        "name": "segments_to_delete",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.bulkUpdateUserSegmentsBodyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/register": {
+            "post": {
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user"
+                ],
+                "summary": "Register user",
+                "parameters": [
+                    {
+                        "description": "user id to register",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/v1.createUserBodyRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/report": {
+            "post": {
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "operation"
+                ],
+                "summary": "Queue a report (csv, ndjson, xlsx or parquet) and return its id, url to download the file and url to check its status",
+                "parameters": [
+                    {
+                        "description": "month (year-month) or range from/to and optional filters",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/v1.createCSVRepostAndURLBodyRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/v1.createCSVRepostAndURLBodyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/report/{id}": {
+            "get": {
+                "description": "The link must be the signed one returned on report creation and not expired.\nRedirects to a presigned link when the report store supports it.",
+                "tags": [
+                    "operation"
+                ],
+                "summary": "Get report file to download, the content type and extension follow the report format.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "report id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "unix time the link expires at",
+                        "name": "expires",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "link signature",
+                        "name": "sig",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "307": {
+                        "description": "Temporary Redirect"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "tags": [
+                    "operation"
+                ],
+                "summary": "Delete report and its file, a report which is being generated cannot be deleted",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "report id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/report/{id}/status": {
+            "get": {
+                "tags": [
+                    "operation"
+                ],
+                "summary": "Get status of report generation (pending, running, done, failed), period, number of rows, file size and expiry",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "report id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.reportStatusResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}": {
+            "delete": {
+                "tags": [
+                    "user"
+                ],
+                "summary": "Delete user with all its segments",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "user id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/attributes": {
+            "put": {
+                "description": "Attributes replace the previous ones, the user gets segments whose rule they match and loses rule added segments whose rule they don't match anymore.",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user"
+                ],
+                "summary": "Set attributes of user",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "user id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "attribute names (lowercase letters, digits and underscores) to values (strings, numbers and bools), 50 attributes at most",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/v1.setUserAttributesBodyRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/history": {
+            "get": {
+                "description": "Every operation tells what made the change: manual update, auto add, segment update or deletion, expiry or user deletion, removal of the parent segment or a segment rule.",
+                "tags": [
+                    "user"
+                ],
+                "summary": "Get history of user segments, newest first",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "user id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "start of the range inclusively (RFC3339 or year-month-day)",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "end of the range exclusively (RFC3339 or year-month-day)",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "max number of operations (from 1 to 1000, default 100)",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.getUserHistoryBodyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/segments": {
+            "get": {
+                "description": "Segments are rebuilt from the history of the user, so they are known for deleted users and segments too.",
+                "tags": [
+                    "user"
+                ],
+                "summary": "Get segments the user had at the moment",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "user id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "moment (RFC3339 or year-month-day)",
+                        "name": "at",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.getUserSegmentsAtBodyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/v1.response"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "v1.addAndDeleteUserSegmentsBodyRequest": {
+            "type": "object",
+            "properties": {
+                "segments_to_add": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/v1.segmentToAddRequest"
+                    }
+                },
+                "segments_to_delete": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "v1.bulkUpdateUserSegmentsBodyRequest": {
+            "type": "object",
+            "properties": {
+                "segments_to_add": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/v1.segmentToAddRequest"
+                    }
+                },
+                "segments_to_delete": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "user_ids": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "v1.bulkUpdateUserSegmentsBodyResponse": {
+            "type": "object",
+            "properties": {
+                "failed": {
+                    "type": "integer"
+                },
+                "results": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/v1.bulkUserResultResponse"
+                    }
+                },
+                "succeeded": {
+                    "type": "integer"
+                }
+            }
+        },
+        "v1.bulkUserResultResponse": {
+            "type": "object",
+            "properties": {
+                "added": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "deleted": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "error": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "v1.createCSVRepostAndURLBodyRequest": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string"
+                },
+                "auto_add": {
+                    "type": "boolean"
+                },
+                "date": {
+                    "type": "string"
+                },
+                "format": {
+                    "type": "string",
+                    "enum": [
+                        "csv",
+                        "ndjson",
+                        "xlsx",
+                        "parquet"
+                    ]
+                },
+                "from": {
+                    "type": "string"
+                },
+                "gzip": {
+                    "type": "boolean"
+                },
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "to": {
+                    "type": "string"
+                },
+                "user_ids": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "v1.createCSVRepostAndURLBodyResponse": {
+            "type": "object",
+            "properties": {
+                "report_id": {
+                    "type": "string"
+                },
+                "report_url": {
+                    "type": "string"
+                },
+                "status_url": {
+                    "type": "string"
+                }
+            }
+        },
+        "v1.createExclusionGroupBodyRequest": {
+            "type": "object",
+            "properties": {
+                "segments": {
+                    "type": "array",
                     "items": {
                         "type": "string"
                     }
                 },
-                "segments_to_delete": {
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "v1.createExperimentBodyRequest": {
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "type": "string"
+                },
+                "variants": {
                     "type": "array",
                     "items": {
-                        "type": "string"
+                        "$ref": "#/definitions/v1.experimentVariantRequest"
                     }
+                }
+            }
+        },
+        "v1.createSegmentBodyRequest": {
+            "type": "object",
+            "properties": {
+                "auto_add_percentage": {
+                    "type": "string"
+                },
+                "ends_at": {
+                    "type": "string"
+                },
+                "parent": {
+                    "type": "string"
                 },
+                "rule": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "starts_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "v1.createUserBodyRequest": {
+            "type": "object",
+            "properties": {
                 "user_id": {
                     "type": "integer"
                 }
             }
         },
-        "v1.createCSVRepostAndURLBodyRequest": {
+        "v1.deleteSegmentBodyRequest": {
             "type": "object",
             "properties": {
-                "date": {
+                "slug": {
                     "type": "string"
                 }
             }
         },
-        "v1.createCSVRepostAndURLBodyResponse": {
+        "v1.exclusionGroupResponse": {
             "type": "object",
             "properties": {
-                "report_url": {
+                "created_at": {
+                    "type": "string"
+                },
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "slug": {
                     "type": "string"
                 }
             }
         },
-        "v1.createSegmentBodyRequest": {
+        "v1.experimentResponse": {
             "type": "object",
             "properties": {
-                "auto_add_percentage": {
+                "created_at": {
                     "type": "string"
                 },
                 "slug": {
                     "type": "string"
+                },
+                "variants": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/v1.experimentVariantResponse"
+                    }
+                }
+            }
+        },
+        "v1.experimentVariantRequest": {
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "type": "string"
+                },
+                "weight": {
+                    "type": "integer"
                 }
             }
         },
-        "v1.deleteSegmentBodyRequest": {
+        "v1.experimentVariantResponse": {
             "type": "object",
             "properties": {
                 "slug": {
                     "type": "string"
+                },
+                "users_count": {
+                    "type": "integer"
+                },
+                "weight": {
+                    "type": "integer"
                 }
             }
         },
@@ -324,6 +1488,134 @@ const docTemplate = `{
                 }
             }
         },
+        "v1.getSegmentStatsBodyResponse": {
+            "type": "object",
+            "properties": {
+                "auto_added_users": {
+                    "type": "integer"
+                },
+                "days": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/v1.segmentDayStatsResponse"
+                    }
+                },
+                "manual_users": {
+                    "type": "integer"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "users": {
+                    "type": "integer"
+                }
+            }
+        },
+        "v1.getSegmentUsersBodyResponse": {
+            "type": "object",
+            "properties": {
+                "next_cursor": {
+                    "type": "string"
+                },
+                "users": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/v1.segmentUserResponse"
+                    }
+                }
+            }
+        },
+        "v1.getSegmentWindowEventsBodyResponse": {
+            "type": "object",
+            "properties": {
+                "events": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/v1.segmentWindowEventResponse"
+                    }
+                }
+            }
+        },
+        "v1.getSegmentsBodyResponse": {
+            "type": "object",
+            "properties": {
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/v1.segmentResponse"
+                    }
+                }
+            }
+        },
+        "v1.getUserHistoryBodyResponse": {
+            "type": "object",
+            "properties": {
+                "next_cursor": {
+                    "type": "string"
+                },
+                "operations": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/v1.userOperationResponse"
+                    }
+                }
+            }
+        },
+        "v1.getUserSegmentsAtBodyResponse": {
+            "type": "object",
+            "properties": {
+                "at": {
+                    "type": "string"
+                },
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "v1.reportStatusResponse": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "format": {
+                    "type": "string"
+                },
+                "from": {
+                    "type": "string"
+                },
+                "gzip": {
+                    "type": "boolean"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "rows": {
+                    "type": "integer"
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "to": {
+                    "type": "string"
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
         "v1.response": {
             "type": "object",
             "properties": {
@@ -337,6 +1629,154 @@ const docTemplate = `{
                     "type": "string"
                 }
             }
+        },
+        "v1.segmentDayStatsResponse": {
+            "type": "object",
+            "properties": {
+                "auto_adds": {
+                    "type": "integer"
+                },
+                "date": {
+                    "type": "string"
+                },
+                "deletes": {
+                    "type": "integer"
+                },
+                "manual_adds": {
+                    "type": "integer"
+                }
+            }
+        },
+        "v1.segmentResponse": {
+            "type": "object",
+            "properties": {
+                "auto_add_percentage": {
+                    "type": "integer"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "ends_at": {
+                    "type": "string"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "parent": {
+                    "type": "string"
+                },
+                "rule": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "starts_at": {
+                    "type": "string"
+                },
+                "users_count": {
+                    "type": "integer"
+                }
+            }
+        },
+        "v1.segmentToAddRequest": {
+            "type": "object",
+            "properties": {
+                "expires_at": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "ttl": {
+                    "type": "string"
+                }
+            }
+        },
+        "v1.segmentUserResponse": {
+            "type": "object",
+            "properties": {
+                "added_at": {
+                    "type": "string"
+                },
+                "auto_add": {
+                    "type": "boolean"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "v1.segmentWindowEventResponse": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string"
+                },
+                "date": {
+                    "type": "string"
+                }
+            }
+        },
+        "v1.setUserAttributesBodyRequest": {
+            "type": "object",
+            "additionalProperties": {}
+        },
+        "v1.updateSegmentBodyRequest": {
+            "type": "object",
+            "properties": {
+                "auto_add_percentage": {
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "trim_auto_added": {
+                    "type": "boolean"
+                }
+            }
+        },
+        "v1.userOperationResponse": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string"
+                },
+                "auto_add": {
+                    "type": "boolean"
+                },
+                "date": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "segment_slug": {
+                    "type": "string"
+                },
+                "source": {
+                    "type": "string",
+                    "enum": [
+                        "manual",
+                        "auto_add",
+                        "segment_update",
+                        "segment_delete",
+                        "expire",
+                        "user_delete",
+                        "parent_delete",
+                        "rule"
+                    ]
+                }
+            }
         }
     }
 }`
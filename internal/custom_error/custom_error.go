@@ -8,3 +8,13 @@ type CustomError struct {
 func (c CustomError) Error() string {
 	return c.Message
 }
+
+// NotFoundError is returned when the requested entity doesn't exist.
+type NotFoundError struct {
+	Field   string
+	Message string
+}
+
+func (n NotFoundError) Error() string {
+	return n.Message
+}
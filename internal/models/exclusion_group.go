@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// ExclusionGroup is a set of segments which never coexist on one user.
+type ExclusionGroup struct {
+	Slug      string
+	Segments  []string
+	CreatedAt time.Time
+}
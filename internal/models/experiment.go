@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// Experiment splits users between its variant segments by weights. Weights are percentages of all users,
+// their sum is at most 100 and users out of the sum are in none of the variants.
+type Experiment struct {
+	Slug      string
+	Salt      string
+	CreatedAt time.Time
+	Variants  []ExperimentVariant
+}
+
+type ExperimentVariant struct {
+	Slug       string
+	Weight     int
+	UsersCount int
+}
+
+// Variant returns the variant segment of the user. The user bucket is taken by the experiment salt and
+// variants take consecutive ranges of buckets by their weights, so every user is in one variant at most.
+func (e Experiment) Variant(userID int) (string, bool) {
+	bucket := bucket(e.Salt, userID)
+
+	upperBound := 0
+	for _, variant := range e.Variants {
+		upperBound += variant.Weight
+		if bucket < upperBound {
+			return variant.Slug, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestExperiment_Variant(t *testing.T) {
+	experiment := Experiment{
+		Slug: "CHECKOUT",
+		Salt: "salt",
+		Variants: []ExperimentVariant{
+			{Slug: "CHECKOUT_CONTROL", Weight: 50},
+			{Slug: "CHECKOUT_A", Weight: 25},
+			{Slug: "CHECKOUT_B", Weight: 15},
+		},
+	}
+
+	const users = 10000
+
+	inVariants := make(map[string]int)
+	for userID := 1; userID <= users; userID++ {
+		variant, ok := experiment.Variant(userID)
+
+		sameVariant, sameOk := experiment.Variant(userID)
+		require.Equal(t, variant, sameVariant, "variant must be stable")
+		require.Equal(t, ok, sameOk, "variant must be stable")
+
+		if ok {
+			inVariants[variant]++
+		} else {
+			require.Empty(t, variant)
+		}
+	}
+
+	// users are split by weights and about 10% of them are out of the experiment
+	require.InDelta(t, users*0.5, inVariants["CHECKOUT_CONTROL"], users*0.02)
+	require.InDelta(t, users*0.25, inVariants["CHECKOUT_A"], users*0.02)
+	require.InDelta(t, users*0.15, inVariants["CHECKOUT_B"], users*0.02)
+}
@@ -2,9 +2,44 @@ package models
 
 import "time"
 
+// Sources of operations, they tell what made the change.
+const (
+	OperationSourceManual        = "manual"         // update of user segments
+	OperationSourceAutoAdd       = "auto_add"       // auto add job or registration of the user
+	OperationSourceSegmentUpdate = "segment_update" // auto added users trimmed on lowering the percentage
+	OperationSourceSegmentDelete = "segment_delete" // deletion of the segment
+	OperationSourceExpire        = "expire"         // expiry of the user segment
+	OperationSourceUserDelete    = "user_delete"    // deletion of the user
+	OperationSourceParentDelete  = "parent_delete"  // removal of the parent segment from the user
+	OperationSourceRule          = "rule"           // attributes of the user started or stopped matching the segment rule
+)
+
 type Operation struct {
+	ID          int
 	UserID      int
 	SegmentSlug string
 	Date        time.Time
 	Action      string
+	AutoAdd     bool
+	Source      string
+}
+
+// OperationFilter selects operations made in [From, To). Empty UserIDs and Segments,
+// empty Action and nil AutoAdd don't filter anything.
+type OperationFilter struct {
+	From     time.Time
+	To       time.Time
+	UserIDs  []int
+	Segments []string
+	Action   string
+	AutoAdd  *bool
+}
+
+// UserHistoryFilter selects a page of operations of the user made in [From, To) with id less than BeforeID.
+// Zero From, To and BeforeID don't filter anything.
+type UserHistoryFilter struct {
+	From     time.Time
+	To       time.Time
+	BeforeID int
+	Limit    int
 }
@@ -0,0 +1,57 @@
+package models
+
+import "time"
+
+const (
+	ReportStatusPending = "pending"
+	ReportStatusRunning = "running"
+	ReportStatusDone    = "done"
+	ReportStatusFailed  = "failed"
+)
+
+const (
+	ReportFormatCSV     = "csv"
+	ReportFormatNDJSON  = "ndjson"
+	ReportFormatXLSX    = "xlsx"
+	ReportFormatParquet = "parquet"
+)
+
+var reportContentTypes = map[string]string{
+	ReportFormatCSV:     "text/csv",
+	ReportFormatNDJSON:  "application/x-ndjson",
+	ReportFormatXLSX:    "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	ReportFormatParquet: "application/vnd.apache.parquet",
+}
+
+// Report is a job generating a report file of operations selected by Filter.
+type Report struct {
+	ID        string
+	Status    string
+	Filter    OperationFilter
+	Format    string
+	Gzip      bool
+	Rows      int64
+	Size      int64
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// ExpiresAt is the time after which the report is removed, nil if it's kept forever.
+	ExpiresAt *time.Time
+}
+
+// FileName returns the name of the report file, the extension follows the format.
+func (r Report) FileName() string {
+	name := r.ID + "." + r.Format
+	if r.Gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+// ContentType returns the media type of the report file.
+func (r Report) ContentType() string {
+	if r.Gzip {
+		return "application/gzip"
+	}
+	return reportContentTypes[r.Format]
+}
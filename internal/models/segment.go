@@ -1,6 +1,78 @@
 package models
 
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+	"time"
+)
+
 type Segment struct {
-	Slug       string
-	Percentage int
+	Slug        string
+	Percentage  int
+	Salt        string
+	Parent      string     // only users in the parent segment can have the segment, empty when there is no parent
+	Rule        string     // users whose attributes match the rule get the segment, empty when there is no rule
+	StartsAt    *time.Time // the segment takes effect from StartsAt, nil when it has no start
+	EndsAt      *time.Time // the segment takes effect until EndsAt, nil when it has no end
+	Description string
+	Owner       string
+	CreatedAt   time.Time
+	UsersCount  int
+}
+
+// SegmentStats is the current number of users in the segment, manually and auto added,
+// and the number of changes of the segment per day (UTC).
+type SegmentStats struct {
+	Slug           string
+	Users          int
+	AutoAddedUsers int
+	Days           []SegmentDayStats
+}
+
+type SegmentDayStats struct {
+	Day        time.Time
+	ManualAdds int
+	AutoAdds   int
+	Deletes    int
+}
+
+// SegmentWindowEvent is an opening or a closing of the window of the segment noticed by the scheduler.
+type SegmentWindowEvent struct {
+	Action string // open or close
+	Date   time.Time
+}
+
+// SegmentUpdate holds segment fields to change, nil fields stay as they are.
+// When TrimAutoAdded is set and the percentage is lowered, auto added users
+// whose bucket is out of the new percentage lose the segment.
+type SegmentUpdate struct {
+	Percentage    *int
+	Description   *string
+	Owner         *string
+	TrimAutoAdded bool
+}
+
+// WindowOpen reports whether the segment takes effect at the moment, it does in [StartsAt, EndsAt).
+func (s Segment) WindowOpen(at time.Time) bool {
+	if s.StartsAt != nil && at.Before(*s.StartsAt) {
+		return false
+	}
+	if s.EndsAt != nil && !at.Before(*s.EndsAt) {
+		return false
+	}
+
+	return true
+}
+
+// Bucket maps the user into one of 100 buckets (0-99) by hashing the segment salt with the user id.
+// The same user always lands in the same bucket of a segment and different salts make buckets
+// of different segments independent, so the user is in the segment when Bucket < Percentage.
+func (s Segment) Bucket(userID int) int {
+	return bucket(s.Salt, userID)
+}
+
+func bucket(salt string, userID int) int {
+	sum := sha256.Sum256([]byte(salt + ":" + strconv.Itoa(userID)))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
 }
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSegment_Bucket(t *testing.T) {
+	segment := Segment{Slug: "TEST", Percentage: 30, Salt: "salt"}
+	otherSegment := Segment{Slug: "OTHER", Percentage: 30, Salt: "other salt"}
+
+	const users = 10000
+
+	var inSegment, inBoth int
+	for userID := 1; userID <= users; userID++ {
+		bucket := segment.Bucket(userID)
+		require.GreaterOrEqual(t, bucket, 0)
+		require.Less(t, bucket, 100)
+		require.Equal(t, bucket, segment.Bucket(userID), "bucket must be stable")
+
+		if bucket < segment.Percentage {
+			inSegment++
+			if otherSegment.Bucket(userID) < otherSegment.Percentage {
+				inBoth++
+			}
+		}
+	}
+
+	// about 30% of users are in the segment and about 30% of them are in the other one as well
+	require.InDelta(t, users*0.3, inSegment, users*0.02)
+	require.InDelta(t, float64(inSegment)*0.3, inBoth, float64(inSegment)*0.05)
+}
+
+func TestSegment_WindowOpen(t *testing.T) {
+	startsAt := time.Date(2023, 11, 24, 0, 0, 0, 0, time.UTC)
+	endsAt := time.Date(2023, 11, 27, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		segment  Segment
+		at       time.Time
+		expected bool
+	}{
+		{
+			name:     "no window",
+			segment:  Segment{},
+			at:       startsAt,
+			expected: true,
+		},
+		{
+			name:     "before start",
+			segment:  Segment{StartsAt: &startsAt, EndsAt: &endsAt},
+			at:       startsAt.Add(-time.Second),
+			expected: false,
+		},
+		{
+			name:     "at start",
+			segment:  Segment{StartsAt: &startsAt, EndsAt: &endsAt},
+			at:       startsAt,
+			expected: true,
+		},
+		{
+			name:     "at end",
+			segment:  Segment{StartsAt: &startsAt, EndsAt: &endsAt},
+			at:       endsAt,
+			expected: false,
+		},
+		{
+			name:     "no end",
+			segment:  Segment{StartsAt: &startsAt},
+			at:       endsAt,
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.segment.WindowOpen(tc.at))
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+type UserSegment struct {
+	UserID    int
+	Slug      string
+	AutoAdd   bool
+	AddedAt   time.Time
+	ExpiresAt *time.Time
+}
+
+// BulkUserResult is the outcome of a bulk update for one user.
+// When Error is set none of the user changes were applied.
+type BulkUserResult struct {
+	UserID  int
+	Added   []string
+	Deleted []string
+	Error   string
+}
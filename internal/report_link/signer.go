@@ -0,0 +1,104 @@
+package report_link
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// MinKeyLength is the minimum length of a signing key in bytes.
+const MinKeyLength = 32
+
+var (
+	ErrEmptyKeys        = errors.New("no signing keys")
+	ErrShortKey         = errors.New("signing key is too short (at least 32 bytes)")
+	ErrInvalidTTL       = errors.New("link ttl must be only positive")
+	ErrMissingSignature = errors.New("link is not signed")
+	ErrInvalidSignature = errors.New("invalid link signature")
+	ErrLinkExpired      = errors.New("link is expired")
+)
+
+type Config struct {
+	// Keys sign and verify links. The first key signs new links and all of them verify links,
+	// so a key is rotated by putting a new key first and removing the old one when its links expire.
+	Keys []string
+	// TTL is how long a link is valid after it's signed.
+	TTL time.Duration
+}
+
+// Signer signs links to reports with HMAC-SHA256 of the report id and the link expiry.
+type Signer struct {
+	keys [][]byte
+	ttl  time.Duration
+}
+
+func NewSigner(cfg Config) (*Signer, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, ErrEmptyKeys
+	}
+	if cfg.TTL <= 0 {
+		return nil, ErrInvalidTTL
+	}
+
+	keys := make([][]byte, 0, len(cfg.Keys))
+	for _, key := range cfg.Keys {
+		if len(key) < MinKeyLength {
+			return nil, ErrShortKey
+		}
+		keys = append(keys, []byte(key))
+	}
+
+	return &Signer{
+		keys: keys,
+		ttl:  cfg.TTL,
+	}, nil
+}
+
+// Sign returns unix time the link to report id expires at and its signature, both are hex and url safe.
+func (s *Signer) Sign(id string, now time.Time) (string, string) {
+	expires := strconv.FormatInt(now.Add(s.ttl).Unix(), 10)
+	return expires, hex.EncodeToString(signature(s.keys[0], id, expires))
+}
+
+// Verify checks the link to report id was signed by one of the keys and isn't expired yet.
+func (s *Signer) Verify(id, expires, sig string, now time.Time) error {
+	if expires == "" || sig == "" {
+		return ErrMissingSignature
+	}
+
+	decodedSig, err := hex.DecodeString(sig)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	valid := false
+	for _, key := range s.keys {
+		if hmac.Equal(signature(key, id, expires), decodedSig) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+
+	// expiry is checked after the signature, so a forged expiry is reported as an invalid signature
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if now.Unix() > expiresAt {
+		return ErrLinkExpired
+	}
+
+	return nil
+}
+
+func signature(key []byte, id, expires string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id + ":" + expires))
+	return mac.Sum(nil)
+}
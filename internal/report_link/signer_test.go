@@ -0,0 +1,155 @@
+package report_link
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	oldKey = strings.Repeat("o", MinKeyLength)
+	newKey = strings.Repeat("n", MinKeyLength)
+)
+
+func TestNewSigner(t *testing.T) {
+	testCases := []struct {
+		name          string
+		cfg           Config
+		expectedError error
+	}{
+		{
+			name: "valid",
+			cfg:  Config{Keys: []string{newKey, oldKey}, TTL: time.Hour},
+		},
+		{
+			name:          "no keys",
+			cfg:           Config{TTL: time.Hour},
+			expectedError: ErrEmptyKeys,
+		},
+		{
+			name:          "short key",
+			cfg:           Config{Keys: []string{newKey, "secret"}, TTL: time.Hour},
+			expectedError: ErrShortKey,
+		},
+		{
+			name:          "zero ttl",
+			cfg:           Config{Keys: []string{newKey}},
+			expectedError: ErrInvalidTTL,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewSigner(tc.cfg)
+			require.ErrorIs(t, err, tc.expectedError)
+		})
+	}
+}
+
+func TestSigner_Verify(t *testing.T) {
+	now := time.Date(2023, 9, 1, 10, 0, 0, 0, time.UTC)
+	id := "1f674039-d035-4b1a-ac8b-51b67ab350e1"
+
+	signer, err := NewSigner(Config{Keys: []string{newKey, oldKey}, TTL: time.Hour})
+	require.NoError(t, err)
+
+	oldSigner, err := NewSigner(Config{Keys: []string{oldKey}, TTL: time.Hour})
+	require.NoError(t, err)
+
+	unknownSigner, err := NewSigner(Config{Keys: []string{strings.Repeat("u", MinKeyLength)}, TTL: time.Hour})
+	require.NoError(t, err)
+
+	expires, sig := signer.Sign(id, now)
+	require.Equal(t, "1693566000", expires)
+
+	oldExpires, oldSig := oldSigner.Sign(id, now)
+	unknownExpires, unknownSig := unknownSigner.Sign(id, now)
+
+	testCases := []struct {
+		name          string
+		id            string
+		expires       string
+		sig           string
+		now           time.Time
+		expectedError error
+	}{
+		{
+			name:    "valid",
+			id:      id,
+			expires: expires,
+			sig:     sig,
+			now:     now.Add(time.Hour),
+		},
+		{
+			name:    "signed by rotated key",
+			id:      id,
+			expires: oldExpires,
+			sig:     oldSig,
+			now:     now,
+		},
+		{
+			name:          "signed by unknown key",
+			id:            id,
+			expires:       unknownExpires,
+			sig:           unknownSig,
+			now:           now,
+			expectedError: ErrInvalidSignature,
+		},
+		{
+			name:          "expired",
+			id:            id,
+			expires:       expires,
+			sig:           sig,
+			now:           now.Add(time.Hour + time.Second),
+			expectedError: ErrLinkExpired,
+		},
+		{
+			name:          "another report",
+			id:            "2f674039-d035-4b1a-ac8b-51b67ab350e1",
+			expires:       expires,
+			sig:           sig,
+			now:           now,
+			expectedError: ErrInvalidSignature,
+		},
+		{
+			name:          "extended expiry",
+			id:            id,
+			expires:       "1893456000",
+			sig:           sig,
+			now:           now,
+			expectedError: ErrInvalidSignature,
+		},
+		{
+			name:          "not hex signature",
+			id:            id,
+			expires:       expires,
+			sig:           "signature",
+			now:           now,
+			expectedError: ErrInvalidSignature,
+		},
+		{
+			name:          "no signature",
+			id:            id,
+			expires:       expires,
+			now:           now,
+			expectedError: ErrMissingSignature,
+		},
+		{
+			name:          "no expiry",
+			id:            id,
+			sig:           sig,
+			now:           now,
+			expectedError: ErrMissingSignature,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := signer.Verify(tc.id, tc.expires, tc.sig, tc.now)
+			require.ErrorIs(t, err, tc.expectedError)
+		})
+	}
+}
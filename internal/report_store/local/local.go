@@ -0,0 +1,139 @@
+package local_report_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_store"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempPrefix marks files which are being written, they are renamed when complete and skipped by List.
+const tempPrefix = ".upload-"
+
+// Store keeps report files in a local directory.
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("LocalReportStore.NewStore - os.MkdirAll: %w", err)
+	}
+
+	return &Store{dir: dir}, nil
+}
+
+// Put writes the file to a temporary file first, so a partially written report is never served.
+func (s *Store) Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.dir, tempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("LocalReportStore.Put - os.CreateTemp: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	written, err := io.Copy(f, r)
+	if err != nil {
+		return fmt.Errorf("LocalReportStore.Put - io.Copy: %w", err)
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("LocalReportStore.Put - written %d bytes instead of %d", written, size)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("LocalReportStore.Put - f.Close: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("LocalReportStore.Put - os.Rename: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) Get(ctx context.Context, name string) (io.ReadSeekCloser, report_store.FileInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, report_store.FileInfo{}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, report_store.FileInfo{}, report_store.ErrNotExist
+		}
+		return nil, report_store.FileInfo{}, fmt.Errorf("LocalReportStore.Get - os.Open: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, report_store.FileInfo{}, fmt.Errorf("LocalReportStore.Get - f.Stat: %w", err)
+	}
+
+	return f, report_store.FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *Store) Delete(ctx context.Context, name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("LocalReportStore.Delete - os.Remove: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) List(ctx context.Context) ([]report_store.FileInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("LocalReportStore.List - os.ReadDir: %w", err)
+	}
+
+	var files []report_store.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // removed while listing
+			}
+			return nil, fmt.Errorf("LocalReportStore.List - entry.Info: %w", err)
+		}
+
+		files = append(files, report_store.FileInfo{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return files, nil
+}
+
+// path returns the path of the file, names cannot point outside the directory.
+func (s *Store) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", report_store.ErrInvalidName
+	}
+
+	return filepath.Join(s.dir, name), nil
+}
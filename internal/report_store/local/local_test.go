@@ -0,0 +1,74 @@
+package local_report_store
+
+import (
+	"context"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_store"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "reports")
+
+	store, err := NewStore(dir)
+	require.NoError(t, err)
+
+	content := "user id,segment_slug,action,date,auto_add\n"
+	err = store.Put(ctx, "report.csv", strings.NewReader(content), int64(len(content)), "text/csv")
+	require.NoError(t, err)
+
+	// a file being written is not listed
+	err = os.WriteFile(filepath.Join(dir, tempPrefix+"1"), []byte("partial"), 0o644)
+	require.NoError(t, err)
+
+	files, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "report.csv", files[0].Name)
+	require.Equal(t, int64(len(content)), files[0].Size)
+
+	f, info, err := store.Get(ctx, "report.csv")
+	require.NoError(t, err)
+	defer f.Close()
+	require.Equal(t, int64(len(content)), info.Size)
+
+	actual, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, content, string(actual))
+
+	require.NoError(t, store.Delete(ctx, "report.csv"))
+	require.NoError(t, store.Delete(ctx, "report.csv"))
+
+	_, _, err = store.Get(ctx, "report.csv")
+	require.ErrorIs(t, err, report_store.ErrNotExist)
+}
+
+func TestStorePutSizeMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	err = store.Put(ctx, "report.csv", strings.NewReader("short"), 100, "text/csv")
+	require.Error(t, err)
+
+	_, _, err = store.Get(ctx, "report.csv")
+	require.ErrorIs(t, err, report_store.ErrNotExist)
+}
+
+func TestStoreInvalidName(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	for _, name := range []string{"", "../report.csv", "dir/report.csv", tempPrefix + "1"} {
+		_, _, err = store.Get(ctx, name)
+		require.ErrorIs(t, err, report_store.ErrInvalidName, name)
+	}
+}
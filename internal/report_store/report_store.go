@@ -0,0 +1,38 @@
+package report_store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrNotExist    = errors.New("report file doesn't exist")
+	ErrInvalidName = errors.New("invalid report file name")
+)
+
+// FileInfo describes a report file in the store.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ReportStore keeps generated report files, so every replica of the service can serve them.
+type ReportStore interface {
+	// Put stores size bytes from r under the name, an existing file is replaced.
+	Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) error
+	// Get opens the file, it returns ErrNotExist if there is no such file.
+	Get(ctx context.Context, name string) (io.ReadSeekCloser, FileInfo, error)
+	// Delete removes the file, removing a file which doesn't exist is not an error.
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context) ([]FileInfo, error)
+}
+
+// Presigner is implemented by stores which can give a temporary link to download a file directly from the store.
+type Presigner interface {
+	// PresignGet returns the link to the file, it returns ErrNotExist if there is no such file
+	// and an empty link if presigning is turned off.
+	PresignGet(ctx context.Context, name, contentType string) (string, error)
+}
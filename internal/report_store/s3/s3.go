@@ -0,0 +1,160 @@
+package s3_report_store
+
+import (
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_store"
+	"io"
+	"net/url"
+	"time"
+)
+
+type Config struct {
+	Endpoint string
+	// PublicEndpoint is the host clients use in presigned links, Endpoint is used if it's empty.
+	PublicEndpoint string
+	AccessKey      string
+	SecretKey      string
+	Bucket         string
+	Region         string
+	UseSSL         bool
+	// PresignExpiry is the lifetime of presigned links, zero turns presigning off.
+	PresignExpiry time.Duration
+}
+
+// Store keeps report files in a bucket of an S3 compatible storage (AWS S3, MinIO).
+type Store struct {
+	client        *minio.Client
+	presignClient *minio.Client
+	bucket        string
+	presignExpiry time.Duration
+}
+
+// NewStore connects to the storage and creates the bucket if it doesn't exist.
+func NewStore(ctx context.Context, config Config) (*Store, error) {
+	newClient := func(endpoint string) (*minio.Client, error) {
+		return minio.New(endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+			Secure: config.UseSSL,
+			Region: config.Region, // with a known region presigning doesn't need a request to the storage
+		})
+	}
+
+	client, err := newClient(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("S3ReportStore.NewStore - minio.New: %w", err)
+	}
+
+	presignClient := client
+	if config.PublicEndpoint != "" {
+		presignClient, err = newClient(config.PublicEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("S3ReportStore.NewStore - minio.New: %w", err)
+		}
+	}
+
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("S3ReportStore.NewStore - client.BucketExists: %w", err)
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region})
+		if err != nil {
+			return nil, fmt.Errorf("S3ReportStore.NewStore - client.MakeBucket: %w", err)
+		}
+	}
+
+	return &Store{
+		client:        client,
+		presignClient: presignClient,
+		bucket:        config.Bucket,
+		presignExpiry: config.PresignExpiry,
+	}, nil
+}
+
+func (s *Store) Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, name, r, size, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return fmt.Errorf("S3ReportStore.Put - client.PutObject: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) Get(ctx context.Context, name string) (io.ReadSeekCloser, report_store.FileInfo, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, report_store.FileInfo{}, fmt.Errorf("S3ReportStore.Get - client.GetObject: %w", err)
+	}
+
+	info, err := object.Stat()
+	if err != nil {
+		_ = object.Close()
+		if isNotExist(err) {
+			return nil, report_store.FileInfo{}, report_store.ErrNotExist
+		}
+		return nil, report_store.FileInfo{}, fmt.Errorf("S3ReportStore.Get - object.Stat: %w", err)
+	}
+
+	return object, report_store.FileInfo{Name: name, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *Store) Delete(ctx context.Context, name string) error {
+	err := s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+	if err != nil && !isNotExist(err) {
+		return fmt.Errorf("S3ReportStore.Delete - client.RemoveObject: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) List(ctx context.Context) ([]report_store.FileInfo, error) {
+	var files []report_store.FileInfo
+
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("S3ReportStore.List - client.ListObjects: %w", object.Err)
+		}
+
+		files = append(files, report_store.FileInfo{
+			Name:    object.Key,
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+	}
+
+	return files, nil
+}
+
+// PresignGet returns a link which downloads the file as an attachment with the content type.
+func (s *Store) PresignGet(ctx context.Context, name, contentType string) (string, error) {
+	if s.presignExpiry == 0 {
+		return "", nil
+	}
+
+	_, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		if isNotExist(err) {
+			return "", report_store.ErrNotExist
+		}
+		return "", fmt.Errorf("S3ReportStore.PresignGet - client.StatObject: %w", err)
+	}
+
+	params := url.Values{}
+	params.Set("response-content-type", contentType)
+	params.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+	u, err := s.presignClient.PresignedGetObject(ctx, s.bucket, name, s.presignExpiry, params)
+	if err != nil {
+		return "", fmt.Errorf("S3ReportStore.PresignGet - client.PresignedGetObject: %w", err)
+	}
+
+	return u.String(), nil
+}
+
+func isNotExist(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
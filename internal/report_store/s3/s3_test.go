@@ -0,0 +1,209 @@
+package s3_report_store
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_store"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a stand-in for MinIO which supports requests of a single bucket the store makes.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	created bool
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead && !f.created:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut:
+			f.created = true
+		case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+			type content struct {
+				Key          string
+				Size         int64
+				LastModified string
+			}
+			var result struct {
+				XMLName  xml.Name `xml:"ListBucketResult"`
+				Name     string
+				KeyCount int
+				Contents []content
+			}
+			result.Name = f.bucket
+			for key, object := range f.objects {
+				result.Contents = append(result.Contents, content{
+					Key:          key,
+					Size:         int64(len(object)),
+					LastModified: time.Now().UTC().Format(time.RFC3339),
+				})
+			}
+			result.KeyCount = len(result.Contents)
+			_ = xml.NewEncoder(w).Encode(result)
+		}
+		return
+	}
+
+	object, ok := f.objects[key]
+
+	switch r.Method {
+	case http.MethodPut:
+		body := r.Body
+		if r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+			body = io.NopCloser(decodeAWSChunked(r.Body))
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodHead, http.MethodGet:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(object)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// decodeAWSChunked strips chunk headers of a body signed with a streaming signature.
+func decodeAWSChunked(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			header, err := br.ReadString('\n')
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+			size, err := strconv.ParseInt(sizeHex, 16, 64)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if size == 0 {
+				pw.Close()
+				return
+			}
+			if _, err := io.CopyN(pw, br, size); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, _ = br.Discard(2) // \r\n after the chunk
+		}
+	}()
+	return pr
+}
+
+func newTestStore(t *testing.T, presignExpiry time.Duration) (*Store, *fakeS3) {
+	fake := &fakeS3{bucket: "reports", objects: make(map[string][]byte)}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	store, err := NewStore(context.Background(), Config{
+		Endpoint:       strings.TrimPrefix(server.URL, "http://"),
+		PublicEndpoint: "localhost:9000",
+		AccessKey:      "minio",
+		SecretKey:      "minio1234",
+		Bucket:         "reports",
+		Region:         "us-east-1",
+		PresignExpiry:  presignExpiry,
+	})
+	require.NoError(t, err)
+	require.True(t, fake.created)
+
+	return store, fake
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	store, fake := newTestStore(t, 0)
+
+	content := "user id,segment_slug,action,date,auto_add\n"
+	err := store.Put(ctx, "report.csv", strings.NewReader(content), int64(len(content)), "text/csv")
+	require.NoError(t, err)
+	require.Equal(t, content, string(fake.objects["report.csv"]))
+
+	files, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "report.csv", files[0].Name)
+	require.Equal(t, int64(len(content)), files[0].Size)
+
+	f, info, err := store.Get(ctx, "report.csv")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), info.Size)
+
+	actual, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, content, string(actual))
+
+	link, err := store.PresignGet(ctx, "report.csv", "text/csv")
+	require.NoError(t, err)
+	require.Empty(t, link)
+
+	require.NoError(t, store.Delete(ctx, "report.csv"))
+
+	_, _, err = store.Get(ctx, "report.csv")
+	require.ErrorIs(t, err, report_store.ErrNotExist)
+}
+
+func TestStorePresignGet(t *testing.T) {
+	ctx := context.Background()
+	store, fake := newTestStore(t, 15*time.Minute)
+
+	fake.objects["report.parquet"] = []byte("PAR1")
+
+	link, err := store.PresignGet(ctx, "report.parquet", "application/vnd.apache.parquet")
+	require.NoError(t, err)
+
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	require.Equal(t, "localhost:9000", u.Host)
+	require.Equal(t, "/reports/report.parquet", u.Path)
+	require.Equal(t, "900", u.Query().Get("X-Amz-Expires"))
+	require.Equal(t, "application/vnd.apache.parquet", u.Query().Get("response-content-type"))
+	require.Equal(t, fmt.Sprintf("attachment; filename=%q", "report.parquet"), u.Query().Get("response-content-disposition"))
+	require.NotEmpty(t, u.Query().Get("X-Amz-Signature"))
+
+	_, err = store.PresignGet(ctx, "missing.csv", "text/csv")
+	require.ErrorIs(t, err, report_store.ErrNotExist)
+}
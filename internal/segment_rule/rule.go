@@ -0,0 +1,481 @@
+package segment_rule
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxLength is the maximum length of a rule in bytes.
+const MaxLength = 1000
+
+var (
+	ErrEmptyRule   = errors.New("empty rule")
+	ErrRuleTooLong = errors.New("rule cannot be longer than 1000 characters")
+)
+
+var attributeName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// IsAttributeName reports whether name can be used as an attribute in rules: lowercase letters, digits and underscores,
+// not starting with a digit.
+func IsAttributeName(name string) bool {
+	return attributeName.MatchString(name) && name != "true" && name != "false" && name != "in"
+}
+
+// Rule is a condition over attributes of a user, e.g. country == "RU" && age >= 18 && platform in ["ios", "android"].
+//
+// Conditions compare an attribute with a literal by ==, !=, <, <=, > and >= or check it's in a list of literals by in,
+// literals are strings in double quotes, numbers, true and false. <, <=, > and >= compare only numbers.
+// Conditions are combined by ! (not), && (and) and || (or) in this order of precedence and grouped by parentheses.
+// A condition on a missing attribute or on an attribute of another type than the literal is false.
+type Rule struct {
+	source string
+	root   node
+}
+
+// Parse parses and validates the rule.
+func Parse(source string) (*Rule, error) {
+	source = strings.TrimSpace(source)
+
+	if source == "" {
+		return nil, ErrEmptyRule
+	}
+	if len(source) > MaxLength {
+		return nil, ErrRuleTooLong
+	}
+
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind != tokenEOF {
+		return nil, p.unexpected()
+	}
+
+	return &Rule{
+		source: source,
+		root:   root,
+	}, nil
+}
+
+// String returns the rule as it was parsed, without surrounding spaces.
+func (r *Rule) String() string {
+	return r.source
+}
+
+// Match reports whether the attributes match the rule. Values are strings, float64 or int numbers and bools.
+func (r *Rule) Match(attributes map[string]any) bool {
+	return r.root.match(attributes)
+}
+
+type node interface {
+	match(attributes map[string]any) bool
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) match(attributes map[string]any) bool {
+	return n.left.match(attributes) || n.right.match(attributes)
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) match(attributes map[string]any) bool {
+	return n.left.match(attributes) && n.right.match(attributes)
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n notNode) match(attributes map[string]any) bool {
+	return !n.operand.match(attributes)
+}
+
+type compareNode struct {
+	attribute string
+	operator  string
+	value     any
+}
+
+func (n compareNode) match(attributes map[string]any) bool {
+	attribute, ok := attributes[n.attribute]
+	if !ok {
+		return false
+	}
+
+	switch value := n.value.(type) {
+	case float64:
+		number, ok := toNumber(attribute)
+		if !ok {
+			return false
+		}
+		switch n.operator {
+		case "==":
+			return number == value
+		case "!=":
+			return number != value
+		case "<":
+			return number < value
+		case "<=":
+			return number <= value
+		case ">":
+			return number > value
+		case ">=":
+			return number >= value
+		}
+	case string:
+		str, ok := attribute.(string)
+		if !ok {
+			return false
+		}
+		if n.operator == "==" {
+			return str == value
+		}
+		return str != value
+	case bool:
+		b, ok := attribute.(bool)
+		if !ok {
+			return false
+		}
+		if n.operator == "==" {
+			return b == value
+		}
+		return b != value
+	}
+
+	return false
+}
+
+type inNode struct {
+	attribute string
+	values    []any
+}
+
+func (n inNode) match(attributes map[string]any) bool {
+	for _, value := range n.values {
+		if (compareNode{attribute: n.attribute, operator: "==", value: value}).match(attributes) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func toNumber(value any) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case int:
+		return float64(number), true
+	}
+
+	return 0, false
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenTrue
+	tokenFalse
+	tokenIn
+	tokenOperator
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLeftParen
+	tokenRightParen
+	tokenLeftBracket
+	tokenRightBracket
+	tokenComma
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value any
+	pos   int
+}
+
+var (
+	identPattern  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*`)
+	numberPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?`)
+	stringPattern = regexp.MustCompile(`^"(\\.|[^"\\])*"`)
+)
+
+// symbols are matched in order, so two character symbols go before their one character prefixes.
+var symbols = []struct {
+	text string
+	kind tokenKind
+}{
+	{"&&", tokenAnd},
+	{"||", tokenOr},
+	{"==", tokenOperator},
+	{"!=", tokenOperator},
+	{"<=", tokenOperator},
+	{">=", tokenOperator},
+	{"<", tokenOperator},
+	{">", tokenOperator},
+	{"!", tokenNot},
+	{"(", tokenLeftParen},
+	{")", tokenRightParen},
+	{"[", tokenLeftBracket},
+	{"]", tokenRightBracket},
+	{",", tokenComma},
+}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+
+	pos := 0
+	for pos < len(source) {
+		rest := source[pos:]
+
+		if rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\n' || rest[0] == '\r' {
+			pos++
+			continue
+		}
+
+		tok, err := nextToken(rest, pos)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, tok)
+		pos += len(tok.text)
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: pos}), nil
+}
+
+func nextToken(rest string, pos int) (token, error) {
+	for _, symbol := range symbols {
+		if strings.HasPrefix(rest, symbol.text) {
+			return token{kind: symbol.kind, text: symbol.text, pos: pos}, nil
+		}
+	}
+
+	if text := stringPattern.FindString(rest); text != "" {
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return token{}, fmt.Errorf("invalid string %s at position %d", text, pos+1)
+		}
+		return token{kind: tokenString, text: text, value: value, pos: pos}, nil
+	}
+
+	if text := numberPattern.FindString(rest); text != "" {
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return token{}, fmt.Errorf("invalid number %s at position %d", text, pos+1)
+		}
+		return token{kind: tokenNumber, text: text, value: value, pos: pos}, nil
+	}
+
+	if text := identPattern.FindString(rest); text != "" {
+		switch text {
+		case "true":
+			return token{kind: tokenTrue, text: text, value: true, pos: pos}, nil
+		case "false":
+			return token{kind: tokenFalse, text: text, value: false, pos: pos}, nil
+		case "in":
+			return token{kind: tokenIn, text: text, pos: pos}, nil
+		}
+		if !IsAttributeName(text) {
+			return token{}, fmt.Errorf("invalid attribute %s at position %d (lowercase letters, digits and underscores)", text, pos+1)
+		}
+		return token{kind: tokenIdent, text: text, pos: pos}, nil
+	}
+
+	if rest[0] == '"' {
+		return token{}, fmt.Errorf("unterminated string at position %d", pos+1)
+	}
+
+	return token{}, fmt.Errorf("unexpected character %q at position %d", rest[0], pos+1)
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) unexpected() error {
+	tok := p.peek()
+	if tok.kind == tokenEOF {
+		return errors.New("unexpected end of rule")
+	}
+	return fmt.Errorf("unexpected %s at position %d", tok.text, tok.pos+1)
+}
+
+func (p *parser) expect(kind tokenKind) error {
+	if p.peek().kind != kind {
+		return p.unexpected()
+	}
+	p.next()
+	return nil
+}
+
+// parseOr parses conditions joined by ||.
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokenOr {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = orNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// parseAnd parses conditions joined by &&.
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokenAnd {
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = andNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// parseUnary parses a negated condition, a condition in parentheses or a single condition.
+func (p *parser) parseUnary() (node, error) {
+	switch p.peek().kind {
+	case tokenNot:
+		p.next()
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return notNode{operand: operand}, nil
+	case tokenLeftParen:
+		p.next()
+
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.expect(tokenRightParen)
+		if err != nil {
+			return nil, err
+		}
+
+		return inner, nil
+	case tokenIdent:
+		return p.parseCondition()
+	}
+
+	return nil, p.unexpected()
+}
+
+// parseCondition parses a comparison of an attribute with a literal or an in of a list of literals.
+func (p *parser) parseCondition() (node, error) {
+	attribute := p.next().text
+
+	if p.peek().kind == tokenIn {
+		p.next()
+
+		err := p.expect(tokenLeftBracket)
+		if err != nil {
+			return nil, err
+		}
+
+		var values []any
+		for {
+			value, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+
+			if p.peek().kind != tokenComma {
+				break
+			}
+			p.next()
+		}
+
+		err = p.expect(tokenRightBracket)
+		if err != nil {
+			return nil, err
+		}
+
+		return inNode{attribute: attribute, values: values}, nil
+	}
+
+	if p.peek().kind != tokenOperator {
+		return nil, p.unexpected()
+	}
+	operator := p.next()
+
+	valuePos := p.peek().pos
+	value, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := value.(float64); !ok && operator.text != "==" && operator.text != "!=" {
+		return nil, fmt.Errorf("%s compares only numbers at position %d", operator.text, valuePos+1)
+	}
+
+	return compareNode{attribute: attribute, operator: operator.text, value: value}, nil
+}
+
+func (p *parser) parseLiteral() (any, error) {
+	switch p.peek().kind {
+	case tokenString, tokenNumber, tokenTrue, tokenFalse:
+		return p.next().value, nil
+	}
+
+	return nil, p.unexpected()
+}
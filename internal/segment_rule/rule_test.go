@@ -0,0 +1,156 @@
+package segment_rule
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name          string
+		source        string
+		expectedError string
+	}{
+		{
+			name:   "comparisons and in",
+			source: ` country == "RU" && age >= 18 && platform in ["ios", "android"] `,
+		},
+		{
+			name:   "not, or and parentheses",
+			source: `!(beta == true || score < -1.5) && premium != false`,
+		},
+		{
+			name:          "empty",
+			source:        "  ",
+			expectedError: ErrEmptyRule.Error(),
+		},
+		{
+			name:          "too long",
+			source:        strings.Repeat("a", MaxLength+1),
+			expectedError: ErrRuleTooLong.Error(),
+		},
+		{
+			name:          "uppercase attribute",
+			source:        `Country == "RU"`,
+			expectedError: "invalid attribute Country at position 1 (lowercase letters, digits and underscores)",
+		},
+		{
+			name:          "unterminated string",
+			source:        `country == "RU`,
+			expectedError: "unterminated string at position 12",
+		},
+		{
+			name:          "unexpected character",
+			source:        `age = 18`,
+			expectedError: "unexpected character '=' at position 5",
+		},
+		{
+			name:          "ordering of a string",
+			source:        `country > "RU"`,
+			expectedError: "> compares only numbers at position 11",
+		},
+		{
+			name:          "missing operand",
+			source:        `age >= 18 &&`,
+			expectedError: "unexpected end of rule",
+		},
+		{
+			name:          "attribute compared with attribute",
+			source:        `age == limit`,
+			expectedError: "unexpected limit at position 8",
+		},
+		{
+			name:          "empty list",
+			source:        `platform in []`,
+			expectedError: "unexpected ] at position 14",
+		},
+		{
+			name:          "unclosed parenthesis",
+			source:        `(age > 18`,
+			expectedError: "unexpected end of rule",
+		},
+		{
+			name:          "trailing token",
+			source:        `age > 18 true`,
+			expectedError: "unexpected true at position 10",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualRule, actualError := Parse(tc.source)
+			if tc.expectedError != "" {
+				require.EqualError(t, actualError, tc.expectedError)
+				return
+			}
+
+			require.NoError(t, actualError)
+			require.Equal(t, strings.TrimSpace(tc.source), actualRule.String())
+		})
+	}
+}
+
+func TestRule_Match(t *testing.T) {
+	rule, err := Parse(`country == "RU" && age >= 18 && platform in ["ios", "android"] || vip == true`)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		attributes map[string]any
+		expected   bool
+	}{
+		{
+			name:       "all conditions match",
+			attributes: map[string]any{"country": "RU", "age": float64(18), "platform": "ios"},
+			expected:   true,
+		},
+		{
+			name:       "int number",
+			attributes: map[string]any{"country": "RU", "age": 30, "platform": "android"},
+			expected:   true,
+		},
+		{
+			name:       "too young",
+			attributes: map[string]any{"country": "RU", "age": float64(17), "platform": "ios"},
+		},
+		{
+			name:       "platform not in list",
+			attributes: map[string]any{"country": "RU", "age": float64(18), "platform": "web"},
+		},
+		{
+			name:       "missing attribute",
+			attributes: map[string]any{"country": "RU", "platform": "ios"},
+		},
+		{
+			name:       "attribute of another type",
+			attributes: map[string]any{"country": "RU", "age": "18", "platform": "ios"},
+		},
+		{
+			name:       "or",
+			attributes: map[string]any{"vip": true},
+			expected:   true,
+		},
+		{
+			name: "no attributes",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, rule.Match(tc.attributes))
+		})
+	}
+}
+
+func TestRule_MatchNot(t *testing.T) {
+	rule, err := Parse(`!(country == "RU") && score != 1.5`)
+	require.NoError(t, err)
+
+	require.True(t, rule.Match(map[string]any{"score": float64(2)}))
+	require.False(t, rule.Match(map[string]any{"country": "RU", "score": float64(2)}))
+	require.False(t, rule.Match(map[string]any{"country": "US", "score": 1.5}))
+	require.False(t, rule.Match(map[string]any{"country": "US"}))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"time"
 )
@@ -13,6 +14,10 @@ type Config struct {
 	Port         int
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+	// PublicBaseURL is the url clients reach the service at, e.g. behind a proxy. It's optional.
+	PublicBaseURL string
+	// TrustedProxies are addresses of proxies whose forwarded headers are trusted when PublicBaseURL isn't set.
+	TrustedProxies []netip.Prefix
 }
 
 type Server struct {
@@ -0,0 +1,118 @@
+package v1
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"net/http"
+	"time"
+)
+
+type createExclusionGroupBodyRequest struct {
+	Slug     string   `json:"slug"`
+	Segments []string `json:"segments"`
+}
+
+// CreateExclusionGroup godoc
+// @Summary Create exclusion group of segments, a user can have only one of them
+// @Tags exclusion group
+// @Accept json
+// @Param input body createExclusionGroupBodyRequest true "segments must exist and no user can have two of them"
+// @Success 201
+// @Failure 400 {object} response
+// @Failure 500 {object} response
+// @Router /exclusion_groups [post]
+func (h *Handler) CreateExclusionGroup(c *gin.Context) {
+	var groupBody createExclusionGroupBodyRequest
+
+	if err := c.ShouldBindJSON(&groupBody); err != nil {
+		resp := newResponse("", ErrParsingBody.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	err := h.services.CreateExclusionGroup(c, groupBody.Slug, groupBody.Segments)
+	if err != nil {
+		message := "error creating exclusion group"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
+
+type exclusionGroupResponse struct {
+	Slug      string    `json:"slug"`
+	CreatedAt time.Time `json:"created_at"`
+	Segments  []string  `json:"segments"`
+}
+
+// GetExclusionGroup godoc
+// @Summary Get exclusion group with its segments
+// @Tags exclusion group
+// @Param slug path string true "exclusion group slug"
+// @Success 200 {object} exclusionGroupResponse
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 500 {object} response
+// @Router /exclusion_groups/{slug} [get]
+func (h *Handler) GetExclusionGroup(c *gin.Context) {
+	group, err := h.services.GetExclusionGroup(c, c.Param("slug"))
+	if err != nil {
+		message := "error getting exclusion group"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, exclusionGroupResponse{
+		Slug:      group.Slug,
+		CreatedAt: group.CreatedAt,
+		Segments:  group.Segments,
+	})
+}
+
+// DeleteExclusionGroup godoc
+// @Summary Delete exclusion group, its segments stay with their users
+// @Tags exclusion group
+// @Param slug path string true "exclusion group slug"
+// @Success 200
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 500 {object} response
+// @Router /exclusion_groups/{slug} [delete]
+func (h *Handler) DeleteExclusionGroup(c *gin.Context) {
+	err := h.services.DeleteExclusionGroup(c, c.Param("slug"))
+	if err != nil {
+		message := "error deleting exclusion group"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
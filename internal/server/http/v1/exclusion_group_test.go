@@ -0,0 +1,174 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	mock_logger "github.com/romandnk/dynamic-user-segmentation-service/internal/logger/mock"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	mock_service "github.com/romandnk/dynamic-user-segmentation-service/internal/service/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler_CreateExclusionGroup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedSlug := "BANNERS"
+	expectedSegments := []string{"BANNER_A", "BANNER_B"}
+
+	services.EXPECT().CreateExclusionGroup(gomock.Any(), expectedSlug, expectedSegments).Return(nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.POST(url+"/exclusion_groups", handler.CreateExclusionGroup)
+
+	requestBody := map[string]interface{}{
+		"slug":     expectedSlug,
+		"segments": expectedSegments,
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/exclusion_groups", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestHandler_CreateExclusionGroupUserConflict(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	expectedSlug := "BANNERS"
+	expectedSegments := []string{"BANNER_A", "BANNER_B"}
+	expectedError := custom_error.CustomError{
+		Field:   "segments",
+		Message: "User (7) already has segments BANNER_A, BANNER_B",
+	}
+	expectedMessage := "error creating exclusion group"
+
+	services.EXPECT().CreateExclusionGroup(gomock.Any(), expectedSlug, expectedSegments).Return(expectedError)
+	logger.EXPECT().Error(expectedMessage, zap.String("errors", expectedError.Error()))
+
+	handler := NewHandler(services, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.POST(url+"/exclusion_groups", handler.CreateExclusionGroup)
+
+	requestBody := map[string]interface{}{
+		"slug":     expectedSlug,
+		"segments": expectedSegments,
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/exclusion_groups", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	var responseBody map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, expectedError.Field, responseBody["field"])
+	require.Equal(t, expectedError.Error(), responseBody["error"])
+}
+
+func TestHandler_GetExclusionGroup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedGroup := models.ExclusionGroup{
+		Slug:      "BANNERS",
+		Segments:  []string{"BANNER_A", "BANNER_B"},
+		CreatedAt: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	services.EXPECT().GetExclusionGroup(gomock.Any(), expectedGroup.Slug).Return(expectedGroup, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/exclusion_groups/:slug", handler.GetExclusionGroup)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/exclusion_groups/"+expectedGroup.Slug, nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var responseBody exclusionGroupResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, exclusionGroupResponse{
+		Slug:      expectedGroup.Slug,
+		CreatedAt: expectedGroup.CreatedAt,
+		Segments:  expectedGroup.Segments,
+	}, responseBody)
+}
+
+func TestHandler_DeleteExclusionGroupNotFound(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	expectedSlug := "BANNERS"
+	expectedError := custom_error.NotFoundError{
+		Field:   "slug",
+		Message: expectedSlug + " doesn't exist",
+	}
+	expectedMessage := "error deleting exclusion group"
+
+	services.EXPECT().DeleteExclusionGroup(gomock.Any(), expectedSlug).Return(expectedError)
+	logger.EXPECT().Error(expectedMessage, zap.String("errors", expectedError.Error()))
+
+	handler := NewHandler(services, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.DELETE(url+"/exclusion_groups/:slug", handler.DeleteExclusionGroup)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url+"/exclusion_groups/"+expectedSlug, nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,147 @@
+package v1
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"net/http"
+	"time"
+)
+
+type experimentVariantRequest struct {
+	Slug   string `json:"slug"`
+	Weight int    `json:"weight"`
+}
+
+type createExperimentBodyRequest struct {
+	Slug     string                     `json:"slug"`
+	Variants []experimentVariantRequest `json:"variants"`
+}
+
+// CreateExperiment godoc
+// @Summary Create experiment with variant segments
+// @Tags experiment
+// @Accept json
+// @Param input body createExperimentBodyRequest true "variants are new segments, weight is a percentage of users in the variant (sum is at most 100)"
+// @Success 201
+// @Failure 400 {object} response
+// @Failure 500 {object} response
+// @Router /experiments [post]
+func (h *Handler) CreateExperiment(c *gin.Context) {
+	var experimentBody createExperimentBodyRequest
+
+	if err := c.ShouldBindJSON(&experimentBody); err != nil {
+		resp := newResponse("", ErrParsingBody.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	variants := make([]models.ExperimentVariant, 0, len(experimentBody.Variants))
+	for _, variant := range experimentBody.Variants {
+		variants = append(variants, models.ExperimentVariant{
+			Slug:   variant.Slug,
+			Weight: variant.Weight,
+		})
+	}
+
+	err := h.services.CreateExperiment(c, experimentBody.Slug, variants)
+	if err != nil {
+		message := "error creating experiment"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
+
+type experimentVariantResponse struct {
+	Slug       string `json:"slug"`
+	Weight     int    `json:"weight"`
+	UsersCount int    `json:"users_count"`
+}
+
+type experimentResponse struct {
+	Slug      string                      `json:"slug"`
+	CreatedAt time.Time                   `json:"created_at"`
+	Variants  []experimentVariantResponse `json:"variants"`
+}
+
+// GetExperiment godoc
+// @Summary Get experiment with its variants and their numbers of users
+// @Tags experiment
+// @Param slug path string true "experiment slug"
+// @Success 200 {object} experimentResponse
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 500 {object} response
+// @Router /experiments/{slug} [get]
+func (h *Handler) GetExperiment(c *gin.Context) {
+	experiment, err := h.services.GetExperiment(c, c.Param("slug"))
+	if err != nil {
+		message := "error getting experiment"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	variantsResponse := make([]experimentVariantResponse, 0, len(experiment.Variants))
+	for _, variant := range experiment.Variants {
+		variantsResponse = append(variantsResponse, experimentVariantResponse{
+			Slug:       variant.Slug,
+			Weight:     variant.Weight,
+			UsersCount: variant.UsersCount,
+		})
+	}
+
+	c.JSON(http.StatusOK, experimentResponse{
+		Slug:      experiment.Slug,
+		CreatedAt: experiment.CreatedAt,
+		Variants:  variantsResponse,
+	})
+}
+
+// DeleteExperiment godoc
+// @Summary Delete experiment, its variant segments stay with their users
+// @Tags experiment
+// @Param slug path string true "experiment slug"
+// @Success 200
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 500 {object} response
+// @Router /experiments/{slug} [delete]
+func (h *Handler) DeleteExperiment(c *gin.Context) {
+	err := h.services.DeleteExperiment(c, c.Param("slug"))
+	if err != nil {
+		message := "error deleting experiment"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
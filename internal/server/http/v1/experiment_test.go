@@ -0,0 +1,187 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	mock_logger "github.com/romandnk/dynamic-user-segmentation-service/internal/logger/mock"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/service"
+	mock_service "github.com/romandnk/dynamic-user-segmentation-service/internal/service/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler_CreateExperiment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedSlug := "CHECKOUT"
+	expectedVariants := []models.ExperimentVariant{
+		{Slug: "CHECKOUT_CONTROL", Weight: 50},
+		{Slug: "CHECKOUT_A", Weight: 50},
+	}
+
+	services.EXPECT().CreateExperiment(gomock.Any(), expectedSlug, expectedVariants).Return(nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.POST(url+"/experiments", handler.CreateExperiment)
+
+	requestBody := map[string]interface{}{
+		"slug": expectedSlug,
+		"variants": []map[string]interface{}{
+			{"slug": "CHECKOUT_CONTROL", "weight": 50},
+			{"slug": "CHECKOUT_A", "weight": 50},
+		},
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/experiments", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestHandler_CreateExperimentError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	expectedSlug := "CHECKOUT"
+	expectedVariants := []models.ExperimentVariant{{Slug: "CHECKOUT_CONTROL", Weight: 50}}
+	expectedError := custom_error.CustomError{
+		Field:   "variants",
+		Message: service.ErrTooFewVariants.Error(),
+	}
+	expectedMessage := "error creating experiment"
+
+	services.EXPECT().CreateExperiment(gomock.Any(), expectedSlug, expectedVariants).Return(expectedError)
+	logger.EXPECT().Error(expectedMessage, zap.String("errors", expectedError.Error()))
+
+	handler := NewHandler(services, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.POST(url+"/experiments", handler.CreateExperiment)
+
+	requestBody := map[string]interface{}{
+		"slug":     expectedSlug,
+		"variants": []map[string]interface{}{{"slug": "CHECKOUT_CONTROL", "weight": 50}},
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/experiments", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	var responseBody map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, expectedError.Field, responseBody["field"])
+	require.Equal(t, expectedError.Error(), responseBody["error"])
+}
+
+func TestHandler_GetExperiment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedExperiment := models.Experiment{
+		Slug:      "CHECKOUT",
+		CreatedAt: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+		Variants: []models.ExperimentVariant{
+			{Slug: "CHECKOUT_A", Weight: 50, UsersCount: 4},
+			{Slug: "CHECKOUT_CONTROL", Weight: 50, UsersCount: 6},
+		},
+	}
+
+	services.EXPECT().GetExperiment(gomock.Any(), expectedExperiment.Slug).Return(expectedExperiment, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/experiments/:slug", handler.GetExperiment)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/experiments/"+expectedExperiment.Slug, nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var responseBody experimentResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, experimentResponse{
+		Slug:      expectedExperiment.Slug,
+		CreatedAt: expectedExperiment.CreatedAt,
+		Variants: []experimentVariantResponse{
+			{Slug: "CHECKOUT_A", Weight: 50, UsersCount: 4},
+			{Slug: "CHECKOUT_CONTROL", Weight: 50, UsersCount: 6},
+		},
+	}, responseBody)
+}
+
+func TestHandler_DeleteExperimentNotFound(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	expectedSlug := "CHECKOUT"
+	expectedError := custom_error.NotFoundError{
+		Field:   "slug",
+		Message: expectedSlug + " doesn't exist",
+	}
+	expectedMessage := "error deleting experiment"
+
+	services.EXPECT().DeleteExperiment(gomock.Any(), expectedSlug).Return(expectedError)
+	logger.EXPECT().Error(expectedMessage, zap.String("errors", expectedError.Error()))
+
+	handler := NewHandler(services, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.DELETE(url+"/experiments/:slug", handler.DeleteExperiment)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url+"/experiments/"+expectedSlug, nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -4,23 +4,45 @@ import (
 	"github.com/gin-gonic/gin"
 	_ "github.com/romandnk/dynamic-user-segmentation-service/docs"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/logger"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_link"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_store"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/service"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
+	"net/netip"
 )
 
 type Handler struct {
-	engine        *gin.Engine
-	services      service.Services
-	logger        logger.Logger
-	pathToReports string
+	engine      *gin.Engine
+	services    service.Services
+	logger      logger.Logger
+	reportStore report_store.ReportStore
+	// publicBaseURL is the url clients reach the service at, links to reports are built on it.
+	// If it's empty, links are built from the request.
+	publicBaseURL string
+	// trustedProxies are addresses of proxies whose X-Forwarded-Proto and X-Forwarded-Host headers are trusted
+	// when links are built from the request. Headers of other clients are ignored.
+	trustedProxies []netip.Prefix
+	// linkSigner signs links to report files and checks them on download.
+	// If it's nil, links are neither signed nor checked.
+	linkSigner *report_link.Signer
 }
 
-func NewHandler(services service.Services, logger logger.Logger, pathToReports string) *Handler {
+func NewHandler(
+	services service.Services,
+	logger logger.Logger,
+	reportStore report_store.ReportStore,
+	publicBaseURL string,
+	trustedProxies []netip.Prefix,
+	linkSigner *report_link.Signer,
+) *Handler {
 	return &Handler{
-		services:      services,
-		logger:        logger,
-		pathToReports: pathToReports,
+		services:       services,
+		logger:         logger,
+		reportStore:    reportStore,
+		publicBaseURL:  publicBaseURL,
+		trustedProxies: trustedProxies,
+		linkSigner:     linkSigner,
 	}
 }
 
@@ -40,17 +62,45 @@ func (h *Handler) InitRoutes() *gin.Engine {
 			{
 				segments.POST("/", h.CreateSegment)
 				segments.DELETE("/", h.DeleteSegment)
+				segments.GET("/", h.GetSegments)
+				segments.GET("/:slug", h.GetSegment)
+				segments.PATCH("/:slug", h.UpdateSegment)
+				segments.GET("/:slug/users", h.GetSegmentUsers)
+				segments.GET("/:slug/stats", h.GetSegmentStats)
+				segments.GET("/:slug/window_events", h.GetSegmentWindowEvents)
+			}
+
+			experiments := version.Group("/experiments")
+			{
+				experiments.POST("/", h.CreateExperiment)
+				experiments.GET("/:slug", h.GetExperiment)
+				experiments.DELETE("/:slug", h.DeleteExperiment)
+			}
+
+			exclusionGroups := version.Group("/exclusion_groups")
+			{
+				exclusionGroups.POST("/", h.CreateExclusionGroup)
+				exclusionGroups.GET("/:slug", h.GetExclusionGroup)
+				exclusionGroups.DELETE("/:slug", h.DeleteExclusionGroup)
 			}
 
 			users := version.Group("/users")
 			{
 				users.POST("/", h.UpdateUserSegments)
 				users.POST("/active_segments", h.GetActiveUserSegments)
+				users.POST("/bulk", h.BulkUpdateUserSegments)
+				users.POST("/register", h.CreateUser)
+				users.DELETE("/:id", h.DeleteUser)
+				users.PUT("/:id/attributes", h.SetUserAttributes)
+				users.GET("/:id/history", h.GetUserHistory)
+				users.GET("/:id/segments", h.GetUserSegmentsAt)
 
 				report := users.Group("/report")
 				{
 					report.POST("/", h.CreateCSVReportAndURL)
 					report.GET("/:id", h.GetReportByID)
+					report.GET("/:id/status", h.GetReportStatus)
+					report.DELETE("/:id", h.DeleteReport)
 				}
 			}
 		}
@@ -7,23 +7,45 @@ import (
 	"github.com/google/uuid"
 	_ "github.com/romandnk/dynamic-user-segmentation-service/docs"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_store"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/service"
 	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+var (
+	ErrParsingReportID = errors.New("error parsing report id")
+	ErrReportNotReady  = errors.New("report is not ready")
+	ErrReportLink      = errors.New("invalid report link")
 )
 
 type createCSVRepostAndURLBodyRequest struct {
-	Date string `json:"date"`
+	Date     string   `json:"date"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	UserIDs  []int    `json:"user_ids"`
+	Segments []string `json:"segments"`
+	Action   string   `json:"action"`
+	AutoAdd  *bool    `json:"auto_add"`
+	Format   string   `json:"format" enums:"csv,ndjson,xlsx,parquet"`
+	Gzip     bool     `json:"gzip"`
 }
 
 type createCSVRepostAndURLBodyResponse struct {
-	URL string `json:"report_url"`
+	ID        string `json:"report_id"`
+	URL       string `json:"report_url"`
+	StatusURL string `json:"status_url"`
 }
 
 // CreateCSVReportAndURL godoc
-// @Summary Create a CSV file locally and return url to download a file
+// @Summary Queue a report (csv, ndjson, xlsx or parquet) and return its id, url to download the file and url to check its status
 // @Tags operation
 // @Accept json
-// @Param input body createCSVRepostAndURLBodyRequest true "date format year-month"
-// @Success 200 {object} createCSVRepostAndURLBodyResponse
+// @Param input body createCSVRepostAndURLBodyRequest true "month (year-month) or range from/to and optional filters"
+// @Success 202 {object} createCSVRepostAndURLBodyResponse
 // @Failure 400 {object} response
 // @Failure 500 {object} response
 // @Router /users/report [post]
@@ -36,7 +58,17 @@ func (h *Handler) CreateCSVReportAndURL(c *gin.Context) {
 		return
 	}
 
-	url, err := h.services.CreateCSVReportAndURL(c, createCSVRepostAndURLBody.Date)
+	id, err := h.services.CreateReport(c, service.ReportRequest{
+		Date:     createCSVRepostAndURLBody.Date,
+		From:     createCSVRepostAndURLBody.From,
+		To:       createCSVRepostAndURLBody.To,
+		UserIDs:  createCSVRepostAndURLBody.UserIDs,
+		Segments: createCSVRepostAndURLBody.Segments,
+		Action:   createCSVRepostAndURLBody.Action,
+		AutoAdd:  createCSVRepostAndURLBody.AutoAdd,
+		Format:   createCSVRepostAndURLBody.Format,
+		Gzip:     createCSVRepostAndURLBody.Gzip,
+	})
 	if err != nil {
 		message := "error creating csv report and url"
 		code := http.StatusInternalServerError
@@ -49,32 +81,271 @@ func (h *Handler) CreateCSVReportAndURL(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, createCSVRepostAndURLBodyResponse{
-		URL: url,
+	reportURL := h.reportURL(c, id)
+
+	c.JSON(http.StatusAccepted, createCSVRepostAndURLBodyResponse{
+		ID:        id,
+		URL:       h.signReportURL(reportURL, id),
+		StatusURL: reportURL + "/status",
+	})
+}
+
+// signReportURL adds expiry and signature of the link to the report url, GetReportByID serves the file only by such link.
+func (h *Handler) signReportURL(reportURL, id string) string {
+	if h.linkSigner == nil {
+		return reportURL
+	}
+
+	expires, sig := h.linkSigner.Sign(id, time.Now())
+	return reportURL + "?expires=" + expires + "&sig=" + sig
+}
+
+// reportURL returns the link to download the report. It's built on the configured public base url,
+// without it on the request host, taking X-Forwarded-Proto and X-Forwarded-Host of a trusted proxy into account.
+func (h *Handler) reportURL(c *gin.Context, id string) string {
+	baseURL := h.publicBaseURL
+	if baseURL == "" {
+		baseURL = requestBaseURL(c.Request, h.trustedProxies)
+	}
+
+	return strings.TrimSuffix(baseURL, "/") + "/api/v1/users/report/" + id
+}
+
+// requestBaseURL returns the url the request was sent to. Forwarded headers are taken only from trusted proxies,
+// otherwise any client could make links point at a host of its choice.
+func requestBaseURL(r *http.Request, trustedProxies []netip.Prefix) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if !fromTrustedProxy(r, trustedProxies) {
+		return scheme + "://" + host
+	}
+
+	if proto := firstHeaderValue(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+
+	if forwardedHost := firstHeaderValue(r.Header.Get("X-Forwarded-Host")); forwardedHost != "" {
+		host = forwardedHost
+	}
+
+	return scheme + "://" + host
+}
+
+// fromTrustedProxy reports whether the request came from one of the trusted proxies.
+func fromTrustedProxy(r *http.Request, trustedProxies []netip.Prefix) bool {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	addr := addrPort.Addr().Unmap()
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// firstHeaderValue returns the first value of a comma separated header, each proxy in a chain appends its own.
+func firstHeaderValue(header string) string {
+	value, _, _ := strings.Cut(header, ",")
+	return strings.TrimSpace(value)
+}
+
+type reportStatusResponse struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	Format    string     `json:"format"`
+	Gzip      bool       `json:"gzip"`
+	From      time.Time  `json:"from"`
+	To        time.Time  `json:"to"`
+	Rows      int64      `json:"rows"`
+	Size      int64      `json:"size"`
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// GetReportStatus godoc
+// @Summary Get status of report generation (pending, running, done, failed), period, number of rows, file size and expiry
+// @Tags operation
+// @Param id path string true "report id"
+// @Success 200 {object} reportStatusResponse
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 500 {object} response
+// @Router /users/report/{id}/status [get]
+func (h *Handler) GetReportStatus(c *gin.Context) {
+	parsedID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		resp := newResponse("id", ErrParsingReportID.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	report, err := h.services.GetReport(c, parsedID.String())
+	if err != nil {
+		message := "error getting report"
+		code := http.StatusInternalServerError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, reportStatusResponse{
+		ID:        report.ID,
+		Status:    report.Status,
+		Format:    report.Format,
+		Gzip:      report.Gzip,
+		From:      report.Filter.From,
+		To:        report.Filter.To,
+		Rows:      report.Rows,
+		Size:      report.Size,
+		Error:     report.Error,
+		CreatedAt: report.CreatedAt,
+		UpdatedAt: report.UpdatedAt,
+		ExpiresAt: report.ExpiresAt,
 	})
 }
 
 // GetReportByID godoc
-// @Summary Get report CSV file to download
+// @Summary Get report file to download, the content type and extension follow the report format.
+// @Description The link must be the signed one returned on report creation and not expired.
+// @Description Redirects to a presigned link when the report store supports it.
 // @Tags operation
-// @Param input path string true "report id"
+// @Param id path string true "report id"
+// @Param expires query int true "unix time the link expires at"
+// @Param sig query string true "link signature"
 // @Success 200
+// @Success 307
 // @Failure 400 {object} response
+// @Failure 403 {object} response
+// @Failure 404 {object} response
+// @Failure 409 {object} response
 // @Failure 500 {object} response
 // @Router /users/report/{id} [get]
 func (h *Handler) GetReportByID(c *gin.Context) {
-	id := c.Param("id")
-	parsedID, err := uuid.Parse(id)
+	parsedID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
-		resp := newResponse("", ErrParsingBody.Error(), err)
+		resp := newResponse("id", ErrParsingReportID.Error(), err)
 		h.sentResponse(c, http.StatusBadRequest, resp)
 		return
 	}
 
-	fileName := parsedID.String() + ".csv"
-	filePath := h.pathToReports + fileName
+	// the link is checked before the report is looked up, so an unsigned link doesn't tell whether the report exists
+	if h.linkSigner != nil {
+		err = h.linkSigner.Verify(parsedID.String(), c.Query("expires"), c.Query("sig"), time.Now())
+		if err != nil {
+			resp := newResponse("sig", ErrReportLink.Error(), err)
+			h.sentResponse(c, http.StatusForbidden, resp)
+			return
+		}
+	}
 
-	fmt.Println(filePath)
+	report, err := h.services.GetReport(c, parsedID.String())
+	if err != nil {
+		message := "error getting report"
+		code := http.StatusInternalServerError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	if report.Status != models.ReportStatusDone {
+		err = fmt.Errorf("report is %s", report.Status)
+		if report.Status == models.ReportStatusFailed {
+			err = fmt.Errorf("report is failed: %s", report.Error)
+		}
+		resp := newResponse("id", ErrReportNotReady.Error(), err)
+		h.sentResponse(c, http.StatusConflict, resp)
+		return
+	}
+
+	fileName := report.FileName()
+
+	// a store which can presign links lets the client download the file directly from it
+	if presigner, ok := h.reportStore.(report_store.Presigner); ok {
+		link, err := presigner.PresignGet(c, fileName, report.ContentType())
+		if err != nil {
+			h.sentReportFileError(c, err)
+			return
+		}
+		if link != "" {
+			c.Redirect(http.StatusTemporaryRedirect, link)
+			return
+		}
+	}
+
+	file, info, err := h.reportStore.Get(c, fileName)
+	if err != nil {
+		h.sentReportFileError(c, err)
+		return
+	}
+	defer file.Close()
+
+	c.Header("Content-Type", report.ContentType())
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	http.ServeContent(c.Writer, c.Request, fileName, info.ModTime, file)
+}
+
+func (h *Handler) sentReportFileError(c *gin.Context, err error) {
+	message := "error getting report file"
+	code := http.StatusInternalServerError
+	if errors.Is(err, report_store.ErrNotExist) {
+		code = http.StatusNotFound
+	}
+	resp := newResponse("id", message, err)
+	h.sentResponse(c, code, resp)
+}
+
+// DeleteReport godoc
+// @Summary Delete report and its file, a report which is being generated cannot be deleted
+// @Tags operation
+// @Param id path string true "report id"
+// @Success 200
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 409 {object} response
+// @Failure 500 {object} response
+// @Router /users/report/{id} [delete]
+func (h *Handler) DeleteReport(c *gin.Context) {
+	parsedID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		resp := newResponse("id", ErrParsingReportID.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	err = h.services.DeleteReport(c, parsedID.String())
+	if err != nil {
+		message := "error deleting report"
+		code := http.StatusInternalServerError
+		var notFoundError custom_error.NotFoundError
+		switch {
+		case errors.As(err, &notFoundError):
+			code = http.StatusNotFound
+		case errors.Is(err, service.ErrReportRunning):
+			code = http.StatusConflict
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
 
-	c.FileAttachment(filePath, fileName)
+	c.Status(http.StatusOK)
 }
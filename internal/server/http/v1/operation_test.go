@@ -6,7 +6,12 @@ import (
 	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
 	mock_logger "github.com/romandnk/dynamic-user-segmentation-service/internal/logger/mock"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_link"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_store"
+	local_report_store "github.com/romandnk/dynamic-user-segmentation-service/internal/report_store/local"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/service"
 	mock_service "github.com/romandnk/dynamic-user-segmentation-service/internal/service/mock"
 	"github.com/stretchr/testify/require"
@@ -14,7 +19,11 @@ import (
 	"go.uber.org/zap"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandler_CreateCSVReportAndURL(t *testing.T) {
@@ -26,9 +35,10 @@ func TestHandler_CreateCSVReportAndURL(t *testing.T) {
 	expectedDate := "2023-08"
 	expectedUrl := "http://localhost:8080/api/v1/users/report/" + expectedID
 
-	services.EXPECT().CreateCSVReportAndURL(gomock.Any(), expectedDate).Return(expectedUrl, nil)
+	services.EXPECT().CreateReport(gomock.Any(), service.ReportRequest{Date: expectedDate}).
+		Return(expectedID, nil)
 
-	handler := NewHandler(services, nil, "")
+	handler := NewHandler(services, nil, nil, "http://localhost:8080/", nil, nil)
 
 	r := gin.Default()
 	r.POST(url+"/users/report", handler.CreateCSVReportAndURL)
@@ -49,15 +59,152 @@ func TestHandler_CreateCSVReportAndURL(t *testing.T) {
 
 	r.ServeHTTP(w, req)
 
-	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, http.StatusAccepted, w.Code)
 
 	var responseBody map[string]interface{}
 	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
 	require.NoError(t, err)
 
+	actualID, ok := responseBody["report_id"]
+	require.Equal(t, expectedID, actualID)
+	require.True(t, ok)
+
 	actualURL, ok := responseBody["report_url"]
 	require.Equal(t, expectedUrl, actualURL)
 	require.True(t, ok)
+
+	actualStatusURL, ok := responseBody["status_url"]
+	require.Equal(t, expectedUrl+"/status", actualStatusURL)
+	require.True(t, ok)
+}
+
+func TestHandler_CreateCSVReportAndURLSigned(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedID := uuid.New().String()
+	expectedUrl := "http://localhost:8080/api/v1/users/report/" + expectedID
+
+	services.EXPECT().CreateReport(gomock.Any(), service.ReportRequest{Date: "2023-08"}).Return(expectedID, nil)
+
+	signer := newTestLinkSigner(t)
+
+	handler := NewHandler(services, nil, nil, "http://localhost:8080", nil, signer)
+
+	r := gin.Default()
+	r.POST(url+"/users/report", handler.CreateCSVReportAndURL)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/users/report", bytes.NewBufferString(`{"date":"2023-08"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	var responseBody createCSVRepostAndURLBodyResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.True(t, strings.HasPrefix(responseBody.URL, expectedUrl+"?"))
+	require.Equal(t, expectedUrl+"/status", responseBody.StatusURL)
+
+	linkReq, err := http.NewRequest(http.MethodGet, responseBody.URL, nil)
+	require.NoError(t, err)
+	query := linkReq.URL.Query()
+	require.NoError(t, signer.Verify(expectedID, query.Get("expires"), query.Get("sig"), time.Now()))
+}
+
+func TestHandler_CreateCSVReportAndURLLinkFromRequest(t *testing.T) {
+	trustedProxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	testCases := []struct {
+		name        string
+		host        string
+		remoteAddr  string
+		headers     map[string]string
+		expectedURL string
+	}{
+		{
+			name:        "request host",
+			host:        "service:8080",
+			remoteAddr:  "192.168.1.10:51234",
+			expectedURL: "http://service:8080/api/v1/users/report/",
+		},
+		{
+			name:       "forwarded by proxy",
+			host:       "service:8080",
+			remoteAddr: "10.0.0.2:51234",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "segments.example.com, proxy.internal",
+			},
+			expectedURL: "https://segments.example.com/api/v1/users/report/",
+		},
+		{
+			name:       "forwarded by untrusted client",
+			host:       "service:8080",
+			remoteAddr: "192.168.1.10:51234",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "attacker.example.com",
+			},
+			expectedURL: "http://service:8080/api/v1/users/report/",
+		},
+		{
+			name:       "invalid forwarded proto",
+			host:       "service:8080",
+			remoteAddr: "10.0.0.2:51234",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "ftp",
+			},
+			expectedURL: "http://service:8080/api/v1/users/report/",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			services := mock_service.NewMockServices(ctrl)
+
+			expectedID := uuid.New().String()
+
+			services.EXPECT().CreateReport(gomock.Any(), service.ReportRequest{Date: "2023-08"}).Return(expectedID, nil)
+
+			handler := NewHandler(services, nil, nil, "", trustedProxies, nil)
+
+			r := gin.Default()
+			r.POST(url+"/users/report", handler.CreateCSVReportAndURL)
+
+			w := httptest.NewRecorder()
+
+			ctx := context.Background()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/users/report", bytes.NewBufferString(`{"date":"2023-08"}`))
+			require.NoError(t, err)
+			req.Host = tc.host
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set("Content-Type", "application/json")
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, http.StatusAccepted, w.Code)
+
+			var responseBody createCSVRepostAndURLBodyResponse
+			err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedURL+expectedID, responseBody.URL)
+			require.Equal(t, tc.expectedURL+expectedID+"/status", responseBody.StatusURL)
+		})
+	}
 }
 
 func TestHandler_CreateCSVReportAndURLErrorParsingJSONBody(t *testing.T) {
@@ -72,7 +219,7 @@ func TestHandler_CreateCSVReportAndURLErrorParsingJSONBody(t *testing.T) {
 
 	logger.EXPECT().Error(ErrParsingBody.Error(), zap.String("errors", expectedError))
 
-	handler := NewHandler(nil, logger, "")
+	handler := NewHandler(nil, logger, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.POST(url+"/users/report", handler.CreateCSVReportAndURL)
@@ -118,10 +265,11 @@ func TestHandler_CreateCSVReportAndURLErrorInvalidDate(t *testing.T) {
 	expectedError := service.ErrParsingDate
 	expectedMessage := "error creating csv report and url"
 
-	services.EXPECT().CreateCSVReportAndURL(gomock.Any(), expectedDate).Return("", expectedError)
+	services.EXPECT().CreateReport(gomock.Any(), service.ReportRequest{Date: expectedDate}).
+		Return("", expectedError)
 	logger.EXPECT().Error(expectedMessage, zap.String("errors", expectedError.Error()))
 
-	handler := NewHandler(services, logger, "")
+	handler := NewHandler(services, logger, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.POST(url+"/users/report", handler.CreateCSVReportAndURL)
@@ -156,3 +304,434 @@ func TestHandler_CreateCSVReportAndURLErrorInvalidDate(t *testing.T) {
 	require.Equal(t, expectedError.Error(), actualError)
 	require.True(t, ok)
 }
+
+func TestHandler_CreateCSVReportAndURLWithFilters(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	autoAdd := true
+	expectedRequest := service.ReportRequest{
+		From:     "2023-08-10",
+		To:       "2023-08-20T12:00:00Z",
+		UserIDs:  []int{1, 2},
+		Segments: []string{"AVITO_TEST"},
+		Action:   "add",
+		AutoAdd:  &autoAdd,
+	}
+	expectedID := uuid.New().String()
+
+	services.EXPECT().CreateReport(gomock.Any(), expectedRequest).Return(expectedID, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.POST(url+"/users/report", handler.CreateCSVReportAndURL)
+
+	requestBody := map[string]interface{}{
+		"from":     expectedRequest.From,
+		"to":       expectedRequest.To,
+		"user_ids": expectedRequest.UserIDs,
+		"segments": expectedRequest.Segments,
+		"action":   expectedRequest.Action,
+		"auto_add": autoAdd,
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/users/report", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusAccepted, w.Code)
+}
+
+func TestHandler_GetReportStatus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedReport := models.Report{
+		ID:     uuid.New().String(),
+		Status: models.ReportStatusDone,
+		Format: models.ReportFormatNDJSON,
+		Gzip:   true,
+		Filter: models.OperationFilter{
+			From: time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+		},
+		Rows:      10,
+		Size:      512,
+		CreatedAt: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+		UpdatedAt: time.Date(2023, 8, 1, 0, 0, 5, 0, time.UTC),
+	}
+	expiresAt := time.Date(2023, 8, 8, 0, 0, 0, 0, time.UTC)
+	expectedReport.ExpiresAt = &expiresAt
+
+	services.EXPECT().GetReport(gomock.Any(), expectedReport.ID).Return(expectedReport, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/users/report/:id/status", handler.GetReportStatus)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/users/report/"+expectedReport.ID+"/status", nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var responseBody reportStatusResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, reportStatusResponse{
+		ID:        expectedReport.ID,
+		Status:    expectedReport.Status,
+		Format:    expectedReport.Format,
+		Gzip:      expectedReport.Gzip,
+		From:      expectedReport.Filter.From,
+		To:        expectedReport.Filter.To,
+		Rows:      expectedReport.Rows,
+		Size:      expectedReport.Size,
+		CreatedAt: expectedReport.CreatedAt,
+		UpdatedAt: expectedReport.UpdatedAt,
+		ExpiresAt: expectedReport.ExpiresAt,
+	}, responseBody)
+}
+
+func TestHandler_GetReportByID(t *testing.T) {
+	pathToReports := t.TempDir() + "/"
+
+	reportStore, err := local_report_store.NewStore(pathToReports)
+	require.NoError(t, err)
+
+	doneID := uuid.New().String()
+	err = os.WriteFile(pathToReports+doneID+".csv", []byte("user id,segment_slug,action,date,auto_add\n"), 0o644)
+	require.NoError(t, err)
+
+	parquetID := uuid.New().String()
+	err = os.WriteFile(pathToReports+parquetID+".parquet", []byte("PAR1"), 0o644)
+	require.NoError(t, err)
+
+	removedID := uuid.New().String()
+
+	testCases := []struct {
+		name                string
+		id                  string
+		report              models.Report
+		returnError         error
+		expectedCode        int
+		expectedContentType string
+		expectedFileName    string
+	}{
+		{
+			name:                "done",
+			id:                  doneID,
+			report:              models.Report{ID: doneID, Status: models.ReportStatusDone, Format: models.ReportFormatCSV},
+			expectedCode:        http.StatusOK,
+			expectedContentType: "text/csv",
+			expectedFileName:    doneID + ".csv",
+		},
+		{
+			name:                "done parquet",
+			id:                  parquetID,
+			report:              models.Report{ID: parquetID, Status: models.ReportStatusDone, Format: models.ReportFormatParquet},
+			expectedCode:        http.StatusOK,
+			expectedContentType: "application/vnd.apache.parquet",
+			expectedFileName:    parquetID + ".parquet",
+		},
+		{
+			name:         "file removed",
+			id:           removedID,
+			report:       models.Report{ID: removedID, Status: models.ReportStatusDone, Format: models.ReportFormatXLSX},
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "running",
+			id:           uuid.New().String(),
+			report:       models.Report{Status: models.ReportStatusRunning},
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "failed",
+			id:           uuid.New().String(),
+			report:       models.Report{Status: models.ReportStatusFailed, Error: "connection refused"},
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name: "not found",
+			id:   uuid.New().String(),
+			returnError: custom_error.NotFoundError{
+				Field:   "id",
+				Message: "report doesn't exist",
+			},
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			services := mock_service.NewMockServices(ctrl)
+			logger := mock_logger.NewMockLogger(ctrl)
+
+			services.EXPECT().GetReport(gomock.Any(), tc.id).Return(tc.report, tc.returnError)
+			logger.EXPECT().Error(gomock.Any(), gomock.Any()).AnyTimes()
+
+			handler := NewHandler(services, logger, reportStore, "", nil, nil)
+
+			r := gin.Default()
+			r.GET(url+"/users/report/:id", handler.GetReportByID)
+
+			w := httptest.NewRecorder()
+
+			ctx := context.Background()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/users/report/"+tc.id, nil)
+			require.NoError(t, err)
+
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, tc.expectedCode, w.Code)
+			if tc.expectedCode == http.StatusOK {
+				require.Equal(t, tc.expectedContentType, w.Header().Get("Content-Type"))
+				require.Contains(t, w.Header().Get("Content-Disposition"), tc.expectedFileName)
+			}
+		})
+	}
+}
+
+// presignStore is a report store which presigns links to files it has.
+type presignStore struct {
+	*local_report_store.Store
+	link string
+}
+
+func (p presignStore) PresignGet(ctx context.Context, name, contentType string) (string, error) {
+	if _, _, err := p.Get(ctx, name); err != nil {
+		return "", err
+	}
+	return p.link + name, nil
+}
+
+func TestHandler_GetReportByIDPresigned(t *testing.T) {
+	localStore, err := local_report_store.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	reportStore := presignStore{Store: localStore, link: "http://minio:9000/reports/"}
+
+	doneID := uuid.New().String()
+	err = reportStore.Put(context.Background(), doneID+".csv", bytes.NewReader(nil), 0, "text/csv")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name             string
+		report           models.Report
+		expectedCode     int
+		expectedLocation string
+	}{
+		{
+			name:             "redirect",
+			report:           models.Report{ID: doneID, Status: models.ReportStatusDone, Format: models.ReportFormatCSV},
+			expectedCode:     http.StatusTemporaryRedirect,
+			expectedLocation: "http://minio:9000/reports/" + doneID + ".csv",
+		},
+		{
+			name:         "file removed",
+			report:       models.Report{ID: uuid.New().String(), Status: models.ReportStatusDone, Format: models.ReportFormatCSV},
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			services := mock_service.NewMockServices(ctrl)
+			logger := mock_logger.NewMockLogger(ctrl)
+
+			services.EXPECT().GetReport(gomock.Any(), tc.report.ID).Return(tc.report, nil)
+			logger.EXPECT().Error(gomock.Any(), gomock.Any()).AnyTimes()
+
+			handler := NewHandler(services, logger, reportStore, "", nil, nil)
+
+			r := gin.Default()
+			r.GET(url+"/users/report/:id", handler.GetReportByID)
+
+			w := httptest.NewRecorder()
+
+			ctx := context.Background()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/users/report/"+tc.report.ID, nil)
+			require.NoError(t, err)
+
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, tc.expectedCode, w.Code)
+			require.Equal(t, tc.expectedLocation, w.Header().Get("Location"))
+		})
+	}
+}
+
+var _ report_store.Presigner = presignStore{}
+
+func TestHandler_DeleteReport(t *testing.T) {
+	testCases := []struct {
+		name         string
+		id           string
+		returnError  error
+		expectedCode int
+	}{
+		{
+			name:         "deleted",
+			id:           uuid.New().String(),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "not found",
+			id:   uuid.New().String(),
+			returnError: custom_error.NotFoundError{
+				Field:   "id",
+				Message: "report doesn't exist",
+			},
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "running",
+			id:           uuid.New().String(),
+			returnError:  service.ErrReportRunning,
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "invalid id",
+			id:           "abc",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			services := mock_service.NewMockServices(ctrl)
+			logger := mock_logger.NewMockLogger(ctrl)
+
+			if tc.expectedCode != http.StatusBadRequest {
+				services.EXPECT().DeleteReport(gomock.Any(), tc.id).Return(tc.returnError)
+			}
+			logger.EXPECT().Error(gomock.Any(), gomock.Any()).AnyTimes()
+
+			handler := NewHandler(services, logger, nil, "", nil, nil)
+
+			r := gin.Default()
+			r.DELETE(url+"/users/report/:id", handler.DeleteReport)
+
+			w := httptest.NewRecorder()
+
+			ctx := context.Background()
+			req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url+"/users/report/"+tc.id, nil)
+			require.NoError(t, err)
+
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, tc.expectedCode, w.Code)
+		})
+	}
+}
+
+func newTestLinkSigner(t *testing.T) *report_link.Signer {
+	signer, err := report_link.NewSigner(report_link.Config{
+		Keys: []string{strings.Repeat("k", report_link.MinKeyLength)},
+		TTL:  time.Hour,
+	})
+	require.NoError(t, err)
+
+	return signer
+}
+
+func TestHandler_GetReportByIDSignedLink(t *testing.T) {
+	pathToReports := t.TempDir() + "/"
+
+	reportStore, err := local_report_store.NewStore(pathToReports)
+	require.NoError(t, err)
+
+	id := uuid.New().String()
+	err = os.WriteFile(pathToReports+id+".csv", []byte("user id,segment_slug,action,date,auto_add\n"), 0o644)
+	require.NoError(t, err)
+
+	signer := newTestLinkSigner(t)
+
+	expires, sig := signer.Sign(id, time.Now())
+	expiredExpires, expiredSig := signer.Sign(id, time.Now().Add(-2*time.Hour))
+	otherExpires, otherSig := signer.Sign(uuid.New().String(), time.Now())
+
+	testCases := []struct {
+		name         string
+		query        string
+		expectedCode int
+	}{
+		{
+			name:         "signed",
+			query:        "?expires=" + expires + "&sig=" + sig,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "not signed",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "expired",
+			query:        "?expires=" + expiredExpires + "&sig=" + expiredSig,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "signed for another report",
+			query:        "?expires=" + otherExpires + "&sig=" + otherSig,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			services := mock_service.NewMockServices(ctrl)
+			logger := mock_logger.NewMockLogger(ctrl)
+
+			if tc.expectedCode == http.StatusOK {
+				services.EXPECT().GetReport(gomock.Any(), id).
+					Return(models.Report{ID: id, Status: models.ReportStatusDone, Format: models.ReportFormatCSV}, nil)
+			}
+			logger.EXPECT().Error(gomock.Any(), gomock.Any()).AnyTimes()
+
+			handler := NewHandler(services, logger, reportStore, "", nil, signer)
+
+			r := gin.Default()
+			r.GET(url+"/users/report/:id", handler.GetReportByID)
+
+			w := httptest.NewRecorder()
+
+			ctx := context.Background()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/users/report/"+id+tc.query, nil)
+			require.NoError(t, err)
+
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, tc.expectedCode, w.Code)
+		})
+	}
+}
@@ -25,6 +25,17 @@ func newResponse(field, message string, err error) response {
 		return resp
 	}
 
+	var notFoundError custom_error.NotFoundError
+
+	if errors.As(err, &notFoundError) {
+		resp := response{
+			Field:   notFoundError.Field,
+			Message: message,
+			Error:   notFoundError.Error(),
+		}
+		return resp
+	}
+
 	resp := response{
 		Field:   field,
 		Message: message,
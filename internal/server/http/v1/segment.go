@@ -4,23 +4,31 @@ import (
 	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/service"
 	"net/http"
+	"time"
 )
 
 var (
-	ErrParsingBody = errors.New("error parsing json body")
+	ErrParsingBody  = errors.New("error parsing json body")
+	ErrParsingQuery = errors.New("error parsing query parameters")
 )
 
 type createSegmentBodyRequest struct {
 	Slug       string `json:"slug"`
 	Percentage string `json:"auto_add_percentage"`
+	Parent     string `json:"parent"`
+	Rule       string `json:"rule"`
+	StartsAt   string `json:"starts_at"`
+	EndsAt     string `json:"ends_at"`
 }
 
 // CreateSegment godoc
 // @Summary Create segment
 // @Tags segment
 // @Accept json
-// @Param input body createSegmentBodyRequest true "slug is a segment name, auto_add_percentage is a percentage of users who will have this segment"
+// @Param input body createSegmentBodyRequest true "slug is a segment name, auto_add_percentage is a percentage of users who will have this segment, parent is an optional segment whose users only can have this one, rule is an optional condition over user attributes (e.g. country == \"RU\" && age >= 18), users whose attributes match it get the segment, starts_at and ends_at (RFC3339) optionally bound the window when the segment takes effect"
 // @Success 201
 // @Failure 400 {object} response
 // @Failure 500 {object} response
@@ -34,7 +42,14 @@ func (h *Handler) CreateSegment(c *gin.Context) {
 		return
 	}
 
-	err := h.services.CreateSegment(c, segmentBody.Slug, segmentBody.Percentage)
+	err := h.services.CreateSegment(c, service.SegmentToCreate{
+		Slug:       segmentBody.Slug,
+		Percentage: segmentBody.Percentage,
+		Parent:     segmentBody.Parent,
+		Rule:       segmentBody.Rule,
+		StartsAt:   segmentBody.StartsAt,
+		EndsAt:     segmentBody.EndsAt,
+	})
 	if err != nil {
 		message := "error creating segment"
 		code := http.StatusInternalServerError
@@ -87,3 +102,366 @@ func (h *Handler) DeleteSegment(c *gin.Context) {
 
 	c.Status(http.StatusOK)
 }
+
+type segmentResponse struct {
+	Slug        string     `json:"slug"`
+	Percentage  int        `json:"auto_add_percentage"`
+	Parent      string     `json:"parent"`
+	Rule        string     `json:"rule"`
+	StartsAt    *time.Time `json:"starts_at"`
+	EndsAt      *time.Time `json:"ends_at"`
+	Description string     `json:"description"`
+	Owner       string     `json:"owner"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UsersCount  int        `json:"users_count"`
+}
+
+func newSegmentResponse(segment models.Segment) segmentResponse {
+	return segmentResponse{
+		Slug:        segment.Slug,
+		Percentage:  segment.Percentage,
+		Parent:      segment.Parent,
+		Rule:        segment.Rule,
+		StartsAt:    segment.StartsAt,
+		EndsAt:      segment.EndsAt,
+		Description: segment.Description,
+		Owner:       segment.Owner,
+		CreatedAt:   segment.CreatedAt,
+		UsersCount:  segment.UsersCount,
+	}
+}
+
+type getSegmentsQueryRequest struct {
+	Prefix string `form:"prefix"`
+	Limit  int    `form:"limit"`
+	Offset int    `form:"offset"`
+}
+
+type getSegmentsBodyResponse struct {
+	Segments []segmentResponse `json:"segments"`
+}
+
+// GetSegments godoc
+// @Summary Get segments
+// @Tags segment
+// @Param prefix query string false "slug prefix"
+// @Param limit query int false "max number of segments (from 1 to 100, default 20)"
+// @Param offset query int false "number of segments to skip"
+// @Success 200 {object} getSegmentsBodyResponse
+// @Failure 400 {object} response
+// @Failure 500 {object} response
+// @Router /segments [get]
+func (h *Handler) GetSegments(c *gin.Context) {
+	var getSegmentsQuery getSegmentsQueryRequest
+
+	if err := c.ShouldBindQuery(&getSegmentsQuery); err != nil {
+		resp := newResponse("", ErrParsingQuery.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	segments, err := h.services.GetSegments(c, getSegmentsQuery.Prefix, getSegmentsQuery.Limit, getSegmentsQuery.Offset)
+	if err != nil {
+		message := "error getting segments"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	segmentsResponse := make([]segmentResponse, 0, len(segments))
+	for _, segment := range segments {
+		segmentsResponse = append(segmentsResponse, newSegmentResponse(segment))
+	}
+
+	c.JSON(http.StatusOK, getSegmentsBodyResponse{
+		Segments: segmentsResponse,
+	})
+}
+
+// GetSegment godoc
+// @Summary Get segment with its number of users
+// @Tags segment
+// @Param slug path string true "segment slug"
+// @Success 200 {object} segmentResponse
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 500 {object} response
+// @Router /segments/{slug} [get]
+func (h *Handler) GetSegment(c *gin.Context) {
+	segment, err := h.services.GetSegment(c, c.Param("slug"))
+	if err != nil {
+		message := "error getting segment"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, newSegmentResponse(segment))
+}
+
+type updateSegmentBodyRequest struct {
+	Percentage    *string `json:"auto_add_percentage"`
+	Description   *string `json:"description"`
+	Owner         *string `json:"owner"`
+	TrimAutoAdded bool    `json:"trim_auto_added"`
+}
+
+// UpdateSegment godoc
+// @Summary Update segment auto add percentage, description and owner
+// @Tags segment
+// @Accept json
+// @Param slug path string true "segment slug"
+// @Param input body updateSegmentBodyRequest true "fields to change, trim_auto_added removes auto added users out of the lowered percentage"
+// @Success 200
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 500 {object} response
+// @Router /segments/{slug} [patch]
+func (h *Handler) UpdateSegment(c *gin.Context) {
+	var segmentBody updateSegmentBodyRequest
+
+	if err := c.ShouldBindJSON(&segmentBody); err != nil {
+		resp := newResponse("", ErrParsingBody.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	err := h.services.UpdateSegment(c, c.Param("slug"), service.SegmentUpdate{
+		Percentage:    segmentBody.Percentage,
+		Description:   segmentBody.Description,
+		Owner:         segmentBody.Owner,
+		TrimAutoAdded: segmentBody.TrimAutoAdded,
+	})
+	if err != nil {
+		message := "error updating segment"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+type getSegmentUsersQueryRequest struct {
+	Cursor string `form:"cursor"`
+	Limit  int    `form:"limit"`
+}
+
+type segmentUserResponse struct {
+	UserID    int        `json:"user_id"`
+	AutoAdd   bool       `json:"auto_add"`
+	AddedAt   time.Time  `json:"added_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type getSegmentUsersBodyResponse struct {
+	Users      []segmentUserResponse `json:"users"`
+	NextCursor string                `json:"next_cursor"`
+}
+
+// GetSegmentUsers godoc
+// @Summary Get users in segment
+// @Tags segment
+// @Param slug path string true "segment slug"
+// @Param cursor query string false "next_cursor from the previous page"
+// @Param limit query int false "max number of users (from 1 to 1000, default 100)"
+// @Success 200 {object} getSegmentUsersBodyResponse
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 500 {object} response
+// @Router /segments/{slug}/users [get]
+func (h *Handler) GetSegmentUsers(c *gin.Context) {
+	var getSegmentUsersQuery getSegmentUsersQueryRequest
+
+	if err := c.ShouldBindQuery(&getSegmentUsersQuery); err != nil {
+		resp := newResponse("", ErrParsingQuery.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	users, nextCursor, err := h.services.GetSegmentUsers(c,
+		c.Param("slug"),
+		getSegmentUsersQuery.Cursor,
+		getSegmentUsersQuery.Limit,
+	)
+	if err != nil {
+		message := "error getting segment users"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	usersResponse := make([]segmentUserResponse, 0, len(users))
+	for _, user := range users {
+		usersResponse = append(usersResponse, segmentUserResponse{
+			UserID:    user.UserID,
+			AutoAdd:   user.AutoAdd,
+			AddedAt:   user.AddedAt,
+			ExpiresAt: user.ExpiresAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, getSegmentUsersBodyResponse{
+		Users:      usersResponse,
+		NextCursor: nextCursor,
+	})
+}
+
+type getSegmentStatsQueryRequest struct {
+	From string `form:"from"`
+	To   string `form:"to"`
+}
+
+type segmentDayStatsResponse struct {
+	Date       string `json:"date"`
+	ManualAdds int    `json:"manual_adds"`
+	AutoAdds   int    `json:"auto_adds"`
+	Deletes    int    `json:"deletes"`
+}
+
+type getSegmentStatsBodyResponse struct {
+	Slug           string                    `json:"slug"`
+	Users          int                       `json:"users"`
+	ManualUsers    int                       `json:"manual_users"`
+	AutoAddedUsers int                       `json:"auto_added_users"`
+	Days           []segmentDayStatsResponse `json:"days"`
+}
+
+// GetSegmentStats godoc
+// @Summary Get segment size and its adds and deletes per day
+// @Tags segment
+// @Param slug path string true "segment slug"
+// @Param from query string false "first day (year-month-day, e.g. 2023-08-01)"
+// @Param to query string false "last day inclusively (year-month-day, e.g. 2023-08-31), the last 30 days if both are empty"
+// @Success 200 {object} getSegmentStatsBodyResponse
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 500 {object} response
+// @Router /segments/{slug}/stats [get]
+func (h *Handler) GetSegmentStats(c *gin.Context) {
+	var getSegmentStatsQuery getSegmentStatsQueryRequest
+
+	if err := c.ShouldBindQuery(&getSegmentStatsQuery); err != nil {
+		resp := newResponse("", ErrParsingQuery.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	stats, err := h.services.GetSegmentStats(c,
+		c.Param("slug"),
+		getSegmentStatsQuery.From,
+		getSegmentStatsQuery.To,
+	)
+	if err != nil {
+		message := "error getting segment stats"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	daysResponse := make([]segmentDayStatsResponse, 0, len(stats.Days))
+	for _, day := range stats.Days {
+		daysResponse = append(daysResponse, segmentDayStatsResponse{
+			Date:       day.Day.Format(time.DateOnly),
+			ManualAdds: day.ManualAdds,
+			AutoAdds:   day.AutoAdds,
+			Deletes:    day.Deletes,
+		})
+	}
+
+	c.JSON(http.StatusOK, getSegmentStatsBodyResponse{
+		Slug:           stats.Slug,
+		Users:          stats.Users,
+		ManualUsers:    stats.Users - stats.AutoAddedUsers,
+		AutoAddedUsers: stats.AutoAddedUsers,
+		Days:           daysResponse,
+	})
+}
+
+type segmentWindowEventResponse struct {
+	Action string    `json:"action"`
+	Date   time.Time `json:"date"`
+}
+
+type getSegmentWindowEventsBodyResponse struct {
+	Events []segmentWindowEventResponse `json:"events"`
+}
+
+// GetSegmentWindowEvents godoc
+// @Summary Get openings and closings of segment window
+// @Tags segment
+// @Param slug path string true "segment slug"
+// @Success 200 {object} getSegmentWindowEventsBodyResponse
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 500 {object} response
+// @Router /segments/{slug}/window_events [get]
+func (h *Handler) GetSegmentWindowEvents(c *gin.Context) {
+	events, err := h.services.GetSegmentWindowEvents(c, c.Param("slug"))
+	if err != nil {
+		message := "error getting segment window events"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	eventsResponse := make([]segmentWindowEventResponse, 0, len(events))
+	for _, event := range events {
+		eventsResponse = append(eventsResponse, segmentWindowEventResponse{
+			Action: event.Action,
+			Date:   event.Date,
+		})
+	}
+
+	c.JSON(http.StatusOK, getSegmentWindowEventsBodyResponse{Events: eventsResponse})
+}
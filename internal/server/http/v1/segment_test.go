@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
 	mock_logger "github.com/romandnk/dynamic-user-segmentation-service/internal/logger/mock"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/service"
 	mock_service "github.com/romandnk/dynamic-user-segmentation-service/internal/service/mock"
 	"github.com/stretchr/testify/require"
@@ -15,6 +17,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 const url = "/api/v1"
@@ -26,10 +29,19 @@ func TestHandler_CreateSegment(t *testing.T) {
 
 	expectedSlug := "AVITO_TEST"
 	expectedAutoAddPercentage := "10%"
+	expectedParent := "AVITO"
+	expectedStartsAt := "2023-11-24T00:00:00Z"
+	expectedEndsAt := "2023-11-27T00:00:00Z"
 
-	services.EXPECT().CreateSegment(gomock.Any(), expectedSlug, expectedAutoAddPercentage).Return(nil)
+	services.EXPECT().CreateSegment(gomock.Any(), service.SegmentToCreate{
+		Slug:       expectedSlug,
+		Percentage: expectedAutoAddPercentage,
+		Parent:     expectedParent,
+		StartsAt:   expectedStartsAt,
+		EndsAt:     expectedEndsAt,
+	}).Return(nil)
 
-	handler := NewHandler(services, nil, "")
+	handler := NewHandler(services, nil, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.POST(url+"/segments", handler.CreateSegment)
@@ -37,6 +49,9 @@ func TestHandler_CreateSegment(t *testing.T) {
 	requestBody := map[string]interface{}{
 		"slug":                "AVITO_TEST",
 		"auto_add_percentage": "10%",
+		"parent":              "AVITO",
+		"starts_at":           "2023-11-24T00:00:00Z",
+		"ends_at":             "2023-11-27T00:00:00Z",
 	}
 
 	jsonBody, err := json.Marshal(requestBody)
@@ -66,7 +81,7 @@ func TestHandler_CreateSegmentErrorParsingJSONBody(t *testing.T) {
 
 	logger.EXPECT().Error(ErrParsingBody.Error(), zap.String("errors", expectedError))
 
-	handler := NewHandler(nil, logger, "")
+	handler := NewHandler(nil, logger, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.POST(url+"/segments", handler.CreateSegment)
@@ -146,9 +161,12 @@ func TestHandler_CreateSegmentError(t *testing.T) {
 			logger := mock_logger.NewMockLogger(ctrl)
 
 			logger.EXPECT().Error(expectedMessage, zap.String("errors", tc.expectedError.Error()))
-			services.EXPECT().CreateSegment(gomock.Any(), tc.inputSlug, tc.inputPercentage).Return(tc.expectedError)
+			services.EXPECT().CreateSegment(gomock.Any(), service.SegmentToCreate{
+				Slug:       tc.inputSlug,
+				Percentage: tc.inputPercentage,
+			}).Return(tc.expectedError)
 
-			handler := NewHandler(services, logger, "")
+			handler := NewHandler(services, logger, nil, "", nil, nil)
 
 			r := gin.Default()
 			r.POST(url+"/segments", handler.CreateSegment)
@@ -201,7 +219,7 @@ func TestHandler_DeleteSegment(t *testing.T) {
 
 	services.EXPECT().DeleteSegment(gomock.Any(), expectedSlug).Return(nil)
 
-	handler := NewHandler(services, nil, "")
+	handler := NewHandler(services, nil, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.DELETE(url+"/segments", handler.DeleteSegment)
@@ -237,7 +255,7 @@ func TestHandler_DeleteSegmentErrorParsingJsonBody(t *testing.T) {
 
 	logger.EXPECT().Error(ErrParsingBody.Error(), zap.String("errors", expectedError))
 
-	handler := NewHandler(nil, logger, "")
+	handler := NewHandler(nil, logger, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.DELETE(url+"/segments", handler.DeleteSegment)
@@ -316,7 +334,7 @@ func TestHandler_DeleteSegmentError(t *testing.T) {
 			logger.EXPECT().Error(expectedMessage, zap.String("errors", tc.expectedError.Error()))
 			services.EXPECT().DeleteSegment(gomock.Any(), tc.inputSlug).Return(tc.expectedError)
 
-			handler := NewHandler(services, logger, "")
+			handler := NewHandler(services, logger, nil, "", nil, nil)
 
 			r := gin.Default()
 			r.DELETE(url+"/segments", handler.DeleteSegment)
@@ -358,3 +376,547 @@ func TestHandler_DeleteSegmentError(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_GetSegments(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedPrefix := "AVITO"
+	expectedLimit := 10
+	expectedOffset := 20
+	expectedSegments := []models.Segment{
+		{
+			Slug:       "AVITO_TEST",
+			Percentage: 10,
+			CreatedAt:  time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+			UsersCount: 5,
+		},
+	}
+
+	services.EXPECT().GetSegments(gomock.Any(), expectedPrefix, expectedLimit, expectedOffset).
+		Return(expectedSegments, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/segments", handler.GetSegments)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/segments?prefix=AVITO&limit=10&offset=20", nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var responseBody getSegmentsBodyResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, []segmentResponse{newSegmentResponse(expectedSegments[0])}, responseBody.Segments)
+}
+
+func TestHandler_GetSegmentsErrorParsingQuery(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	expectedMessage := "error parsing query parameters"
+	expectedError := "strconv.ParseInt: parsing \"ten\": invalid syntax"
+
+	logger.EXPECT().Error(ErrParsingQuery.Error(), zap.String("errors", expectedError))
+
+	handler := NewHandler(nil, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/segments", handler.GetSegments)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/segments?limit=ten", nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	var responseBody map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	actualMessage, ok := responseBody["message"]
+	require.Equal(t, expectedMessage, actualMessage)
+	require.True(t, ok)
+
+	actualError, ok := responseBody["error"]
+	require.Equal(t, expectedError, actualError)
+	require.True(t, ok)
+}
+
+func TestHandler_GetSegment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedSegment := models.Segment{
+		Slug:       "AVITO_TEST",
+		Percentage: 10,
+		CreatedAt:  time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+		UsersCount: 5,
+	}
+
+	services.EXPECT().GetSegment(gomock.Any(), expectedSegment.Slug).Return(expectedSegment, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/segments/:slug", handler.GetSegment)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/segments/"+expectedSegment.Slug, nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var responseBody segmentResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, newSegmentResponse(expectedSegment), responseBody)
+}
+
+func TestHandler_GetSegmentNotFound(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	expectedSlug := "AVITO_TEST"
+	expectedError := custom_error.NotFoundError{
+		Field:   "slug",
+		Message: expectedSlug + " doesn't exist",
+	}
+	expectedMessage := "error getting segment"
+
+	services.EXPECT().GetSegment(gomock.Any(), expectedSlug).Return(models.Segment{}, expectedError)
+	logger.EXPECT().Error(expectedMessage, zap.String("errors", expectedError.Error()))
+
+	handler := NewHandler(services, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/segments/:slug", handler.GetSegment)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/segments/"+expectedSlug, nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	var responseBody map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	actualField, ok := responseBody["field"]
+	require.Equal(t, expectedError.Field, actualField)
+	require.True(t, ok)
+
+	actualError, ok := responseBody["error"]
+	require.Equal(t, expectedError.Error(), actualError)
+	require.True(t, ok)
+}
+
+func TestHandler_UpdateSegment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedSlug := "AVITO_TEST"
+	expectedPercentage := "5%"
+	expectedOwner := "team"
+	expectedUpdate := service.SegmentUpdate{
+		Percentage:    &expectedPercentage,
+		Owner:         &expectedOwner,
+		TrimAutoAdded: true,
+	}
+
+	services.EXPECT().UpdateSegment(gomock.Any(), expectedSlug, expectedUpdate).Return(nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.PATCH(url+"/segments/:slug", handler.UpdateSegment)
+
+	requestBody := map[string]interface{}{
+		"auto_add_percentage": expectedPercentage,
+		"owner":               expectedOwner,
+		"trim_auto_added":     true,
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url+"/segments/"+expectedSlug, bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	require.Equal(t, []byte(nil), w.Body.Bytes())
+}
+
+func TestHandler_UpdateSegmentError(t *testing.T) {
+	expectedMessage := "error updating segment"
+	expectedSlug := "AVITO_TEST"
+	expectedDescription := "test segment"
+
+	testCases := []struct {
+		name          string
+		expectedError error
+		expectedField string
+		expectedCode  int
+	}{
+		{
+			name: "segment doesn't exist",
+			expectedError: custom_error.NotFoundError{
+				Field:   "slug",
+				Message: expectedSlug + " doesn't exist",
+			},
+			expectedField: "slug",
+			expectedCode:  http.StatusNotFound,
+		},
+		{
+			name: "invalid percentage",
+			expectedError: custom_error.CustomError{
+				Field:   "percentage",
+				Message: service.ErrInvalidPercentageFormat.Error(),
+			},
+			expectedField: "percentage",
+			expectedCode:  http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			services := mock_service.NewMockServices(ctrl)
+			logger := mock_logger.NewMockLogger(ctrl)
+
+			logger.EXPECT().Error(expectedMessage, zap.String("errors", tc.expectedError.Error()))
+			services.EXPECT().
+				UpdateSegment(gomock.Any(), expectedSlug, service.SegmentUpdate{Description: &expectedDescription}).
+				Return(tc.expectedError)
+
+			handler := NewHandler(services, logger, nil, "", nil, nil)
+
+			r := gin.Default()
+			r.PATCH(url+"/segments/:slug", handler.UpdateSegment)
+
+			requestBody := map[string]interface{}{
+				"description": expectedDescription,
+			}
+
+			jsonBody, err := json.Marshal(requestBody)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+
+			ctx := context.Background()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url+"/segments/"+expectedSlug, bytes.NewBuffer(jsonBody))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, tc.expectedCode, w.Code)
+
+			var responseBody map[string]interface{}
+			err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+			require.NoError(t, err)
+
+			actualField, ok := responseBody["field"]
+			require.Equal(t, tc.expectedField, actualField)
+			require.True(t, ok)
+
+			actualMessage, ok := responseBody["message"]
+			require.Equal(t, expectedMessage, actualMessage)
+			require.True(t, ok)
+		})
+	}
+}
+
+func TestHandler_GetSegmentUsers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedSlug := "AVITO_TEST"
+	expectedCursor := "MTA"
+	expectedNextCursor := "MTE"
+	expectedLimit := 1
+	expectedUsers := []models.UserSegment{
+		{
+			UserID:  11,
+			Slug:    expectedSlug,
+			AutoAdd: true,
+			AddedAt: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	services.EXPECT().GetSegmentUsers(gomock.Any(), expectedSlug, expectedCursor, expectedLimit).
+		Return(expectedUsers, expectedNextCursor, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/segments/:slug/users", handler.GetSegmentUsers)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		url+"/segments/"+expectedSlug+"/users?cursor="+expectedCursor+"&limit=1", nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var responseBody getSegmentUsersBodyResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, expectedNextCursor, responseBody.NextCursor)
+	require.Equal(t, []segmentUserResponse{
+		{
+			UserID:  expectedUsers[0].UserID,
+			AutoAdd: expectedUsers[0].AutoAdd,
+			AddedAt: expectedUsers[0].AddedAt,
+		},
+	}, responseBody.Users)
+}
+
+func TestHandler_GetSegmentStats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedSlug := "AVITO_TEST"
+	expectedFrom := "2023-08-01"
+	expectedTo := "2023-08-02"
+	expectedStats := models.SegmentStats{
+		Slug:           expectedSlug,
+		Users:          10,
+		AutoAddedUsers: 4,
+		Days: []models.SegmentDayStats{
+			{Day: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC), ManualAdds: 3, AutoAdds: 1, Deletes: 2},
+			{Day: time.Date(2023, 8, 2, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	services.EXPECT().GetSegmentStats(gomock.Any(), expectedSlug, expectedFrom, expectedTo).
+		Return(expectedStats, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/segments/:slug/stats", handler.GetSegmentStats)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		url+"/segments/"+expectedSlug+"/stats?from="+expectedFrom+"&to="+expectedTo, nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var responseBody getSegmentStatsBodyResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, getSegmentStatsBodyResponse{
+		Slug:           expectedSlug,
+		Users:          10,
+		ManualUsers:    6,
+		AutoAddedUsers: 4,
+		Days: []segmentDayStatsResponse{
+			{Date: "2023-08-01", ManualAdds: 3, AutoAdds: 1, Deletes: 2},
+			{Date: "2023-08-02"},
+		},
+	}, responseBody)
+}
+
+func TestHandler_GetSegmentStatsError(t *testing.T) {
+	expectedSlug := "AVITO_TEST"
+	expectedMessage := "error getting segment stats"
+
+	testCases := []struct {
+		name          string
+		err           error
+		expectedCode  int
+		expectedField string
+	}{
+		{
+			name: "invalid range",
+			err: custom_error.CustomError{
+				Field:   "from",
+				Message: service.ErrStatsFromAfterTo.Error(),
+			},
+			expectedCode:  http.StatusBadRequest,
+			expectedField: "from",
+		},
+		{
+			name: "segment not found",
+			err: custom_error.NotFoundError{
+				Field:   "slug",
+				Message: expectedSlug + " doesn't exist",
+			},
+			expectedCode:  http.StatusNotFound,
+			expectedField: "slug",
+		},
+		{
+			name:         "internal error",
+			err:          errors.New("connection refused"),
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			services := mock_service.NewMockServices(ctrl)
+			logger := mock_logger.NewMockLogger(ctrl)
+
+			services.EXPECT().GetSegmentStats(gomock.Any(), expectedSlug, "", "").
+				Return(models.SegmentStats{}, tc.err)
+			logger.EXPECT().Error(expectedMessage, zap.String("errors", tc.err.Error()))
+
+			handler := NewHandler(services, logger, nil, "", nil, nil)
+
+			r := gin.Default()
+			r.GET(url+"/segments/:slug/stats", handler.GetSegmentStats)
+
+			w := httptest.NewRecorder()
+
+			ctx := context.Background()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/segments/"+expectedSlug+"/stats", nil)
+			require.NoError(t, err)
+
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, tc.expectedCode, w.Code)
+
+			var responseBody map[string]interface{}
+			err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+			require.NoError(t, err)
+
+			require.Equal(t, expectedMessage, responseBody["message"])
+			require.Equal(t, tc.err.Error(), responseBody["error"])
+			if tc.expectedField != "" {
+				require.Equal(t, tc.expectedField, responseBody["field"])
+			}
+		})
+	}
+}
+
+func TestHandler_GetSegmentWindowEvents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedSlug := "AVITO_TEST"
+	expectedEvents := []models.SegmentWindowEvent{
+		{Action: "open", Date: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)},
+		{Action: "close", Date: time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	services.EXPECT().GetSegmentWindowEvents(gomock.Any(), expectedSlug).Return(expectedEvents, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/segments/:slug/window_events", handler.GetSegmentWindowEvents)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/segments/"+expectedSlug+"/window_events", nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var responseBody getSegmentWindowEventsBodyResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, getSegmentWindowEventsBodyResponse{
+		Events: []segmentWindowEventResponse{
+			{Action: "open", Date: expectedEvents[0].Date},
+			{Action: "close", Date: expectedEvents[1].Date},
+		},
+	}, responseBody)
+}
+
+func TestHandler_GetSegmentWindowEventsNotFound(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	expectedSlug := "AVITO_TEST"
+	expectedMessage := "error getting segment window events"
+	expectedErr := custom_error.NotFoundError{
+		Field:   "slug",
+		Message: expectedSlug + " doesn't exist",
+	}
+
+	services.EXPECT().GetSegmentWindowEvents(gomock.Any(), expectedSlug).Return(nil, expectedErr)
+	logger.EXPECT().Error(expectedMessage, zap.String("errors", expectedErr.Error()))
+
+	handler := NewHandler(services, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/segments/:slug/window_events", handler.GetSegmentWindowEvents)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/segments/"+expectedSlug+"/window_events", nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	var responseBody map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, expectedMessage, responseBody["message"])
+	require.Equal(t, "slug", responseBody["field"])
+}
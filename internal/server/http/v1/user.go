@@ -1,24 +1,342 @@
 package v1
 
 import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	_ "github.com/romandnk/dynamic-user-segmentation-service/docs"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/service"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+var (
+	ErrParsingUserIDs = errors.New("error parsing user ids")
+	ErrParsingUserID  = errors.New("error parsing user id")
+)
+
+type segmentToAddRequest struct {
+	Slug      string `json:"slug"`
+	ExpiresAt string `json:"expires_at"`
+	TTL       string `json:"ttl"`
+}
+
+// UnmarshalJSON accepts either a plain segment slug ("AVITO")
+// or an object with an expiration ({"slug": "AVITO", "ttl": "72h"}).
+func (s *segmentToAddRequest) UnmarshalJSON(data []byte) error {
+	var slug string
+	if err := json.Unmarshal(data, &slug); err == nil {
+		*s = segmentToAddRequest{Slug: slug}
+		return nil
+	}
+
+	type segmentToAddObject segmentToAddRequest
+
+	var segment segmentToAddObject
+	if err := json.Unmarshal(data, &segment); err != nil {
+		return err
+	}
+
+	*s = segmentToAddRequest(segment)
+
+	return nil
+}
+
+func toServiceSegmentsToAdd(segments []segmentToAddRequest) []service.SegmentToAdd {
+	segmentsToAdd := make([]service.SegmentToAdd, 0, len(segments))
+	for _, segment := range segments {
+		segmentsToAdd = append(segmentsToAdd, service.SegmentToAdd{
+			Slug:      segment.Slug,
+			ExpiresAt: segment.ExpiresAt,
+			TTL:       segment.TTL,
+		})
+	}
+	return segmentsToAdd
+}
+
+type createUserBodyRequest struct {
+	UserID int `json:"user_id"`
+}
+
+// CreateUser godoc
+// @Summary Register user
+// @Tags user
+// @Accept json
+// @Param input body createUserBodyRequest true "user id to register"
+// @Success 201
+// @Failure 400 {object} response
+// @Failure 500 {object} response
+// @Router /users/register [post]
+func (h *Handler) CreateUser(c *gin.Context) {
+	var createUserBody createUserBodyRequest
+
+	if err := c.ShouldBindJSON(&createUserBody); err != nil {
+		resp := newResponse("", ErrParsingBody.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	err := h.services.CreateUser(c, createUserBody.UserID)
+	if err != nil {
+		message := "error creating user"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
+
+// DeleteUser godoc
+// @Summary Delete user with all its segments
+// @Tags user
+// @Param id path int true "user id"
+// @Success 200
+// @Failure 400 {object} response
+// @Failure 404 {object} response
+// @Failure 500 {object} response
+// @Router /users/{id} [delete]
+func (h *Handler) DeleteUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		resp := newResponse("id", ErrParsingUserID.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	err = h.services.DeleteUser(c, userID)
+	if err != nil {
+		message := "error deleting user"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		var notFoundError custom_error.NotFoundError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		if errors.As(err, &notFoundError) {
+			code = http.StatusNotFound
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// setUserAttributesBodyRequest maps attribute names to values, which are strings, numbers and bools.
+type setUserAttributesBodyRequest map[string]any
+
+// SetUserAttributes godoc
+// @Summary Set attributes of user
+// @Description Attributes replace the previous ones, the user gets segments whose rule they match and loses rule added segments whose rule they don't match anymore.
+// @Tags user
+// @Accept json
+// @Param id path int true "user id"
+// @Param input body setUserAttributesBodyRequest true "attribute names (lowercase letters, digits and underscores) to values (strings, numbers and bools), 50 attributes at most"
+// @Success 200
+// @Failure 400 {object} response
+// @Failure 500 {object} response
+// @Router /users/{id}/attributes [put]
+func (h *Handler) SetUserAttributes(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		resp := newResponse("id", ErrParsingUserID.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	var attributesBody setUserAttributesBodyRequest
+
+	if err := c.ShouldBindJSON(&attributesBody); err != nil {
+		resp := newResponse("", ErrParsingBody.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	err = h.services.SetUserAttributes(c, userID, attributesBody)
+	if err != nil {
+		message := "error setting user attributes"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+type getUserHistoryQueryRequest struct {
+	From   string `form:"from"`
+	To     string `form:"to"`
+	Cursor string `form:"cursor"`
+	Limit  int    `form:"limit"`
+}
+
+type userOperationResponse struct {
+	ID          int       `json:"id"`
+	SegmentSlug string    `json:"segment_slug"`
+	Action      string    `json:"action"`
+	AutoAdd     bool      `json:"auto_add"`
+	Source      string    `json:"source" enums:"manual,auto_add,segment_update,segment_delete,expire,user_delete,parent_delete,rule"`
+	Date        time.Time `json:"date"`
+}
+
+type getUserHistoryBodyResponse struct {
+	Operations []userOperationResponse `json:"operations"`
+	NextCursor string                  `json:"next_cursor"`
+}
+
+// GetUserHistory godoc
+// @Summary Get history of user segments, newest first
+// @Description Every operation tells what made the change: manual update, auto add, segment update or deletion, expiry or user deletion, removal of the parent segment or a segment rule.
+// @Tags user
+// @Param id path int true "user id"
+// @Param from query string false "start of the range inclusively (RFC3339 or year-month-day)"
+// @Param to query string false "end of the range exclusively (RFC3339 or year-month-day)"
+// @Param cursor query string false "next_cursor from the previous page"
+// @Param limit query int false "max number of operations (from 1 to 1000, default 100)"
+// @Success 200 {object} getUserHistoryBodyResponse
+// @Failure 400 {object} response
+// @Failure 500 {object} response
+// @Router /users/{id}/history [get]
+func (h *Handler) GetUserHistory(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		resp := newResponse("id", ErrParsingUserID.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	var getUserHistoryQuery getUserHistoryQueryRequest
+
+	if err := c.ShouldBindQuery(&getUserHistoryQuery); err != nil {
+		resp := newResponse("", ErrParsingQuery.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	operations, nextCursor, err := h.services.GetUserHistory(c, userID, service.HistoryRequest{
+		From:   getUserHistoryQuery.From,
+		To:     getUserHistoryQuery.To,
+		Cursor: getUserHistoryQuery.Cursor,
+		Limit:  getUserHistoryQuery.Limit,
+	})
+	if err != nil {
+		message := "error getting user history"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	operationsResponse := make([]userOperationResponse, 0, len(operations))
+	for _, operation := range operations {
+		operationsResponse = append(operationsResponse, userOperationResponse{
+			ID:          operation.ID,
+			SegmentSlug: operation.SegmentSlug,
+			Action:      operation.Action,
+			AutoAdd:     operation.AutoAdd,
+			Source:      operation.Source,
+			Date:        operation.Date,
+		})
+	}
+
+	c.JSON(http.StatusOK, getUserHistoryBodyResponse{
+		Operations: operationsResponse,
+		NextCursor: nextCursor,
+	})
+}
+
+type getUserSegmentsAtQueryRequest struct {
+	At string `form:"at"`
+}
+
+type getUserSegmentsAtBodyResponse struct {
+	At       string   `json:"at"`
+	Segments []string `json:"segments"`
+}
+
+// GetUserSegmentsAt godoc
+// @Summary Get segments the user had at the moment
+// @Description Segments are rebuilt from the history of the user, so they are known for deleted users and segments too.
+// @Tags user
+// @Param id path int true "user id"
+// @Param at query string true "moment (RFC3339 or year-month-day)"
+// @Success 200 {object} getUserSegmentsAtBodyResponse
+// @Failure 400 {object} response
+// @Failure 500 {object} response
+// @Router /users/{id}/segments [get]
+func (h *Handler) GetUserSegmentsAt(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		resp := newResponse("id", ErrParsingUserID.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	var getUserSegmentsAtQuery getUserSegmentsAtQueryRequest
+
+	if err := c.ShouldBindQuery(&getUserSegmentsAtQuery); err != nil {
+		resp := newResponse("", ErrParsingQuery.Error(), err)
+		h.sentResponse(c, http.StatusBadRequest, resp)
+		return
+	}
+
+	segments, err := h.services.GetUserSegmentsAt(c, userID, getUserSegmentsAtQuery.At)
+	if err != nil {
+		message := "error getting user segments at the moment"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	if segments == nil {
+		segments = []string{}
+	}
+
+	c.JSON(http.StatusOK, getUserSegmentsAtBodyResponse{
+		At:       getUserSegmentsAtQuery.At,
+		Segments: segments,
+	})
+}
+
 type addAndDeleteUserSegmentsBodyRequest struct {
-	SegmentsToAdd    []string `json:"segments_to_add"`
-	SegmentsToDelete []string `json:"segments_to_delete"`
-	UserID           int      `json:"user_id"`
+	SegmentsToAdd    []segmentToAddRequest `json:"segments_to_add"`
+	SegmentsToDelete []string              `json:"segments_to_delete"`
+	UserID           int                   `json:"user_id"`
 }
 
 // UpdateUserSegments godoc
 // @Summary Add and delete user segments by his id
 // @Tags user
 // @Accept json
-// @Param input body addAndDeleteUserSegmentsBodyRequest true "user segments to add and delete and his user id"
+// @Param input body addAndDeleteUserSegmentsBodyRequest true "user segments to add (slug or object with optional expires_at/ttl) and delete and his user id"
 // @Success 200
 // @Failure 400 {object} response
 // @Failure 500 {object} response
@@ -33,7 +351,7 @@ func (h *Handler) UpdateUserSegments(c *gin.Context) {
 	}
 
 	err := h.services.UpdateUserSegments(c,
-		addAndDeleteUserSegmentsBody.SegmentsToAdd,
+		toServiceSegmentsToAdd(addAndDeleteUserSegmentsBody.SegmentsToAdd),
 		addAndDeleteUserSegmentsBody.SegmentsToDelete,
 		addAndDeleteUserSegmentsBody.UserID,
 	)
@@ -102,3 +420,193 @@ func (h *Handler) GetActiveUserSegments(c *gin.Context) {
 		Segments: segments,
 	})
 }
+
+type bulkUpdateUserSegmentsBodyRequest struct {
+	UserIDs          []int                 `json:"user_ids"`
+	SegmentsToAdd    []segmentToAddRequest `json:"segments_to_add"`
+	SegmentsToDelete []string              `json:"segments_to_delete"`
+}
+
+type bulkUpdateUserSegmentsQueryRequest struct {
+	SegmentsToAdd    []string `form:"segments_to_add"`
+	SegmentsToDelete []string `form:"segments_to_delete"`
+}
+
+type bulkUserResultResponse struct {
+	UserID  int      `json:"user_id"`
+	Added   []string `json:"added"`
+	Deleted []string `json:"deleted"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type bulkUpdateUserSegmentsBodyResponse struct {
+	Succeeded int                      `json:"succeeded"`
+	Failed    int                      `json:"failed"`
+	Results   []bulkUserResultResponse `json:"results"`
+}
+
+// BulkUpdateUserSegments godoc
+// @Summary Add and delete segments of many users
+// @Description Accepts a JSON body, or a CSV (text/csv, one user id per line) or NDJSON (application/x-ndjson, {"user_id": 1} per line) upload with segments in query parameters.
+// @Tags user
+// @Accept json,text/csv,application/x-ndjson
+// @Param input body bulkUpdateUserSegmentsBodyRequest false "user ids and their segments to add and delete"
+// @Param segments_to_add query []string false "segments to add for CSV and NDJSON uploads"
+// @Param segments_to_delete query []string false "segments to delete for CSV and NDJSON uploads"
+// @Success 200 {object} bulkUpdateUserSegmentsBodyResponse
+// @Failure 400 {object} response
+// @Failure 500 {object} response
+// @Router /users/bulk [post]
+func (h *Handler) BulkUpdateUserSegments(c *gin.Context) {
+	var (
+		userIDs          []int
+		segmentsToAdd    []segmentToAddRequest
+		segmentsToDelete []string
+	)
+
+	switch c.ContentType() {
+	case "text/csv", "application/x-ndjson":
+		var bulkUpdateUserSegmentsQuery bulkUpdateUserSegmentsQueryRequest
+
+		if err := c.ShouldBindQuery(&bulkUpdateUserSegmentsQuery); err != nil {
+			resp := newResponse("", ErrParsingQuery.Error(), err)
+			h.sentResponse(c, http.StatusBadRequest, resp)
+			return
+		}
+
+		var err error
+		if c.ContentType() == "text/csv" {
+			userIDs, err = parseUserIDsCSV(c.Request.Body)
+		} else {
+			userIDs, err = parseUserIDsNDJSON(c.Request.Body)
+		}
+		if err != nil {
+			resp := newResponse("user_ids", ErrParsingUserIDs.Error(), err)
+			h.sentResponse(c, http.StatusBadRequest, resp)
+			return
+		}
+
+		for _, segment := range bulkUpdateUserSegmentsQuery.SegmentsToAdd {
+			segmentsToAdd = append(segmentsToAdd, segmentToAddRequest{Slug: segment})
+		}
+		segmentsToDelete = bulkUpdateUserSegmentsQuery.SegmentsToDelete
+	default:
+		var bulkUpdateUserSegmentsBody bulkUpdateUserSegmentsBodyRequest
+
+		if err := c.ShouldBindJSON(&bulkUpdateUserSegmentsBody); err != nil {
+			resp := newResponse("", ErrParsingBody.Error(), err)
+			h.sentResponse(c, http.StatusBadRequest, resp)
+			return
+		}
+
+		userIDs = bulkUpdateUserSegmentsBody.UserIDs
+		segmentsToAdd = bulkUpdateUserSegmentsBody.SegmentsToAdd
+		segmentsToDelete = bulkUpdateUserSegmentsBody.SegmentsToDelete
+	}
+
+	if segmentsToDelete == nil {
+		segmentsToDelete = []string{}
+	}
+
+	results, err := h.services.BulkUpdateUserSegments(c, toServiceSegmentsToAdd(segmentsToAdd), segmentsToDelete, userIDs)
+	if err != nil {
+		message := "error bulk updating user segments"
+		code := http.StatusInternalServerError
+		var customError custom_error.CustomError
+		if errors.As(err, &customError) {
+			code = http.StatusBadRequest
+		}
+		resp := newResponse("", message, err)
+		h.sentResponse(c, code, resp)
+		return
+	}
+
+	bulkResponse := bulkUpdateUserSegmentsBodyResponse{
+		Results: make([]bulkUserResultResponse, 0, len(results)),
+	}
+	for _, result := range results {
+		if result.Error != "" {
+			bulkResponse.Failed++
+		} else {
+			bulkResponse.Succeeded++
+		}
+
+		resultResponse := bulkUserResultResponse{
+			UserID:  result.UserID,
+			Added:   result.Added,
+			Deleted: result.Deleted,
+			Error:   result.Error,
+		}
+		if resultResponse.Added == nil {
+			resultResponse.Added = []string{}
+		}
+		if resultResponse.Deleted == nil {
+			resultResponse.Deleted = []string{}
+		}
+
+		bulkResponse.Results = append(bulkResponse.Results, resultResponse)
+	}
+
+	c.JSON(http.StatusOK, bulkResponse)
+}
+
+// parseUserIDsCSV reads user ids from the first column of CSV, a header row is skipped.
+func parseUserIDsCSV(r io.Reader) ([]int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	var userIDs []int
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+
+		value := strings.TrimSpace(record[0])
+
+		userID, err := strconv.Atoi(value)
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: invalid user id %q", line, value)
+		}
+
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, nil
+}
+
+// parseUserIDsNDJSON reads user ids from lines like {"user_id": 1}, empty lines are skipped.
+func parseUserIDsNDJSON(r io.Reader) ([]int, error) {
+	scanner := bufio.NewScanner(r)
+
+	var userIDs []int
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var user struct {
+			UserID int `json:"user_id"`
+		}
+
+		err := json.Unmarshal([]byte(text), &user)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		userIDs = append(userIDs, user.UserID)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return userIDs, nil
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
 	mock_logger "github.com/romandnk/dynamic-user-segmentation-service/internal/logger/mock"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/service"
 	mock_service "github.com/romandnk/dynamic-user-segmentation-service/internal/service/mock"
 	"github.com/stretchr/testify/require"
@@ -14,7 +16,9 @@ import (
 	"go.uber.org/zap"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandler_UpdateUserSegments(t *testing.T) {
@@ -26,10 +30,12 @@ func TestHandler_UpdateUserSegments(t *testing.T) {
 	expectedSegmentsToDelete := []string{"AVITO_TEST3"}
 	expectedUserID := 1
 
-	services.EXPECT().UpdateUserSegments(gomock.Any(), expectedSegmentsToAdd, expectedSegmentsToDelete, expectedUserID).
-		Return(nil)
+	services.EXPECT().UpdateUserSegments(gomock.Any(), []service.SegmentToAdd{
+		{Slug: expectedSegmentsToAdd[0]},
+		{Slug: expectedSegmentsToAdd[1]},
+	}, expectedSegmentsToDelete, expectedUserID).Return(nil)
 
-	handler := NewHandler(services, nil, "")
+	handler := NewHandler(services, nil, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.POST(url+"/users", handler.UpdateUserSegments)
@@ -57,17 +63,63 @@ func TestHandler_UpdateUserSegments(t *testing.T) {
 	require.Equal(t, []byte(nil), w.Body.Bytes())
 }
 
+func TestHandler_UpdateUserSegmentsWithExpiration(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedSegmentsToAdd := []service.SegmentToAdd{
+		{Slug: "AVITO_TEST1"},
+		{Slug: "AVITO_PROMO", TTL: "72h"},
+		{Slug: "AVITO_SALE", ExpiresAt: "2023-09-01T00:00:00Z"},
+	}
+	expectedSegmentsToDelete := []string{}
+	expectedUserID := 1
+
+	services.EXPECT().UpdateUserSegments(gomock.Any(), expectedSegmentsToAdd, expectedSegmentsToDelete, expectedUserID).
+		Return(nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.POST(url+"/users", handler.UpdateUserSegments)
+
+	requestBody := map[string]interface{}{
+		"segments_to_add": []interface{}{
+			"AVITO_TEST1",
+			map[string]string{"slug": "AVITO_PROMO", "ttl": "72h"},
+			map[string]string{"slug": "AVITO_SALE", "expires_at": "2023-09-01T00:00:00Z"},
+		},
+		"segments_to_delete": expectedSegmentsToDelete,
+		"user_id":            expectedUserID,
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/users", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
 func TestHandler_UpdateUserSegmentsErrorParsingJSONBody(t *testing.T) {
 	ctrl := gomock.NewController(t)
 
 	logger := mock_logger.NewMockLogger(ctrl)
 
 	expectedMessage := "error parsing json body"
-	expectedError := "json: cannot unmarshal bool into Go struct field addAndDeleteUserSegmentsBodyRequest.segments_to_add of type []string"
+	expectedError := "json: cannot unmarshal bool into Go struct field addAndDeleteUserSegmentsBodyRequest.segments_to_add of type []v1.segmentToAddRequest"
 
 	logger.EXPECT().Error(ErrParsingBody.Error(), zap.String("errors", expectedError))
 
-	handler := NewHandler(nil, logger, "")
+	handler := NewHandler(nil, logger, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.POST(url+"/users", handler.UpdateUserSegments)
@@ -175,12 +227,17 @@ func TestHandler_UpdateUserSegmentsError(t *testing.T) {
 			services := mock_service.NewMockServices(ctrl)
 			logger := mock_logger.NewMockLogger(ctrl)
 
+			expectedSegmentsToAdd := make([]service.SegmentToAdd, 0, len(tc.inputSegmentsToAdd))
+			for _, segment := range tc.inputSegmentsToAdd {
+				expectedSegmentsToAdd = append(expectedSegmentsToAdd, service.SegmentToAdd{Slug: segment})
+			}
+
 			logger.EXPECT().Error(expectedMessage, zap.String("errors", tc.expectedError.Error()))
 			services.EXPECT().
-				UpdateUserSegments(gomock.Any(), tc.inputSegmentsToAdd, tc.inputSegmentsToDelete, tc.inputUserID).
+				UpdateUserSegments(gomock.Any(), expectedSegmentsToAdd, tc.inputSegmentsToDelete, tc.inputUserID).
 				Return(tc.expectedError)
 
-			handler := NewHandler(services, logger, "")
+			handler := NewHandler(services, logger, nil, "", nil, nil)
 
 			r := gin.Default()
 			r.POST(url+"/users", handler.UpdateUserSegments)
@@ -235,7 +292,7 @@ func TestHandler_GetActiveUserSegments(t *testing.T) {
 
 	services.EXPECT().GetActiveSegments(gomock.Any(), expectedUserID).Return(expectedUserSegments, nil)
 
-	handler := NewHandler(services, nil, "")
+	handler := NewHandler(services, nil, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.POST(url+"/users/active_segments", handler.GetActiveUserSegments)
@@ -277,7 +334,7 @@ func TestHandler_GetActiveUserSegmentsEmptySegments(t *testing.T) {
 
 	services.EXPECT().GetActiveSegments(gomock.Any(), expectedUserID).Return(expectedUserSegments, nil)
 
-	handler := NewHandler(services, nil, "")
+	handler := NewHandler(services, nil, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.POST(url+"/users/active_segments", handler.GetActiveUserSegments)
@@ -321,7 +378,7 @@ func TestHandler_GetActiveUserSegmentsErrorParsingJSONBody(t *testing.T) {
 
 	logger.EXPECT().Error(ErrParsingBody.Error(), zap.String("errors", expectedError))
 
-	handler := NewHandler(nil, logger, "")
+	handler := NewHandler(nil, logger, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.POST(url+"/users/active_segments", handler.GetActiveUserSegments)
@@ -374,7 +431,7 @@ func TestHandler_GetActiveUserSegmentsErrorInvalidUserID(t *testing.T) {
 	services.EXPECT().GetActiveSegments(gomock.Any(), expectedUserID).Return(expectedUserSegments, expectedError)
 	logger.EXPECT().Error(expectedMessage, zap.String("errors", expectedError.Error()))
 
-	handler := NewHandler(services, logger, "")
+	handler := NewHandler(services, logger, nil, "", nil, nil)
 
 	r := gin.Default()
 	r.POST(url+"/users/active_segments", handler.GetActiveUserSegments)
@@ -409,3 +466,551 @@ func TestHandler_GetActiveUserSegmentsErrorInvalidUserID(t *testing.T) {
 	require.Equal(t, expectedError.Error(), actualError)
 	require.True(t, ok)
 }
+
+func TestHandler_BulkUpdateUserSegments(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedUserIDs := []int{1, 2}
+	expectedSegmentsToAdd := []service.SegmentToAdd{{Slug: "AVITO_PROMO", TTL: "24h"}}
+	expectedSegmentsToDelete := []string{"AVITO_TEST"}
+	expectedResults := []models.BulkUserResult{
+		{UserID: 1, Added: []string{"AVITO_PROMO"}, Deleted: []string{"AVITO_TEST"}},
+		{UserID: 2, Error: "User (2) doesn't have segment AVITO_TEST"},
+	}
+
+	services.EXPECT().BulkUpdateUserSegments(gomock.Any(), expectedSegmentsToAdd, expectedSegmentsToDelete, expectedUserIDs).
+		Return(expectedResults, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.POST(url+"/users/bulk", handler.BulkUpdateUserSegments)
+
+	requestBody := map[string]interface{}{
+		"user_ids": expectedUserIDs,
+		"segments_to_add": []interface{}{
+			map[string]string{"slug": "AVITO_PROMO", "ttl": "24h"},
+		},
+		"segments_to_delete": expectedSegmentsToDelete,
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/users/bulk", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var responseBody bulkUpdateUserSegmentsBodyResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, 1, responseBody.Succeeded)
+	require.Equal(t, 1, responseBody.Failed)
+	require.Equal(t, []bulkUserResultResponse{
+		{UserID: 1, Added: []string{"AVITO_PROMO"}, Deleted: []string{"AVITO_TEST"}},
+		{UserID: 2, Added: []string{}, Deleted: []string{}, Error: "User (2) doesn't have segment AVITO_TEST"},
+	}, responseBody.Results)
+}
+
+func TestHandler_BulkUpdateUserSegmentsUpload(t *testing.T) {
+	testCases := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "csv with header",
+			contentType: "text/csv",
+			body:        "user_id\n1\n2\n3\n",
+		},
+		{
+			name:        "csv without header",
+			contentType: "text/csv",
+			body:        "1,extra\n2\n3",
+		},
+		{
+			name:        "ndjson",
+			contentType: "application/x-ndjson",
+			body:        "{\"user_id\": 1}\n\n{\"user_id\": 2}\n{\"user_id\": 3}\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			services := mock_service.NewMockServices(ctrl)
+
+			expectedUserIDs := []int{1, 2, 3}
+			expectedSegmentsToAdd := []service.SegmentToAdd{{Slug: "AVITO_TEST1"}, {Slug: "AVITO_TEST2"}}
+
+			services.EXPECT().BulkUpdateUserSegments(gomock.Any(), expectedSegmentsToAdd, []string{}, expectedUserIDs).
+				Return([]models.BulkUserResult{}, nil)
+
+			handler := NewHandler(services, nil, nil, "", nil, nil)
+
+			r := gin.Default()
+			r.POST(url+"/users/bulk", handler.BulkUpdateUserSegments)
+
+			w := httptest.NewRecorder()
+
+			ctx := context.Background()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+				url+"/users/bulk?segments_to_add=AVITO_TEST1&segments_to_add=AVITO_TEST2", strings.NewReader(tc.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", tc.contentType)
+
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+func TestHandler_BulkUpdateUserSegmentsErrorParsingUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	expectedError := "line 3: invalid user id \"abc\""
+
+	logger.EXPECT().Error(ErrParsingUserIDs.Error(), zap.String("errors", expectedError))
+
+	handler := NewHandler(nil, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.POST(url+"/users/bulk", handler.BulkUpdateUserSegments)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/users/bulk", strings.NewReader("user_id\n1\nabc\n"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/csv")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandler_CreateUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedUserID := 1
+
+	services.EXPECT().CreateUser(gomock.Any(), expectedUserID).Return(nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.POST(url+"/users/register", handler.CreateUser)
+
+	requestBody := map[string]interface{}{
+		"user_id": expectedUserID,
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/users/register", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestHandler_CreateUserAlreadyExists(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	expectedUserID := 1
+	expectedError := custom_error.CustomError{
+		Field:   "user_id",
+		Message: "User (1) already exists",
+	}
+
+	services.EXPECT().CreateUser(gomock.Any(), expectedUserID).Return(expectedError)
+	logger.EXPECT().Error("error creating user", zap.String("errors", expectedError.Error()))
+
+	handler := NewHandler(services, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.POST(url+"/users/register", handler.CreateUser)
+
+	requestBody := map[string]interface{}{
+		"user_id": expectedUserID,
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/users/register", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandler_DeleteUser(t *testing.T) {
+	testCases := []struct {
+		name         string
+		returnError  error
+		expectedCode int
+	}{
+		{
+			name:         "deleted",
+			returnError:  nil,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "not found",
+			returnError: custom_error.NotFoundError{
+				Field:   "id",
+				Message: "User (1) doesn't exist",
+			},
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			services := mock_service.NewMockServices(ctrl)
+			logger := mock_logger.NewMockLogger(ctrl)
+
+			services.EXPECT().DeleteUser(gomock.Any(), 1).Return(tc.returnError)
+			if tc.returnError != nil {
+				logger.EXPECT().Error("error deleting user", zap.String("errors", tc.returnError.Error()))
+			}
+
+			handler := NewHandler(services, logger, nil, "", nil, nil)
+
+			r := gin.Default()
+			r.DELETE(url+"/users/:id", handler.DeleteUser)
+
+			w := httptest.NewRecorder()
+
+			ctx := context.Background()
+			req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url+"/users/1", nil)
+			require.NoError(t, err)
+
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, tc.expectedCode, w.Code)
+		})
+	}
+}
+
+func TestHandler_DeleteUserErrorParsingID(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	logger.EXPECT().Error(ErrParsingUserID.Error(), zap.String("errors", "strconv.Atoi: parsing \"abc\": invalid syntax"))
+
+	handler := NewHandler(nil, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.DELETE(url+"/users/:id", handler.DeleteUser)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url+"/users/abc", nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandler_SetUserAttributes(t *testing.T) {
+	testCases := []struct {
+		name         string
+		returnError  error
+		expectedCode int
+	}{
+		{
+			name:         "set",
+			returnError:  nil,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "invalid attributes",
+			returnError: custom_error.CustomError{
+				Field:   "attributes",
+				Message: service.ErrInvalidAttributeName.Error(),
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			services := mock_service.NewMockServices(ctrl)
+			logger := mock_logger.NewMockLogger(ctrl)
+
+			expectedAttributes := map[string]any{"country": "RU", "age": float64(18), "premium": true}
+
+			services.EXPECT().SetUserAttributes(gomock.Any(), 1, expectedAttributes).Return(tc.returnError)
+			if tc.returnError != nil {
+				logger.EXPECT().Error("error setting user attributes", zap.String("errors", tc.returnError.Error()))
+			}
+
+			handler := NewHandler(services, logger, nil, "", nil, nil)
+
+			r := gin.Default()
+			r.PUT(url+"/users/:id/attributes", handler.SetUserAttributes)
+
+			jsonBody, err := json.Marshal(expectedAttributes)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+
+			ctx := context.Background()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPut, url+"/users/1/attributes", bytes.NewBuffer(jsonBody))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, tc.expectedCode, w.Code)
+		})
+	}
+}
+
+func TestHandler_SetUserAttributesErrorParsingBody(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	expectedError := "json: cannot unmarshal array into Go value of type v1.setUserAttributesBodyRequest"
+
+	logger.EXPECT().Error(ErrParsingBody.Error(), zap.String("errors", expectedError))
+
+	handler := NewHandler(nil, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.PUT(url+"/users/:id/attributes", handler.SetUserAttributes)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url+"/users/1/attributes", bytes.NewBufferString(`["country"]`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandler_GetUserHistory(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedUserID := 1000
+	expectedRequest := service.HistoryRequest{
+		From:   "2023-08-01",
+		To:     "2023-09-01",
+		Cursor: "MTA",
+		Limit:  1,
+	}
+	expectedNextCursor := "OQ"
+	expectedOperations := []models.Operation{
+		{
+			ID:          9,
+			UserID:      expectedUserID,
+			SegmentSlug: "AVITO_TEST",
+			Date:        time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+			Action:      "delete",
+			Source:      models.OperationSourceSegmentDelete,
+		},
+	}
+
+	services.EXPECT().GetUserHistory(gomock.Any(), expectedUserID, expectedRequest).
+		Return(expectedOperations, expectedNextCursor, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/users/:id/history", handler.GetUserHistory)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		url+"/users/1000/history?from=2023-08-01&to=2023-09-01&cursor=MTA&limit=1", nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var responseBody getUserHistoryBodyResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, expectedNextCursor, responseBody.NextCursor)
+	require.Equal(t, []userOperationResponse{
+		{
+			ID:          expectedOperations[0].ID,
+			SegmentSlug: expectedOperations[0].SegmentSlug,
+			Action:      expectedOperations[0].Action,
+			Source:      expectedOperations[0].Source,
+			Date:        expectedOperations[0].Date,
+		},
+	}, responseBody.Operations)
+}
+
+func TestHandler_GetUserHistoryError(t *testing.T) {
+	testCases := []struct {
+		name         string
+		path         string
+		returnError  error
+		expectedCode int
+	}{
+		{
+			name:         "invalid user id",
+			path:         "/users/abc/history",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "invalid range",
+			path: "/users/1000/history?from=2023-09-01&to=2023-08-01",
+			returnError: custom_error.CustomError{
+				Field:   "from",
+				Message: service.ErrInvalidReportRange.Error(),
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "internal error",
+			path:         "/users/1000/history",
+			returnError:  errors.New("connection refused"),
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			services := mock_service.NewMockServices(ctrl)
+			logger := mock_logger.NewMockLogger(ctrl)
+
+			if tc.returnError != nil {
+				services.EXPECT().GetUserHistory(gomock.Any(), 1000, gomock.Any()).Return(nil, "", tc.returnError)
+			}
+			logger.EXPECT().Error(gomock.Any(), gomock.Any())
+
+			handler := NewHandler(services, logger, nil, "", nil, nil)
+
+			r := gin.Default()
+			r.GET(url+"/users/:id/history", handler.GetUserHistory)
+
+			w := httptest.NewRecorder()
+
+			ctx := context.Background()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+tc.path, nil)
+			require.NoError(t, err)
+
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, tc.expectedCode, w.Code)
+		})
+	}
+}
+
+func TestHandler_GetUserSegmentsAt(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+
+	expectedUserID := 1000
+	expectedAt := "2023-08-15T12:00:00Z"
+	expectedSegments := []string{"AVITO_DISCOUNT", "AVITO_VOICE"}
+
+	services.EXPECT().GetUserSegmentsAt(gomock.Any(), expectedUserID, expectedAt).Return(expectedSegments, nil)
+
+	handler := NewHandler(services, nil, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/users/:id/segments", handler.GetUserSegmentsAt)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/users/1000/segments?at="+expectedAt, nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var responseBody getUserSegmentsAtBodyResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responseBody)
+	require.NoError(t, err)
+
+	require.Equal(t, getUserSegmentsAtBodyResponse{
+		At:       expectedAt,
+		Segments: expectedSegments,
+	}, responseBody)
+}
+
+func TestHandler_GetUserSegmentsAtError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	services := mock_service.NewMockServices(ctrl)
+	logger := mock_logger.NewMockLogger(ctrl)
+
+	services.EXPECT().GetUserSegmentsAt(gomock.Any(), 1000, "").Return(nil, custom_error.CustomError{
+		Field:   "at",
+		Message: service.ErrEmptyAt.Error(),
+	})
+	logger.EXPECT().Error("error getting user segments at the moment", zap.String("errors", "at cannot be empty"))
+
+	handler := NewHandler(services, logger, nil, "", nil, nil)
+
+	r := gin.Default()
+	r.GET(url+"/users/:id/segments", handler.GetUserSegmentsAt)
+
+	w := httptest.NewRecorder()
+
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/users/1000/segments", nil)
+	require.NoError(t, err)
+
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/storage"
+	"strings"
+)
+
+var (
+	ErrTooFewGroupSegments     = errors.New("exclusion group must have at least 2 segments")
+	ErrDuplicateGroupSegment   = errors.New("segments must be unique")
+	ErrInvalidGroupSegmentSlug = errors.New("segment slug cannot be empty and can only contain uppercase letters")
+)
+
+type exclusionGroupService struct {
+	exclusionGroup storage.ExclusionGroupStorage
+}
+
+func newExclusionGroupService(exclusionGroup storage.ExclusionGroupStorage) *exclusionGroupService {
+	return &exclusionGroupService{exclusionGroup: exclusionGroup}
+}
+
+// CreateExclusionGroup creates the group of existing segments, a user can have only one of them.
+func (e *exclusionGroupService) CreateExclusionGroup(ctx context.Context, slug string, segments []string) error {
+	slug, err := validateSlug(slug)
+	if err != nil {
+		return err
+	}
+
+	validSegments, err := validateGroupSegments(segments)
+	if err != nil {
+		return err
+	}
+
+	group := models.ExclusionGroup{
+		Slug:     slug,
+		Segments: validSegments,
+	}
+
+	return e.exclusionGroup.CreateExclusionGroup(ctx, group)
+}
+
+func (e *exclusionGroupService) GetExclusionGroup(ctx context.Context, slug string) (models.ExclusionGroup, error) {
+	slug, err := validateSlug(slug)
+	if err != nil {
+		return models.ExclusionGroup{}, err
+	}
+
+	return e.exclusionGroup.GetExclusionGroup(ctx, slug)
+}
+
+// DeleteExclusionGroup deletes the group, its segments stay with their users.
+func (e *exclusionGroupService) DeleteExclusionGroup(ctx context.Context, slug string) error {
+	slug, err := validateSlug(slug)
+	if err != nil {
+		return err
+	}
+
+	return e.exclusionGroup.DeleteExclusionGroup(ctx, slug)
+}
+
+func validateGroupSegments(segments []string) ([]string, error) {
+	if len(segments) < 2 {
+		return nil, custom_error.CustomError{
+			Field:   "segments",
+			Message: ErrTooFewGroupSegments.Error(),
+		}
+	}
+
+	validSegments := make([]string, 0, len(segments))
+	slugs := make(map[string]struct{}, len(segments))
+
+	for _, segment := range segments {
+		slug := strings.TrimSpace(segment)
+
+		if slug == "" || strings.ToUpper(slug) != slug {
+			return nil, custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrInvalidGroupSegmentSlug.Error(),
+			}
+		}
+
+		if _, ok := slugs[slug]; ok {
+			return nil, custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrDuplicateGroupSegment.Error(),
+			}
+		}
+		slugs[slug] = struct{}{}
+
+		validSegments = append(validSegments, slug)
+	}
+
+	return validSegments, nil
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestValidateGroupSegments(t *testing.T) {
+	testCases := []struct {
+		name           string
+		input          []string
+		expectedOutput []string
+		expectedError  error
+	}{
+		{
+			name:           "valid segments",
+			input:          []string{" BANNER_A ", "BANNER_B"},
+			expectedOutput: []string{"BANNER_A", "BANNER_B"},
+		},
+		{
+			name:  "one segment",
+			input: []string{"BANNER_A"},
+			expectedError: custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrTooFewGroupSegments.Error(),
+			},
+		},
+		{
+			name:  "lowercase segment",
+			input: []string{"BANNER_A", "banner_b"},
+			expectedError: custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrInvalidGroupSegmentSlug.Error(),
+			},
+		},
+		{
+			name:  "empty segment",
+			input: []string{"BANNER_A", " "},
+			expectedError: custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrInvalidGroupSegmentSlug.Error(),
+			},
+		},
+		{
+			name:  "duplicate segment",
+			input: []string{"BANNER_A", " BANNER_A"},
+			expectedError: custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrDuplicateGroupSegment.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualOutput, actualError := validateGroupSegments(tc.input)
+			require.Equal(t, tc.expectedOutput, actualOutput)
+			require.ErrorIs(t, actualError, tc.expectedError)
+		})
+	}
+}
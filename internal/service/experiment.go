@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/storage"
+	"strings"
+)
+
+var (
+	ErrTooFewVariants        = errors.New("experiment must have at least 2 variants")
+	ErrInvalidVariantWeight  = errors.New("variant weight must be from 1 to 100 inclusively")
+	ErrVariantWeightsTooBig  = errors.New("sum of variant weights cannot be more than 100")
+	ErrDuplicateVariant      = errors.New("variants must be unique")
+	ErrInvalidVariantSegment = errors.New("variant slug cannot be empty and can only contain uppercase letters")
+)
+
+type experimentService struct {
+	experiment storage.ExperimentStorage
+}
+
+func newExperimentService(experiment storage.ExperimentStorage) *experimentService {
+	return &experimentService{experiment: experiment}
+}
+
+// CreateExperiment creates the experiment with new variant segments. Weights are percentages of users
+// in the variants, users out of their sum are in none of the variants.
+func (e *experimentService) CreateExperiment(ctx context.Context, slug string, variants []models.ExperimentVariant) error {
+	slug, err := validateSlug(slug)
+	if err != nil {
+		return err
+	}
+
+	validVariants, err := validateVariants(variants)
+	if err != nil {
+		return err
+	}
+
+	experiment := models.Experiment{
+		Slug:     slug,
+		Salt:     uuid.NewString(),
+		Variants: validVariants,
+	}
+
+	return e.experiment.CreateExperiment(ctx, experiment)
+}
+
+func (e *experimentService) GetExperiment(ctx context.Context, slug string) (models.Experiment, error) {
+	slug, err := validateSlug(slug)
+	if err != nil {
+		return models.Experiment{}, err
+	}
+
+	return e.experiment.GetExperiment(ctx, slug)
+}
+
+// DeleteExperiment deletes the experiment, its variant segments stay with their users.
+func (e *experimentService) DeleteExperiment(ctx context.Context, slug string) error {
+	slug, err := validateSlug(slug)
+	if err != nil {
+		return err
+	}
+
+	return e.experiment.DeleteExperiment(ctx, slug)
+}
+
+func validateSlug(slug string) (string, error) {
+	slug = strings.TrimSpace(slug)
+
+	if slug == "" {
+		return "", custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrEmptySlug.Error(),
+		}
+	}
+
+	if strings.ToUpper(slug) != slug {
+		return "", custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrInvalidSlugRepresentation.Error(),
+		}
+	}
+
+	return slug, nil
+}
+
+func validateVariants(variants []models.ExperimentVariant) ([]models.ExperimentVariant, error) {
+	if len(variants) < 2 {
+		return nil, custom_error.CustomError{
+			Field:   "variants",
+			Message: ErrTooFewVariants.Error(),
+		}
+	}
+
+	validVariants := make([]models.ExperimentVariant, 0, len(variants))
+	slugs := make(map[string]struct{}, len(variants))
+	sum := 0
+
+	for _, variant := range variants {
+		slug := strings.TrimSpace(variant.Slug)
+
+		if slug == "" || strings.ToUpper(slug) != slug {
+			return nil, custom_error.CustomError{
+				Field:   "variants",
+				Message: ErrInvalidVariantSegment.Error(),
+			}
+		}
+
+		if _, ok := slugs[slug]; ok {
+			return nil, custom_error.CustomError{
+				Field:   "variants",
+				Message: ErrDuplicateVariant.Error(),
+			}
+		}
+		slugs[slug] = struct{}{}
+
+		if variant.Weight < 1 || variant.Weight > 100 {
+			return nil, custom_error.CustomError{
+				Field:   "variants",
+				Message: ErrInvalidVariantWeight.Error(),
+			}
+		}
+
+		sum += variant.Weight
+		validVariants = append(validVariants, models.ExperimentVariant{Slug: slug, Weight: variant.Weight})
+	}
+
+	if sum > 100 {
+		return nil, custom_error.CustomError{
+			Field:   "variants",
+			Message: ErrVariantWeightsTooBig.Error(),
+		}
+	}
+
+	return validVariants, nil
+}
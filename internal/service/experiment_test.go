@@ -0,0 +1,92 @@
+package service
+
+import (
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestValidateVariants(t *testing.T) {
+	testCases := []struct {
+		name           string
+		input          []models.ExperimentVariant
+		expectedOutput []models.ExperimentVariant
+		expectedError  error
+	}{
+		{
+			name: "valid variants",
+			input: []models.ExperimentVariant{
+				{Slug: " CHECKOUT_CONTROL ", Weight: 50},
+				{Slug: "CHECKOUT_A", Weight: 25},
+				{Slug: "CHECKOUT_B", Weight: 25},
+			},
+			expectedOutput: []models.ExperimentVariant{
+				{Slug: "CHECKOUT_CONTROL", Weight: 50},
+				{Slug: "CHECKOUT_A", Weight: 25},
+				{Slug: "CHECKOUT_B", Weight: 25},
+			},
+		},
+		{
+			name:  "one variant",
+			input: []models.ExperimentVariant{{Slug: "CHECKOUT_CONTROL", Weight: 50}},
+			expectedError: custom_error.CustomError{
+				Field:   "variants",
+				Message: ErrTooFewVariants.Error(),
+			},
+		},
+		{
+			name: "lowercase variant",
+			input: []models.ExperimentVariant{
+				{Slug: "CHECKOUT_CONTROL", Weight: 50},
+				{Slug: "checkout_a", Weight: 50},
+			},
+			expectedError: custom_error.CustomError{
+				Field:   "variants",
+				Message: ErrInvalidVariantSegment.Error(),
+			},
+		},
+		{
+			name: "duplicate variant",
+			input: []models.ExperimentVariant{
+				{Slug: "CHECKOUT_A", Weight: 50},
+				{Slug: "CHECKOUT_A", Weight: 50},
+			},
+			expectedError: custom_error.CustomError{
+				Field:   "variants",
+				Message: ErrDuplicateVariant.Error(),
+			},
+		},
+		{
+			name: "zero weight",
+			input: []models.ExperimentVariant{
+				{Slug: "CHECKOUT_CONTROL", Weight: 50},
+				{Slug: "CHECKOUT_A"},
+			},
+			expectedError: custom_error.CustomError{
+				Field:   "variants",
+				Message: ErrInvalidVariantWeight.Error(),
+			},
+		},
+		{
+			name: "weights more than 100",
+			input: []models.ExperimentVariant{
+				{Slug: "CHECKOUT_CONTROL", Weight: 50},
+				{Slug: "CHECKOUT_A", Weight: 51},
+			},
+			expectedError: custom_error.CustomError{
+				Field:   "variants",
+				Message: ErrVariantWeightsTooBig.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualOutput, actualError := validateVariants(tc.input)
+			require.Equal(t, tc.expectedOutput, actualOutput)
+			require.ErrorIs(t, actualError, tc.expectedError)
+		})
+	}
+}
@@ -8,6 +8,8 @@ import (
 	context "context"
 	reflect "reflect"
 
+	models "github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	service "github.com/romandnk/dynamic-user-segmentation-service/internal/service"
 	gomock "go.uber.org/mock/gomock"
 )
 
@@ -34,18 +36,33 @@ func (m *MockSegment) EXPECT() *MockSegmentMockRecorder {
 	return m.recorder
 }
 
+// ApplySegmentWindows mocks base method.
+func (m *MockSegment) ApplySegmentWindows(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ApplySegmentWindows", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ApplySegmentWindows indicates an expected call of ApplySegmentWindows.
+func (mr *MockSegmentMockRecorder) ApplySegmentWindows(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ApplySegmentWindows", reflect.TypeOf((*MockSegment)(nil).ApplySegmentWindows), ctx)
+}
+
 // CreateSegment mocks base method.
-func (m *MockSegment) CreateSegment(ctx context.Context, slug, percentageStr string) error {
+func (m *MockSegment) CreateSegment(ctx context.Context, segment service.SegmentToCreate) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateSegment", ctx, slug, percentageStr)
+	ret := m.ctrl.Call(m, "CreateSegment", ctx, segment)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // CreateSegment indicates an expected call of CreateSegment.
-func (mr *MockSegmentMockRecorder) CreateSegment(ctx, slug, percentageStr interface{}) *gomock.Call {
+func (mr *MockSegmentMockRecorder) CreateSegment(ctx, segment interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegment", reflect.TypeOf((*MockSegment)(nil).CreateSegment), ctx, slug, percentageStr)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegment", reflect.TypeOf((*MockSegment)(nil).CreateSegment), ctx, segment)
 }
 
 // DeleteSegment mocks base method.
@@ -62,6 +79,227 @@ func (mr *MockSegmentMockRecorder) DeleteSegment(ctx, slug interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteSegment", reflect.TypeOf((*MockSegment)(nil).DeleteSegment), ctx, slug)
 }
 
+// GetSegment mocks base method.
+func (m *MockSegment) GetSegment(ctx context.Context, slug string) (models.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegment", ctx, slug)
+	ret0, _ := ret[0].(models.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegment indicates an expected call of GetSegment.
+func (mr *MockSegmentMockRecorder) GetSegment(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegment", reflect.TypeOf((*MockSegment)(nil).GetSegment), ctx, slug)
+}
+
+// GetSegmentStats mocks base method.
+func (m *MockSegment) GetSegmentStats(ctx context.Context, slug, from, to string) (models.SegmentStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegmentStats", ctx, slug, from, to)
+	ret0, _ := ret[0].(models.SegmentStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegmentStats indicates an expected call of GetSegmentStats.
+func (mr *MockSegmentMockRecorder) GetSegmentStats(ctx, slug, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegmentStats", reflect.TypeOf((*MockSegment)(nil).GetSegmentStats), ctx, slug, from, to)
+}
+
+// GetSegmentWindowEvents mocks base method.
+func (m *MockSegment) GetSegmentWindowEvents(ctx context.Context, slug string) ([]models.SegmentWindowEvent, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegmentWindowEvents", ctx, slug)
+	ret0, _ := ret[0].([]models.SegmentWindowEvent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegmentWindowEvents indicates an expected call of GetSegmentWindowEvents.
+func (mr *MockSegmentMockRecorder) GetSegmentWindowEvents(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegmentWindowEvents", reflect.TypeOf((*MockSegment)(nil).GetSegmentWindowEvents), ctx, slug)
+}
+
+// GetSegments mocks base method.
+func (m *MockSegment) GetSegments(ctx context.Context, prefix string, limit, offset int) ([]models.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegments", ctx, prefix, limit, offset)
+	ret0, _ := ret[0].([]models.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegments indicates an expected call of GetSegments.
+func (mr *MockSegmentMockRecorder) GetSegments(ctx, prefix, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegments", reflect.TypeOf((*MockSegment)(nil).GetSegments), ctx, prefix, limit, offset)
+}
+
+// RollupSegmentStats mocks base method.
+func (m *MockSegment) RollupSegmentStats(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RollupSegmentStats", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RollupSegmentStats indicates an expected call of RollupSegmentStats.
+func (mr *MockSegmentMockRecorder) RollupSegmentStats(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RollupSegmentStats", reflect.TypeOf((*MockSegment)(nil).RollupSegmentStats), ctx)
+}
+
+// UpdateSegment mocks base method.
+func (m *MockSegment) UpdateSegment(ctx context.Context, slug string, update service.SegmentUpdate) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateSegment", ctx, slug, update)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateSegment indicates an expected call of UpdateSegment.
+func (mr *MockSegmentMockRecorder) UpdateSegment(ctx, slug, update interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateSegment", reflect.TypeOf((*MockSegment)(nil).UpdateSegment), ctx, slug, update)
+}
+
+// MockExperiment is a mock of Experiment interface.
+type MockExperiment struct {
+	ctrl     *gomock.Controller
+	recorder *MockExperimentMockRecorder
+}
+
+// MockExperimentMockRecorder is the mock recorder for MockExperiment.
+type MockExperimentMockRecorder struct {
+	mock *MockExperiment
+}
+
+// NewMockExperiment creates a new mock instance.
+func NewMockExperiment(ctrl *gomock.Controller) *MockExperiment {
+	mock := &MockExperiment{ctrl: ctrl}
+	mock.recorder = &MockExperimentMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockExperiment) EXPECT() *MockExperimentMockRecorder {
+	return m.recorder
+}
+
+// CreateExperiment mocks base method.
+func (m *MockExperiment) CreateExperiment(ctx context.Context, slug string, variants []models.ExperimentVariant) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateExperiment", ctx, slug, variants)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateExperiment indicates an expected call of CreateExperiment.
+func (mr *MockExperimentMockRecorder) CreateExperiment(ctx, slug, variants interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateExperiment", reflect.TypeOf((*MockExperiment)(nil).CreateExperiment), ctx, slug, variants)
+}
+
+// DeleteExperiment mocks base method.
+func (m *MockExperiment) DeleteExperiment(ctx context.Context, slug string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExperiment", ctx, slug)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteExperiment indicates an expected call of DeleteExperiment.
+func (mr *MockExperimentMockRecorder) DeleteExperiment(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExperiment", reflect.TypeOf((*MockExperiment)(nil).DeleteExperiment), ctx, slug)
+}
+
+// GetExperiment mocks base method.
+func (m *MockExperiment) GetExperiment(ctx context.Context, slug string) (models.Experiment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExperiment", ctx, slug)
+	ret0, _ := ret[0].(models.Experiment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExperiment indicates an expected call of GetExperiment.
+func (mr *MockExperimentMockRecorder) GetExperiment(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExperiment", reflect.TypeOf((*MockExperiment)(nil).GetExperiment), ctx, slug)
+}
+
+// MockExclusionGroup is a mock of ExclusionGroup interface.
+type MockExclusionGroup struct {
+	ctrl     *gomock.Controller
+	recorder *MockExclusionGroupMockRecorder
+}
+
+// MockExclusionGroupMockRecorder is the mock recorder for MockExclusionGroup.
+type MockExclusionGroupMockRecorder struct {
+	mock *MockExclusionGroup
+}
+
+// NewMockExclusionGroup creates a new mock instance.
+func NewMockExclusionGroup(ctrl *gomock.Controller) *MockExclusionGroup {
+	mock := &MockExclusionGroup{ctrl: ctrl}
+	mock.recorder = &MockExclusionGroupMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockExclusionGroup) EXPECT() *MockExclusionGroupMockRecorder {
+	return m.recorder
+}
+
+// CreateExclusionGroup mocks base method.
+func (m *MockExclusionGroup) CreateExclusionGroup(ctx context.Context, slug string, segments []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateExclusionGroup", ctx, slug, segments)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateExclusionGroup indicates an expected call of CreateExclusionGroup.
+func (mr *MockExclusionGroupMockRecorder) CreateExclusionGroup(ctx, slug, segments interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateExclusionGroup", reflect.TypeOf((*MockExclusionGroup)(nil).CreateExclusionGroup), ctx, slug, segments)
+}
+
+// DeleteExclusionGroup mocks base method.
+func (m *MockExclusionGroup) DeleteExclusionGroup(ctx context.Context, slug string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExclusionGroup", ctx, slug)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteExclusionGroup indicates an expected call of DeleteExclusionGroup.
+func (mr *MockExclusionGroupMockRecorder) DeleteExclusionGroup(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExclusionGroup", reflect.TypeOf((*MockExclusionGroup)(nil).DeleteExclusionGroup), ctx, slug)
+}
+
+// GetExclusionGroup mocks base method.
+func (m *MockExclusionGroup) GetExclusionGroup(ctx context.Context, slug string) (models.ExclusionGroup, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExclusionGroup", ctx, slug)
+	ret0, _ := ret[0].(models.ExclusionGroup)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExclusionGroup indicates an expected call of GetExclusionGroup.
+func (mr *MockExclusionGroupMockRecorder) GetExclusionGroup(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExclusionGroup", reflect.TypeOf((*MockExclusionGroup)(nil).GetExclusionGroup), ctx, slug)
+}
+
 // MockUser is a mock of User interface.
 type MockUser struct {
 	ctrl     *gomock.Controller
@@ -86,11 +324,12 @@ func (m *MockUser) EXPECT() *MockUserMockRecorder {
 }
 
 // AutoAddSegments mocks base method.
-func (m *MockUser) AutoAddSegments(ctx context.Context) error {
+func (m *MockUser) AutoAddSegments(ctx context.Context) (bool, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "AutoAddSegments", ctx)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // AutoAddSegments indicates an expected call of AutoAddSegments.
@@ -99,6 +338,63 @@ func (mr *MockUserMockRecorder) AutoAddSegments(ctx interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AutoAddSegments", reflect.TypeOf((*MockUser)(nil).AutoAddSegments), ctx)
 }
 
+// BulkUpdateUserSegments mocks base method.
+func (m *MockUser) BulkUpdateUserSegments(ctx context.Context, segmentsToAdd []service.SegmentToAdd, segmentsToDelete []string, userIDs []int) ([]models.BulkUserResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BulkUpdateUserSegments", ctx, segmentsToAdd, segmentsToDelete, userIDs)
+	ret0, _ := ret[0].([]models.BulkUserResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// BulkUpdateUserSegments indicates an expected call of BulkUpdateUserSegments.
+func (mr *MockUserMockRecorder) BulkUpdateUserSegments(ctx, segmentsToAdd, segmentsToDelete, userIDs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BulkUpdateUserSegments", reflect.TypeOf((*MockUser)(nil).BulkUpdateUserSegments), ctx, segmentsToAdd, segmentsToDelete, userIDs)
+}
+
+// CreateUser mocks base method.
+func (m *MockUser) CreateUser(ctx context.Context, userID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateUser", ctx, userID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateUser indicates an expected call of CreateUser.
+func (mr *MockUserMockRecorder) CreateUser(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockUser)(nil).CreateUser), ctx, userID)
+}
+
+// DeleteExpiredSegments mocks base method.
+func (m *MockUser) DeleteExpiredSegments(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExpiredSegments", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteExpiredSegments indicates an expected call of DeleteExpiredSegments.
+func (mr *MockUserMockRecorder) DeleteExpiredSegments(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExpiredSegments", reflect.TypeOf((*MockUser)(nil).DeleteExpiredSegments), ctx)
+}
+
+// DeleteUser mocks base method.
+func (m *MockUser) DeleteUser(ctx context.Context, userID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteUser", ctx, userID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteUser indicates an expected call of DeleteUser.
+func (mr *MockUserMockRecorder) DeleteUser(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUser", reflect.TypeOf((*MockUser)(nil).DeleteUser), ctx, userID)
+}
+
 // GetActiveSegments mocks base method.
 func (m *MockUser) GetActiveSegments(ctx context.Context, userID int) ([]string, error) {
 	m.ctrl.T.Helper()
@@ -114,8 +410,38 @@ func (mr *MockUserMockRecorder) GetActiveSegments(ctx, userID interface{}) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetActiveSegments", reflect.TypeOf((*MockUser)(nil).GetActiveSegments), ctx, userID)
 }
 
+// GetSegmentUsers mocks base method.
+func (m *MockUser) GetSegmentUsers(ctx context.Context, slug, cursor string, limit int) ([]models.UserSegment, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegmentUsers", ctx, slug, cursor, limit)
+	ret0, _ := ret[0].([]models.UserSegment)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetSegmentUsers indicates an expected call of GetSegmentUsers.
+func (mr *MockUserMockRecorder) GetSegmentUsers(ctx, slug, cursor, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegmentUsers", reflect.TypeOf((*MockUser)(nil).GetSegmentUsers), ctx, slug, cursor, limit)
+}
+
+// SetUserAttributes mocks base method.
+func (m *MockUser) SetUserAttributes(ctx context.Context, userID int, attributes map[string]any) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserAttributes", ctx, userID, attributes)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetUserAttributes indicates an expected call of SetUserAttributes.
+func (mr *MockUserMockRecorder) SetUserAttributes(ctx, userID, attributes interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserAttributes", reflect.TypeOf((*MockUser)(nil).SetUserAttributes), ctx, userID, attributes)
+}
+
 // UpdateUserSegments mocks base method.
-func (m *MockUser) UpdateUserSegments(ctx context.Context, segmentsToAdd, segmentsToDelete []string, userID int) error {
+func (m *MockUser) UpdateUserSegments(ctx context.Context, segmentsToAdd []service.SegmentToAdd, segmentsToDelete []string, userID int) error {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "UpdateUserSegments", ctx, segmentsToAdd, segmentsToDelete, userID)
 	ret0, _ := ret[0].(error)
@@ -151,19 +477,139 @@ func (m *MockOperations) EXPECT() *MockOperationsMockRecorder {
 	return m.recorder
 }
 
-// CreateCSVReportAndURL mocks base method.
-func (m *MockOperations) CreateCSVReportAndURL(ctx context.Context, date string) (string, error) {
+// CreateReport mocks base method.
+func (m *MockOperations) CreateReport(ctx context.Context, request service.ReportRequest) (string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateCSVReportAndURL", ctx, date)
+	ret := m.ctrl.Call(m, "CreateReport", ctx, request)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// CreateCSVReportAndURL indicates an expected call of CreateCSVReportAndURL.
-func (mr *MockOperationsMockRecorder) CreateCSVReportAndURL(ctx, date interface{}) *gomock.Call {
+// CreateReport indicates an expected call of CreateReport.
+func (mr *MockOperationsMockRecorder) CreateReport(ctx, request interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateReport", reflect.TypeOf((*MockOperations)(nil).CreateReport), ctx, request)
+}
+
+// DeleteExpiredReports mocks base method.
+func (m *MockOperations) DeleteExpiredReports(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExpiredReports", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteExpiredReports indicates an expected call of DeleteExpiredReports.
+func (mr *MockOperationsMockRecorder) DeleteExpiredReports(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExpiredReports", reflect.TypeOf((*MockOperations)(nil).DeleteExpiredReports), ctx)
+}
+
+// DeleteReport mocks base method.
+func (m *MockOperations) DeleteReport(ctx context.Context, id string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteReport", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteReport indicates an expected call of DeleteReport.
+func (mr *MockOperationsMockRecorder) DeleteReport(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteReport", reflect.TypeOf((*MockOperations)(nil).DeleteReport), ctx, id)
+}
+
+// GetReport mocks base method.
+func (m *MockOperations) GetReport(ctx context.Context, id string) (models.Report, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReport", ctx, id)
+	ret0, _ := ret[0].(models.Report)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReport indicates an expected call of GetReport.
+func (mr *MockOperationsMockRecorder) GetReport(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReport", reflect.TypeOf((*MockOperations)(nil).GetReport), ctx, id)
+}
+
+// GetUserHistory mocks base method.
+func (m *MockOperations) GetUserHistory(ctx context.Context, userID int, request service.HistoryRequest) ([]models.Operation, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserHistory", ctx, userID, request)
+	ret0, _ := ret[0].([]models.Operation)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetUserHistory indicates an expected call of GetUserHistory.
+func (mr *MockOperationsMockRecorder) GetUserHistory(ctx, userID, request interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserHistory", reflect.TypeOf((*MockOperations)(nil).GetUserHistory), ctx, userID, request)
+}
+
+// GetUserSegmentsAt mocks base method.
+func (m *MockOperations) GetUserSegmentsAt(ctx context.Context, userID int, at string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserSegmentsAt", ctx, userID, at)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserSegmentsAt indicates an expected call of GetUserSegmentsAt.
+func (mr *MockOperationsMockRecorder) GetUserSegmentsAt(ctx, userID, at interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserSegmentsAt", reflect.TypeOf((*MockOperations)(nil).GetUserSegmentsAt), ctx, userID, at)
+}
+
+// ProcessReport mocks base method.
+func (m *MockOperations) ProcessReport(ctx context.Context) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProcessReport", ctx)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProcessReport indicates an expected call of ProcessReport.
+func (mr *MockOperationsMockRecorder) ProcessReport(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProcessReport", reflect.TypeOf((*MockOperations)(nil).ProcessReport), ctx)
+}
+
+// SetMissingReportsExpiry mocks base method.
+func (m *MockOperations) SetMissingReportsExpiry(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetMissingReportsExpiry", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetMissingReportsExpiry indicates an expected call of SetMissingReportsExpiry.
+func (mr *MockOperationsMockRecorder) SetMissingReportsExpiry(ctx interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateCSVReportAndURL", reflect.TypeOf((*MockOperations)(nil).CreateCSVReportAndURL), ctx, date)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMissingReportsExpiry", reflect.TypeOf((*MockOperations)(nil).SetMissingReportsExpiry), ctx)
+}
+
+// SnapshotUserSegments mocks base method.
+func (m *MockOperations) SnapshotUserSegments(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SnapshotUserSegments", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SnapshotUserSegments indicates an expected call of SnapshotUserSegments.
+func (mr *MockOperationsMockRecorder) SnapshotUserSegments(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SnapshotUserSegments", reflect.TypeOf((*MockOperations)(nil).SnapshotUserSegments), ctx)
 }
 
 // MockServices is a mock of Services interface.
@@ -189,12 +635,28 @@ func (m *MockServices) EXPECT() *MockServicesMockRecorder {
 	return m.recorder
 }
 
+// ApplySegmentWindows mocks base method.
+func (m *MockServices) ApplySegmentWindows(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ApplySegmentWindows", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ApplySegmentWindows indicates an expected call of ApplySegmentWindows.
+func (mr *MockServicesMockRecorder) ApplySegmentWindows(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ApplySegmentWindows", reflect.TypeOf((*MockServices)(nil).ApplySegmentWindows), ctx)
+}
+
 // AutoAddSegments mocks base method.
-func (m *MockServices) AutoAddSegments(ctx context.Context) error {
+func (m *MockServices) AutoAddSegments(ctx context.Context) (bool, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "AutoAddSegments", ctx)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // AutoAddSegments indicates an expected call of AutoAddSegments.
@@ -203,33 +665,161 @@ func (mr *MockServicesMockRecorder) AutoAddSegments(ctx interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AutoAddSegments", reflect.TypeOf((*MockServices)(nil).AutoAddSegments), ctx)
 }
 
-// CreateCSVReportAndURL mocks base method.
-func (m *MockServices) CreateCSVReportAndURL(ctx context.Context, date string) (string, error) {
+// BulkUpdateUserSegments mocks base method.
+func (m *MockServices) BulkUpdateUserSegments(ctx context.Context, segmentsToAdd []service.SegmentToAdd, segmentsToDelete []string, userIDs []int) ([]models.BulkUserResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BulkUpdateUserSegments", ctx, segmentsToAdd, segmentsToDelete, userIDs)
+	ret0, _ := ret[0].([]models.BulkUserResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// BulkUpdateUserSegments indicates an expected call of BulkUpdateUserSegments.
+func (mr *MockServicesMockRecorder) BulkUpdateUserSegments(ctx, segmentsToAdd, segmentsToDelete, userIDs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BulkUpdateUserSegments", reflect.TypeOf((*MockServices)(nil).BulkUpdateUserSegments), ctx, segmentsToAdd, segmentsToDelete, userIDs)
+}
+
+// CreateExclusionGroup mocks base method.
+func (m *MockServices) CreateExclusionGroup(ctx context.Context, slug string, segments []string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateCSVReportAndURL", ctx, date)
+	ret := m.ctrl.Call(m, "CreateExclusionGroup", ctx, slug, segments)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateExclusionGroup indicates an expected call of CreateExclusionGroup.
+func (mr *MockServicesMockRecorder) CreateExclusionGroup(ctx, slug, segments interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateExclusionGroup", reflect.TypeOf((*MockServices)(nil).CreateExclusionGroup), ctx, slug, segments)
+}
+
+// CreateExperiment mocks base method.
+func (m *MockServices) CreateExperiment(ctx context.Context, slug string, variants []models.ExperimentVariant) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateExperiment", ctx, slug, variants)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateExperiment indicates an expected call of CreateExperiment.
+func (mr *MockServicesMockRecorder) CreateExperiment(ctx, slug, variants interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateExperiment", reflect.TypeOf((*MockServices)(nil).CreateExperiment), ctx, slug, variants)
+}
+
+// CreateReport mocks base method.
+func (m *MockServices) CreateReport(ctx context.Context, request service.ReportRequest) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateReport", ctx, request)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// CreateCSVReportAndURL indicates an expected call of CreateCSVReportAndURL.
-func (mr *MockServicesMockRecorder) CreateCSVReportAndURL(ctx, date interface{}) *gomock.Call {
+// CreateReport indicates an expected call of CreateReport.
+func (mr *MockServicesMockRecorder) CreateReport(ctx, request interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateCSVReportAndURL", reflect.TypeOf((*MockServices)(nil).CreateCSVReportAndURL), ctx, date)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateReport", reflect.TypeOf((*MockServices)(nil).CreateReport), ctx, request)
 }
 
 // CreateSegment mocks base method.
-func (m *MockServices) CreateSegment(ctx context.Context, slug, percentageStr string) error {
+func (m *MockServices) CreateSegment(ctx context.Context, segment service.SegmentToCreate) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateSegment", ctx, slug, percentageStr)
+	ret := m.ctrl.Call(m, "CreateSegment", ctx, segment)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // CreateSegment indicates an expected call of CreateSegment.
-func (mr *MockServicesMockRecorder) CreateSegment(ctx, slug, percentageStr interface{}) *gomock.Call {
+func (mr *MockServicesMockRecorder) CreateSegment(ctx, segment interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegment", reflect.TypeOf((*MockServices)(nil).CreateSegment), ctx, segment)
+}
+
+// CreateUser mocks base method.
+func (m *MockServices) CreateUser(ctx context.Context, userID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateUser", ctx, userID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateUser indicates an expected call of CreateUser.
+func (mr *MockServicesMockRecorder) CreateUser(ctx, userID interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegment", reflect.TypeOf((*MockServices)(nil).CreateSegment), ctx, slug, percentageStr)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockServices)(nil).CreateUser), ctx, userID)
+}
+
+// DeleteExclusionGroup mocks base method.
+func (m *MockServices) DeleteExclusionGroup(ctx context.Context, slug string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExclusionGroup", ctx, slug)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteExclusionGroup indicates an expected call of DeleteExclusionGroup.
+func (mr *MockServicesMockRecorder) DeleteExclusionGroup(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExclusionGroup", reflect.TypeOf((*MockServices)(nil).DeleteExclusionGroup), ctx, slug)
+}
+
+// DeleteExperiment mocks base method.
+func (m *MockServices) DeleteExperiment(ctx context.Context, slug string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExperiment", ctx, slug)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteExperiment indicates an expected call of DeleteExperiment.
+func (mr *MockServicesMockRecorder) DeleteExperiment(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExperiment", reflect.TypeOf((*MockServices)(nil).DeleteExperiment), ctx, slug)
+}
+
+// DeleteExpiredReports mocks base method.
+func (m *MockServices) DeleteExpiredReports(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExpiredReports", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteExpiredReports indicates an expected call of DeleteExpiredReports.
+func (mr *MockServicesMockRecorder) DeleteExpiredReports(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExpiredReports", reflect.TypeOf((*MockServices)(nil).DeleteExpiredReports), ctx)
+}
+
+// DeleteExpiredSegments mocks base method.
+func (m *MockServices) DeleteExpiredSegments(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExpiredSegments", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteExpiredSegments indicates an expected call of DeleteExpiredSegments.
+func (mr *MockServicesMockRecorder) DeleteExpiredSegments(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExpiredSegments", reflect.TypeOf((*MockServices)(nil).DeleteExpiredSegments), ctx)
+}
+
+// DeleteReport mocks base method.
+func (m *MockServices) DeleteReport(ctx context.Context, id string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteReport", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteReport indicates an expected call of DeleteReport.
+func (mr *MockServicesMockRecorder) DeleteReport(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteReport", reflect.TypeOf((*MockServices)(nil).DeleteReport), ctx, id)
 }
 
 // DeleteSegment mocks base method.
@@ -246,6 +836,20 @@ func (mr *MockServicesMockRecorder) DeleteSegment(ctx, slug interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteSegment", reflect.TypeOf((*MockServices)(nil).DeleteSegment), ctx, slug)
 }
 
+// DeleteUser mocks base method.
+func (m *MockServices) DeleteUser(ctx context.Context, userID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteUser", ctx, userID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteUser indicates an expected call of DeleteUser.
+func (mr *MockServicesMockRecorder) DeleteUser(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUser", reflect.TypeOf((*MockServices)(nil).DeleteUser), ctx, userID)
+}
+
 // GetActiveSegments mocks base method.
 func (m *MockServices) GetActiveSegments(ctx context.Context, userID int) ([]string, error) {
 	m.ctrl.T.Helper()
@@ -261,8 +865,248 @@ func (mr *MockServicesMockRecorder) GetActiveSegments(ctx, userID interface{}) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetActiveSegments", reflect.TypeOf((*MockServices)(nil).GetActiveSegments), ctx, userID)
 }
 
+// GetExclusionGroup mocks base method.
+func (m *MockServices) GetExclusionGroup(ctx context.Context, slug string) (models.ExclusionGroup, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExclusionGroup", ctx, slug)
+	ret0, _ := ret[0].(models.ExclusionGroup)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExclusionGroup indicates an expected call of GetExclusionGroup.
+func (mr *MockServicesMockRecorder) GetExclusionGroup(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExclusionGroup", reflect.TypeOf((*MockServices)(nil).GetExclusionGroup), ctx, slug)
+}
+
+// GetExperiment mocks base method.
+func (m *MockServices) GetExperiment(ctx context.Context, slug string) (models.Experiment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExperiment", ctx, slug)
+	ret0, _ := ret[0].(models.Experiment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExperiment indicates an expected call of GetExperiment.
+func (mr *MockServicesMockRecorder) GetExperiment(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExperiment", reflect.TypeOf((*MockServices)(nil).GetExperiment), ctx, slug)
+}
+
+// GetReport mocks base method.
+func (m *MockServices) GetReport(ctx context.Context, id string) (models.Report, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReport", ctx, id)
+	ret0, _ := ret[0].(models.Report)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReport indicates an expected call of GetReport.
+func (mr *MockServicesMockRecorder) GetReport(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReport", reflect.TypeOf((*MockServices)(nil).GetReport), ctx, id)
+}
+
+// GetSegment mocks base method.
+func (m *MockServices) GetSegment(ctx context.Context, slug string) (models.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegment", ctx, slug)
+	ret0, _ := ret[0].(models.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegment indicates an expected call of GetSegment.
+func (mr *MockServicesMockRecorder) GetSegment(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegment", reflect.TypeOf((*MockServices)(nil).GetSegment), ctx, slug)
+}
+
+// GetSegmentStats mocks base method.
+func (m *MockServices) GetSegmentStats(ctx context.Context, slug, from, to string) (models.SegmentStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegmentStats", ctx, slug, from, to)
+	ret0, _ := ret[0].(models.SegmentStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegmentStats indicates an expected call of GetSegmentStats.
+func (mr *MockServicesMockRecorder) GetSegmentStats(ctx, slug, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegmentStats", reflect.TypeOf((*MockServices)(nil).GetSegmentStats), ctx, slug, from, to)
+}
+
+// GetSegmentUsers mocks base method.
+func (m *MockServices) GetSegmentUsers(ctx context.Context, slug, cursor string, limit int) ([]models.UserSegment, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegmentUsers", ctx, slug, cursor, limit)
+	ret0, _ := ret[0].([]models.UserSegment)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetSegmentUsers indicates an expected call of GetSegmentUsers.
+func (mr *MockServicesMockRecorder) GetSegmentUsers(ctx, slug, cursor, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegmentUsers", reflect.TypeOf((*MockServices)(nil).GetSegmentUsers), ctx, slug, cursor, limit)
+}
+
+// GetSegmentWindowEvents mocks base method.
+func (m *MockServices) GetSegmentWindowEvents(ctx context.Context, slug string) ([]models.SegmentWindowEvent, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegmentWindowEvents", ctx, slug)
+	ret0, _ := ret[0].([]models.SegmentWindowEvent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegmentWindowEvents indicates an expected call of GetSegmentWindowEvents.
+func (mr *MockServicesMockRecorder) GetSegmentWindowEvents(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegmentWindowEvents", reflect.TypeOf((*MockServices)(nil).GetSegmentWindowEvents), ctx, slug)
+}
+
+// GetSegments mocks base method.
+func (m *MockServices) GetSegments(ctx context.Context, prefix string, limit, offset int) ([]models.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegments", ctx, prefix, limit, offset)
+	ret0, _ := ret[0].([]models.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegments indicates an expected call of GetSegments.
+func (mr *MockServicesMockRecorder) GetSegments(ctx, prefix, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegments", reflect.TypeOf((*MockServices)(nil).GetSegments), ctx, prefix, limit, offset)
+}
+
+// GetUserHistory mocks base method.
+func (m *MockServices) GetUserHistory(ctx context.Context, userID int, request service.HistoryRequest) ([]models.Operation, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserHistory", ctx, userID, request)
+	ret0, _ := ret[0].([]models.Operation)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetUserHistory indicates an expected call of GetUserHistory.
+func (mr *MockServicesMockRecorder) GetUserHistory(ctx, userID, request interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserHistory", reflect.TypeOf((*MockServices)(nil).GetUserHistory), ctx, userID, request)
+}
+
+// GetUserSegmentsAt mocks base method.
+func (m *MockServices) GetUserSegmentsAt(ctx context.Context, userID int, at string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserSegmentsAt", ctx, userID, at)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserSegmentsAt indicates an expected call of GetUserSegmentsAt.
+func (mr *MockServicesMockRecorder) GetUserSegmentsAt(ctx, userID, at interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserSegmentsAt", reflect.TypeOf((*MockServices)(nil).GetUserSegmentsAt), ctx, userID, at)
+}
+
+// ProcessReport mocks base method.
+func (m *MockServices) ProcessReport(ctx context.Context) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProcessReport", ctx)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProcessReport indicates an expected call of ProcessReport.
+func (mr *MockServicesMockRecorder) ProcessReport(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProcessReport", reflect.TypeOf((*MockServices)(nil).ProcessReport), ctx)
+}
+
+// RollupSegmentStats mocks base method.
+func (m *MockServices) RollupSegmentStats(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RollupSegmentStats", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RollupSegmentStats indicates an expected call of RollupSegmentStats.
+func (mr *MockServicesMockRecorder) RollupSegmentStats(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RollupSegmentStats", reflect.TypeOf((*MockServices)(nil).RollupSegmentStats), ctx)
+}
+
+// SetMissingReportsExpiry mocks base method.
+func (m *MockServices) SetMissingReportsExpiry(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetMissingReportsExpiry", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetMissingReportsExpiry indicates an expected call of SetMissingReportsExpiry.
+func (mr *MockServicesMockRecorder) SetMissingReportsExpiry(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMissingReportsExpiry", reflect.TypeOf((*MockServices)(nil).SetMissingReportsExpiry), ctx)
+}
+
+// SetUserAttributes mocks base method.
+func (m *MockServices) SetUserAttributes(ctx context.Context, userID int, attributes map[string]any) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserAttributes", ctx, userID, attributes)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetUserAttributes indicates an expected call of SetUserAttributes.
+func (mr *MockServicesMockRecorder) SetUserAttributes(ctx, userID, attributes interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserAttributes", reflect.TypeOf((*MockServices)(nil).SetUserAttributes), ctx, userID, attributes)
+}
+
+// SnapshotUserSegments mocks base method.
+func (m *MockServices) SnapshotUserSegments(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SnapshotUserSegments", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SnapshotUserSegments indicates an expected call of SnapshotUserSegments.
+func (mr *MockServicesMockRecorder) SnapshotUserSegments(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SnapshotUserSegments", reflect.TypeOf((*MockServices)(nil).SnapshotUserSegments), ctx)
+}
+
+// UpdateSegment mocks base method.
+func (m *MockServices) UpdateSegment(ctx context.Context, slug string, update service.SegmentUpdate) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateSegment", ctx, slug, update)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateSegment indicates an expected call of UpdateSegment.
+func (mr *MockServicesMockRecorder) UpdateSegment(ctx, slug, update interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateSegment", reflect.TypeOf((*MockServices)(nil).UpdateSegment), ctx, slug, update)
+}
+
 // UpdateUserSegments mocks base method.
-func (m *MockServices) UpdateUserSegments(ctx context.Context, segmentsToAdd, segmentsToDelete []string, userID int) error {
+func (m *MockServices) UpdateUserSegments(ctx context.Context, segmentsToAdd []service.SegmentToAdd, segmentsToDelete []string, userID int) error {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "UpdateUserSegments", ctx, segmentsToAdd, segmentsToDelete, userID)
 	ret0, _ := ret[0].(error)
@@ -1,106 +1,619 @@
 package service
 
 import (
+	"compress/gzip"
 	"context"
-	"encoding/csv"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_store"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/storage"
-	"github.com/spf13/viper"
-	"net"
-	"net/url"
+	"io"
 	"os"
-	"strconv"
+	"strings"
 	"time"
 )
 
 var (
-	ErrParsingDate = errors.New("invalid date (year-month, e.g. 2023-08)")
+	ErrParsingDate        = errors.New("invalid date (year-month, e.g. 2023-08)")
+	ErrParsingFrom        = errors.New("invalid from (RFC3339 or year-month-day, e.g. 2023-08-01)")
+	ErrParsingTo          = errors.New("invalid to (RFC3339 or year-month-day, e.g. 2023-09-01)")
+	ErrDateWithRange      = errors.New("date cannot be set together with from and to")
+	ErrEmptyReportPeriod  = errors.New("either date or both from and to must be set")
+	ErrInvalidReportRange = errors.New("from must be before to")
+	ErrInvalidAction      = errors.New("action can be only add or delete")
+	ErrInvalidFormat      = errors.New("format can be only csv, ndjson, xlsx or parquet")
+	ErrGzipFormat         = errors.New("gzip can be used only with csv and ndjson formats")
+	ErrReportRunning      = errors.New("report is being generated, it can be deleted when it's done")
+	ErrReportInterrupted  = errors.New("report generation was interrupted")
+	ErrReportNotRunning   = errors.New("report is not running anymore")
+	ErrEmptyAt            = errors.New("at cannot be empty")
+	ErrParsingAt          = errors.New("invalid at (RFC3339 or year-month-day, e.g. 2023-08-01T12:00:00Z)")
 )
 
+const (
+	// reportCleanupBatch is the number of expired reports removed in one query.
+	reportCleanupBatch = 100
+	// reportTimeout is how long a report can be generated.
+	reportTimeout = 30 * time.Minute
+	// reportStaleAfter is how long a report can be running before it is considered left by a stopped worker,
+	// it is longer than reportTimeout, so a working worker gives up on the report before.
+	reportStaleAfter = reportTimeout + time.Minute
+
+	defaultUserHistoryLimit = 100
+	maxUserHistoryLimit     = 1000
+
+	// snapshotMinOperations is the number of operations after the latest snapshot of a user which is worth a new one.
+	snapshotMinOperations = 100
+	// snapshotBatch is the max number of snapshots taken in one run.
+	snapshotBatch = 1000
+)
+
+// ReportRequest describes operations to put into the report. The period is either a month in Date
+// (year-month) or a range [From, To) in RFC3339 or year-month-day, the other fields are optional filters.
+// Format is the report file format, csv by default. Gzip makes the report file compressed.
+type ReportRequest struct {
+	Date     string
+	From     string
+	To       string
+	UserIDs  []int
+	Segments []string
+	Action   string
+	AutoAdd  *bool
+	Format   string
+	Gzip     bool
+}
+
+// HistoryRequest selects operations of a user. From and To (RFC3339 or year-month-day) are optional
+// bounds of the range [From, To), Cursor is the cursor of the next page from the previous one.
+type HistoryRequest struct {
+	From   string
+	To     string
+	Cursor string
+	Limit  int
+}
+
 type operationService struct {
-	operation     storage.OperationStorage
-	pathToReports string
+	operation   storage.OperationStorage
+	report      storage.ReportStorage
+	reportStore report_store.ReportStore
+	// retention is how long reports are kept, zero keeps them forever.
+	retention time.Duration
 }
 
-func newOperationService(operation storage.OperationStorage, pathToReports string) *operationService {
+func newOperationService(operation storage.OperationStorage, report storage.ReportStorage,
+	reportStore report_store.ReportStore, retention time.Duration) *operationService {
 	return &operationService{
-		operation:     operation,
-		pathToReports: pathToReports,
+		operation:   operation,
+		report:      report,
+		reportStore: reportStore,
+		retention:   retention,
 	}
 }
 
-func (o *operationService) CreateCSVReportAndURL(ctx context.Context, date string) (string, error) {
-	layout := "2006-01"
-	parsedTime, err := time.Parse(layout, date)
+// CreateReport queues a report for the background workers and returns its id.
+func (o *operationService) CreateReport(ctx context.Context, request ReportRequest) (string, error) {
+	filter, err := newOperationFilter(request)
 	if err != nil {
-		return "", ErrParsingDate
+		return "", err
 	}
 
-	operations, err := o.operation.GetOperations(ctx, parsedTime)
+	format, err := validateReportFormat(request.Format, request.Gzip)
 	if err != nil {
 		return "", err
 	}
 
-	id := uuid.New().String()
+	report := models.Report{
+		ID:        uuid.New().String(),
+		Status:    models.ReportStatusPending,
+		Filter:    filter,
+		Format:    format,
+		Gzip:      request.Gzip,
+		CreatedAt: time.Now().UTC(),
+	}
+	if o.retention > 0 {
+		expiresAt := report.CreatedAt.Add(o.retention)
+		report.ExpiresAt = &expiresAt
+	}
 
-	err = createCSVFile(o.pathToReports, operations, id)
+	err = o.report.CreateReport(ctx, report)
 	if err != nil {
 		return "", err
 	}
 
-	host, err := os.Hostname()
+	return report.ID, nil
+}
+
+func (o *operationService) GetReport(ctx context.Context, id string) (models.Report, error) {
+	return o.report.GetReport(ctx, id)
+}
+
+// DeleteReport removes the report and its file, a report which is being generated cannot be removed.
+func (o *operationService) DeleteReport(ctx context.Context, id string) error {
+	report, err := o.report.GetReport(ctx, id)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	if report.Status == models.ReportStatusRunning {
+		return ErrReportRunning
+	}
+
+	return o.deleteReport(ctx, id)
+}
+
+// SetMissingReportsExpiry sets the expiry of reports created without one, e.g. before the retention
+// was configured, from the retention. It returns the number of updated reports, nothing is updated without retention.
+func (o *operationService) SetMissingReportsExpiry(ctx context.Context) (int, error) {
+	if o.retention <= 0 {
+		return 0, nil
+	}
+
+	return o.report.SetMissingReportsExpiry(ctx, o.retention)
+}
+
+// DeleteExpiredReports removes expired reports and files older than the retention which have no report,
+// e.g. left after a failed removal. It returns the number of removed reports and files.
+func (o *operationService) DeleteExpiredReports(ctx context.Context) (int, error) {
+	now := time.Now().UTC()
+	deleted := 0
+
+	for {
+		reports, err := o.report.GetExpiredReports(ctx, now, reportCleanupBatch)
+		if err != nil {
+			return deleted, err
+		}
+
+		for _, report := range reports {
+			err = o.deleteReport(ctx, report.ID)
+			if err != nil {
+				var notFoundError custom_error.NotFoundError
+				if errors.As(err, &notFoundError) {
+					continue // removed or claimed by someone else
+				}
+				return deleted, err
+			}
+			deleted++
+		}
+
+		if len(reports) < reportCleanupBatch {
+			break
+		}
 	}
 
-	IPs, err := net.LookupIP(host)
+	if o.retention <= 0 {
+		return deleted, nil
+	}
+
+	orphans, err := o.deleteOrphanFiles(ctx, now.Add(-o.retention))
+	return deleted + orphans, err
+}
+
+// deleteReport removes the report first, so the file is never removed while the report is being generated.
+// If removing the file fails, it's removed later as an orphan.
+func (o *operationService) deleteReport(ctx context.Context, id string) error {
+	report, err := o.report.DeleteReport(ctx, id)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	port := viper.GetString("server.port")
+	err = o.reportStore.Delete(ctx, report.FileName())
+	if err != nil {
+		return fmt.Errorf("error deleting file of report with id %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// deleteOrphanFiles removes report files modified before the time which have no report.
+func (o *operationService) deleteOrphanFiles(ctx context.Context, modifiedBefore time.Time) (int, error) {
+	files, err := o.reportStore.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	names := make(map[string][]string)
+	var ids []string
+	for _, file := range files {
+		if !file.ModTime.Before(modifiedBefore) {
+			continue
+		}
 
-	u := url.URL{
-		Scheme: "http",
-		Host:   net.JoinHostPort(IPs[0].String(), port),
-		Path:   fmt.Sprintf("/api/v1/users/report/%s", id),
+		// report files are named by report id, other files are left alone
+		id, _, _ := strings.Cut(file.Name, ".")
+		if _, err := uuid.Parse(id); err != nil {
+			continue
+		}
+
+		if _, ok := names[id]; !ok {
+			ids = append(ids, id)
+		}
+		names[id] = append(names[id], file.Name)
 	}
 
-	return u.String(), nil
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	existing, err := o.report.GetExistingReportIDs(ctx, ids)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range existing {
+		delete(names, id)
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		for _, name := range names[id] {
+			if err := o.reportStore.Delete(ctx, name); err != nil {
+				return deleted, fmt.Errorf("error deleting orphan file %s: %w", name, err)
+			}
+			deleted++
+		}
+	}
+
+	return deleted, nil
 }
 
-func createCSVFile(path string, operations []models.Operation, id string) error {
-	f, err := os.Create(path + id + ".csv")
+// ProcessReport generates the oldest pending report. It returns false when there is nothing to process,
+// a report which cannot be generated in reportTimeout is marked as failed. Reports left running by stopped
+// workers are marked as failed before, so they can be deleted.
+func (o *operationService) ProcessReport(ctx context.Context) (bool, error) {
+	_, err := o.report.FailStaleReports(ctx, time.Now().UTC().Add(-reportStaleAfter), ErrReportInterrupted.Error())
+	if err != nil {
+		return false, err
+	}
+
+	report, err := o.report.ClaimReport(ctx)
 	if err != nil {
-		return fmt.Errorf("error creating file with id %s: %w", id, err)
+		return false, err
+	}
+	if report == nil {
+		return false, nil
+	}
+
+	generateCtx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+
+	rows, size, err := o.generateReport(generateCtx, *report)
+	if err != nil {
+		failed, failErr := o.report.FailReport(ctx, report.ID, err.Error())
+		if failErr != nil {
+			return true, fmt.Errorf("report %s: %w (marking as failed: %s)", report.ID, err, failErr.Error())
+		}
+		if !failed {
+			return true, fmt.Errorf("report %s: %w (marking as failed: %s)", report.ID, err, ErrReportNotRunning.Error())
+		}
+		return true, fmt.Errorf("report %s: %w", report.ID, err)
+	}
+
+	finished, err := o.report.FinishReport(ctx, report.ID, rows, size)
+	if err != nil {
+		return true, err
+	}
+
+	if !finished {
+		// the report was marked as failed meanwhile, so its file isn't kept
+		err = o.reportStore.Delete(ctx, report.FileName())
+		if err != nil {
+			return true, fmt.Errorf("error deleting file of report with id %s: %w", report.ID, err)
+		}
+		return true, fmt.Errorf("report %s: %w", report.ID, ErrReportNotRunning)
+	}
+
+	return true, nil
+}
+
+// generateReport streams operations of the report into a temporary file, puts the file into the report store
+// and returns the number of rows and the file size.
+func (o *operationService) generateReport(ctx context.Context, report models.Report) (int64, int64, error) {
+	f, err := os.CreateTemp("", "report-")
+	if err != nil {
+		return 0, 0, fmt.Errorf("error creating file with id %s: %w", report.ID, err)
 	}
 	defer func() {
 		_ = f.Close()
+		_ = os.Remove(f.Name())
 	}()
 
-	w := csv.NewWriter(f)
-	defer w.Flush()
+	rows, err := writeReport(ctx, o.operation, report, f)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error getting size of file with id %s: %w", report.ID, err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, fmt.Errorf("error reading file with id %s: %w", report.ID, err)
+	}
+
+	err = o.reportStore.Put(ctx, report.FileName(), f, size, report.ContentType())
+	if err != nil {
+		return 0, 0, fmt.Errorf("error storing file with id %s: %w", report.ID, err)
+	}
+
+	return rows, size, nil
+}
+
+// newOperationFilter validates the report request and converts it to the storage filter.
+func newOperationFilter(request ReportRequest) (models.OperationFilter, error) {
+	var filter models.OperationFilter
 
-	columns := []string{"user id", "segment_slug", "action", "date"}
-	err = w.Write(columns)
+	from, to, err := parseReportPeriod(request.Date, request.From, request.To)
 	if err != nil {
-		return fmt.Errorf("error writing column to file with id %s: %w", id, err)
+		return filter, err
 	}
 
-	for _, operation := range operations {
-		userID := strconv.Itoa(operation.UserID)
-		segmentSlug := operation.SegmentSlug
-		action := operation.Action
-		date := operation.Date.Format(time.DateTime) // a human-readable format
-		row := []string{userID, segmentSlug, action, date}
+	for _, userID := range request.UserIDs {
+		if userID <= 0 {
+			return filter, custom_error.CustomError{
+				Field:   "user_ids",
+				Message: ErrInvalidUserID.Error(),
+			}
+		}
+	}
 
-		if err := w.Write(row); err != nil {
-			return fmt.Errorf("error writing file with id %s: %w", id, err)
+	for _, segment := range request.Segments {
+		if strings.ToUpper(segment) != segment {
+			return filter, custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrInvalidSegmentRepresentation.Error(),
+			}
 		}
 	}
 
-	return nil
+	if request.Action != "" && request.Action != "add" && request.Action != "delete" {
+		return filter, custom_error.CustomError{
+			Field:   "action",
+			Message: ErrInvalidAction.Error(),
+		}
+	}
+
+	filter = models.OperationFilter{
+		From:     from,
+		To:       to,
+		UserIDs:  request.UserIDs,
+		Segments: request.Segments,
+		Action:   request.Action,
+		AutoAdd:  request.AutoAdd,
+	}
+
+	return filter, nil
+}
+
+// validateReportFormat returns the report format, csv if it's empty.
+// Xlsx and parquet files are compressed by themselves, so gzip is allowed only for text formats.
+func validateReportFormat(format string, gzip bool) (string, error) {
+	if format == "" {
+		format = models.ReportFormatCSV
+	}
+
+	if _, ok := reportWriters[format]; !ok {
+		return "", custom_error.CustomError{
+			Field:   "format",
+			Message: ErrInvalidFormat.Error(),
+		}
+	}
+
+	if gzip && format != models.ReportFormatCSV && format != models.ReportFormatNDJSON {
+		return "", custom_error.CustomError{
+			Field:   "gzip",
+			Message: ErrGzipFormat.Error(),
+		}
+	}
+
+	return format, nil
+}
+
+// GetUserHistory returns a page of operations of the user, newest first, and the cursor of the next page.
+// The next cursor is empty when there are no more operations. History of a deleted user is kept.
+func (o *operationService) GetUserHistory(ctx context.Context, userID int, request HistoryRequest) ([]models.Operation, string, error) {
+	if userID <= 0 {
+		return nil, "", custom_error.CustomError{
+			Field:   "user_id",
+			Message: ErrInvalidUserID.Error(),
+		}
+	}
+
+	filter := models.UserHistoryFilter{}
+
+	if request.From != "" {
+		from, err := parseReportTime(request.From)
+		if err != nil {
+			return nil, "", custom_error.CustomError{
+				Field:   "from",
+				Message: ErrParsingFrom.Error(),
+			}
+		}
+		filter.From = from
+	}
+
+	if request.To != "" {
+		to, err := parseReportTime(request.To)
+		if err != nil {
+			return nil, "", custom_error.CustomError{
+				Field:   "to",
+				Message: ErrParsingTo.Error(),
+			}
+		}
+		filter.To = to
+	}
+
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return nil, "", custom_error.CustomError{
+			Field:   "from",
+			Message: ErrInvalidReportRange.Error(),
+		}
+	}
+
+	limit, err := validateLimit(request.Limit, defaultUserHistoryLimit, maxUserHistoryLimit)
+	if err != nil {
+		return nil, "", err
+	}
+	filter.Limit = limit
+
+	filter.BeforeID, err = decodeCursor(request.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	operations, err := o.operation.GetUserOperations(ctx, userID, filter)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var nextCursor string
+	if len(operations) == limit {
+		nextCursor = encodeCursor(operations[len(operations)-1].ID)
+	}
+
+	return operations, nextCursor, nil
+}
+
+// GetUserSegmentsAt returns segments the user had at the moment (RFC3339 or year-month-day), it's rebuilt from the operations log.
+func (o *operationService) GetUserSegmentsAt(ctx context.Context, userID int, at string) ([]string, error) {
+	if userID <= 0 {
+		return nil, custom_error.CustomError{
+			Field:   "user_id",
+			Message: ErrInvalidUserID.Error(),
+		}
+	}
+
+	if at == "" {
+		return nil, custom_error.CustomError{
+			Field:   "at",
+			Message: ErrEmptyAt.Error(),
+		}
+	}
+
+	parsedAt, err := parseReportTime(at)
+	if err != nil {
+		return nil, custom_error.CustomError{
+			Field:   "at",
+			Message: ErrParsingAt.Error(),
+		}
+	}
+
+	return o.operation.GetUserSegmentsAt(ctx, userID, parsedAt)
+}
+
+// SnapshotUserSegments takes snapshots of segments of users with many operations since their latest snapshot,
+// so rebuilding their segments at a moment replays few operations. It returns the number of snapshots taken.
+func (o *operationService) SnapshotUserSegments(ctx context.Context) (int, error) {
+	return o.operation.CreateUserSegmentsSnapshots(ctx, time.Now().UTC(), snapshotMinOperations, snapshotBatch)
+}
+
+// parseReportPeriod returns the report period [from, to) either from the month or from the range.
+func parseReportPeriod(date, from, to string) (time.Time, time.Time, error) {
+	if date != "" {
+		if from != "" || to != "" {
+			return time.Time{}, time.Time{}, custom_error.CustomError{
+				Field:   "date",
+				Message: ErrDateWithRange.Error(),
+			}
+		}
+
+		month, err := time.Parse("2006-01", date)
+		if err != nil {
+			return time.Time{}, time.Time{}, custom_error.CustomError{
+				Field:   "date",
+				Message: ErrParsingDate.Error(),
+			}
+		}
+
+		return month, month.AddDate(0, 1, 0), nil
+	}
+
+	if from == "" || to == "" {
+		return time.Time{}, time.Time{}, custom_error.CustomError{
+			Field:   "date",
+			Message: ErrEmptyReportPeriod.Error(),
+		}
+	}
+
+	parsedFrom, err := parseReportTime(from)
+	if err != nil {
+		return time.Time{}, time.Time{}, custom_error.CustomError{
+			Field:   "from",
+			Message: ErrParsingFrom.Error(),
+		}
+	}
+
+	parsedTo, err := parseReportTime(to)
+	if err != nil {
+		return time.Time{}, time.Time{}, custom_error.CustomError{
+			Field:   "to",
+			Message: ErrParsingTo.Error(),
+		}
+	}
+
+	if !parsedFrom.Before(parsedTo) {
+		return time.Time{}, time.Time{}, custom_error.CustomError{
+			Field:   "from",
+			Message: ErrInvalidReportRange.Error(),
+		}
+	}
+
+	return parsedFrom, parsedTo, nil
+}
+
+func parseReportTime(value string) (time.Time, error) {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return parsed, nil
+	}
+
+	return time.Parse(time.DateOnly, value)
+}
+
+// writeReport writes operations of the report to w in the report format as they come from the storage,
+// so memory usage doesn't depend on the report size. It returns the number of rows.
+func writeReport(ctx context.Context, operationStorage storage.OperationStorage, report models.Report, w io.Writer) (int64, error) {
+	newReportWriter, ok := reportWriters[report.Format]
+	if !ok {
+		return 0, fmt.Errorf("unknown format %q of report with id %s", report.Format, report.ID)
+	}
+
+	var gz *gzip.Writer
+	if report.Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	rw, err := newReportWriter(w)
+	if err != nil {
+		return 0, fmt.Errorf("error writing file with id %s: %w", report.ID, err)
+	}
+
+	var rows int64
+	err = operationStorage.ForEachOperation(ctx, report.Filter, func(operation models.Operation) error {
+		if err := rw.Write(operation); err != nil {
+			return fmt.Errorf("error writing file with id %s: %w", report.ID, err)
+		}
+
+		rows++
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := rw.Close(); err != nil {
+		return 0, fmt.Errorf("error writing file with id %s: %w", report.ID, err)
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return 0, fmt.Errorf("error compressing file with id %s: %w", report.ID, err)
+		}
+	}
+
+	return rows, nil
 }
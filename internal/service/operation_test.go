@@ -0,0 +1,791 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"github.com/google/uuid"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_store"
+	local_report_store "github.com/romandnk/dynamic-user-segmentation-service/internal/report_store/local"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReportPeriod(t *testing.T) {
+	testCases := []struct {
+		name          string
+		inputDate     string
+		inputFrom     string
+		inputTo       string
+		expectedFrom  time.Time
+		expectedTo    time.Time
+		expectedError error
+	}{
+		{
+			name:         "month",
+			inputDate:    "2023-08",
+			expectedFrom: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+			expectedTo:   time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:         "range of dates",
+			inputFrom:    "2023-08-10",
+			inputTo:      "2023-08-20",
+			expectedFrom: time.Date(2023, 8, 10, 0, 0, 0, 0, time.UTC),
+			expectedTo:   time.Date(2023, 8, 20, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:         "range of timestamps",
+			inputFrom:    "2023-08-10T03:00:00+03:00",
+			inputTo:      "2023-08-10T12:00:00Z",
+			expectedFrom: time.Date(2023, 8, 10, 0, 0, 0, 0, time.UTC),
+			expectedTo:   time.Date(2023, 8, 10, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "invalid month",
+			inputDate: "2023-08-21",
+			expectedError: custom_error.CustomError{
+				Field:   "date",
+				Message: ErrParsingDate.Error(),
+			},
+		},
+		{
+			name:      "month with range",
+			inputDate: "2023-08",
+			inputFrom: "2023-08-10",
+			expectedError: custom_error.CustomError{
+				Field:   "date",
+				Message: ErrDateWithRange.Error(),
+			},
+		},
+		{
+			name:      "empty period",
+			inputFrom: "2023-08-10",
+			expectedError: custom_error.CustomError{
+				Field:   "date",
+				Message: ErrEmptyReportPeriod.Error(),
+			},
+		},
+		{
+			name:      "invalid from",
+			inputFrom: "10.08.2023",
+			inputTo:   "2023-08-20",
+			expectedError: custom_error.CustomError{
+				Field:   "from",
+				Message: ErrParsingFrom.Error(),
+			},
+		},
+		{
+			name:      "invalid to",
+			inputFrom: "2023-08-10",
+			inputTo:   "tomorrow",
+			expectedError: custom_error.CustomError{
+				Field:   "to",
+				Message: ErrParsingTo.Error(),
+			},
+		},
+		{
+			name:      "from after to",
+			inputFrom: "2023-08-20",
+			inputTo:   "2023-08-10",
+			expectedError: custom_error.CustomError{
+				Field:   "from",
+				Message: ErrInvalidReportRange.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualFrom, actualTo, actualError := parseReportPeriod(tc.inputDate, tc.inputFrom, tc.inputTo)
+			require.ErrorIs(t, actualError, tc.expectedError)
+			if tc.expectedError != nil {
+				return
+			}
+			require.True(t, tc.expectedFrom.Equal(actualFrom))
+			require.True(t, tc.expectedTo.Equal(actualTo))
+		})
+	}
+}
+
+func TestNewOperationFilter(t *testing.T) {
+	testCases := []struct {
+		name          string
+		input         ReportRequest
+		expectedError error
+	}{
+		{
+			name: "valid filters",
+			input: ReportRequest{
+				Date:     "2023-08",
+				UserIDs:  []int{1, 2},
+				Segments: []string{"AVITO_TEST"},
+				Action:   "delete",
+			},
+		},
+		{
+			name: "invalid user id",
+			input: ReportRequest{
+				Date:    "2023-08",
+				UserIDs: []int{1, 0},
+			},
+			expectedError: custom_error.CustomError{
+				Field:   "user_ids",
+				Message: ErrInvalidUserID.Error(),
+			},
+		},
+		{
+			name: "invalid segment",
+			input: ReportRequest{
+				Date:     "2023-08",
+				Segments: []string{"avito"},
+			},
+			expectedError: custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrInvalidSegmentRepresentation.Error(),
+			},
+		},
+		{
+			name: "invalid action",
+			input: ReportRequest{
+				Date:   "2023-08",
+				Action: "update",
+			},
+			expectedError: custom_error.CustomError{
+				Field:   "action",
+				Message: ErrInvalidAction.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			filter, actualError := newOperationFilter(tc.input)
+			require.ErrorIs(t, actualError, tc.expectedError)
+			if tc.expectedError != nil {
+				return
+			}
+			require.Equal(t, tc.input.UserIDs, filter.UserIDs)
+			require.Equal(t, tc.input.Segments, filter.Segments)
+			require.Equal(t, tc.input.Action, filter.Action)
+		})
+	}
+}
+
+type operationStorageStub struct {
+	operations []models.Operation
+}
+
+func (o operationStorageStub) ForEachOperation(_ context.Context, _ models.OperationFilter, fn func(operation models.Operation) error) error {
+	for _, operation := range o.operations {
+		if err := fn(operation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetUserOperations returns operations, which are sorted newest first, before the cursor.
+func (o operationStorageStub) GetUserOperations(_ context.Context, _ int, filter models.UserHistoryFilter) ([]models.Operation, error) {
+	var operations []models.Operation
+	for _, operation := range o.operations {
+		if filter.BeforeID > 0 && operation.ID >= filter.BeforeID {
+			continue
+		}
+		if len(operations) == filter.Limit {
+			break
+		}
+		operations = append(operations, operation)
+	}
+	return operations, nil
+}
+
+func (o operationStorageStub) GetUserSegmentsAt(_ context.Context, _ int, _ time.Time) ([]string, error) {
+	return nil, nil
+}
+
+func (o operationStorageStub) CreateUserSegmentsSnapshots(_ context.Context, _ time.Time, _, _ int) (int, error) {
+	return 0, nil
+}
+
+func TestWriteReport(t *testing.T) {
+	date := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	var operations []models.Operation
+	for userID := 1; userID <= reportFlushRows+1; userID++ {
+		operations = append(operations, models.Operation{
+			UserID:      userID,
+			SegmentSlug: "AVITO_TEST",
+			Date:        date,
+			Action:      "add",
+			AutoAdd:     userID%2 == 0,
+		})
+	}
+
+	testCases := []struct {
+		format string
+		gzip   bool
+		check  func(t *testing.T, r io.Reader)
+	}{
+		{
+			format: models.ReportFormatCSV,
+			check: func(t *testing.T, r io.Reader) {
+				records, err := csv.NewReader(r).ReadAll()
+				require.NoError(t, err)
+				require.Len(t, records, len(operations)+1)
+				require.Equal(t, []string{"user id", "segment_slug", "action", "date", "auto_add"}, records[0])
+				require.Equal(t, []string{"2", "AVITO_TEST", "add", "2023-08-01 12:00:00", "true"}, records[2])
+			},
+		},
+		{
+			format: models.ReportFormatNDJSON,
+			check: func(t *testing.T, r io.Reader) {
+				scanner := bufio.NewScanner(r)
+				var lines []string
+				for scanner.Scan() {
+					lines = append(lines, scanner.Text())
+				}
+				require.NoError(t, scanner.Err())
+				require.Len(t, lines, len(operations))
+				require.JSONEq(t,
+					`{"user_id":2,"segment_slug":"AVITO_TEST","action":"add","date":"2023-08-01T12:00:00Z","auto_add":true}`,
+					lines[1])
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, gzipped := range []bool{false, true} {
+			report := models.Report{ID: "report", Format: tc.format, Gzip: gzipped}
+
+			var buf bytes.Buffer
+			rows, err := writeReport(context.Background(), operationStorageStub{operations: operations}, report, &buf)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(operations)), rows)
+
+			var r io.Reader = &buf
+			if gzipped {
+				gz, err := gzip.NewReader(&buf)
+				require.NoError(t, err)
+				r = gz
+			}
+
+			tc.check(t, r)
+		}
+	}
+}
+
+func TestGenerateReport(t *testing.T) {
+	ctx := context.Background()
+
+	reportStore, err := local_report_store.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	operations := []models.Operation{
+		{UserID: 1, SegmentSlug: "AVITO_TEST", Date: time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC), Action: "add"},
+		{UserID: 2, SegmentSlug: "AVITO_TEST", Date: time.Date(2023, 8, 2, 12, 0, 0, 0, time.UTC), Action: "delete"},
+	}
+
+	o := newOperationService(operationStorageStub{operations: operations}, nil, reportStore, 0)
+
+	report := models.Report{ID: "report", Format: models.ReportFormatNDJSON}
+
+	rows, size, err := o.generateReport(ctx, report)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(operations)), rows)
+
+	f, info, err := reportStore.Get(ctx, report.FileName())
+	require.NoError(t, err)
+	defer f.Close()
+	require.Equal(t, info.Size, size)
+
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, len(operations), bytes.Count(content, []byte("\n")))
+}
+
+func TestValidateReportFormat(t *testing.T) {
+	testCases := []struct {
+		name           string
+		inputFormat    string
+		inputGzip      bool
+		expectedFormat string
+		expectedError  error
+	}{
+		{
+			name:           "default format",
+			expectedFormat: models.ReportFormatCSV,
+		},
+		{
+			name:           "gzipped ndjson",
+			inputFormat:    models.ReportFormatNDJSON,
+			inputGzip:      true,
+			expectedFormat: models.ReportFormatNDJSON,
+		},
+		{
+			name:           "parquet",
+			inputFormat:    models.ReportFormatParquet,
+			expectedFormat: models.ReportFormatParquet,
+		},
+		{
+			name:        "unknown format",
+			inputFormat: "pdf",
+			expectedError: custom_error.CustomError{
+				Field:   "format",
+				Message: ErrInvalidFormat.Error(),
+			},
+		},
+		{
+			name:        "gzipped xlsx",
+			inputFormat: models.ReportFormatXLSX,
+			inputGzip:   true,
+			expectedError: custom_error.CustomError{
+				Field:   "gzip",
+				Message: ErrGzipFormat.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			format, err := validateReportFormat(tc.inputFormat, tc.inputGzip)
+			require.Equal(t, tc.expectedError, err)
+			require.Equal(t, tc.expectedFormat, format)
+		})
+	}
+}
+
+// reportStorageStub keeps reports in memory.
+type reportStorageStub struct {
+	reports map[string]models.Report
+}
+
+func (r reportStorageStub) CreateReport(_ context.Context, report models.Report) error {
+	r.reports[report.ID] = report
+	return nil
+}
+
+func (r reportStorageStub) ClaimReport(_ context.Context) (*models.Report, error) {
+	return nil, nil
+}
+
+func (r reportStorageStub) FinishReport(_ context.Context, id string, rows, size int64) (bool, error) {
+	report, ok := r.reports[id]
+	if !ok || report.Status != models.ReportStatusRunning {
+		return false, nil
+	}
+	report.Status = models.ReportStatusDone
+	report.Rows = rows
+	report.Size = size
+	r.reports[id] = report
+	return true, nil
+}
+
+func (r reportStorageStub) FailReport(_ context.Context, id string, message string) (bool, error) {
+	report, ok := r.reports[id]
+	if !ok || report.Status != models.ReportStatusRunning {
+		return false, nil
+	}
+	report.Status = models.ReportStatusFailed
+	report.Error = message
+	r.reports[id] = report
+	return true, nil
+}
+
+func (r reportStorageStub) FailStaleReports(_ context.Context, staleBefore time.Time, message string) (int, error) {
+	var failed int
+	for id, report := range r.reports {
+		if report.Status == models.ReportStatusRunning && report.UpdatedAt.Before(staleBefore) {
+			report.Status = models.ReportStatusFailed
+			report.Error = message
+			r.reports[id] = report
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+func (r reportStorageStub) GetReport(_ context.Context, id string) (models.Report, error) {
+	report, ok := r.reports[id]
+	if !ok {
+		return models.Report{}, custom_error.NotFoundError{Field: "id", Message: "report doesn't exist"}
+	}
+	return report, nil
+}
+
+func (r reportStorageStub) DeleteReport(_ context.Context, id string) (models.Report, error) {
+	report, ok := r.reports[id]
+	if !ok || report.Status == models.ReportStatusRunning {
+		return models.Report{}, custom_error.NotFoundError{Field: "id", Message: "report doesn't exist"}
+	}
+	delete(r.reports, id)
+	return report, nil
+}
+
+func (r reportStorageStub) SetMissingReportsExpiry(_ context.Context, retention time.Duration) (int, error) {
+	var updated int
+	for id, report := range r.reports {
+		if report.ExpiresAt == nil {
+			expiresAt := report.CreatedAt.Add(retention)
+			report.ExpiresAt = &expiresAt
+			r.reports[id] = report
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+func (r reportStorageStub) GetExpiredReports(_ context.Context, now time.Time, limit int) ([]models.Report, error) {
+	var reports []models.Report
+	for _, report := range r.reports {
+		if report.ExpiresAt != nil && !report.ExpiresAt.After(now) && report.Status != models.ReportStatusRunning {
+			reports = append(reports, report)
+		}
+	}
+	if len(reports) > limit {
+		reports = reports[:limit]
+	}
+	return reports, nil
+}
+
+func (r reportStorageStub) GetExistingReportIDs(_ context.Context, ids []string) ([]string, error) {
+	var existing []string
+	for _, id := range ids {
+		if _, ok := r.reports[id]; ok {
+			existing = append(existing, id)
+		}
+	}
+	return existing, nil
+}
+
+func TestDeleteExpiredReports(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	reportStore, err := local_report_store.NewStore(dir)
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	expired := now.Add(-time.Minute)
+	notExpired := now.Add(time.Hour)
+
+	reports := map[string]models.Report{}
+	newReport := func(status string, expiresAt *time.Time) models.Report {
+		report := models.Report{ID: uuid.New().String(), Status: status, Format: models.ReportFormatCSV, ExpiresAt: expiresAt}
+		reports[report.ID] = report
+		err := reportStore.Put(ctx, report.FileName(), strings.NewReader("user id"), 7, "text/csv")
+		require.NoError(t, err)
+		return report
+	}
+
+	expiredReport := newReport(models.ReportStatusDone, &expired)
+	runningReport := newReport(models.ReportStatusRunning, &expired)
+	freshReport := newReport(models.ReportStatusDone, &notExpired)
+	keptReport := newReport(models.ReportStatusDone, nil)
+
+	// an old file without report and an old file which is not a report
+	oldTime := now.Add(-48 * time.Hour)
+	orphan := uuid.New().String() + ".csv"
+	for _, name := range []string{orphan, "readme.txt"} {
+		require.NoError(t, reportStore.Put(ctx, name, strings.NewReader("x"), 1, "text/plain"))
+		require.NoError(t, os.Chtimes(filepath.Join(dir, name), oldTime, oldTime))
+	}
+
+	o := newOperationService(nil, reportStorageStub{reports: reports}, reportStore, 24*time.Hour)
+
+	deleted, err := o.DeleteExpiredReports(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+
+	require.NotContains(t, reports, expiredReport.ID)
+	require.Contains(t, reports, runningReport.ID)
+	require.Contains(t, reports, freshReport.ID)
+	require.Contains(t, reports, keptReport.ID)
+
+	files, err := reportStore.List(ctx)
+	require.NoError(t, err)
+
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	require.ElementsMatch(t, []string{
+		runningReport.FileName(),
+		freshReport.FileName(),
+		keptReport.FileName(),
+		"readme.txt",
+	}, names)
+}
+
+func TestDeleteReport(t *testing.T) {
+	ctx := context.Background()
+
+	reportStore, err := local_report_store.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	done := models.Report{ID: uuid.New().String(), Status: models.ReportStatusDone, Format: models.ReportFormatNDJSON, Gzip: true}
+	running := models.Report{ID: uuid.New().String(), Status: models.ReportStatusRunning, Format: models.ReportFormatCSV}
+	reports := map[string]models.Report{done.ID: done, running.ID: running}
+
+	require.NoError(t, reportStore.Put(ctx, done.FileName(), strings.NewReader("{}"), 2, "application/gzip"))
+
+	o := newOperationService(nil, reportStorageStub{reports: reports}, reportStore, 0)
+
+	require.NoError(t, o.DeleteReport(ctx, done.ID))
+	require.NotContains(t, reports, done.ID)
+
+	_, _, err = reportStore.Get(ctx, done.FileName())
+	require.ErrorIs(t, err, report_store.ErrNotExist)
+
+	require.ErrorIs(t, o.DeleteReport(ctx, running.ID), ErrReportRunning)
+
+	var notFoundError custom_error.NotFoundError
+	require.ErrorAs(t, o.DeleteReport(ctx, done.ID), &notFoundError)
+}
+
+func TestProcessReportFailsStaleReports(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	stale := models.Report{ID: uuid.New().String(), Status: models.ReportStatusRunning, UpdatedAt: now.Add(-2 * reportTimeout)}
+	running := models.Report{ID: uuid.New().String(), Status: models.ReportStatusRunning, UpdatedAt: now.Add(-time.Minute)}
+	reports := map[string]models.Report{stale.ID: stale, running.ID: running}
+
+	reportStore, err := local_report_store.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	o := newOperationService(nil, reportStorageStub{reports: reports}, reportStore, 0)
+
+	processed, err := o.ProcessReport(ctx)
+	require.NoError(t, err)
+	require.False(t, processed)
+
+	require.Equal(t, models.ReportStatusFailed, reports[stale.ID].Status)
+	require.Equal(t, ErrReportInterrupted.Error(), reports[stale.ID].Error)
+	require.Equal(t, models.ReportStatusRunning, reports[running.ID].Status)
+
+	// the failed report isn't running anymore, so it can be deleted
+	require.NoError(t, o.DeleteReport(ctx, stale.ID))
+}
+
+// staleReportStorageStub claims the report and marks it as failed right away,
+// as another instance does with a report it considers stale.
+type staleReportStorageStub struct {
+	reportStorageStub
+	id string
+}
+
+func (r staleReportStorageStub) ClaimReport(_ context.Context) (*models.Report, error) {
+	report := r.reports[r.id]
+	report.Status = models.ReportStatusFailed
+	report.Error = ErrReportInterrupted.Error()
+	r.reports[r.id] = report
+	return &report, nil
+}
+
+func TestProcessReportNotRunning(t *testing.T) {
+	ctx := context.Background()
+
+	report := models.Report{ID: uuid.New().String(), Status: models.ReportStatusRunning, Format: models.ReportFormatCSV,
+		UpdatedAt: time.Now().UTC()}
+	reports := map[string]models.Report{report.ID: report}
+
+	reportStore, err := local_report_store.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	o := newOperationService(operationStorageStub{}, staleReportStorageStub{reportStorageStub{reports: reports}, report.ID},
+		reportStore, 0)
+
+	processed, err := o.ProcessReport(ctx)
+	require.True(t, processed)
+	require.ErrorIs(t, err, ErrReportNotRunning)
+
+	// the failed report isn't marked as done and its file isn't kept
+	require.Equal(t, models.ReportStatusFailed, reports[report.ID].Status)
+	files, err := reportStore.List(ctx)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestSetMissingReportsExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	createdAt := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	expiresAt := createdAt.Add(time.Hour)
+	withoutExpiry := models.Report{ID: uuid.New().String(), Status: models.ReportStatusDone, CreatedAt: createdAt}
+	withExpiry := models.Report{ID: uuid.New().String(), Status: models.ReportStatusDone, CreatedAt: createdAt,
+		ExpiresAt: &expiresAt}
+	reports := map[string]models.Report{withoutExpiry.ID: withoutExpiry, withExpiry.ID: withExpiry}
+
+	// reports are kept forever without retention
+	o := newOperationService(nil, reportStorageStub{reports: reports}, nil, 0)
+
+	updated, err := o.SetMissingReportsExpiry(ctx)
+	require.NoError(t, err)
+	require.Zero(t, updated)
+	require.Nil(t, reports[withoutExpiry.ID].ExpiresAt)
+
+	o = newOperationService(nil, reportStorageStub{reports: reports}, nil, 24*time.Hour)
+
+	updated, err = o.SetMissingReportsExpiry(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, updated)
+	require.Equal(t, createdAt.Add(24*time.Hour), *reports[withoutExpiry.ID].ExpiresAt)
+	require.Equal(t, expiresAt, *reports[withExpiry.ID].ExpiresAt)
+}
+
+func TestGetUserHistory(t *testing.T) {
+	date := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	stub := operationStorageStub{operations: []models.Operation{
+		{ID: 3, UserID: 1000, SegmentSlug: "AVITO_TEST", Date: date.Add(time.Hour), Action: "delete", Source: models.OperationSourceSegmentDelete},
+		{ID: 2, UserID: 1000, SegmentSlug: "AVITO_VOICE", Date: date, Action: "add", AutoAdd: true, Source: models.OperationSourceAutoAdd},
+		{ID: 1, UserID: 1000, SegmentSlug: "AVITO_TEST", Date: date, Action: "add", Source: models.OperationSourceManual},
+	}}
+
+	o := newOperationService(stub, nil, nil, 0)
+	ctx := context.Background()
+
+	firstPage, cursor, err := o.GetUserHistory(ctx, 1000, HistoryRequest{Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, stub.operations[:2], firstPage)
+	require.NotEmpty(t, cursor)
+
+	secondPage, cursor, err := o.GetUserHistory(ctx, 1000, HistoryRequest{Limit: 2, Cursor: cursor})
+	require.NoError(t, err)
+	require.Equal(t, stub.operations[2:], secondPage)
+	require.Empty(t, cursor)
+
+	testCases := []struct {
+		name          string
+		userID        int
+		request       HistoryRequest
+		expectedError error
+	}{
+		{
+			name:    "range",
+			userID:  1000,
+			request: HistoryRequest{From: "2023-08-01", To: "2023-08-02T00:00:00Z"},
+		},
+		{
+			name:   "invalid user id",
+			userID: 0,
+			expectedError: custom_error.CustomError{
+				Field:   "user_id",
+				Message: ErrInvalidUserID.Error(),
+			},
+		},
+		{
+			name:    "invalid from",
+			userID:  1000,
+			request: HistoryRequest{From: "01.08.2023"},
+			expectedError: custom_error.CustomError{
+				Field:   "from",
+				Message: ErrParsingFrom.Error(),
+			},
+		},
+		{
+			name:    "from after to",
+			userID:  1000,
+			request: HistoryRequest{From: "2023-08-02", To: "2023-08-01"},
+			expectedError: custom_error.CustomError{
+				Field:   "from",
+				Message: ErrInvalidReportRange.Error(),
+			},
+		},
+		{
+			name:    "invalid cursor",
+			userID:  1000,
+			request: HistoryRequest{Cursor: "!"},
+			expectedError: custom_error.CustomError{
+				Field:   "cursor",
+				Message: ErrInvalidCursor.Error(),
+			},
+		},
+		{
+			name:    "invalid limit",
+			userID:  1000,
+			request: HistoryRequest{Limit: maxUserHistoryLimit + 1},
+			expectedError: custom_error.CustomError{
+				Field:   "limit",
+				Message: "limit must be from 1 to 1000 inclusively",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := o.GetUserHistory(ctx, tc.userID, tc.request)
+			require.ErrorIs(t, err, tc.expectedError)
+		})
+	}
+}
+
+func TestGetUserSegmentsAt(t *testing.T) {
+	o := newOperationService(operationStorageStub{}, nil, nil, 0)
+
+	testCases := []struct {
+		name          string
+		userID        int
+		at            string
+		expectedError error
+	}{
+		{
+			name:   "moment",
+			userID: 1000,
+			at:     "2023-08-15T12:00:00Z",
+		},
+		{
+			name:   "date",
+			userID: 1000,
+			at:     "2023-08-15",
+		},
+		{
+			name:   "invalid user id",
+			userID: -1,
+			at:     "2023-08-15",
+			expectedError: custom_error.CustomError{
+				Field:   "user_id",
+				Message: ErrInvalidUserID.Error(),
+			},
+		},
+		{
+			name:   "empty at",
+			userID: 1000,
+			expectedError: custom_error.CustomError{
+				Field:   "at",
+				Message: ErrEmptyAt.Error(),
+			},
+		},
+		{
+			name:   "invalid at",
+			userID: 1000,
+			at:     "15.08.2023",
+			expectedError: custom_error.CustomError{
+				Field:   "at",
+				Message: ErrParsingAt.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := o.GetUserSegmentsAt(context.Background(), tc.userID, tc.at)
+			require.ErrorIs(t, err, tc.expectedError)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"github.com/parquet-go/parquet-go"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"io"
+)
+
+// parquetRowGroupRows is the number of rows buffered in memory before they are written as a row group.
+const parquetRowGroupRows = 100000
+
+// parquetOperation is a row of the parquet report, the date is a UTC timestamp in milliseconds.
+type parquetOperation struct {
+	UserID      int32  `parquet:"user_id"`
+	SegmentSlug string `parquet:"segment_slug"`
+	Action      string `parquet:"action"`
+	Date        int64  `parquet:"date,timestamp(millisecond)"`
+	AutoAdd     bool   `parquet:"auto_add"`
+}
+
+// parquetReportWriter writes the report as a parquet file. Rows are passed to the parquet writer in batches
+// of reportFlushRows and written in row groups of parquetRowGroupRows, so memory usage doesn't depend on the report size.
+type parquetReportWriter struct {
+	w    *parquet.GenericWriter[parquetOperation]
+	rows []parquetOperation
+}
+
+func newParquetReportWriter(w io.Writer) (reportWriter, error) {
+	return &parquetReportWriter{
+		w:    parquet.NewGenericWriter[parquetOperation](w, parquet.MaxRowsPerRowGroup(parquetRowGroupRows)),
+		rows: make([]parquetOperation, 0, reportFlushRows),
+	}, nil
+}
+
+func (p *parquetReportWriter) Write(operation models.Operation) error {
+	p.rows = append(p.rows, parquetOperation{
+		UserID:      int32(operation.UserID),
+		SegmentSlug: operation.SegmentSlug,
+		Action:      operation.Action,
+		Date:        operation.Date.UnixMilli(),
+		AutoAdd:     operation.AutoAdd,
+	})
+
+	if len(p.rows) == reportFlushRows {
+		return p.flush()
+	}
+
+	return nil
+}
+
+func (p *parquetReportWriter) Close() error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+
+	return p.w.Close()
+}
+
+func (p *parquetReportWriter) flush() error {
+	if _, err := p.w.Write(p.rows); err != nil {
+		return err
+	}
+	p.rows = p.rows[:0]
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"io"
+	"strconv"
+	"time"
+)
+
+// reportFlushRows is the number of rows after which the report writer flushes its buffer to the file.
+const reportFlushRows = 1000
+
+// reportColumns are the header of the tabular report formats.
+var reportColumns = []string{"user id", "segment_slug", "action", "date", "auto_add"}
+
+// reportWriter writes operations to a report file in a specific format.
+type reportWriter interface {
+	// Write adds the operation to the report, the writer may keep a bounded number of rows in memory.
+	Write(operation models.Operation) error
+	// Close writes everything that is buffered and finishes the report. It doesn't close the underlying writer.
+	Close() error
+}
+
+// reportWriters creates a report writer for every supported format.
+var reportWriters = map[string]func(w io.Writer) (reportWriter, error){
+	models.ReportFormatCSV:     newCSVReportWriter,
+	models.ReportFormatNDJSON:  newNDJSONReportWriter,
+	models.ReportFormatXLSX:    newXLSXReportWriter,
+	models.ReportFormatParquet: newParquetReportWriter,
+}
+
+type csvReportWriter struct {
+	w    *csv.Writer
+	rows int64
+}
+
+func newCSVReportWriter(w io.Writer) (reportWriter, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(reportColumns); err != nil {
+		return nil, err
+	}
+
+	return &csvReportWriter{w: cw}, nil
+}
+
+func (c *csvReportWriter) Write(operation models.Operation) error {
+	userID := strconv.Itoa(operation.UserID)
+	segmentSlug := operation.SegmentSlug
+	action := operation.Action
+	date := operation.Date.Format(time.DateTime) // a human-readable format
+	autoAdd := strconv.FormatBool(operation.AutoAdd)
+	row := []string{userID, segmentSlug, action, date, autoAdd}
+
+	if err := c.w.Write(row); err != nil {
+		return err
+	}
+
+	c.rows++
+	if c.rows%reportFlushRows == 0 {
+		c.w.Flush()
+		return c.w.Error()
+	}
+
+	return nil
+}
+
+func (c *csvReportWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// ndjsonOperation is a line of the NDJSON report.
+type ndjsonOperation struct {
+	UserID      int       `json:"user_id"`
+	SegmentSlug string    `json:"segment_slug"`
+	Action      string    `json:"action"`
+	Date        time.Time `json:"date"`
+	AutoAdd     bool      `json:"auto_add"`
+}
+
+type ndjsonReportWriter struct {
+	buf  *bufio.Writer
+	enc  *json.Encoder
+	rows int64
+}
+
+func newNDJSONReportWriter(w io.Writer) (reportWriter, error) {
+	buf := bufio.NewWriter(w)
+	return &ndjsonReportWriter{buf: buf, enc: json.NewEncoder(buf)}, nil
+}
+
+func (n *ndjsonReportWriter) Write(operation models.Operation) error {
+	err := n.enc.Encode(ndjsonOperation{
+		UserID:      operation.UserID,
+		SegmentSlug: operation.SegmentSlug,
+		Action:      operation.Action,
+		Date:        operation.Date,
+		AutoAdd:     operation.AutoAdd,
+	})
+	if err != nil {
+		return err
+	}
+
+	n.rows++
+	if n.rows%reportFlushRows == 0 {
+		return n.buf.Flush()
+	}
+
+	return nil
+}
+
+func (n *ndjsonReportWriter) Close() error {
+	return n.buf.Flush()
+}
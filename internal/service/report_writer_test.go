@@ -0,0 +1,138 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"github.com/parquet-go/parquet-go"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestXLSXReportWriter(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := newXLSXReportWriter(&buf)
+	require.NoError(t, err)
+
+	require.NoError(t, w.Write(models.Operation{
+		UserID:      1,
+		SegmentSlug: "AVITO_<TEST>",
+		Date:        time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC),
+		Action:      "add",
+		AutoAdd:     true,
+	}))
+	require.NoError(t, w.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	var sheet []byte
+	names := make(map[string]bool)
+	for _, f := range zr.File {
+		names[f.Name] = true
+		if f.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		r, err := f.Open()
+		require.NoError(t, err)
+		sheet, err = io.ReadAll(r)
+		require.NoError(t, err)
+	}
+	for _, part := range xlsxParts {
+		require.True(t, names[part.name], part.name)
+	}
+
+	var worksheet struct {
+		Rows []struct {
+			Cells []struct {
+				Ref    string `xml:"r,attr"`
+				Type   string `xml:"t,attr"`
+				Style  string `xml:"s,attr"`
+				Value  string `xml:"v"`
+				Inline string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	require.NoError(t, xml.Unmarshal(sheet, &worksheet))
+	require.Len(t, worksheet.Rows, 2)
+	require.Equal(t, "user id", worksheet.Rows[0].Cells[0].Inline)
+
+	cells := worksheet.Rows[1].Cells
+	require.Len(t, cells, 5)
+	require.Equal(t, "A2", cells[0].Ref)
+	require.Equal(t, "1", cells[0].Value)
+	require.Equal(t, "AVITO_<TEST>", cells[1].Inline)
+	require.Equal(t, "add", cells[2].Inline)
+	require.Equal(t, "1", cells[3].Style)
+	require.Equal(t, "45139.5", cells[3].Value)
+	require.Equal(t, "b", cells[4].Type)
+	require.Equal(t, "1", cells[4].Value)
+}
+
+func TestParquetReportWriter(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := newParquetReportWriter(&buf)
+	require.NoError(t, err)
+
+	date := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+	expected := make([]models.Operation, 0, parquetRowGroupRows+1)
+	for userID := 1; userID <= parquetRowGroupRows+1; userID++ {
+		operation := models.Operation{
+			UserID:      userID,
+			SegmentSlug: "AVITO_TEST",
+			Date:        date.Add(time.Duration(userID) * time.Millisecond),
+			Action:      "add",
+			AutoAdd:     userID%2 == 0,
+		}
+		expected = append(expected, operation)
+		require.NoError(t, w.Write(operation))
+	}
+	require.NoError(t, w.Close())
+
+	// the file is read back by the parquet library
+	file, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(expected)), file.NumRows())
+
+	rowGroups := file.RowGroups()
+	require.Len(t, rowGroups, 2)
+	require.Equal(t, int64(parquetRowGroupRows), rowGroups[0].NumRows())
+	require.Equal(t, int64(1), rowGroups[1].NumRows())
+
+	columns := make(map[string]parquet.Node)
+	for _, field := range file.Schema().Fields() {
+		columns[field.Name()] = field
+	}
+	require.Len(t, columns, 5)
+	require.Equal(t, parquet.Int32, columns["user_id"].Type().Kind())
+	require.Equal(t, parquet.ByteArray, columns["segment_slug"].Type().Kind())
+	require.NotNil(t, columns["segment_slug"].Type().LogicalType().UTF8)
+	require.Equal(t, parquet.ByteArray, columns["action"].Type().Kind())
+	require.Equal(t, parquet.Int64, columns["date"].Type().Kind())
+	timestamp := columns["date"].Type().LogicalType().Timestamp
+	require.NotNil(t, timestamp)
+	require.NotNil(t, timestamp.Unit.Millis)
+	require.Equal(t, parquet.Boolean, columns["auto_add"].Type().Kind())
+
+	rows := make([]parquetOperation, len(expected))
+	r := parquet.NewGenericReader[parquetOperation](bytes.NewReader(buf.Bytes()))
+	n, err := r.Read(rows)
+	if err != io.EOF {
+		require.NoError(t, err)
+	}
+	require.Equal(t, len(expected), n)
+	require.NoError(t, r.Close())
+
+	for i, operation := range expected {
+		require.Equal(t, int32(operation.UserID), rows[i].UserID)
+		require.Equal(t, operation.SegmentSlug, rows[i].SegmentSlug)
+		require.Equal(t, operation.Action, rows[i].Action)
+		require.True(t, operation.Date.Equal(time.UnixMilli(rows[i].Date)))
+		require.Equal(t, operation.AutoAdd, rows[i].AutoAdd)
+	}
+}
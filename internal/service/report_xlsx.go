@@ -0,0 +1,178 @@
+package service
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"io"
+	"strconv"
+	"time"
+)
+
+// xlsxMaxRows is the row limit of an Excel sheet, the first row is the header.
+const xlsxMaxRows = 1048576
+
+var ErrXLSXTooManyRows = errors.New("report has too many rows for xlsx, use csv, ndjson or parquet")
+
+// xlsxEpoch is the zero of Excel serial dates.
+var xlsxEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// xlsxParts are the static parts of the workbook, the sheet itself is streamed into xl/worksheets/sheet1.xml.
+var xlsxParts = []struct {
+	name    string
+	content string
+}{
+	{
+		name: "[Content_Types].xml",
+		content: xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+			`</Types>`,
+	},
+	{
+		name: "_rels/.rels",
+		content: xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`,
+	},
+	{
+		name: "xl/workbook.xml",
+		content: xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+			`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="operations" sheetId="1" r:id="rId1"/></sheets>` +
+			`</workbook>`,
+	},
+	{
+		name: "xl/_rels/workbook.xml.rels",
+		content: xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+			`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+			`</Relationships>`,
+	},
+	{
+		// the second cell format is the built-in date and time format used by the date column
+		name: "xl/styles.xml",
+		content: xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<fonts count="1"><font/></fonts>` +
+			`<fills count="1"><fill/></fills>` +
+			`<borders count="1"><border/></borders>` +
+			`<cellStyleXfs count="1"><xf/></cellStyleXfs>` +
+			`<cellXfs count="2"><xf/><xf numFmtId="22" applyNumberFormat="1"/></cellXfs>` +
+			`</styleSheet>`,
+	},
+}
+
+// xlsxReportWriter streams rows into a single sheet workbook with inline strings,
+// so nothing but the zip buffers is kept in memory.
+type xlsxReportWriter struct {
+	zw   *zip.Writer
+	buf  *bufio.Writer
+	rows int
+}
+
+func newXLSXReportWriter(w io.Writer) (reportWriter, error) {
+	zw := zip.NewWriter(w)
+
+	for _, part := range xlsxParts {
+		pw, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(pw, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	x := &xlsxReportWriter{zw: zw, buf: bufio.NewWriter(sheet)}
+
+	_, _ = x.buf.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	x.startRow()
+	for i, column := range reportColumns {
+		x.stringCell(i, column)
+	}
+	x.endRow()
+
+	return x, nil
+}
+
+func (x *xlsxReportWriter) Write(operation models.Operation) error {
+	if x.rows >= xlsxMaxRows {
+		return ErrXLSXTooManyRows
+	}
+
+	x.startRow()
+	x.numberCell(0, strconv.Itoa(operation.UserID), false)
+	x.stringCell(1, operation.SegmentSlug)
+	x.stringCell(2, operation.Action)
+	x.numberCell(3, strconv.FormatFloat(xlsxSerialDate(operation.Date), 'f', -1, 64), true)
+	x.boolCell(4, operation.AutoAdd)
+	x.endRow()
+
+	if x.rows%reportFlushRows == 0 {
+		return x.buf.Flush()
+	}
+
+	return nil
+}
+
+func (x *xlsxReportWriter) Close() error {
+	_, _ = x.buf.WriteString(`</sheetData></worksheet>`)
+	if err := x.buf.Flush(); err != nil {
+		return err
+	}
+
+	return x.zw.Close()
+}
+
+// Errors of the buffered writer are sticky, so cell helpers ignore them and they are returned by the next Flush.
+
+func (x *xlsxReportWriter) startRow() {
+	x.rows++
+	_, _ = x.buf.WriteString(`<row r="` + strconv.Itoa(x.rows) + `">`)
+}
+
+func (x *xlsxReportWriter) endRow() {
+	_, _ = x.buf.WriteString(`</row>`)
+}
+
+func (x *xlsxReportWriter) cellRef(column int) string {
+	return string(rune('A'+column)) + strconv.Itoa(x.rows)
+}
+
+func (x *xlsxReportWriter) stringCell(column int, value string) {
+	_, _ = x.buf.WriteString(`<c r="` + x.cellRef(column) + `" t="inlineStr"><is><t>`)
+	_ = xml.EscapeText(x.buf, []byte(value))
+	_, _ = x.buf.WriteString(`</t></is></c>`)
+}
+
+func (x *xlsxReportWriter) numberCell(column int, value string, date bool) {
+	style := ""
+	if date {
+		style = ` s="1"`
+	}
+	_, _ = x.buf.WriteString(`<c r="` + x.cellRef(column) + `"` + style + `><v>` + value + `</v></c>`)
+}
+
+func (x *xlsxReportWriter) boolCell(column int, value bool) {
+	v := "0"
+	if value {
+		v = "1"
+	}
+	_, _ = x.buf.WriteString(`<c r="` + x.cellRef(column) + `" t="b"><v>` + v + `</v></c>`)
+}
+
+// xlsxSerialDate converts the time to the number of days since the Excel epoch, which is how Excel stores dates.
+func xlsxSerialDate(t time.Time) float64 {
+	return float64(t.UTC().Sub(xlsxEpoch)) / float64(24*time.Hour)
+}
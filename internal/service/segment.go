@@ -3,12 +3,16 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/segment_rule"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/storage"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -17,6 +21,52 @@ var (
 	ErrInvalidPercentageZero     = errors.New("percentage cannot be zero")
 	ErrInvalidPercentageFormat   = errors.New("invalid percentage format (e.g. 100%, 99%, 1%)")
 	ErrInvalidPercentageTooBig   = errors.New("percentage cannot be more than 100")
+	ErrInvalidPrefix             = errors.New("prefix can only contain uppercase letters")
+	ErrInvalidOffset             = errors.New("offset cannot be less than zero")
+	ErrNothingToUpdate           = errors.New("percentage, description and owner cannot all be empty")
+	ErrOwnerTooLong              = errors.New("owner cannot be longer than 255 characters")
+	ErrParsingStatsFrom          = errors.New("invalid from (year-month-day, e.g. 2023-08-01)")
+	ErrParsingStatsTo            = errors.New("invalid to (year-month-day, e.g. 2023-08-31)")
+	ErrStatsFromAfterTo          = errors.New("from cannot be after to")
+	ErrStatsRangeTooLong         = errors.New("range cannot be longer than 366 days")
+	ErrInvalidParent             = errors.New("parent can only contain uppercase letters")
+	ErrParentIsSegment           = errors.New("segment cannot be its own parent")
+	ErrRuleWithPercentage        = errors.New("rule and percentage cannot both be set")
+	ErrRuleWithParent            = errors.New("segment with a rule cannot have a parent")
+	ErrInvalidStartsAt           = errors.New("invalid starts at (RFC3339, e.g. 2023-11-24T00:00:00Z)")
+	ErrInvalidEndsAt             = errors.New("invalid ends at (RFC3339, e.g. 2023-11-27T00:00:00Z)")
+	ErrEndsAtBeforeStartsAt      = errors.New("ends at must be after starts at")
+	ErrEndsAtInPast              = errors.New("ends at must be in the future")
+)
+
+// SegmentToCreate holds fields of a new segment, all of them but Slug are optional.
+// StartsAt and EndsAt (RFC3339) bound the window when the segment takes effect.
+type SegmentToCreate struct {
+	Slug       string
+	Percentage string
+	Parent     string
+	Rule       string
+	StartsAt   string
+	EndsAt     string
+}
+
+// SegmentUpdate holds segment fields to change, nil fields stay as they are.
+// TrimAutoAdded defines what happens to auto added users when the percentage is lowered:
+// they are kept by default and lose the segment if they are out of the new percentage when set.
+type SegmentUpdate struct {
+	Percentage    *string
+	Description   *string
+	Owner         *string
+	TrimAutoAdded bool
+}
+
+const (
+	defaultSegmentsLimit = 20
+	maxSegmentsLimit     = 100
+
+	// defaultStatsDays is the number of days up to today in stats when the range isn't set.
+	defaultStatsDays = 30
+	maxStatsDays     = 366
 )
 
 var percentageValidFormat = regexp.MustCompile(`^\d+%$`)
@@ -29,9 +79,13 @@ func newSegmentService(segment storage.SegmentStorage) *segmentService {
 	return &segmentService{segment: segment}
 }
 
-func (s *segmentService) CreateSegment(ctx context.Context, slug string, percentageStr string) error {
-	slug = strings.TrimSpace(slug)
-	percentageStr = strings.TrimSpace(percentageStr)
+// CreateSegment creates the segment. A segment with a parent can only be assigned to users of the parent,
+// its auto add percentage applies within the parent's users. A segment with a rule is assigned to users
+// whose attributes match the rule, it has neither a percentage nor a parent. A segment with a window
+// is hidden from users and isn't auto added outside of it.
+func (s *segmentService) CreateSegment(ctx context.Context, segmentToCreate SegmentToCreate) error {
+	slug := strings.TrimSpace(segmentToCreate.Slug)
+	percentageStr := strings.TrimSpace(segmentToCreate.Percentage)
 
 	if slug == "" {
 		return custom_error.CustomError{
@@ -52,9 +106,29 @@ func (s *segmentService) CreateSegment(ctx context.Context, slug string, percent
 		return err
 	}
 
+	parent, err := validateParent(slug, segmentToCreate.Parent)
+	if err != nil {
+		return err
+	}
+
+	rule, err := validateRule(segmentToCreate.Rule, percentage, parent)
+	if err != nil {
+		return err
+	}
+
+	startsAt, endsAt, err := parseWindow(strings.TrimSpace(segmentToCreate.StartsAt), strings.TrimSpace(segmentToCreate.EndsAt), time.Now())
+	if err != nil {
+		return err
+	}
+
 	segment := models.Segment{
 		Slug:       slug,
 		Percentage: percentage,
+		Salt:       uuid.NewString(),
+		Parent:     parent,
+		Rule:       rule,
+		StartsAt:   startsAt,
+		EndsAt:     endsAt,
 	}
 
 	return s.segment.CreateSegment(ctx, segment)
@@ -97,6 +171,108 @@ func validatePercentage(percentageStr string) (int, error) {
 	return int(percentage), nil
 }
 
+func validateParent(slug, parent string) (string, error) {
+	parent = strings.TrimSpace(parent)
+
+	if strings.ToUpper(parent) != parent {
+		return "", custom_error.CustomError{
+			Field:   "parent",
+			Message: ErrInvalidParent.Error(),
+		}
+	}
+
+	if parent == slug {
+		return "", custom_error.CustomError{
+			Field:   "parent",
+			Message: ErrParentIsSegment.Error(),
+		}
+	}
+
+	return parent, nil
+}
+
+// validateRule parses the rule and returns it without surrounding spaces, an empty rule is valid.
+func validateRule(rule string, percentage int, parent string) (string, error) {
+	rule = strings.TrimSpace(rule)
+
+	if rule == "" {
+		return "", nil
+	}
+
+	if percentage > 0 {
+		return "", custom_error.CustomError{
+			Field:   "rule",
+			Message: ErrRuleWithPercentage.Error(),
+		}
+	}
+
+	if parent != "" {
+		return "", custom_error.CustomError{
+			Field:   "rule",
+			Message: ErrRuleWithParent.Error(),
+		}
+	}
+
+	parsed, err := segment_rule.Parse(rule)
+	if err != nil {
+		return "", custom_error.CustomError{
+			Field:   "rule",
+			Message: err.Error(),
+		}
+	}
+
+	return parsed.String(), nil
+}
+
+// parseWindow parses bounds of the window of a segment, a missing bound is nil. The window must end in the future.
+func parseWindow(startsAtStr, endsAtStr string, now time.Time) (*time.Time, *time.Time, error) {
+	var startsAt, endsAt *time.Time
+
+	if startsAtStr != "" {
+		parsed, err := time.Parse(time.RFC3339, startsAtStr)
+		if err != nil {
+			return nil, nil, custom_error.CustomError{
+				Field:   "starts_at",
+				Message: ErrInvalidStartsAt.Error(),
+			}
+		}
+		parsed = parsed.UTC()
+		startsAt = &parsed
+	}
+
+	if endsAtStr != "" {
+		parsed, err := time.Parse(time.RFC3339, endsAtStr)
+		if err != nil {
+			return nil, nil, custom_error.CustomError{
+				Field:   "ends_at",
+				Message: ErrInvalidEndsAt.Error(),
+			}
+		}
+		parsed = parsed.UTC()
+		endsAt = &parsed
+	}
+
+	if endsAt == nil {
+		return startsAt, nil, nil
+	}
+
+	if startsAt != nil && !endsAt.After(*startsAt) {
+		return nil, nil, custom_error.CustomError{
+			Field:   "ends_at",
+			Message: ErrEndsAtBeforeStartsAt.Error(),
+		}
+	}
+
+	if !endsAt.After(now) {
+		return nil, nil, custom_error.CustomError{
+			Field:   "ends_at",
+			Message: ErrEndsAtInPast.Error(),
+		}
+	}
+
+	return startsAt, endsAt, nil
+}
+
 func (s *segmentService) DeleteSegment(ctx context.Context, slug string) error {
 	slug = strings.TrimSpace(slug)
 
@@ -116,3 +292,262 @@ func (s *segmentService) DeleteSegment(ctx context.Context, slug string) error {
 
 	return s.segment.DeleteSegment(ctx, slug)
 }
+
+func (s *segmentService) GetSegments(ctx context.Context, prefix string, limit, offset int) ([]models.Segment, error) {
+	prefix = strings.TrimSpace(prefix)
+
+	if strings.ToUpper(prefix) != prefix {
+		return nil, custom_error.CustomError{
+			Field:   "prefix",
+			Message: ErrInvalidPrefix.Error(),
+		}
+	}
+
+	limit, err := validateLimit(limit, defaultSegmentsLimit, maxSegmentsLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < 0 {
+		return nil, custom_error.CustomError{
+			Field:   "offset",
+			Message: ErrInvalidOffset.Error(),
+		}
+	}
+
+	return s.segment.GetSegments(ctx, prefix, limit, offset)
+}
+
+// validateLimit returns defaultLimit for zero limit and checks that limit is within maxLimit.
+func validateLimit(limit, defaultLimit, maxLimit int) (int, error) {
+	if limit == 0 {
+		return defaultLimit, nil
+	}
+
+	if limit < 0 || limit > maxLimit {
+		return 0, custom_error.CustomError{
+			Field:   "limit",
+			Message: fmt.Sprintf("limit must be from 1 to %d inclusively", maxLimit),
+		}
+	}
+
+	return limit, nil
+}
+
+func (s *segmentService) GetSegment(ctx context.Context, slug string) (models.Segment, error) {
+	slug = strings.TrimSpace(slug)
+
+	if slug == "" {
+		return models.Segment{}, custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrEmptySlug.Error(),
+		}
+	}
+
+	if strings.ToUpper(slug) != slug {
+		return models.Segment{}, custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrInvalidSlugRepresentation.Error(),
+		}
+	}
+
+	return s.segment.GetSegment(ctx, slug)
+}
+
+func (s *segmentService) UpdateSegment(ctx context.Context, slug string, update SegmentUpdate) error {
+	slug = strings.TrimSpace(slug)
+
+	if slug == "" {
+		return custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrEmptySlug.Error(),
+		}
+	}
+
+	if strings.ToUpper(slug) != slug {
+		return custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrInvalidSlugRepresentation.Error(),
+		}
+	}
+
+	if update.Percentage == nil && update.Description == nil && update.Owner == nil {
+		return custom_error.CustomError{
+			Field:   "segment",
+			Message: ErrNothingToUpdate.Error(),
+		}
+	}
+
+	var segmentUpdate models.SegmentUpdate
+
+	if update.Percentage != nil {
+		percentage, err := validatePercentage(strings.TrimSpace(*update.Percentage))
+		if err != nil {
+			return err
+		}
+		segmentUpdate.Percentage = &percentage
+	}
+
+	if update.Description != nil {
+		description := strings.TrimSpace(*update.Description)
+		segmentUpdate.Description = &description
+	}
+
+	if update.Owner != nil {
+		owner := strings.TrimSpace(*update.Owner)
+		if len([]rune(owner)) > 255 {
+			return custom_error.CustomError{
+				Field:   "owner",
+				Message: ErrOwnerTooLong.Error(),
+			}
+		}
+		segmentUpdate.Owner = &owner
+	}
+
+	segmentUpdate.TrimAutoAdded = update.TrimAutoAdded
+
+	return s.segment.UpdateSegment(ctx, slug, segmentUpdate)
+}
+
+// GetSegmentStats returns the current number of users in the segment and its adds and deletes per day (UTC)
+// from the day from to the day to inclusively, both are year-month-day. The last 30 days are returned by default.
+func (s *segmentService) GetSegmentStats(ctx context.Context, slug, from, to string) (models.SegmentStats, error) {
+	slug = strings.TrimSpace(slug)
+
+	if slug == "" {
+		return models.SegmentStats{}, custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrEmptySlug.Error(),
+		}
+	}
+
+	if strings.ToUpper(slug) != slug {
+		return models.SegmentStats{}, custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrInvalidSlugRepresentation.Error(),
+		}
+	}
+
+	firstDay, lastDay, err := parseStatsRange(strings.TrimSpace(from), strings.TrimSpace(to), time.Now())
+	if err != nil {
+		return models.SegmentStats{}, err
+	}
+
+	stats, err := s.segment.GetSegmentStats(ctx, slug, firstDay, lastDay.AddDate(0, 0, 1))
+	if err != nil {
+		return models.SegmentStats{}, err
+	}
+
+	stats.Days = fillStatsDays(stats.Days, firstDay, lastDay)
+
+	return stats, nil
+}
+
+// RollupSegmentStats rolls up operations of finished days into daily stats of segments,
+// so stats are aggregated from operations of the current day only. It returns the number of rolled up days.
+func (s *segmentService) RollupSegmentStats(ctx context.Context) (int, error) {
+	return s.segment.RollupSegmentStats(ctx, time.Now().UTC())
+}
+
+// ApplySegmentWindows records window events of segments whose window opened or closed since the previous run,
+// it returns the number of such segments.
+func (s *segmentService) ApplySegmentWindows(ctx context.Context) (int, error) {
+	return s.segment.ApplySegmentWindows(ctx, time.Now().UTC())
+}
+
+// GetSegmentWindowEvents returns openings and closings of the window of the segment, the earliest first.
+func (s *segmentService) GetSegmentWindowEvents(ctx context.Context, slug string) ([]models.SegmentWindowEvent, error) {
+	slug = strings.TrimSpace(slug)
+
+	if slug == "" {
+		return nil, custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrEmptySlug.Error(),
+		}
+	}
+
+	if strings.ToUpper(slug) != slug {
+		return nil, custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrInvalidSlugRepresentation.Error(),
+		}
+	}
+
+	return s.segment.GetSegmentWindowEvents(ctx, slug)
+}
+
+// parseStatsRange returns the first and the last days of stats. A missing day is set
+// so the range is the default number of days, which end today if both are missing.
+func parseStatsRange(from, to string, now time.Time) (time.Time, time.Time, error) {
+	var firstDay, lastDay time.Time
+
+	if from != "" {
+		parsed, err := time.Parse(time.DateOnly, from)
+		if err != nil {
+			return time.Time{}, time.Time{}, custom_error.CustomError{
+				Field:   "from",
+				Message: ErrParsingStatsFrom.Error(),
+			}
+		}
+		firstDay = parsed
+	}
+
+	if to != "" {
+		parsed, err := time.Parse(time.DateOnly, to)
+		if err != nil {
+			return time.Time{}, time.Time{}, custom_error.CustomError{
+				Field:   "to",
+				Message: ErrParsingStatsTo.Error(),
+			}
+		}
+		lastDay = parsed
+	}
+
+	switch {
+	case from == "" && to == "":
+		year, month, day := now.UTC().Date()
+		lastDay = time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+		firstDay = lastDay.AddDate(0, 0, 1-defaultStatsDays)
+	case from == "":
+		firstDay = lastDay.AddDate(0, 0, 1-defaultStatsDays)
+	case to == "":
+		lastDay = firstDay.AddDate(0, 0, defaultStatsDays-1)
+	}
+
+	if firstDay.After(lastDay) {
+		return time.Time{}, time.Time{}, custom_error.CustomError{
+			Field:   "from",
+			Message: ErrStatsFromAfterTo.Error(),
+		}
+	}
+
+	if lastDay.Sub(firstDay) >= maxStatsDays*24*time.Hour {
+		return time.Time{}, time.Time{}, custom_error.CustomError{
+			Field:   "to",
+			Message: ErrStatsRangeTooLong.Error(),
+		}
+	}
+
+	return firstDay, lastDay, nil
+}
+
+// fillStatsDays returns stats of every day from firstDay to lastDay, days missing in sorted days have no changes.
+func fillStatsDays(days []models.SegmentDayStats, firstDay, lastDay time.Time) []models.SegmentDayStats {
+	filled := make([]models.SegmentDayStats, 0, int(lastDay.Sub(firstDay)/(24*time.Hour))+1)
+
+	i := 0
+	for day := firstDay; !day.After(lastDay); day = day.AddDate(0, 0, 1) {
+		for i < len(days) && days[i].Day.Before(day) {
+			i++
+		}
+
+		if i < len(days) && days[i].Day.Equal(day) {
+			filled = append(filled, days[i])
+			continue
+		}
+
+		filled = append(filled, models.SegmentDayStats{Day: day})
+	}
+
+	return filled
+}
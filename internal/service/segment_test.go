@@ -2,8 +2,10 @@ package service
 
 import (
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestValidatePercentage(t *testing.T) {
@@ -72,3 +74,350 @@ func TestValidatePercentage(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateParent(t *testing.T) {
+	testCases := []struct {
+		name           string
+		inputSlug      string
+		inputParent    string
+		expectedOutput string
+		expectedError  error
+	}{
+		{
+			name:           "valid parent",
+			inputSlug:      "VOICE_MESSAGES_BETA",
+			inputParent:    " BETA_TESTERS ",
+			expectedOutput: "BETA_TESTERS",
+		},
+		{
+			name:           "no parent",
+			inputSlug:      "VOICE_MESSAGES_BETA",
+			inputParent:    "",
+			expectedOutput: "",
+		},
+		{
+			name:        "parent in lowercase",
+			inputSlug:   "VOICE_MESSAGES_BETA",
+			inputParent: "beta_testers",
+			expectedError: custom_error.CustomError{
+				Field:   "parent",
+				Message: ErrInvalidParent.Error(),
+			},
+		},
+		{
+			name:        "parent is the segment",
+			inputSlug:   "BETA_TESTERS",
+			inputParent: "BETA_TESTERS",
+			expectedError: custom_error.CustomError{
+				Field:   "parent",
+				Message: ErrParentIsSegment.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualOutput, actualError := validateParent(tc.inputSlug, tc.inputParent)
+			require.Equal(t, tc.expectedOutput, actualOutput)
+			require.ErrorIs(t, actualError, tc.expectedError)
+		})
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	testCases := []struct {
+		name            string
+		inputRule       string
+		inputPercentage int
+		inputParent     string
+		expectedOutput  string
+		expectedError   error
+	}{
+		{
+			name:           "valid rule",
+			inputRule:      ` country == "RU" && age >= 18 `,
+			expectedOutput: `country == "RU" && age >= 18`,
+		},
+		{
+			name:            "no rule",
+			inputRule:       " ",
+			inputPercentage: 10,
+			expectedOutput:  "",
+		},
+		{
+			name:            "rule with percentage",
+			inputRule:       "age >= 18",
+			inputPercentage: 10,
+			expectedError: custom_error.CustomError{
+				Field:   "rule",
+				Message: ErrRuleWithPercentage.Error(),
+			},
+		},
+		{
+			name:        "rule with parent",
+			inputRule:   "age >= 18",
+			inputParent: "BETA_TESTERS",
+			expectedError: custom_error.CustomError{
+				Field:   "rule",
+				Message: ErrRuleWithParent.Error(),
+			},
+		},
+		{
+			name:      "invalid rule",
+			inputRule: `country > "RU"`,
+			expectedError: custom_error.CustomError{
+				Field:   "rule",
+				Message: "> compares only numbers at position 11",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualOutput, actualError := validateRule(tc.inputRule, tc.inputPercentage, tc.inputParent)
+			require.Equal(t, tc.expectedOutput, actualOutput)
+			require.ErrorIs(t, actualError, tc.expectedError)
+		})
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	now := time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)
+	startsAt := time.Date(2023, 11, 24, 0, 0, 0, 0, time.UTC)
+	endsAt := time.Date(2023, 11, 27, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name             string
+		inputStartsAt    string
+		inputEndsAt      string
+		expectedStartsAt *time.Time
+		expectedEndsAt   *time.Time
+		expectedError    error
+	}{
+		{
+			name:             "start and end",
+			inputStartsAt:    "2023-11-24T03:00:00+03:00",
+			inputEndsAt:      "2023-11-27T00:00:00Z",
+			expectedStartsAt: &startsAt,
+			expectedEndsAt:   &endsAt,
+		},
+		{
+			name: "no window",
+		},
+		{
+			name:             "start in the past without end",
+			inputStartsAt:    "2023-10-01T00:00:00Z",
+			expectedStartsAt: func() *time.Time { t := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC); return &t }(),
+		},
+		{
+			name:          "invalid start",
+			inputStartsAt: "2023-11-24",
+			expectedError: custom_error.CustomError{
+				Field:   "starts_at",
+				Message: ErrInvalidStartsAt.Error(),
+			},
+		},
+		{
+			name:        "invalid end",
+			inputEndsAt: "tomorrow",
+			expectedError: custom_error.CustomError{
+				Field:   "ends_at",
+				Message: ErrInvalidEndsAt.Error(),
+			},
+		},
+		{
+			name:          "end before start",
+			inputStartsAt: "2023-11-27T00:00:00Z",
+			inputEndsAt:   "2023-11-24T00:00:00Z",
+			expectedError: custom_error.CustomError{
+				Field:   "ends_at",
+				Message: ErrEndsAtBeforeStartsAt.Error(),
+			},
+		},
+		{
+			name:        "end in the past",
+			inputEndsAt: "2023-10-01T00:00:00Z",
+			expectedError: custom_error.CustomError{
+				Field:   "ends_at",
+				Message: ErrEndsAtInPast.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualStartsAt, actualEndsAt, actualError := parseWindow(tc.inputStartsAt, tc.inputEndsAt, now)
+			require.Equal(t, tc.expectedStartsAt, actualStartsAt)
+			require.Equal(t, tc.expectedEndsAt, actualEndsAt)
+			require.ErrorIs(t, actualError, tc.expectedError)
+		})
+	}
+}
+
+func TestValidateLimit(t *testing.T) {
+	testCases := []struct {
+		name           string
+		input          int
+		expectedOutput int
+		expectedError  error
+	}{
+		{
+			name:           "valid limit",
+			input:          50,
+			expectedOutput: 50,
+			expectedError:  nil,
+		},
+		{
+			name:           "zero limit uses default",
+			input:          0,
+			expectedOutput: defaultSegmentsLimit,
+			expectedError:  nil,
+		},
+		{
+			name:           "negative limit",
+			input:          -1,
+			expectedOutput: 0,
+			expectedError: custom_error.CustomError{
+				Field:   "limit",
+				Message: "limit must be from 1 to 100 inclusively",
+			},
+		},
+		{
+			name:           "limit more than max",
+			input:          maxSegmentsLimit + 1,
+			expectedOutput: 0,
+			expectedError: custom_error.CustomError{
+				Field:   "limit",
+				Message: "limit must be from 1 to 100 inclusively",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualOutput, actualError := validateLimit(tc.input, defaultSegmentsLimit, maxSegmentsLimit)
+			require.Equal(t, tc.expectedOutput, actualOutput)
+			require.ErrorIs(t, actualError, tc.expectedError)
+		})
+	}
+}
+
+func TestParseStatsRange(t *testing.T) {
+	now := time.Date(2023, 8, 31, 23, 0, 0, 0, time.FixedZone("UTC-3", -3*60*60))
+
+	testCases := []struct {
+		name             string
+		inputFrom        string
+		inputTo          string
+		expectedFirstDay time.Time
+		expectedLastDay  time.Time
+		expectedError    error
+	}{
+		{
+			name:             "range",
+			inputFrom:        "2023-08-01",
+			inputTo:          "2023-08-10",
+			expectedFirstDay: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+			expectedLastDay:  time.Date(2023, 8, 10, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:             "one day",
+			inputFrom:        "2023-08-01",
+			inputTo:          "2023-08-01",
+			expectedFirstDay: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+			expectedLastDay:  time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:             "default range ends today (UTC)",
+			expectedFirstDay: time.Date(2023, 8, 3, 0, 0, 0, 0, time.UTC),
+			expectedLastDay:  time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:             "only from",
+			inputFrom:        "2023-08-01",
+			expectedFirstDay: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+			expectedLastDay:  time.Date(2023, 8, 30, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:             "only to",
+			inputTo:          "2023-08-30",
+			expectedFirstDay: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+			expectedLastDay:  time.Date(2023, 8, 30, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "invalid from",
+			inputFrom: "2023-08-01T00:00:00Z",
+			expectedError: custom_error.CustomError{
+				Field:   "from",
+				Message: ErrParsingStatsFrom.Error(),
+			},
+		},
+		{
+			name:    "invalid to",
+			inputTo: "31.08.2023",
+			expectedError: custom_error.CustomError{
+				Field:   "to",
+				Message: ErrParsingStatsTo.Error(),
+			},
+		},
+		{
+			name:      "from after to",
+			inputFrom: "2023-08-02",
+			inputTo:   "2023-08-01",
+			expectedError: custom_error.CustomError{
+				Field:   "from",
+				Message: ErrStatsFromAfterTo.Error(),
+			},
+		},
+		{
+			name:             "max range",
+			inputFrom:        "2023-01-01",
+			inputTo:          "2024-01-01",
+			expectedFirstDay: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+			expectedLastDay:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "range too long",
+			inputFrom: "2023-01-01",
+			inputTo:   "2024-01-02",
+			expectedError: custom_error.CustomError{
+				Field:   "to",
+				Message: ErrStatsRangeTooLong.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			firstDay, lastDay, err := parseStatsRange(tc.inputFrom, tc.inputTo, now)
+			require.ErrorIs(t, err, tc.expectedError)
+			require.Equal(t, tc.expectedFirstDay, firstDay)
+			require.Equal(t, tc.expectedLastDay, lastDay)
+		})
+	}
+}
+
+func TestFillStatsDays(t *testing.T) {
+	firstDay := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	lastDay := time.Date(2023, 8, 4, 0, 0, 0, 0, time.UTC)
+
+	days := []models.SegmentDayStats{
+		{Day: firstDay.AddDate(0, 0, 1), ManualAdds: 3, AutoAdds: 1},
+		{Day: lastDay, Deletes: 2},
+	}
+
+	expectedDays := []models.SegmentDayStats{
+		{Day: firstDay},
+		{Day: firstDay.AddDate(0, 0, 1), ManualAdds: 3, AutoAdds: 1},
+		{Day: firstDay.AddDate(0, 0, 2)},
+		{Day: lastDay, Deletes: 2},
+	}
+
+	require.Equal(t, expectedDays, fillStatsDays(days, firstDay, lastDay))
+	require.Len(t, fillStatsDays(nil, firstDay, firstDay), 1)
+}
@@ -4,40 +4,82 @@ package service
 
 import (
 	"context"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/report_store"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/storage"
+	"time"
 )
 
 type Segment interface {
-	CreateSegment(ctx context.Context, slug string, percentageStr string) error
+	CreateSegment(ctx context.Context, segment SegmentToCreate) error
 	DeleteSegment(ctx context.Context, slug string) error
+	GetSegments(ctx context.Context, prefix string, limit, offset int) ([]models.Segment, error)
+	GetSegment(ctx context.Context, slug string) (models.Segment, error)
+	UpdateSegment(ctx context.Context, slug string, update SegmentUpdate) error
+	GetSegmentStats(ctx context.Context, slug, from, to string) (models.SegmentStats, error)
+	RollupSegmentStats(ctx context.Context) (int, error)
+	ApplySegmentWindows(ctx context.Context) (int, error)
+	GetSegmentWindowEvents(ctx context.Context, slug string) ([]models.SegmentWindowEvent, error)
+}
+
+type Experiment interface {
+	CreateExperiment(ctx context.Context, slug string, variants []models.ExperimentVariant) error
+	GetExperiment(ctx context.Context, slug string) (models.Experiment, error)
+	DeleteExperiment(ctx context.Context, slug string) error
+}
+
+type ExclusionGroup interface {
+	CreateExclusionGroup(ctx context.Context, slug string, segments []string) error
+	GetExclusionGroup(ctx context.Context, slug string) (models.ExclusionGroup, error)
+	DeleteExclusionGroup(ctx context.Context, slug string) error
 }
 
 type User interface {
-	UpdateUserSegments(ctx context.Context, segmentsToAdd, segmentsToDelete []string, userID int) error
+	CreateUser(ctx context.Context, userID int) error
+	DeleteUser(ctx context.Context, userID int) error
+	UpdateUserSegments(ctx context.Context, segmentsToAdd []SegmentToAdd, segmentsToDelete []string, userID int) error
+	BulkUpdateUserSegments(ctx context.Context, segmentsToAdd []SegmentToAdd, segmentsToDelete []string, userIDs []int) ([]models.BulkUserResult, error)
 	GetActiveSegments(ctx context.Context, userID int) ([]string, error)
-	AutoAddSegments(ctx context.Context) error
+	AutoAddSegments(ctx context.Context) (bool, error)
+	DeleteExpiredSegments(ctx context.Context) error
+	GetSegmentUsers(ctx context.Context, slug, cursor string, limit int) ([]models.UserSegment, string, error)
+	SetUserAttributes(ctx context.Context, userID int, attributes map[string]any) error
 }
 
 type Operations interface {
-	CreateCSVReportAndURL(ctx context.Context, date string) (string, error)
+	CreateReport(ctx context.Context, request ReportRequest) (string, error)
+	GetReport(ctx context.Context, id string) (models.Report, error)
+	ProcessReport(ctx context.Context) (bool, error)
+	DeleteReport(ctx context.Context, id string) error
+	DeleteExpiredReports(ctx context.Context) (int, error)
+	SetMissingReportsExpiry(ctx context.Context) (int, error)
+	GetUserHistory(ctx context.Context, userID int, request HistoryRequest) ([]models.Operation, string, error)
+	GetUserSegmentsAt(ctx context.Context, userID int, at string) ([]string, error)
+	SnapshotUserSegments(ctx context.Context) (int, error)
 }
 
 type Services interface {
 	Segment
+	Experiment
+	ExclusionGroup
 	User
 	Operations
 }
 
 type Service struct {
 	Segment
+	Experiment
+	ExclusionGroup
 	User
 	Operations
 }
 
-func NewService(storage storage.Storage, pathToReports string) *Service {
+func NewService(storage storage.Storage, reportStore report_store.ReportStore, reportRetention time.Duration) *Service {
 	return &Service{
 		newSegmentService(storage),
+		newExperimentService(storage),
+		newExclusionGroupService(storage),
 		newUserService(storage),
-		newOperationService(storage, pathToReports),
+		newOperationService(storage, storage, reportStore, reportRetention),
 	}
 }
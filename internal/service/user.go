@@ -2,18 +2,52 @@ package service
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/segment_rule"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/storage"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	ErrBothEmptySegments            = errors.New("segments to add and segments to delete cannot both be empty")
 	ErrInvalidSegmentRepresentation = errors.New("segment can only contain uppercase letters")
 	ErrInvalidUserID                = errors.New("user id can be only positive number")
+	ErrBothExpiresAtAndTTL          = errors.New("expires at and ttl cannot both be set")
+	ErrInvalidExpiresAt             = errors.New("invalid expires at (RFC3339, e.g. 2023-09-01T00:00:00Z)")
+	ErrInvalidTTL                   = errors.New("invalid ttl (format 1h2m3s, must be only positive)")
+	ErrExpiresAtInPast              = errors.New("expires at must be in the future")
+	ErrInvalidCursor                = errors.New("invalid cursor")
+	ErrEmptyUserIDs                 = errors.New("user ids cannot be empty")
+	ErrTooManyUserIDs               = errors.New("too many user ids (max 100000)")
+	ErrSegmentToAddAndDelete        = errors.New("segment cannot be both added and deleted")
+	ErrDuplicateSegment             = errors.New("segment cannot be passed more than once")
+	ErrTooManyAttributes            = errors.New("too many attributes (max 50)")
+	ErrInvalidAttributeName         = errors.New("attribute name can only contain lowercase letters, digits and underscores and cannot start with a digit")
+	ErrInvalidAttributeValue        = errors.New("attribute value can only be a string, a number or a bool")
+	ErrAttributeValueTooLong        = errors.New("attribute value cannot be longer than 255 characters")
 )
 
+const (
+	defaultSegmentUsersLimit = 100
+	maxSegmentUsersLimit     = 1000
+	maxBulkUsers             = 100000
+	maxUserAttributes        = 50
+	maxAttributeValueLength  = 255
+)
+
+// SegmentToAdd is a segment to add to the user. ExpiresAt (RFC3339) and TTL (e.g. 72h)
+// are optional and mutually exclusive, without them the segment is added forever.
+type SegmentToAdd struct {
+	Slug      string
+	ExpiresAt string
+	TTL       string
+}
+
 type userService struct {
 	user storage.UserStorage
 }
@@ -22,7 +56,7 @@ func newUserService(user storage.UserStorage) *userService {
 	return &userService{user: user}
 }
 
-func (u *userService) UpdateUserSegments(ctx context.Context, segmentsToAdd, segmentsToDelete []string, userID int) error {
+func (u *userService) CreateUser(ctx context.Context, userID int) error {
 	if userID <= 0 {
 		return custom_error.CustomError{
 			Field:   "user_id",
@@ -30,32 +64,189 @@ func (u *userService) UpdateUserSegments(ctx context.Context, segmentsToAdd, seg
 		}
 	}
 
-	if len(segmentsToAdd) == 0 && len(segmentsToDelete) == 0 {
+	return u.user.CreateUser(ctx, userID)
+}
+
+func (u *userService) DeleteUser(ctx context.Context, userID int) error {
+	if userID <= 0 {
+		return custom_error.CustomError{
+			Field:   "id",
+			Message: ErrInvalidUserID.Error(),
+		}
+	}
+
+	return u.user.DeleteUser(ctx, userID)
+}
+
+func (u *userService) UpdateUserSegments(ctx context.Context, segmentsToAdd []SegmentToAdd, segmentsToDelete []string, userID int) error {
+	if userID <= 0 {
 		return custom_error.CustomError{
+			Field:   "user_id",
+			Message: ErrInvalidUserID.Error(),
+		}
+	}
+
+	userSegmentsToAdd, err := validateUserSegments(segmentsToAdd, segmentsToDelete)
+	if err != nil {
+		return err
+	}
+
+	return u.user.UpdateUserSegments(ctx, userSegmentsToAdd, segmentsToDelete, userID)
+}
+
+func (u *userService) BulkUpdateUserSegments(ctx context.Context, segmentsToAdd []SegmentToAdd, segmentsToDelete []string, userIDs []int) ([]models.BulkUserResult, error) {
+	if len(userIDs) == 0 {
+		return nil, custom_error.CustomError{
+			Field:   "user_ids",
+			Message: ErrEmptyUserIDs.Error(),
+		}
+	}
+
+	if len(userIDs) > maxBulkUsers {
+		return nil, custom_error.CustomError{
+			Field:   "user_ids",
+			Message: ErrTooManyUserIDs.Error(),
+		}
+	}
+
+	uniqueUserIDs := make([]int, 0, len(userIDs))
+	seen := make(map[int]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		if userID <= 0 {
+			return nil, custom_error.CustomError{
+				Field:   "user_ids",
+				Message: ErrInvalidUserID.Error(),
+			}
+		}
+		if _, ok := seen[userID]; ok {
+			continue
+		}
+		seen[userID] = struct{}{}
+		uniqueUserIDs = append(uniqueUserIDs, userID)
+	}
+
+	userSegmentsToAdd, err := validateUserSegments(segmentsToAdd, segmentsToDelete)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.user.BulkUpdateUserSegments(ctx, userSegmentsToAdd, segmentsToDelete, uniqueUserIDs)
+}
+
+// validateUserSegments checks segments to add and delete and resolves expiration of segments to add.
+// It is shared by the single user and the bulk update, so both reject a segment passed twice in the same list
+// or passed both to add and to delete, otherwise it would be changed twice in one update.
+func validateUserSegments(segmentsToAdd []SegmentToAdd, segmentsToDelete []string) ([]models.UserSegment, error) {
+	if len(segmentsToAdd) == 0 && len(segmentsToDelete) == 0 {
+		return nil, custom_error.CustomError{
 			Field:   "segments",
 			Message: ErrBothEmptySegments.Error(),
 		}
 	}
 
+	now := time.Now().UTC()
+
+	userSegmentsToAdd := make([]models.UserSegment, 0, len(segmentsToAdd))
+	seen := make(map[string]struct{}, len(segmentsToAdd))
 	for _, segment := range segmentsToAdd {
-		if strings.ToUpper(segment) != segment {
-			return custom_error.CustomError{
+		if strings.ToUpper(segment.Slug) != segment.Slug {
+			return nil, custom_error.CustomError{
 				Field:   "segment to add",
 				Message: ErrInvalidSegmentRepresentation.Error(),
 			}
 		}
+		if _, ok := seen[segment.Slug]; ok {
+			return nil, custom_error.CustomError{
+				Field:   "segment to add",
+				Message: ErrDuplicateSegment.Error(),
+			}
+		}
+		seen[segment.Slug] = struct{}{}
+
+		expiresAt, err := parseExpiration(segment.ExpiresAt, segment.TTL, now)
+		if err != nil {
+			return nil, err
+		}
+
+		userSegmentsToAdd = append(userSegmentsToAdd, models.UserSegment{
+			Slug:      segment.Slug,
+			ExpiresAt: expiresAt,
+		})
 	}
 
+	seen = make(map[string]struct{}, len(segmentsToDelete))
 	for _, segment := range segmentsToDelete {
 		if strings.ToUpper(segment) != segment {
-			return custom_error.CustomError{
+			return nil, custom_error.CustomError{
 				Field:   "segment to delete",
 				Message: ErrInvalidSegmentRepresentation.Error(),
 			}
 		}
+		if _, ok := seen[segment]; ok {
+			return nil, custom_error.CustomError{
+				Field:   "segment to delete",
+				Message: ErrDuplicateSegment.Error(),
+			}
+		}
+		seen[segment] = struct{}{}
+	}
+
+	for _, segment := range userSegmentsToAdd {
+		if _, ok := seen[segment.Slug]; ok {
+			return nil, custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrSegmentToAddAndDelete.Error(),
+			}
+		}
+	}
+
+	return userSegmentsToAdd, nil
+}
+
+func parseExpiration(expiresAtStr, ttlStr string, now time.Time) (*time.Time, error) {
+	expiresAtStr = strings.TrimSpace(expiresAtStr)
+	ttlStr = strings.TrimSpace(ttlStr)
+
+	if expiresAtStr != "" && ttlStr != "" {
+		return nil, custom_error.CustomError{
+			Field:   "segment to add",
+			Message: ErrBothExpiresAtAndTTL.Error(),
+		}
+	}
+
+	var expiresAt time.Time
+
+	switch {
+	case expiresAtStr != "":
+		parsedExpiresAt, err := time.Parse(time.RFC3339, expiresAtStr)
+		if err != nil {
+			return nil, custom_error.CustomError{
+				Field:   "expires_at",
+				Message: ErrInvalidExpiresAt.Error(),
+			}
+		}
+		expiresAt = parsedExpiresAt.UTC()
+	case ttlStr != "":
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil || ttl <= 0 {
+			return nil, custom_error.CustomError{
+				Field:   "ttl",
+				Message: ErrInvalidTTL.Error(),
+			}
+		}
+		expiresAt = now.Add(ttl)
+	default:
+		return nil, nil
+	}
+
+	if !expiresAt.After(now) {
+		return nil, custom_error.CustomError{
+			Field:   "expires_at",
+			Message: ErrExpiresAtInPast.Error(),
+		}
 	}
 
-	return u.user.UpdateUserSegments(ctx, segmentsToAdd, segmentsToDelete, userID)
+	return &expiresAt, nil
 }
 
 func (u *userService) GetActiveSegments(ctx context.Context, userID int) ([]string, error) {
@@ -69,6 +260,139 @@ func (u *userService) GetActiveSegments(ctx context.Context, userID int) ([]stri
 	return u.user.GetActiveSegments(ctx, userID)
 }
 
-func (u *userService) AutoAddSegments(ctx context.Context) error {
+// AutoAddSegments runs the auto add job, false is returned when another instance is already running it.
+func (u *userService) AutoAddSegments(ctx context.Context) (bool, error) {
 	return u.user.AutoAddUserSegments(ctx)
 }
+
+func (u *userService) DeleteExpiredSegments(ctx context.Context) error {
+	return u.user.DeleteExpiredUserSegments(ctx)
+}
+
+// GetSegmentUsers returns a page of users in the segment ordered by user id and the cursor of the next page.
+// The next cursor is empty when there are no more users.
+func (u *userService) GetSegmentUsers(ctx context.Context, slug, cursor string, limit int) ([]models.UserSegment, string, error) {
+	slug = strings.TrimSpace(slug)
+
+	if slug == "" {
+		return nil, "", custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrEmptySlug.Error(),
+		}
+	}
+
+	if strings.ToUpper(slug) != slug {
+		return nil, "", custom_error.CustomError{
+			Field:   "slug",
+			Message: ErrInvalidSlugRepresentation.Error(),
+		}
+	}
+
+	limit, err := validateLimit(limit, defaultSegmentUsersLimit, maxSegmentUsersLimit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	afterUserID, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	users, err := u.user.GetSegmentUsers(ctx, slug, afterUserID, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var nextCursor string
+	if len(users) == limit {
+		nextCursor = encodeCursor(users[len(users)-1].UserID)
+	}
+
+	return users, nextCursor, nil
+}
+
+// SetUserAttributes replaces attributes of the user, which rule segments are assigned by.
+// Values are strings, numbers and bools.
+func (u *userService) SetUserAttributes(ctx context.Context, userID int, attributes map[string]any) error {
+	if userID <= 0 {
+		return custom_error.CustomError{
+			Field:   "id",
+			Message: ErrInvalidUserID.Error(),
+		}
+	}
+
+	if attributes == nil {
+		attributes = make(map[string]any)
+	}
+
+	err := validateAttributes(attributes)
+	if err != nil {
+		return err
+	}
+
+	return u.user.SetUserAttributes(ctx, userID, attributes)
+}
+
+func validateAttributes(attributes map[string]any) error {
+	if len(attributes) > maxUserAttributes {
+		return custom_error.CustomError{
+			Field:   "attributes",
+			Message: ErrTooManyAttributes.Error(),
+		}
+	}
+
+	for name, value := range attributes {
+		if !segment_rule.IsAttributeName(name) {
+			return custom_error.CustomError{
+				Field:   "attributes",
+				Message: ErrInvalidAttributeName.Error(),
+			}
+		}
+
+		switch value := value.(type) {
+		case float64, bool:
+		case string:
+			if len([]rune(value)) > maxAttributeValueLength {
+				return custom_error.CustomError{
+					Field:   "attributes",
+					Message: ErrAttributeValueTooLong.Error(),
+				}
+			}
+		default:
+			return custom_error.CustomError{
+				Field:   "attributes",
+				Message: ErrInvalidAttributeValue.Error(),
+			}
+		}
+	}
+
+	return nil
+}
+
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, custom_error.CustomError{
+			Field:   "cursor",
+			Message: ErrInvalidCursor.Error(),
+		}
+	}
+
+	id, err := strconv.Atoi(string(decoded))
+	if err != nil || id < 0 {
+		return 0, custom_error.CustomError{
+			Field:   "cursor",
+			Message: ErrInvalidCursor.Error(),
+		}
+	}
+
+	return id, nil
+}
@@ -0,0 +1,337 @@
+package service
+
+import (
+	"context"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpiration(t *testing.T) {
+	now := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	inThreeDays := now.Add(72 * time.Hour)
+
+	testCases := []struct {
+		name           string
+		inputExpiresAt string
+		inputTTL       string
+		expectedOutput *time.Time
+		expectedError  error
+	}{
+		{
+			name:           "without expiration",
+			expectedOutput: nil,
+			expectedError:  nil,
+		},
+		{
+			name:           "valid ttl",
+			inputTTL:       "72h",
+			expectedOutput: &inThreeDays,
+			expectedError:  nil,
+		},
+		{
+			name:           "valid expires at",
+			inputExpiresAt: "2023-08-04T03:00:00+03:00",
+			expectedOutput: &inThreeDays,
+			expectedError:  nil,
+		},
+		{
+			name:           "both expires at and ttl",
+			inputExpiresAt: "2023-08-04T00:00:00Z",
+			inputTTL:       "72h",
+			expectedOutput: nil,
+			expectedError: custom_error.CustomError{
+				Field:   "segment to add",
+				Message: ErrBothExpiresAtAndTTL.Error(),
+			},
+		},
+		{
+			name:           "invalid expires at format",
+			inputExpiresAt: "2023-08-04",
+			expectedOutput: nil,
+			expectedError: custom_error.CustomError{
+				Field:   "expires_at",
+				Message: ErrInvalidExpiresAt.Error(),
+			},
+		},
+		{
+			name:           "negative ttl",
+			inputTTL:       "-1h",
+			expectedOutput: nil,
+			expectedError: custom_error.CustomError{
+				Field:   "ttl",
+				Message: ErrInvalidTTL.Error(),
+			},
+		},
+		{
+			name:           "expires at in the past",
+			inputExpiresAt: "2023-07-01T00:00:00Z",
+			expectedOutput: nil,
+			expectedError: custom_error.CustomError{
+				Field:   "expires_at",
+				Message: ErrExpiresAtInPast.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualOutput, actualError := parseExpiration(tc.inputExpiresAt, tc.inputTTL, now)
+			require.ErrorIs(t, actualError, tc.expectedError)
+			if tc.expectedOutput == nil {
+				require.Nil(t, actualOutput)
+				return
+			}
+			require.NotNil(t, actualOutput)
+			require.True(t, tc.expectedOutput.Equal(*actualOutput))
+		})
+	}
+}
+
+func TestValidateUserSegments(t *testing.T) {
+	testCases := []struct {
+		name                  string
+		inputSegmentsToAdd    []SegmentToAdd
+		inputSegmentsToDelete []string
+		expectedOutput        []models.UserSegment
+		expectedError         error
+	}{
+		{
+			name:                  "valid segments",
+			inputSegmentsToAdd:    []SegmentToAdd{{Slug: "AVITO"}, {Slug: "AVITO_PROMO"}},
+			inputSegmentsToDelete: []string{"AVITO_TEST"},
+			expectedOutput:        []models.UserSegment{{Slug: "AVITO"}, {Slug: "AVITO_PROMO"}},
+		},
+		{
+			name:               "duplicate segment to add",
+			inputSegmentsToAdd: []SegmentToAdd{{Slug: "AVITO"}, {Slug: "AVITO", TTL: "72h"}},
+			expectedError: custom_error.CustomError{
+				Field:   "segment to add",
+				Message: ErrDuplicateSegment.Error(),
+			},
+		},
+		{
+			name:                  "duplicate segment to delete",
+			inputSegmentsToDelete: []string{"AVITO", "AVITO"},
+			expectedError: custom_error.CustomError{
+				Field:   "segment to delete",
+				Message: ErrDuplicateSegment.Error(),
+			},
+		},
+		{
+			name:                  "segment to add and delete",
+			inputSegmentsToAdd:    []SegmentToAdd{{Slug: "AVITO"}},
+			inputSegmentsToDelete: []string{"AVITO"},
+			expectedError: custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrSegmentToAddAndDelete.Error(),
+			},
+		},
+		{
+			name:                  "lowercase segment to delete",
+			inputSegmentsToDelete: []string{"avito"},
+			expectedError: custom_error.CustomError{
+				Field:   "segment to delete",
+				Message: ErrInvalidSegmentRepresentation.Error(),
+			},
+		},
+		{
+			name: "both empty",
+			expectedError: custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrBothEmptySegments.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualOutput, actualError := validateUserSegments(tc.inputSegmentsToAdd, tc.inputSegmentsToDelete)
+			require.ErrorIs(t, actualError, tc.expectedError)
+			if tc.expectedError != nil {
+				require.Nil(t, actualOutput)
+				return
+			}
+			require.Equal(t, tc.expectedOutput, actualOutput)
+		})
+	}
+}
+
+func TestUpdateUserSegmentsInvalidSegments(t *testing.T) {
+	// the storage isn't reached, a single user update is validated as the bulk one
+	u := newUserService(nil)
+
+	testCases := []struct {
+		name             string
+		segmentsToAdd    []SegmentToAdd
+		segmentsToDelete []string
+		expectedError    error
+	}{
+		{
+			name:          "duplicate segment to add",
+			segmentsToAdd: []SegmentToAdd{{Slug: "AVITO"}, {Slug: "AVITO"}},
+			expectedError: custom_error.CustomError{
+				Field:   "segment to add",
+				Message: ErrDuplicateSegment.Error(),
+			},
+		},
+		{
+			name:             "duplicate segment to delete",
+			segmentsToDelete: []string{"AVITO", "AVITO"},
+			expectedError: custom_error.CustomError{
+				Field:   "segment to delete",
+				Message: ErrDuplicateSegment.Error(),
+			},
+		},
+		{
+			name:             "segment to add and delete",
+			segmentsToAdd:    []SegmentToAdd{{Slug: "AVITO"}},
+			segmentsToDelete: []string{"AVITO"},
+			expectedError: custom_error.CustomError{
+				Field:   "segments",
+				Message: ErrSegmentToAddAndDelete.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := u.UpdateUserSegments(context.Background(), tc.segmentsToAdd, tc.segmentsToDelete, 1)
+			require.ErrorIs(t, err, tc.expectedError)
+		})
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	testCases := []struct {
+		name           string
+		input          string
+		expectedOutput int
+		expectedError  error
+	}{
+		{
+			name:           "empty cursor",
+			input:          "",
+			expectedOutput: 0,
+			expectedError:  nil,
+		},
+		{
+			name:           "valid cursor",
+			input:          encodeCursor(42),
+			expectedOutput: 42,
+			expectedError:  nil,
+		},
+		{
+			name:           "invalid base64",
+			input:          "!!!",
+			expectedOutput: 0,
+			expectedError: custom_error.CustomError{
+				Field:   "cursor",
+				Message: ErrInvalidCursor.Error(),
+			},
+		},
+		{
+			name:           "not a number",
+			input:          "dGVzdA",
+			expectedOutput: 0,
+			expectedError: custom_error.CustomError{
+				Field:   "cursor",
+				Message: ErrInvalidCursor.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualOutput, actualError := decodeCursor(tc.input)
+			require.Equal(t, tc.expectedOutput, actualOutput)
+			require.ErrorIs(t, actualError, tc.expectedError)
+		})
+	}
+}
+
+func TestValidateAttributes(t *testing.T) {
+	tooMany := make(map[string]any, maxUserAttributes+1)
+	for i := 0; i <= maxUserAttributes; i++ {
+		tooMany["attribute_"+strconv.Itoa(i)] = true
+	}
+
+	testCases := []struct {
+		name          string
+		input         map[string]any
+		expectedError error
+	}{
+		{
+			name:  "valid attributes",
+			input: map[string]any{"country": "RU", "age": float64(18), "premium": true},
+		},
+		{
+			name:  "no attributes",
+			input: map[string]any{},
+		},
+		{
+			name:  "too many attributes",
+			input: tooMany,
+			expectedError: custom_error.CustomError{
+				Field:   "attributes",
+				Message: ErrTooManyAttributes.Error(),
+			},
+		},
+		{
+			name:  "uppercase name",
+			input: map[string]any{"Country": "RU"},
+			expectedError: custom_error.CustomError{
+				Field:   "attributes",
+				Message: ErrInvalidAttributeName.Error(),
+			},
+		},
+		{
+			name:  "keyword name",
+			input: map[string]any{"in": "RU"},
+			expectedError: custom_error.CustomError{
+				Field:   "attributes",
+				Message: ErrInvalidAttributeName.Error(),
+			},
+		},
+		{
+			name:  "list value",
+			input: map[string]any{"platforms": []any{"ios"}},
+			expectedError: custom_error.CustomError{
+				Field:   "attributes",
+				Message: ErrInvalidAttributeValue.Error(),
+			},
+		},
+		{
+			name:  "null value",
+			input: map[string]any{"country": nil},
+			expectedError: custom_error.CustomError{
+				Field:   "attributes",
+				Message: ErrInvalidAttributeValue.Error(),
+			},
+		},
+		{
+			name:  "too long value",
+			input: map[string]any{"country": strings.Repeat("a", maxAttributeValueLength+1)},
+			expectedError: custom_error.CustomError{
+				Field:   "attributes",
+				Message: ErrAttributeValueTooLong.Error(),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actualError := validateAttributes(tc.input)
+			require.ErrorIs(t, actualError, tc.expectedError)
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"strings"
+)
+
+// exclusions maps a segment to the other segments of its exclusion groups and their groups.
+type exclusions map[string]map[string]string
+
+// conflict returns a segment of the user which is in one exclusion group with the segment and the group.
+func (e exclusions) conflict(segment string, userSegments map[string]struct{}) (string, string, bool) {
+	for other, group := range e[segment] {
+		if _, ok := userSegments[other]; ok {
+			return other, group, true
+		}
+	}
+
+	return "", "", false
+}
+
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// CreateExclusionGroup creates the group of existing segments. It fails when a user already has two of them.
+func (s *Storage) CreateExclusionGroup(ctx context.Context, group models.ExclusionGroup) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("ExclusionGroupRepo.CreateExclusionGroup - s.db.Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	queryInsertGroup := fmt.Sprintf(`
+		INSERT INTO %s (slug)
+		VALUES ($1)
+	`, exclusionGroupsTable)
+
+	_, err = tx.Exec(ctx, queryInsertGroup, group.Slug)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.Code == "23505" {
+				return custom_error.CustomError{
+					Field:   "slug",
+					Message: group.Slug + " already exists",
+				}
+			}
+		}
+		return fmt.Errorf("ExclusionGroupRepo.CreateExclusionGroup - tx.Exec: %w", err)
+	}
+
+	queryInsertSegment := fmt.Sprintf(`
+		INSERT INTO %s (group_slug, segment_slug)
+		VALUES ($1, $2)
+	`, exclusionGroupSegmentsTable)
+
+	for _, segment := range group.Segments {
+		_, err = tx.Exec(ctx, queryInsertSegment, group.Slug, segment)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				if pgErr.Code == "23503" {
+					return custom_error.CustomError{
+						Field:   "segments",
+						Message: segment + " doesn't exist",
+					}
+				}
+			}
+			return fmt.Errorf("ExclusionGroupRepo.CreateExclusionGroup - tx.Exec: %w", err)
+		}
+	}
+
+	querySelectConflict := fmt.Sprintf(`
+		SELECT user_id, array_agg(segment_slug ORDER BY segment_slug)
+		FROM %s
+		WHERE segment_slug = ANY($1)
+		GROUP BY user_id
+		HAVING COUNT(*) > 1
+		ORDER BY user_id
+		LIMIT 1
+	`, userSegmentsTable)
+
+	var (
+		userID   int
+		segments []string
+	)
+
+	err = tx.QueryRow(ctx, querySelectConflict, group.Segments).Scan(&userID, &segments)
+	if err == nil {
+		return custom_error.CustomError{
+			Field:   "segments",
+			Message: fmt.Sprintf("User (%d) already has segments %s", userID, strings.Join(segments, ", ")),
+		}
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("ExclusionGroupRepo.CreateExclusionGroup - tx.QueryRow.Scan: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("ExclusionGroupRepo.CreateExclusionGroup - tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) GetExclusionGroup(ctx context.Context, slug string) (models.ExclusionGroup, error) {
+	query := fmt.Sprintf(`
+		SELECT g.slug, g.created_at, COALESCE(array_agg(gs.segment_slug ORDER BY gs.segment_slug)
+			FILTER (WHERE gs.segment_slug IS NOT NULL), '{}')
+		FROM %s g
+		LEFT JOIN %s gs ON gs.group_slug = g.slug
+		WHERE g.slug = $1
+		GROUP BY g.slug
+	`, exclusionGroupsTable, exclusionGroupSegmentsTable)
+
+	var group models.ExclusionGroup
+
+	err := s.db.QueryRow(ctx, query, slug).Scan(&group.Slug, &group.CreatedAt, &group.Segments)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.ExclusionGroup{}, custom_error.NotFoundError{
+				Field:   "slug",
+				Message: slug + " doesn't exist",
+			}
+		}
+		return models.ExclusionGroup{}, fmt.Errorf("ExclusionGroupRepo.GetExclusionGroup - s.db.QueryRow.Scan: %w", err)
+	}
+
+	return group, nil
+}
+
+// DeleteExclusionGroup deletes the group, its segments and their users stay.
+func (s *Storage) DeleteExclusionGroup(ctx context.Context, slug string) error {
+	query := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE slug = $1
+	`, exclusionGroupsTable)
+
+	ct, err := s.db.Exec(ctx, query, slug)
+	if err != nil {
+		return fmt.Errorf("ExclusionGroupRepo.DeleteExclusionGroup - s.db.Exec: %w", err)
+	}
+
+	if ct.RowsAffected() == 0 {
+		return custom_error.NotFoundError{
+			Field:   "slug",
+			Message: slug + " doesn't exist",
+		}
+	}
+
+	return nil
+}
+
+// selectExclusions returns every pair of segments which are in one exclusion group.
+func selectExclusions(ctx context.Context, db querier) (exclusions, error) {
+	query := fmt.Sprintf(`
+		SELECT g.group_slug, g.segment_slug, other.segment_slug
+		FROM %s g
+		JOIN %s other ON other.group_slug = g.group_slug AND other.segment_slug <> g.segment_slug
+	`, exclusionGroupSegmentsTable, exclusionGroupSegmentsTable)
+
+	rows, err := db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("ExclusionGroupRepo.selectExclusions - db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	result := make(exclusions)
+	for rows.Next() {
+		var group, segment, other string
+
+		err = rows.Scan(&group, &segment, &other)
+		if err != nil {
+			return nil, fmt.Errorf("ExclusionGroupRepo.selectExclusions - rows.Scan: %w", err)
+		}
+
+		if result[segment] == nil {
+			result[segment] = make(map[string]string)
+		}
+		result[segment][other] = group
+	}
+
+	return result, nil
+}
+
+// findExclusionConflict returns a segment of the user which is in one exclusion group with the segment and the group,
+// segments deleted in the same update are not counted.
+func findExclusionConflict(ctx context.Context, tx pgx.Tx, segment string, userID int, segmentsToDelete []string) (string, string, bool, error) {
+	if segmentsToDelete == nil {
+		segmentsToDelete = []string{}
+	}
+
+	query := fmt.Sprintf(`
+		SELECT g.group_slug, us.segment_slug
+		FROM %s g
+		JOIN %s other ON other.group_slug = g.group_slug AND other.segment_slug <> g.segment_slug
+		JOIN %s us ON us.segment_slug = other.segment_slug AND us.user_id = $2
+		WHERE g.segment_slug = $1 AND us.segment_slug <> ALL($3)
+		LIMIT 1
+	`, exclusionGroupSegmentsTable, exclusionGroupSegmentsTable, userSegmentsTable)
+
+	var group, other string
+
+	err := tx.QueryRow(ctx, query, segment, userID, segmentsToDelete).Scan(&group, &other)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", "", false, nil
+		}
+		return "", "", false, fmt.Errorf("ExclusionGroupRepo.findExclusionConflict - tx.QueryRow.Scan: %w", err)
+	}
+
+	return other, group, true, nil
+}
+
+// checkExclusionGroups returns an error when the user already has a segment of an exclusion group of the segment,
+// so a segment of the group can be swapped for another one by deleting it in the same update.
+func checkExclusionGroups(ctx context.Context, tx pgx.Tx, segment string, userID int, segmentsToDelete []string) error {
+	other, group, ok, err := findExclusionConflict(ctx, tx, segment, userID, segmentsToDelete)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return custom_error.CustomError{
+			Field:   "segments_to_add",
+			Message: exclusionConflictMessage(userID, segment, other, group),
+		}
+	}
+
+	return nil
+}
+
+func exclusionConflictMessage(userID int, segment, other, group string) string {
+	return fmt.Sprintf("User (%d) cannot have %s, it has %s of exclusion group %s", userID, segment, other, group)
+}
@@ -0,0 +1,386 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v2"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var (
+	queryInsertExclusionGroup = fmt.Sprintf(`
+		INSERT INTO %s (slug)
+		VALUES ($1)
+	`, exclusionGroupsTable)
+
+	queryInsertExclusionGroupSegment = fmt.Sprintf(`
+		INSERT INTO %s (group_slug, segment_slug)
+		VALUES ($1, $2)
+	`, exclusionGroupSegmentsTable)
+
+	querySelectExclusionGroupConflict = fmt.Sprintf(`
+		SELECT user_id, array_agg(segment_slug ORDER BY segment_slug)
+		FROM %s
+		WHERE segment_slug = ANY($1)
+		GROUP BY user_id
+		HAVING COUNT(*) > 1
+		ORDER BY user_id
+		LIMIT 1
+	`, userSegmentsTable)
+
+	querySelectExclusionGroup = fmt.Sprintf(`
+		SELECT g.slug, g.created_at, COALESCE(array_agg(gs.segment_slug ORDER BY gs.segment_slug)
+			FILTER (WHERE gs.segment_slug IS NOT NULL), '{}')
+		FROM %s g
+		LEFT JOIN %s gs ON gs.group_slug = g.slug
+		WHERE g.slug = $1
+		GROUP BY g.slug
+	`, exclusionGroupsTable, exclusionGroupSegmentsTable)
+
+	querySelectExclusions = fmt.Sprintf(`
+		SELECT g.group_slug, g.segment_slug, other.segment_slug
+		FROM %s g
+		JOIN %s other ON other.group_slug = g.group_slug AND other.segment_slug <> g.segment_slug
+	`, exclusionGroupSegmentsTable, exclusionGroupSegmentsTable)
+
+	queryFindExclusionConflict = fmt.Sprintf(`
+		SELECT g.group_slug, us.segment_slug
+		FROM %s g
+		JOIN %s other ON other.group_slug = g.group_slug AND other.segment_slug <> g.segment_slug
+		JOIN %s us ON us.segment_slug = other.segment_slug AND us.user_id = $2
+		WHERE g.segment_slug = $1 AND us.segment_slug <> ALL($3)
+		LIMIT 1
+	`, exclusionGroupSegmentsTable, exclusionGroupSegmentsTable, userSegmentsTable)
+)
+
+func TestStorage_CreateExclusionGroup(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	group := models.ExclusionGroup{
+		Slug:     "BANNERS",
+		Segments: []string{"BANNER_A", "BANNER_B"},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertExclusionGroup)).WithArgs(group.Slug).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	for _, segment := range group.Segments {
+		mock.ExpectExec(regexp.QuoteMeta(queryInsertExclusionGroupSegment)).WithArgs(group.Slug, segment).
+			WillReturnResult(pgxmock.NewResult("insert", 1))
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusionGroupConflict)).WithArgs(group.Segments).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.CreateExclusionGroup(ctx, group)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_CreateExclusionGroupSegmentNotExist(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	group := models.ExclusionGroup{
+		Slug:     "BANNERS",
+		Segments: []string{"BANNER_A", "BANNER_B"},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertExclusionGroup)).WithArgs(group.Slug).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertExclusionGroupSegment)).WithArgs(group.Slug, "BANNER_A").
+		WillReturnError(&pgconn.PgError{Code: "23503"})
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.CreateExclusionGroup(ctx, group)
+	require.ErrorIs(t, err, custom_error.CustomError{
+		Field:   "segments",
+		Message: "BANNER_A doesn't exist",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_CreateExclusionGroupUserConflict(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	group := models.ExclusionGroup{
+		Slug:     "BANNERS",
+		Segments: []string{"BANNER_A", "BANNER_B"},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertExclusionGroup)).WithArgs(group.Slug).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	for _, segment := range group.Segments {
+		mock.ExpectExec(regexp.QuoteMeta(queryInsertExclusionGroupSegment)).WithArgs(group.Slug, segment).
+			WillReturnResult(pgxmock.NewResult("insert", 1))
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusionGroupConflict)).WithArgs(group.Segments).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "array_agg"}).AddRow(7, []string{"BANNER_A", "BANNER_B"}))
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.CreateExclusionGroup(ctx, group)
+	require.ErrorIs(t, err, custom_error.CustomError{
+		Field:   "segments",
+		Message: "User (7) already has segments BANNER_A, BANNER_B",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetExclusionGroup(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedGroup := models.ExclusionGroup{
+		Slug:      "BANNERS",
+		Segments:  []string{"BANNER_A", "BANNER_B"},
+		CreatedAt: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusionGroup)).WithArgs(expectedGroup.Slug).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "created_at", "segments"}).
+			AddRow(expectedGroup.Slug, expectedGroup.CreatedAt, expectedGroup.Segments))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	group, err := storage.GetExclusionGroup(ctx, expectedGroup.Slug)
+	require.NoError(t, err)
+	require.Equal(t, expectedGroup, group)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetExclusionGroupNotFound(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusionGroup)).WithArgs("BANNERS").
+		WillReturnError(pgx.ErrNoRows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.GetExclusionGroup(ctx, "BANNERS")
+	require.ErrorIs(t, err, custom_error.NotFoundError{
+		Field:   "slug",
+		Message: "BANNERS doesn't exist",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_DeleteExclusionGroupNotFound(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	queryDeleteExclusionGroup := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE slug = $1
+	`, exclusionGroupsTable)
+
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteExclusionGroup)).WithArgs("BANNERS").
+		WillReturnResult(pgxmock.NewResult("delete", 0))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.DeleteExclusionGroup(ctx, "BANNERS")
+	require.ErrorIs(t, err, custom_error.NotFoundError{
+		Field:   "slug",
+		Message: "BANNERS doesn't exist",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_UpdateUserSegmentsExclusionConflict(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1
+
+	queryRegisterUser := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryRegisterUser)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateUserSegmentExpiry)).WithArgs(expectedUserID, "BANNER_B", (*time.Time)(nil)).
+		WillReturnResult(pgxmock.NewResult("update", 0))
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegmentParent)).WithArgs("BANNER_B", expectedUserID).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckExperimentVariant)).WithArgs("BANNER_B", expectedUserID, []string{}).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(queryFindExclusionConflict)).WithArgs("BANNER_B", expectedUserID, []string{}).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug"}).AddRow("BANNERS", "BANNER_A"))
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.UpdateUserSegments(ctx, []models.UserSegment{{Slug: "BANNER_B"}}, nil, expectedUserID)
+	require.ErrorIs(t, err, custom_error.CustomError{
+		Field:   "segments_to_add",
+		Message: "User (1) cannot have BANNER_B, it has BANNER_A of exclusion group BANNERS",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_UpdateUserSegmentsSwapExclusionGroupSegment(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1
+	segmentsToDelete := []string{"DISCOUNT_30"}
+
+	queryRegisterUser := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
+
+	queryInsertUserSegment := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
+	`, userSegmentsTable)
+
+	queryInsertAddOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, operationsTable)
+
+	queryDeleteUserSegment := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE user_id = $1 AND segment_slug = $2
+	`, userSegmentsTable)
+
+	queryInsertDeleteOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, false, $5)
+	`, operationsTable)
+
+	// DISCOUNT_30 of the same group is deleted in the update, so it isn't a conflict for DISCOUNT_50
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryRegisterUser)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateUserSegmentExpiry)).WithArgs(expectedUserID, "DISCOUNT_50", (*time.Time)(nil)).
+		WillReturnResult(pgxmock.NewResult("update", 0))
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegmentParent)).WithArgs("DISCOUNT_50", expectedUserID).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckExperimentVariant)).WithArgs("DISCOUNT_50", expectedUserID, segmentsToDelete).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(queryFindExclusionConflict)).WithArgs("DISCOUNT_50", expectedUserID, segmentsToDelete).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).
+		WithArgs(expectedUserID, "DISCOUNT_50", (*time.Time)(nil), false, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertAddOperation)).
+		WithArgs(expectedUserID, "DISCOUNT_50", pgxmock.AnyArg(), "add", false, models.OperationSourceManual).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteUserSegment)).WithArgs(expectedUserID, "DISCOUNT_30").
+		WillReturnResult(pgxmock.NewResult("delete", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertDeleteOperation)).
+		WithArgs(expectedUserID, "DISCOUNT_30", pgxmock.AnyArg(), "delete", models.OperationSourceManual).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteChildUserSegments)).
+		WithArgs(segmentsToDelete, []int{expectedUserID}, pgxmock.AnyArg(), models.OperationSourceParentDelete).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.UpdateUserSegments(ctx, []models.UserSegment{{Slug: "DISCOUNT_50"}}, segmentsToDelete, expectedUserID)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_BulkUpdateUserSegmentsSameExclusionGroup(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	queryCheckSegments := fmt.Sprintf(`
+		SELECT slug
+		FROM %s
+		WHERE slug = ANY($1)
+	`, segmentsTable)
+
+	segments := []string{"BANNER_A", "BANNER_B"}
+
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegments)).WithArgs(segments).
+		WillReturnRows(pgxmock.NewRows([]string{"slug"}).AddRow("BANNER_A").AddRow("BANNER_B"))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperimentVariants)).WithArgs(segments).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "experiment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusions)).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug", "segment_slug"}).
+			AddRow("BANNERS", "BANNER_A", "BANNER_B").
+			AddRow("BANNERS", "BANNER_B", "BANNER_A"))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.BulkUpdateUserSegments(ctx, []models.UserSegment{{Slug: "BANNER_A"}, {Slug: "BANNER_B"}}, []string{}, []int{1, 2})
+	require.ErrorIs(t, err, custom_error.CustomError{
+		Field:   "segments_to_add",
+		Message: "BANNER_A and BANNER_B are in the same exclusion group BANNERS",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
@@ -0,0 +1,334 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"time"
+)
+
+// CreateExperiment creates the experiment together with its variant segments, which must not exist yet,
+// so no user is in two variants from the start. Users get variants by the auto add job.
+func (s *Storage) CreateExperiment(ctx context.Context, experiment models.Experiment) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("ExperimentRepo.CreateExperiment - s.db.Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	queryInsertExperiment := fmt.Sprintf(`
+		INSERT INTO %s (slug, salt)
+		VALUES ($1, $2)
+	`, experimentsTable)
+
+	_, err = tx.Exec(ctx, queryInsertExperiment, experiment.Slug, experiment.Salt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.Code == "23505" {
+				return custom_error.CustomError{
+					Field:   "slug",
+					Message: experiment.Slug + " already exists",
+				}
+			}
+		}
+		return fmt.Errorf("ExperimentRepo.CreateExperiment - tx.Exec: %w", err)
+	}
+
+	queryInsertSegment := fmt.Sprintf(`
+		INSERT INTO %s (slug, auto_add_percentage)
+		VALUES ($1, 0)
+	`, segmentsTable)
+
+	queryInsertVariant := fmt.Sprintf(`
+		INSERT INTO %s (segment_slug, experiment_slug, weight)
+		VALUES ($1, $2, $3)
+	`, experimentVariantsTable)
+
+	for _, variant := range experiment.Variants {
+		_, err = tx.Exec(ctx, queryInsertSegment, variant.Slug)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				if pgErr.Code == "23505" {
+					return custom_error.CustomError{
+						Field:   "variants",
+						Message: variant.Slug + " already exists",
+					}
+				}
+			}
+			return fmt.Errorf("ExperimentRepo.CreateExperiment - tx.Exec: %w", err)
+		}
+
+		_, err = tx.Exec(ctx, queryInsertVariant, variant.Slug, experiment.Slug, variant.Weight)
+		if err != nil {
+			return fmt.Errorf("ExperimentRepo.CreateExperiment - tx.Exec: %w", err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("ExperimentRepo.CreateExperiment - tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+// GetExperiment returns the experiment with its variants and their numbers of users.
+func (s *Storage) GetExperiment(ctx context.Context, slug string) (models.Experiment, error) {
+	querySelectExperiment := fmt.Sprintf(`
+		SELECT slug, salt, created_at
+		FROM %s
+		WHERE slug = $1
+	`, experimentsTable)
+
+	var experiment models.Experiment
+
+	err := s.db.QueryRow(ctx, querySelectExperiment, slug).Scan(&experiment.Slug, &experiment.Salt, &experiment.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.Experiment{}, custom_error.NotFoundError{
+				Field:   "slug",
+				Message: slug + " doesn't exist",
+			}
+		}
+		return models.Experiment{}, fmt.Errorf("ExperimentRepo.GetExperiment - s.db.QueryRow.Scan: %w", err)
+	}
+
+	querySelectVariants := fmt.Sprintf(`
+		SELECT v.segment_slug, v.weight, COUNT(us.user_id)
+		FROM %s v
+		LEFT JOIN %s us ON us.segment_slug = v.segment_slug
+		WHERE v.experiment_slug = $1
+		GROUP BY v.segment_slug, v.weight
+		ORDER BY v.segment_slug
+	`, experimentVariantsTable, userSegmentsTable)
+
+	rows, err := s.db.Query(ctx, querySelectVariants, slug)
+	if err != nil {
+		return models.Experiment{}, fmt.Errorf("ExperimentRepo.GetExperiment - s.db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var variant models.ExperimentVariant
+
+		err = rows.Scan(&variant.Slug, &variant.Weight, &variant.UsersCount)
+		if err != nil {
+			return models.Experiment{}, fmt.Errorf("ExperimentRepo.GetExperiment - rows.Scan: %w", err)
+		}
+
+		experiment.Variants = append(experiment.Variants, variant)
+	}
+
+	return experiment, nil
+}
+
+// DeleteExperiment deletes the experiment only, its variant segments stay with their users.
+func (s *Storage) DeleteExperiment(ctx context.Context, slug string) error {
+	query := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE slug = $1
+	`, experimentsTable)
+
+	ct, err := s.db.Exec(ctx, query, slug)
+	if err != nil {
+		return fmt.Errorf("ExperimentRepo.DeleteExperiment - s.db.Exec: %w", err)
+	}
+
+	if ct.RowsAffected() == 0 {
+		return custom_error.NotFoundError{
+			Field:   "slug",
+			Message: slug + " doesn't exist",
+		}
+	}
+
+	return nil
+}
+
+// selectExperiments returns experiments with their variants ordered by slug,
+// the order defines ranges of buckets of the variants.
+func selectExperiments(ctx context.Context, tx pgx.Tx) ([]models.Experiment, error) {
+	query := fmt.Sprintf(`
+		SELECT e.slug, e.salt, v.segment_slug, v.weight
+		FROM %s e
+		JOIN %s v ON v.experiment_slug = e.slug
+		ORDER BY e.slug, v.segment_slug
+	`, experimentsTable, experimentVariantsTable)
+
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("ExperimentRepo.selectExperiments - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var experiments []models.Experiment
+	for rows.Next() {
+		var (
+			experiment models.Experiment
+			variant    models.ExperimentVariant
+		)
+
+		err = rows.Scan(&experiment.Slug, &experiment.Salt, &variant.Slug, &variant.Weight)
+		if err != nil {
+			return nil, fmt.Errorf("ExperimentRepo.selectExperiments - rows.Scan: %w", err)
+		}
+
+		if len(experiments) == 0 || experiments[len(experiments)-1].Slug != experiment.Slug {
+			experiments = append(experiments, experiment)
+		}
+		last := &experiments[len(experiments)-1]
+		last.Variants = append(last.Variants, variant)
+	}
+
+	return experiments, nil
+}
+
+// addExperimentToUsers puts every user which isn't in any variant of the experiment into the variant of its bucket.
+// Users with a segment of an exclusion group of their variant are skipped.
+func addExperimentToUsers(ctx context.Context, tx pgx.Tx, experiment models.Experiment, now time.Time) error {
+	querySelectUsersWithoutVariant := fmt.Sprintf(`
+		SELECT id
+		FROM %s
+		WHERE id NOT IN (
+    		SELECT us.user_id
+    		FROM %s us
+    		JOIN %s v ON v.segment_slug = us.segment_slug
+    		WHERE v.experiment_slug = $1
+		)
+	`, usersTable, userSegmentsTable, experimentVariantsTable)
+
+	rows, err := tx.Query(ctx, querySelectUsersWithoutVariant, experiment.Slug)
+	if err != nil {
+		return fmt.Errorf("ExperimentRepo.addExperimentToUsers - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var userSegments []models.UserSegment
+	for rows.Next() {
+		var userID int
+
+		err = rows.Scan(&userID)
+		if err != nil {
+			return fmt.Errorf("ExperimentRepo.addExperimentToUsers - rows.Scan: %w", err)
+		}
+
+		if variant, ok := experiment.Variant(userID); ok {
+			userSegments = append(userSegments, models.UserSegment{UserID: userID, Slug: variant})
+		}
+	}
+
+	for _, userSegment := range userSegments {
+		_, _, conflict, err := findExclusionConflict(ctx, tx, userSegment.Slug, userSegment.UserID, nil)
+		if err != nil {
+			return err
+		}
+		if conflict {
+			continue
+		}
+
+		err = addUserSegment(ctx, tx, userSegment.Slug, userSegment.UserID, true, nil, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkExperimentVariant returns an error when the segment is a variant of an experiment and the user is
+// already in another variant of it. Variants deleted from the user in the same update are not counted.
+func checkExperimentVariant(ctx context.Context, tx pgx.Tx, segment string, userID int, segmentsToDelete []string) error {
+	if segmentsToDelete == nil {
+		segmentsToDelete = []string{}
+	}
+
+	query := fmt.Sprintf(`
+		SELECT v.experiment_slug, us.segment_slug
+		FROM %s v
+		JOIN %s other ON other.experiment_slug = v.experiment_slug AND other.segment_slug <> v.segment_slug
+		JOIN %s us ON us.segment_slug = other.segment_slug AND us.user_id = $2
+		WHERE v.segment_slug = $1 AND us.segment_slug <> ALL($3)
+		LIMIT 1
+	`, experimentVariantsTable, experimentVariantsTable, userSegmentsTable)
+
+	var experiment, variant string
+
+	err := tx.QueryRow(ctx, query, segment, userID, segmentsToDelete).Scan(&experiment, &variant)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("ExperimentRepo.checkExperimentVariant - tx.QueryRow.Scan: %w", err)
+	}
+
+	return custom_error.CustomError{
+		Field:   "segments_to_add",
+		Message: fmt.Sprintf("User (%d) is already in variant %s of experiment %s", userID, variant, experiment),
+	}
+}
+
+// selectExperimentVariants returns all variants of experiments the segments are variants of,
+// mapped to their experiments.
+func selectExperimentVariants(ctx context.Context, db PgxPool, slugs []string) (map[string]string, error) {
+	query := fmt.Sprintf(`
+		SELECT segment_slug, experiment_slug
+		FROM %s
+		WHERE experiment_slug IN (
+    		SELECT experiment_slug
+    		FROM %s
+    		WHERE segment_slug = ANY($1)
+		)
+	`, experimentVariantsTable, experimentVariantsTable)
+
+	rows, err := db.Query(ctx, query, slugs)
+	if err != nil {
+		return nil, fmt.Errorf("ExperimentRepo.selectExperimentVariants - db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	variants := make(map[string]string)
+	for rows.Next() {
+		var segment, experiment string
+
+		err = rows.Scan(&segment, &experiment)
+		if err != nil {
+			return nil, fmt.Errorf("ExperimentRepo.selectExperimentVariants - rows.Scan: %w", err)
+		}
+
+		variants[segment] = experiment
+	}
+
+	return variants, nil
+}
+
+// checkNotExperimentVariant returns an error when the segment is a variant of an experiment,
+// variants get users by weights of the experiment and cannot have their own auto add percentage.
+func checkNotExperimentVariant(ctx context.Context, tx pgx.Tx, segment string) error {
+	query := fmt.Sprintf(`
+		SELECT experiment_slug
+		FROM %s
+		WHERE segment_slug = $1
+	`, experimentVariantsTable)
+
+	var experiment string
+
+	err := tx.QueryRow(ctx, query, segment).Scan(&experiment)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("ExperimentRepo.checkNotExperimentVariant - tx.QueryRow.Scan: %w", err)
+	}
+
+	return custom_error.CustomError{
+		Field:   "auto_add_percentage",
+		Message: fmt.Sprintf("%s is a variant of experiment %s and cannot have auto add percentage", segment, experiment),
+	}
+}
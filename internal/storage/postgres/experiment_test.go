@@ -0,0 +1,503 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v2"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var (
+	queryInsertExperiment = fmt.Sprintf(`
+		INSERT INTO %s (slug, salt)
+		VALUES ($1, $2)
+	`, experimentsTable)
+
+	queryInsertVariantSegment = fmt.Sprintf(`
+		INSERT INTO %s (slug, auto_add_percentage)
+		VALUES ($1, 0)
+	`, segmentsTable)
+
+	queryInsertVariant = fmt.Sprintf(`
+		INSERT INTO %s (segment_slug, experiment_slug, weight)
+		VALUES ($1, $2, $3)
+	`, experimentVariantsTable)
+
+	querySelectExperiment = fmt.Sprintf(`
+		SELECT slug, salt, created_at
+		FROM %s
+		WHERE slug = $1
+	`, experimentsTable)
+
+	querySelectVariants = fmt.Sprintf(`
+		SELECT v.segment_slug, v.weight, COUNT(us.user_id)
+		FROM %s v
+		LEFT JOIN %s us ON us.segment_slug = v.segment_slug
+		WHERE v.experiment_slug = $1
+		GROUP BY v.segment_slug, v.weight
+		ORDER BY v.segment_slug
+	`, experimentVariantsTable, userSegmentsTable)
+
+	queryDeleteExperiment = fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE slug = $1
+	`, experimentsTable)
+
+	querySelectExperiments = fmt.Sprintf(`
+		SELECT e.slug, e.salt, v.segment_slug, v.weight
+		FROM %s e
+		JOIN %s v ON v.experiment_slug = e.slug
+		ORDER BY e.slug, v.segment_slug
+	`, experimentsTable, experimentVariantsTable)
+
+	querySelectUsersWithoutVariant = fmt.Sprintf(`
+		SELECT id
+		FROM %s
+		WHERE id NOT IN (
+    		SELECT us.user_id
+    		FROM %s us
+    		JOIN %s v ON v.segment_slug = us.segment_slug
+    		WHERE v.experiment_slug = $1
+		)
+	`, usersTable, userSegmentsTable, experimentVariantsTable)
+
+	queryCheckExperimentVariant = fmt.Sprintf(`
+		SELECT v.experiment_slug, us.segment_slug
+		FROM %s v
+		JOIN %s other ON other.experiment_slug = v.experiment_slug AND other.segment_slug <> v.segment_slug
+		JOIN %s us ON us.segment_slug = other.segment_slug AND us.user_id = $2
+		WHERE v.segment_slug = $1 AND us.segment_slug <> ALL($3)
+		LIMIT 1
+	`, experimentVariantsTable, experimentVariantsTable, userSegmentsTable)
+
+	querySelectExperimentVariants = fmt.Sprintf(`
+		SELECT segment_slug, experiment_slug
+		FROM %s
+		WHERE experiment_slug IN (
+    		SELECT experiment_slug
+    		FROM %s
+    		WHERE segment_slug = ANY($1)
+		)
+	`, experimentVariantsTable, experimentVariantsTable)
+
+	queryCheckNotExperimentVariant = fmt.Sprintf(`
+		SELECT experiment_slug
+		FROM %s
+		WHERE segment_slug = $1
+	`, experimentVariantsTable)
+)
+
+func TestStorage_CreateExperiment(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	experiment := models.Experiment{
+		Slug: "CHECKOUT",
+		Salt: "salt",
+		Variants: []models.ExperimentVariant{
+			{Slug: "CHECKOUT_CONTROL", Weight: 50},
+			{Slug: "CHECKOUT_A", Weight: 50},
+		},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertExperiment)).WithArgs(experiment.Slug, experiment.Salt).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	for _, variant := range experiment.Variants {
+		mock.ExpectExec(regexp.QuoteMeta(queryInsertVariantSegment)).WithArgs(variant.Slug).
+			WillReturnResult(pgxmock.NewResult("insert", 1))
+		mock.ExpectExec(regexp.QuoteMeta(queryInsertVariant)).WithArgs(variant.Slug, experiment.Slug, variant.Weight).
+			WillReturnResult(pgxmock.NewResult("insert", 1))
+	}
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.CreateExperiment(ctx, experiment)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_CreateExperimentVariantExists(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	experiment := models.Experiment{
+		Slug: "CHECKOUT",
+		Salt: "salt",
+		Variants: []models.ExperimentVariant{
+			{Slug: "CHECKOUT_CONTROL", Weight: 50},
+			{Slug: "CHECKOUT_A", Weight: 50},
+		},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertExperiment)).WithArgs(experiment.Slug, experiment.Salt).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertVariantSegment)).WithArgs(experiment.Variants[0].Slug).
+		WillReturnError(&pgconn.PgError{Code: "23505"})
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.CreateExperiment(ctx, experiment)
+	require.ErrorIs(t, err, custom_error.CustomError{
+		Field:   "variants",
+		Message: "CHECKOUT_CONTROL already exists",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetExperiment(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedExperiment := models.Experiment{
+		Slug:      "CHECKOUT",
+		Salt:      "salt",
+		CreatedAt: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+		Variants: []models.ExperimentVariant{
+			{Slug: "CHECKOUT_A", Weight: 25, UsersCount: 2},
+			{Slug: "CHECKOUT_CONTROL", Weight: 50, UsersCount: 5},
+		},
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperiment)).WithArgs(expectedExperiment.Slug).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "salt", "created_at"}).
+			AddRow(expectedExperiment.Slug, expectedExperiment.Salt, expectedExperiment.CreatedAt))
+
+	rows := pgxmock.NewRows([]string{"segment_slug", "weight", "count"})
+	for _, variant := range expectedExperiment.Variants {
+		rows.AddRow(variant.Slug, variant.Weight, variant.UsersCount)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectVariants)).WithArgs(expectedExperiment.Slug).WillReturnRows(rows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	experiment, err := storage.GetExperiment(ctx, expectedExperiment.Slug)
+	require.NoError(t, err)
+	require.Equal(t, expectedExperiment, experiment)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetExperimentNotFound(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperiment)).WithArgs("CHECKOUT").
+		WillReturnError(pgx.ErrNoRows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.GetExperiment(ctx, "CHECKOUT")
+	require.ErrorIs(t, err, custom_error.NotFoundError{
+		Field:   "slug",
+		Message: "CHECKOUT doesn't exist",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_DeleteExperimentNotFound(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteExperiment)).WithArgs("CHECKOUT").
+		WillReturnResult(pgxmock.NewResult("delete", 0))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.DeleteExperiment(ctx, "CHECKOUT")
+	require.ErrorIs(t, err, custom_error.NotFoundError{
+		Field:   "slug",
+		Message: "CHECKOUT doesn't exist",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_UpdateUserSegmentsSecondVariant(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1
+
+	queryRegisterUser := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryRegisterUser)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateUserSegmentExpiry)).WithArgs(expectedUserID, "CHECKOUT_A", (*time.Time)(nil)).
+		WillReturnResult(pgxmock.NewResult("update", 0))
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegmentParent)).WithArgs("CHECKOUT_A", expectedUserID).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckExperimentVariant)).WithArgs("CHECKOUT_A", expectedUserID, []string{}).
+		WillReturnRows(pgxmock.NewRows([]string{"experiment_slug", "segment_slug"}).AddRow("CHECKOUT", "CHECKOUT_CONTROL"))
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.UpdateUserSegments(ctx, []models.UserSegment{{Slug: "CHECKOUT_A"}}, nil, expectedUserID)
+	require.ErrorIs(t, err, custom_error.CustomError{
+		Field:   "segments_to_add",
+		Message: "User (1) is already in variant CHECKOUT_CONTROL of experiment CHECKOUT",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_UpdateSegmentExperimentVariant(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	percentage := 20
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT auto_add_percentage, salt, COALESCE(rule, '')
+		FROM %s
+		WHERE slug = $1
+		FOR UPDATE
+	`, segmentsTable)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegment)).WithArgs("CHECKOUT_A").
+		WillReturnRows(pgxmock.NewRows([]string{"auto_add_percentage", "salt", "rule"}).AddRow(0, "salt", ""))
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckNotExperimentVariant)).WithArgs("CHECKOUT_A").
+		WillReturnRows(pgxmock.NewRows([]string{"experiment_slug"}).AddRow("CHECKOUT"))
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.UpdateSegment(ctx, "CHECKOUT_A", models.SegmentUpdate{Percentage: &percentage})
+	require.ErrorIs(t, err, custom_error.CustomError{
+		Field:   "auto_add_percentage",
+		Message: "CHECKOUT_A is a variant of experiment CHECKOUT and cannot have auto add percentage",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_AutoAddUserSegmentsExperiment(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	experiment := models.Experiment{
+		Slug: "CHECKOUT",
+		Salt: "salt",
+		Variants: []models.ExperimentVariant{
+			{Slug: "CHECKOUT_A", Weight: 25},
+			{Slug: "CHECKOUT_CONTROL", Weight: 50},
+		},
+	}
+
+	querySelectSegments := fmt.Sprintf(`
+		SELECT slug, auto_add_percentage, salt, COALESCE(parent_slug, '')
+		FROM %s
+		WHERE auto_add_percentage > 0
+		  AND (starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1)
+	`, segmentsTable)
+
+	queryInsertUserSegment := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
+	`, userSegmentsTable)
+
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, operationsTable)
+
+	experimentRows := pgxmock.NewRows([]string{"slug", "salt", "segment_slug", "weight"})
+	for _, variant := range experiment.Variants {
+		experimentRows.AddRow(experiment.Slug, experiment.Salt, variant.Slug, variant.Weight)
+	}
+
+	candidateRows := pgxmock.NewRows([]string{"id"})
+	for userID := 1; userID <= 10; userID++ {
+		candidateRows.AddRow(userID)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_xact_lock(hashtext($1))")).WithArgs(autoAddLockKey).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegments)).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "auto_add_percentage", "salt", "parent_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperiments)).WillReturnRows(experimentRows)
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectUsersWithoutVariant)).WithArgs(experiment.Slug).
+		WillReturnRows(candidateRows)
+	for userID := 1; userID <= 10; userID++ {
+		variant, ok := experiment.Variant(userID)
+		if !ok {
+			continue
+		}
+		mock.ExpectQuery(regexp.QuoteMeta(queryFindExclusionConflict)).WithArgs(variant, userID, []string{}).
+			WillReturnError(pgx.ErrNoRows)
+		mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).
+			WithArgs(userID, variant, (*time.Time)(nil), true, pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("insert", 1))
+		mock.ExpectExec(regexp.QuoteMeta(queryInsertOperation)).
+			WithArgs(userID, variant, pgxmock.AnyArg(), "add", true, models.OperationSourceAutoAdd).
+			WillReturnResult(pgxmock.NewResult("insert", 1))
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectRuleSegments)).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "rule"}))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	ran, err := storage.AutoAddUserSegments(ctx)
+	require.NoError(t, err)
+	require.True(t, ran)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_BulkUpdateUserSegmentsSecondVariant(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserIDs := []int{1, 2}
+
+	queryCheckSegments := fmt.Sprintf(`
+		SELECT slug
+		FROM %s
+		WHERE slug = ANY($1)
+	`, segmentsTable)
+
+	querySelectUserSegments := fmt.Sprintf(`
+		SELECT user_id, segment_slug
+		FROM %s
+		WHERE user_id = ANY($1) AND segment_slug = ANY($2)
+	`, userSegmentsTable)
+
+	queryRegisterUsers := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		SELECT unnest($1::integer[]), $2
+		ON CONFLICT (id) DO NOTHING
+		RETURNING id
+	`, usersTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegments)).WithArgs([]string{"CHECKOUT_A"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug"}).AddRow("CHECKOUT_A"))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperimentVariants)).WithArgs([]string{"CHECKOUT_A"}).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "experiment_slug"}).
+			AddRow("CHECKOUT_A", "CHECKOUT").
+			AddRow("CHECKOUT_CONTROL", "CHECKOUT"))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusions)).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug", "segment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentParents)).WithArgs([]string{"CHECKOUT_A"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "parent_slug"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectUserSegments)).
+		WithArgs(expectedUserIDs, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_slug"}).AddRow(2, "CHECKOUT_CONTROL"))
+	mock.ExpectQuery(regexp.QuoteMeta(queryRegisterUsers)).WithArgs([]int{1}, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectCopyFrom(pgx.Identifier{userSegmentsTable},
+		[]string{"user_id", "segment_slug", "expires_at", "auto_add", "added_at"}).
+		WillReturnResult(1)
+	mock.ExpectCopyFrom(pgx.Identifier{operationsTable},
+		[]string{"user_id", "segment_slug", "date", "action", "auto_add", "source"}).
+		WillReturnResult(1)
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	results, err := storage.BulkUpdateUserSegments(ctx, []models.UserSegment{{Slug: "CHECKOUT_A"}}, []string{}, expectedUserIDs)
+	require.NoError(t, err)
+
+	require.Equal(t, []models.BulkUserResult{
+		{UserID: 1, Added: []string{"CHECKOUT_A"}},
+		{UserID: 2, Error: "User (2) is already in variant CHECKOUT_CONTROL of experiment CHECKOUT"},
+	}, results)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_BulkUpdateUserSegmentsTwoVariants(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	queryCheckSegments := fmt.Sprintf(`
+		SELECT slug
+		FROM %s
+		WHERE slug = ANY($1)
+	`, segmentsTable)
+
+	slugs := []string{"CHECKOUT_A", "CHECKOUT_CONTROL"}
+
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegments)).WithArgs(slugs).
+		WillReturnRows(pgxmock.NewRows([]string{"slug"}).AddRow("CHECKOUT_A").AddRow("CHECKOUT_CONTROL"))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperimentVariants)).WithArgs(slugs).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "experiment_slug"}).
+			AddRow("CHECKOUT_A", "CHECKOUT").
+			AddRow("CHECKOUT_CONTROL", "CHECKOUT"))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.BulkUpdateUserSegments(ctx,
+		[]models.UserSegment{{Slug: "CHECKOUT_A"}, {Slug: "CHECKOUT_CONTROL"}}, []string{}, []int{1})
+	require.ErrorIs(t, err, custom_error.CustomError{
+		Field:   "segments_to_add",
+		Message: "CHECKOUT_A and CHECKOUT_CONTROL are variants of the same experiment CHECKOUT",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
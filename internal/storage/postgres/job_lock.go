@@ -0,0 +1,28 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+)
+
+// names of the advisory locks taken by the background jobs
+const (
+	autoAddLockKey     = "auto_add_user_segments"
+	snapshotLockKey    = "user_segments_snapshots"
+	statsRollupLockKey = "segment_stats_rollup"
+)
+
+// tryJobLock takes the transaction level advisory lock of the job, so only one instance of the service
+// runs the job at a time. It returns false without waiting when another instance holds the lock,
+// the lock is released when the transaction ends.
+func tryJobLock(ctx context.Context, tx pgx.Tx, key string) (bool, error) {
+	var locked bool
+
+	err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock(hashtext($1))", key).Scan(&locked)
+	if err != nil {
+		return false, fmt.Errorf("Storage.tryJobLock - tx.QueryRow.Scan: %w", err)
+	}
+
+	return locked, nil
+}
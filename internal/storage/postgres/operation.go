@@ -4,38 +4,126 @@ import (
 	"context"
 	"fmt"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
-	"time"
+	"strings"
 )
 
-func (s *Storage) GetOperations(ctx context.Context, date time.Time) ([]models.Operation, error) {
+// ForEachOperation streams operations selected by the filter to fn row by row without loading them all
+// into memory. Iteration stops at the first error returned by fn.
+func (s *Storage) ForEachOperation(ctx context.Context, filter models.OperationFilter, fn func(operation models.Operation) error) error {
+	conditions := []string{"date >= $1", "date < $2"}
+	args := []any{filter.From, filter.To}
+
+	if len(filter.UserIDs) > 0 {
+		args = append(args, filter.UserIDs)
+		conditions = append(conditions, fmt.Sprintf("user_id = ANY($%d)", len(args)))
+	}
+	if len(filter.Segments) > 0 {
+		args = append(args, filter.Segments)
+		conditions = append(conditions, fmt.Sprintf("segment_slug = ANY($%d)", len(args)))
+	}
+	if filter.Action != "" {
+		args = append(args, filter.Action)
+		conditions = append(conditions, fmt.Sprintf("action = $%d", len(args)))
+	}
+	if filter.AutoAdd != nil {
+		args = append(args, *filter.AutoAdd)
+		conditions = append(conditions, fmt.Sprintf("auto_add = $%d", len(args)))
+	}
+
 	query := fmt.Sprintf(`
 		SELECT
     		user_id,
     		segment_slug,
     		date,
-    		action
+    		action,
+    		auto_add
 		FROM %s
-		WHERE date >= $1 AND date <= $2
-		ORDER BY user_id
-	`, operationsTable)
+		WHERE %s
+		ORDER BY user_id, date
+	`, operationsTable, strings.Join(conditions, " AND "))
 
-	rows, err := s.db.Query(ctx, query, date, date.AddDate(0, 1, 0).Add(-time.Nanosecond))
+	rows, err := s.db.Query(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("OperationRepo.GetOperations - s.db.Query: %w", err)
+		return fmt.Errorf("OperationRepo.ForEachOperation - s.db.Query: %w", err)
 	}
 	defer rows.Close()
 
-	var operations []models.Operation
 	for rows.Next() {
 		var operation models.Operation
 
-		err = rows.Scan(&operation.UserID, &operation.SegmentSlug, &operation.Date, &operation.Action)
+		err = rows.Scan(&operation.UserID, &operation.SegmentSlug, &operation.Date, &operation.Action, &operation.AutoAdd)
+		if err != nil {
+			return fmt.Errorf("OperationRepo.ForEachOperation - rows.Scan: %w", err)
+		}
+
+		err = fn(operation)
 		if err != nil {
-			return nil, fmt.Errorf("OperationRepo.GetOperations - rows.Scan: %w", err)
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("OperationRepo.ForEachOperation - rows.Err: %w", err)
+	}
+
+	return nil
+}
+
+// GetUserOperations returns a page of operations of the user selected by the filter, newest first.
+func (s *Storage) GetUserOperations(ctx context.Context, userID int, filter models.UserHistoryFilter) ([]models.Operation, error) {
+	conditions := []string{"user_id = $1"}
+	args := []any{userID}
+
+	if filter.BeforeID > 0 {
+		args = append(args, filter.BeforeID)
+		conditions = append(conditions, fmt.Sprintf("id < $%d", len(args)))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		conditions = append(conditions, fmt.Sprintf("date >= $%d", len(args)))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		conditions = append(conditions, fmt.Sprintf("date < $%d", len(args)))
+	}
+
+	args = append(args, filter.Limit)
+
+	query := fmt.Sprintf(`
+		SELECT
+    		id,
+    		segment_slug,
+    		date,
+    		action,
+    		auto_add,
+    		source
+		FROM %s
+		WHERE %s
+		ORDER BY id DESC
+		LIMIT $%d
+	`, operationsTable, strings.Join(conditions, " AND "), len(args))
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("OperationRepo.GetUserOperations - s.db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var operations []models.Operation
+	for rows.Next() {
+		operation := models.Operation{UserID: userID}
+
+		err = rows.Scan(&operation.ID, &operation.SegmentSlug, &operation.Date, &operation.Action, &operation.AutoAdd, &operation.Source)
+		if err != nil {
+			return nil, fmt.Errorf("OperationRepo.GetUserOperations - rows.Scan: %w", err)
 		}
 
 		operations = append(operations, operation)
 	}
 
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("OperationRepo.GetUserOperations - rows.Err: %w", err)
+	}
+
 	return operations, nil
 }
@@ -11,7 +11,7 @@ import (
 	"time"
 )
 
-func TestStorage_GetOperations(t *testing.T) {
+func TestStorage_ForEachOperation(t *testing.T) {
 	mock, err := pgxmock.NewPool()
 	require.NoError(t, err)
 	defer mock.Close()
@@ -25,33 +25,197 @@ func TestStorage_GetOperations(t *testing.T) {
 			SegmentSlug: "TEST",
 			Date:        expectedDate,
 			Action:      "add",
+			AutoAdd:     true,
 		},
 	}
+	expectedFilter := models.OperationFilter{
+		From: expectedDate,
+		To:   expectedDate.AddDate(0, 1, 0),
+	}
 
 	query := fmt.Sprintf(`
 		SELECT
     		user_id,
     		segment_slug,
     		date,
-    		action
+    		action,
+    		auto_add
 		FROM %s
-		WHERE date >= $1 AND date <= $2
-		ORDER BY user_id
+		WHERE date >= $1 AND date < $2
+		ORDER BY user_id, date
 	`, operationsTable)
 
-	columns := []string{"user_id", "segment_slug", "date", "action"}
-	rows := pgxmock.NewRows(columns).AddRow(1, "TEST", expectedDate, "add")
+	columns := []string{"user_id", "segment_slug", "date", "action", "auto_add"}
+	rows := pgxmock.NewRows(columns).AddRow(1, "TEST", expectedDate, "add", true)
 
 	mock.ExpectQuery(regexp.QuoteMeta(query)).
-		WithArgs(expectedDate, expectedDate.AddDate(0, 1, 0).Add(-time.Nanosecond)).
+		WithArgs(expectedFilter.From, expectedFilter.To).
 		WillReturnRows(rows)
 
 	storage := NewStoragePostgres()
 	storage.db = mock
 
-	operations, err := storage.GetOperations(ctx, expectedDate)
+	var operations []models.Operation
+	err = storage.ForEachOperation(ctx, expectedFilter, func(operation models.Operation) error {
+		operations = append(operations, operation)
+		return nil
+	})
 	require.NoError(t, err)
 	require.ElementsMatch(t, operations, expectedOperations)
 
 	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
 }
+
+func TestStorage_ForEachOperationWithFilters(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	autoAdd := false
+	expectedFilter := models.OperationFilter{
+		From:     time.Date(2023, 8, 10, 0, 0, 0, 0, time.UTC),
+		To:       time.Date(2023, 8, 20, 0, 0, 0, 0, time.UTC),
+		UserIDs:  []int{1, 2},
+		Segments: []string{"TEST"},
+		Action:   "delete",
+		AutoAdd:  &autoAdd,
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+    		user_id,
+    		segment_slug,
+    		date,
+    		action,
+    		auto_add
+		FROM %s
+		WHERE date >= $1 AND date < $2 AND user_id = ANY($3) AND segment_slug = ANY($4) AND action = $5 AND auto_add = $6
+		ORDER BY user_id, date
+	`, operationsTable)
+
+	columns := []string{"user_id", "segment_slug", "date", "action", "auto_add"}
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(expectedFilter.From, expectedFilter.To, expectedFilter.UserIDs, expectedFilter.Segments, "delete", false).
+		WillReturnRows(pgxmock.NewRows(columns))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	var operations []models.Operation
+	err = storage.ForEachOperation(ctx, expectedFilter, func(operation models.Operation) error {
+		operations = append(operations, operation)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Empty(t, operations)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetUserOperations(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1000
+	expectedDate := time.Date(2023, 8, 1, 0, 0, 0, 0, time.Local)
+	expectedOperations := []models.Operation{
+		{
+			ID:          7,
+			UserID:      expectedUserID,
+			SegmentSlug: "TEST",
+			Date:        expectedDate,
+			Action:      "delete",
+			Source:      models.OperationSourceSegmentDelete,
+		},
+		{
+			ID:          5,
+			UserID:      expectedUserID,
+			SegmentSlug: "TEST",
+			Date:        expectedDate,
+			Action:      "add",
+			AutoAdd:     true,
+			Source:      models.OperationSourceAutoAdd,
+		},
+	}
+	expectedFilter := models.UserHistoryFilter{
+		From:     expectedDate,
+		To:       expectedDate.AddDate(0, 1, 0),
+		BeforeID: 10,
+		Limit:    2,
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+    		id,
+    		segment_slug,
+    		date,
+    		action,
+    		auto_add,
+    		source
+		FROM %s
+		WHERE user_id = $1 AND id < $2 AND date >= $3 AND date < $4
+		ORDER BY id DESC
+		LIMIT $5
+	`, operationsTable)
+
+	columns := []string{"id", "segment_slug", "date", "action", "auto_add", "source"}
+	rows := pgxmock.NewRows(columns).
+		AddRow(7, "TEST", expectedDate, "delete", false, models.OperationSourceSegmentDelete).
+		AddRow(5, "TEST", expectedDate, "add", true, models.OperationSourceAutoAdd)
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(expectedUserID, expectedFilter.BeforeID, expectedFilter.From, expectedFilter.To, expectedFilter.Limit).
+		WillReturnRows(rows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	operations, err := storage.GetUserOperations(ctx, expectedUserID, expectedFilter)
+	require.NoError(t, err)
+	require.Equal(t, expectedOperations, operations)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetUserOperationsFirstPage(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	query := fmt.Sprintf(`
+		SELECT
+    		id,
+    		segment_slug,
+    		date,
+    		action,
+    		auto_add,
+    		source
+		FROM %s
+		WHERE user_id = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, operationsTable)
+
+	columns := []string{"id", "segment_slug", "date", "action", "auto_add", "source"}
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(1000, 100).
+		WillReturnRows(pgxmock.NewRows(columns))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	operations, err := storage.GetUserOperations(ctx, 1000, models.UserHistoryFilter{Limit: 100})
+	require.NoError(t, err)
+	require.Empty(t, operations)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
@@ -0,0 +1,280 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"time"
+)
+
+func (s *Storage) CreateReport(ctx context.Context, report models.Report) error {
+	params, err := json.Marshal(report.Filter)
+	if err != nil {
+		return fmt.Errorf("ReportRepo.CreateReport - json.Marshal: %w", err)
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (id, status, params, format, gzip, created_at, updated_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6, $7)
+	`, reportsTable)
+
+	_, err = s.db.Exec(ctx, query, report.ID, report.Status, params, report.Format, report.Gzip, report.CreatedAt,
+		report.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("ReportRepo.CreateReport - s.db.Exec: %w", err)
+	}
+
+	return nil
+}
+
+// ClaimReport marks the oldest pending report as running and returns it, nil is returned
+// when there are no pending reports. Locked rows are skipped, so concurrent workers never get the same report.
+func (s *Storage) ClaimReport(ctx context.Context) (*models.Report, error) {
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $1, updated_at = $2
+		WHERE id = (
+			SELECT id
+			FROM %s
+			WHERE status = $3
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, params, format, gzip, created_at
+	`, reportsTable, reportsTable)
+
+	report := models.Report{
+		Status:    models.ReportStatusRunning,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	var params []byte
+
+	err := s.db.QueryRow(ctx, query, report.Status, report.UpdatedAt, models.ReportStatusPending).
+		Scan(&report.ID, &params, &report.Format, &report.Gzip, &report.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ReportRepo.ClaimReport - s.db.QueryRow.Scan: %w", err)
+	}
+
+	err = json.Unmarshal(params, &report.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("ReportRepo.ClaimReport - json.Unmarshal: %w", err)
+	}
+
+	return &report, nil
+}
+
+// FinishReport marks the running report as done and returns false when the report isn't running anymore,
+// e.g. it was marked as failed as a stale one.
+func (s *Storage) FinishReport(ctx context.Context, id string, rows, size int64) (bool, error) {
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $2, rows_count = $3, size = $4, updated_at = $5
+		WHERE id = $1 AND status = $6
+	`, reportsTable)
+
+	ct, err := s.db.Exec(ctx, query, id, models.ReportStatusDone, rows, size, time.Now().UTC(), models.ReportStatusRunning)
+	if err != nil {
+		return false, fmt.Errorf("ReportRepo.FinishReport - s.db.Exec: %w", err)
+	}
+
+	return ct.RowsAffected() > 0, nil
+}
+
+// FailReport marks the running report as failed with the message and returns false when the report
+// isn't running anymore.
+func (s *Storage) FailReport(ctx context.Context, id string, message string) (bool, error) {
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $2, error = $3, updated_at = $4
+		WHERE id = $1 AND status = $5
+	`, reportsTable)
+
+	ct, err := s.db.Exec(ctx, query, id, models.ReportStatusFailed, message, time.Now().UTC(), models.ReportStatusRunning)
+	if err != nil {
+		return false, fmt.Errorf("ReportRepo.FailReport - s.db.Exec: %w", err)
+	}
+
+	return ct.RowsAffected() > 0, nil
+}
+
+func (s *Storage) GetReport(ctx context.Context, id string) (models.Report, error) {
+	query := fmt.Sprintf(`
+		SELECT id, status, params, format, gzip, rows_count, size, error, created_at, updated_at, expires_at
+		FROM %s
+		WHERE id = $1
+	`, reportsTable)
+
+	var (
+		report models.Report
+		params []byte
+	)
+
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&report.ID,
+		&report.Status,
+		&params,
+		&report.Format,
+		&report.Gzip,
+		&report.Rows,
+		&report.Size,
+		&report.Error,
+		&report.CreatedAt,
+		&report.UpdatedAt,
+		&report.ExpiresAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.Report{}, custom_error.NotFoundError{
+				Field:   "id",
+				Message: fmt.Sprintf("report %s doesn't exist", id),
+			}
+		}
+		return models.Report{}, fmt.Errorf("ReportRepo.GetReport - s.db.QueryRow.Scan: %w", err)
+	}
+
+	err = json.Unmarshal(params, &report.Filter)
+	if err != nil {
+		return models.Report{}, fmt.Errorf("ReportRepo.GetReport - json.Unmarshal: %w", err)
+	}
+
+	return report, nil
+}
+
+// FailStaleReports marks reports which have been running since before staleBefore as failed with the message
+// and returns their number. Such reports were left by workers which stopped while generating them.
+func (s *Storage) FailStaleReports(ctx context.Context, staleBefore time.Time, message string) (int, error) {
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $1, error = $2, updated_at = $3
+		WHERE status = $4 AND updated_at < $5
+	`, reportsTable)
+
+	ct, err := s.db.Exec(ctx, query, models.ReportStatusFailed, message, time.Now().UTC(), models.ReportStatusRunning,
+		staleBefore)
+	if err != nil {
+		return 0, fmt.Errorf("ReportRepo.FailStaleReports - s.db.Exec: %w", err)
+	}
+
+	return int(ct.RowsAffected()), nil
+}
+
+// DeleteReport deletes the report which is not being generated and returns it.
+func (s *Storage) DeleteReport(ctx context.Context, id string) (models.Report, error) {
+	query := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE id = $1 AND status <> $2
+		RETURNING id, status, format, gzip
+	`, reportsTable)
+
+	var report models.Report
+
+	err := s.db.QueryRow(ctx, query, id, models.ReportStatusRunning).
+		Scan(&report.ID, &report.Status, &report.Format, &report.Gzip)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.Report{}, custom_error.NotFoundError{
+				Field:   "id",
+				Message: fmt.Sprintf("report %s doesn't exist", id),
+			}
+		}
+		return models.Report{}, fmt.Errorf("ReportRepo.DeleteReport - s.db.QueryRow.Scan: %w", err)
+	}
+
+	return report, nil
+}
+
+// SetMissingReportsExpiry sets the expiry of reports which have none to their creation time plus retention
+// and returns the number of updated reports.
+func (s *Storage) SetMissingReportsExpiry(ctx context.Context, retention time.Duration) (int, error) {
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET expires_at = created_at + $1 * INTERVAL '1 microsecond'
+		WHERE expires_at IS NULL
+	`, reportsTable)
+
+	ct, err := s.db.Exec(ctx, query, retention.Microseconds())
+	if err != nil {
+		return 0, fmt.Errorf("ReportRepo.SetMissingReportsExpiry - s.db.Exec: %w", err)
+	}
+
+	return int(ct.RowsAffected()), nil
+}
+
+// GetExpiredReports returns at most limit reports expired by now, except reports which are being generated.
+func (s *Storage) GetExpiredReports(ctx context.Context, now time.Time, limit int) ([]models.Report, error) {
+	query := fmt.Sprintf(`
+		SELECT id, status, format, gzip, expires_at
+		FROM %s
+		WHERE expires_at <= $1 AND status <> $2
+		ORDER BY expires_at
+		LIMIT $3
+	`, reportsTable)
+
+	rows, err := s.db.Query(ctx, query, now, models.ReportStatusRunning, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ReportRepo.GetExpiredReports - s.db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var reports []models.Report
+
+	for rows.Next() {
+		var report models.Report
+
+		err = rows.Scan(&report.ID, &report.Status, &report.Format, &report.Gzip, &report.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("ReportRepo.GetExpiredReports - rows.Scan: %w", err)
+		}
+
+		reports = append(reports, report)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ReportRepo.GetExpiredReports - rows.Err: %w", err)
+	}
+
+	return reports, nil
+}
+
+// GetExistingReportIDs returns those of ids which have a report.
+func (s *Storage) GetExistingReportIDs(ctx context.Context, ids []string) ([]string, error) {
+	query := fmt.Sprintf(`
+		SELECT id
+		FROM %s
+		WHERE id = ANY($1::uuid[])
+	`, reportsTable)
+
+	rows, err := s.db.Query(ctx, query, ids)
+	if err != nil {
+		return nil, fmt.Errorf("ReportRepo.GetExistingReportIDs - s.db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var existing []string
+
+	for rows.Next() {
+		var id string
+
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("ReportRepo.GetExistingReportIDs - rows.Scan: %w", err)
+		}
+
+		existing = append(existing, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ReportRepo.GetExistingReportIDs - rows.Err: %w", err)
+	}
+
+	return existing, nil
+}
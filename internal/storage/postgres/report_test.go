@@ -0,0 +1,443 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v2"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var queryFinishReport = fmt.Sprintf(`
+	UPDATE %s
+	SET status = $2, rows_count = $3, size = $4, updated_at = $5
+	WHERE id = $1 AND status = $6
+`, reportsTable)
+
+func TestStorage_CreateReport(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedReport := models.Report{
+		ID:     "1f674039-d035-4b1a-ac8b-51b67ab350e1",
+		Status: models.ReportStatusPending,
+		Format: models.ReportFormatCSV,
+		Gzip:   true,
+		Filter: models.OperationFilter{
+			From:    time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+			To:      time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC),
+			UserIDs: []int{1},
+		},
+		CreatedAt: time.Now().UTC(),
+	}
+	expiresAt := expectedReport.CreatedAt.Add(7 * 24 * time.Hour)
+	expectedReport.ExpiresAt = &expiresAt
+
+	expectedParams, err := json.Marshal(expectedReport.Filter)
+	require.NoError(t, err)
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (id, status, params, format, gzip, created_at, updated_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6, $7)
+	`, reportsTable)
+
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs(expectedReport.ID, expectedReport.Status, expectedParams, expectedReport.Format,
+			expectedReport.Gzip, expectedReport.CreatedAt, expectedReport.ExpiresAt).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.CreateReport(ctx, expectedReport)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_ClaimReport(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedID := "1f674039-d035-4b1a-ac8b-51b67ab350e1"
+	expectedFilter := models.OperationFilter{
+		From:   time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+		To:     time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC),
+		Action: "add",
+	}
+	expectedCreatedAt := time.Date(2023, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	params, err := json.Marshal(expectedFilter)
+	require.NoError(t, err)
+
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $1, updated_at = $2
+		WHERE id = (
+			SELECT id
+			FROM %s
+			WHERE status = $3
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, params, format, gzip, created_at
+	`, reportsTable, reportsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(models.ReportStatusRunning, pgxmock.AnyArg(), models.ReportStatusPending).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "params", "format", "gzip", "created_at"}).
+			AddRow(expectedID, params, models.ReportFormatParquet, false, expectedCreatedAt))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	report, err := storage.ClaimReport(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, report)
+	require.Equal(t, expectedID, report.ID)
+	require.Equal(t, models.ReportStatusRunning, report.Status)
+	require.Equal(t, expectedFilter, report.Filter)
+	require.Equal(t, models.ReportFormatParquet, report.Format)
+	require.Equal(t, expectedCreatedAt, report.CreatedAt)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_ClaimReportNoPending(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	mock.ExpectQuery(regexp.QuoteMeta("RETURNING id, params, format, gzip, created_at")).
+		WithArgs(models.ReportStatusRunning, pgxmock.AnyArg(), models.ReportStatusPending).
+		WillReturnError(pgx.ErrNoRows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	report, err := storage.ClaimReport(ctx)
+	require.NoError(t, err)
+	require.Nil(t, report)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_FailStaleReports(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	staleBefore := time.Date(2023, 9, 1, 10, 0, 0, 0, time.UTC)
+	message := "report generation was interrupted"
+
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $1, error = $2, updated_at = $3
+		WHERE status = $4 AND updated_at < $5
+	`, reportsTable)
+
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs(models.ReportStatusFailed, message, pgxmock.AnyArg(), models.ReportStatusRunning, staleBefore).
+		WillReturnResult(pgxmock.NewResult("update", 2))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	failed, err := storage.FailStaleReports(ctx, staleBefore, message)
+	require.NoError(t, err)
+	require.Equal(t, 2, failed)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_FinishReport(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedID := "1f674039-d035-4b1a-ac8b-51b67ab350e1"
+
+	mock.ExpectExec(regexp.QuoteMeta(queryFinishReport)).
+		WithArgs(expectedID, models.ReportStatusDone, int64(10), int64(512), pgxmock.AnyArg(), models.ReportStatusRunning).
+		WillReturnResult(pgxmock.NewResult("update", 1))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	finished, err := storage.FinishReport(ctx, expectedID, 10, 512)
+	require.NoError(t, err)
+	require.True(t, finished)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_FinishReportNotRunning(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedID := "1f674039-d035-4b1a-ac8b-51b67ab350e1"
+
+	// the report was marked as failed as a stale one
+	mock.ExpectExec(regexp.QuoteMeta(queryFinishReport)).
+		WithArgs(expectedID, models.ReportStatusDone, int64(10), int64(512), pgxmock.AnyArg(), models.ReportStatusRunning).
+		WillReturnResult(pgxmock.NewResult("update", 0))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	finished, err := storage.FinishReport(ctx, expectedID, 10, 512)
+	require.NoError(t, err)
+	require.False(t, finished)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_FailReportNotRunning(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedID := "1f674039-d035-4b1a-ac8b-51b67ab350e1"
+
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $2, error = $3, updated_at = $4
+		WHERE id = $1 AND status = $5
+	`, reportsTable)
+
+	// the report was finished, so it isn't marked as failed
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs(expectedID, models.ReportStatusFailed, "timeout", pgxmock.AnyArg(), models.ReportStatusRunning).
+		WillReturnResult(pgxmock.NewResult("update", 0))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	failed, err := storage.FailReport(ctx, expectedID, "timeout")
+	require.NoError(t, err)
+	require.False(t, failed)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetReportNotExist(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedID := "1f674039-d035-4b1a-ac8b-51b67ab350e1"
+	expectedError := custom_error.NotFoundError{
+		Field:   "id",
+		Message: "report " + expectedID + " doesn't exist",
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, status, params, format, gzip, rows_count, size, error, created_at, updated_at, expires_at
+		FROM %s
+		WHERE id = $1
+	`, reportsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(expectedID).WillReturnError(pgx.ErrNoRows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.GetReport(ctx, expectedID)
+	require.ErrorIs(t, err, expectedError)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_DeleteReport(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedReport := models.Report{
+		ID:     "1f674039-d035-4b1a-ac8b-51b67ab350e1",
+		Status: models.ReportStatusDone,
+		Format: models.ReportFormatXLSX,
+	}
+
+	query := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE id = $1 AND status <> $2
+		RETURNING id, status, format, gzip
+	`, reportsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(expectedReport.ID, models.ReportStatusRunning).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "status", "format", "gzip"}).
+			AddRow(expectedReport.ID, expectedReport.Status, expectedReport.Format, expectedReport.Gzip))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	report, err := storage.DeleteReport(ctx, expectedReport.ID)
+	require.NoError(t, err)
+	require.Equal(t, expectedReport, report)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_DeleteReportNotExist(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedID := "1f674039-d035-4b1a-ac8b-51b67ab350e1"
+	expectedError := custom_error.NotFoundError{
+		Field:   "id",
+		Message: "report " + expectedID + " doesn't exist",
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM "+reportsTable)).
+		WithArgs(expectedID, models.ReportStatusRunning).
+		WillReturnError(pgx.ErrNoRows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.DeleteReport(ctx, expectedID)
+	require.ErrorIs(t, err, expectedError)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_SetMissingReportsExpiry(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET expires_at = created_at + $1 * INTERVAL '1 microsecond'
+		WHERE expires_at IS NULL
+	`, reportsTable)
+
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs((24 * time.Hour).Microseconds()).
+		WillReturnResult(pgxmock.NewResult("update", 3))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	updated, err := storage.SetMissingReportsExpiry(ctx, 24*time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, 3, updated)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetExpiredReports(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(-time.Hour)
+	expectedReports := []models.Report{
+		{
+			ID:        "1f674039-d035-4b1a-ac8b-51b67ab350e1",
+			Status:    models.ReportStatusDone,
+			Format:    models.ReportFormatCSV,
+			Gzip:      true,
+			ExpiresAt: &expiresAt,
+		},
+		{
+			ID:        "2e1f4a3c-9b7d-4c1e-8f2a-3b4c5d6e7f80",
+			Status:    models.ReportStatusFailed,
+			Format:    models.ReportFormatParquet,
+			ExpiresAt: &expiresAt,
+		},
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, status, format, gzip, expires_at
+		FROM %s
+		WHERE expires_at <= $1 AND status <> $2
+		ORDER BY expires_at
+		LIMIT $3
+	`, reportsTable)
+
+	rows := pgxmock.NewRows([]string{"id", "status", "format", "gzip", "expires_at"})
+	for _, report := range expectedReports {
+		rows.AddRow(report.ID, report.Status, report.Format, report.Gzip, report.ExpiresAt)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(now, models.ReportStatusRunning, 100).
+		WillReturnRows(rows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	reports, err := storage.GetExpiredReports(ctx, now, 100)
+	require.NoError(t, err)
+	require.Equal(t, expectedReports, reports)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetExistingReportIDs(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	ids := []string{"1f674039-d035-4b1a-ac8b-51b67ab350e1", "2e1f4a3c-9b7d-4c1e-8f2a-3b4c5d6e7f80"}
+
+	query := fmt.Sprintf(`
+		SELECT id
+		FROM %s
+		WHERE id = ANY($1::uuid[])
+	`, reportsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(ids).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(ids[1]))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	existing, err := storage.GetExistingReportIDs(ctx, ids)
+	require.NoError(t, err)
+	require.Equal(t, []string{ids[1]}, existing)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
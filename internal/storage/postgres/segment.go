@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
@@ -12,11 +13,12 @@ import (
 
 func (s *Storage) CreateSegment(ctx context.Context, segment models.Segment) error {
 	query := fmt.Sprintf(`
-		INSERT INTO %s (slug, auto_add_percentage) 
-		VALUES ($1, $2)
+		INSERT INTO %s (slug, auto_add_percentage, salt, parent_slug, rule, starts_at, ends_at, window_open)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8)
 	`, segmentsTable)
 
-	_, err := s.db.Exec(ctx, query, segment.Slug, segment.Percentage)
+	_, err := s.db.Exec(ctx, query, segment.Slug, segment.Percentage, segment.Salt, segment.Parent, segment.Rule,
+		segment.StartsAt, segment.EndsAt, segment.WindowOpen(time.Now().UTC()))
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
@@ -26,6 +28,12 @@ func (s *Storage) CreateSegment(ctx context.Context, segment models.Segment) err
 					Message: segment.Slug + " already exists",
 				}
 			}
+			if pgErr.Code == "23503" {
+				return custom_error.CustomError{
+					Field:   "parent",
+					Message: segment.Parent + " doesn't exist",
+				}
+			}
 		}
 		return fmt.Errorf("SegmentRepo.CreateSegment - s.db.Exec: %w", err)
 	}
@@ -73,6 +81,15 @@ func (s *Storage) DeleteSegment(ctx context.Context, slug string) error {
 
 	ct, err := tx.Exec(ctx, queryDeleteFromSegments, slug)
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.Code == "23503" {
+				return custom_error.CustomError{
+					Field:   "slug",
+					Message: slug + " is a parent of other segments",
+				}
+			}
+		}
 		return fmt.Errorf("SegmentRepo.DeleteSegment - tx.Exec: %w", err)
 	}
 
@@ -84,14 +101,14 @@ func (s *Storage) DeleteSegment(ctx context.Context, slug string) error {
 	}
 
 	queryAddOperations := fmt.Sprintf(`
-		INSERT INTO %s (user_id, segment_slug, date, action, auto_add) 
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source) 
+		VALUES ($1, $2, $3, $4, $5, $6)
 	`, operationsTable)
 
 	now := time.Now().UTC()
 
 	for _, userID := range userIDs {
-		_, err = tx.Exec(ctx, queryAddOperations, userID, slug, now, "delete", false)
+		_, err = tx.Exec(ctx, queryAddOperations, userID, slug, now, "delete", false, models.OperationSourceSegmentDelete)
 		if err != nil {
 			return fmt.Errorf("SegmentRepo.DeleteSegment - tx.Exec: %w", err)
 		}
@@ -104,3 +121,194 @@ func (s *Storage) DeleteSegment(ctx context.Context, slug string) error {
 
 	return nil
 }
+
+func (s *Storage) GetSegments(ctx context.Context, prefix string, limit, offset int) ([]models.Segment, error) {
+	query := fmt.Sprintf(`
+		SELECT s.slug, s.auto_add_percentage, COALESCE(s.parent_slug, ''), COALESCE(s.rule, ''), s.starts_at, s.ends_at, s.description, s.owner, s.created_at, COUNT(us.user_id)
+		FROM %s s
+		LEFT JOIN %s us ON us.segment_slug = s.slug
+		WHERE starts_with(s.slug, $1)
+		GROUP BY s.slug
+		ORDER BY s.slug
+		LIMIT $2 OFFSET $3
+	`, segmentsTable, userSegmentsTable)
+
+	rows, err := s.db.Query(ctx, query, prefix, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("SegmentRepo.GetSegments - s.db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var segments []models.Segment
+	for rows.Next() {
+		var segment models.Segment
+
+		err = rows.Scan(&segment.Slug, &segment.Percentage, &segment.Parent, &segment.Rule, &segment.StartsAt, &segment.EndsAt,
+			&segment.Description, &segment.Owner, &segment.CreatedAt, &segment.UsersCount)
+		if err != nil {
+			return nil, fmt.Errorf("SegmentRepo.GetSegments - rows.Scan: %w", err)
+		}
+
+		segments = append(segments, segment)
+	}
+
+	return segments, nil
+}
+
+func (s *Storage) GetSegment(ctx context.Context, slug string) (models.Segment, error) {
+	query := fmt.Sprintf(`
+		SELECT s.slug, s.auto_add_percentage, COALESCE(s.parent_slug, ''), COALESCE(s.rule, ''), s.starts_at, s.ends_at, s.description, s.owner, s.created_at, COUNT(us.user_id)
+		FROM %s s
+		LEFT JOIN %s us ON us.segment_slug = s.slug
+		WHERE s.slug = $1
+		GROUP BY s.slug
+	`, segmentsTable, userSegmentsTable)
+
+	var segment models.Segment
+
+	err := s.db.QueryRow(ctx, query, slug).
+		Scan(&segment.Slug, &segment.Percentage, &segment.Parent, &segment.Rule, &segment.StartsAt, &segment.EndsAt,
+			&segment.Description, &segment.Owner, &segment.CreatedAt, &segment.UsersCount)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.Segment{}, custom_error.NotFoundError{
+				Field:   "slug",
+				Message: slug + " doesn't exist",
+			}
+		}
+		return models.Segment{}, fmt.Errorf("SegmentRepo.GetSegment - s.db.QueryRow.Scan: %w", err)
+	}
+
+	return segment, nil
+}
+
+func (s *Storage) UpdateSegment(ctx context.Context, slug string, update models.SegmentUpdate) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.UpdateSegment - s.db.Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT auto_add_percentage, salt, COALESCE(rule, '')
+		FROM %s
+		WHERE slug = $1
+		FOR UPDATE
+	`, segmentsTable)
+
+	segment := models.Segment{Slug: slug}
+
+	err = tx.QueryRow(ctx, querySelectSegment, slug).Scan(&segment.Percentage, &segment.Salt, &segment.Rule)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return custom_error.NotFoundError{
+				Field:   "slug",
+				Message: slug + " doesn't exist",
+			}
+		}
+		return fmt.Errorf("SegmentRepo.UpdateSegment - tx.QueryRow.Scan: %w", err)
+	}
+
+	if update.Percentage != nil && *update.Percentage > 0 {
+		if segment.Rule != "" {
+			return custom_error.CustomError{
+				Field:   "auto_add_percentage",
+				Message: slug + " is assigned by rule and cannot have auto add percentage",
+			}
+		}
+
+		err = checkNotExperimentVariant(ctx, tx, slug)
+		if err != nil {
+			return err
+		}
+	}
+
+	queryUpdateSegment := fmt.Sprintf(`
+		UPDATE %s
+		SET auto_add_percentage = COALESCE($2, auto_add_percentage),
+		    description = COALESCE($3, description),
+		    owner = COALESCE($4, owner)
+		WHERE slug = $1
+	`, segmentsTable)
+
+	_, err = tx.Exec(ctx, queryUpdateSegment, slug, update.Percentage, update.Description, update.Owner)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.UpdateSegment - tx.Exec: %w", err)
+	}
+
+	if update.TrimAutoAdded && update.Percentage != nil && *update.Percentage < segment.Percentage {
+		segment.Percentage = *update.Percentage
+
+		err = trimAutoAddedUsers(ctx, tx, segment, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.UpdateSegment - tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+// trimAutoAddedUsers removes the segment from auto added users whose bucket is out of the segment percentage,
+// children of the segment are removed from them too. Manually added users keep the segment.
+func trimAutoAddedUsers(ctx context.Context, tx pgx.Tx, segment models.Segment, now time.Time) error {
+	querySelectAutoAddedUsers := fmt.Sprintf(`
+		SELECT user_id
+		FROM %s
+		WHERE segment_slug = $1 AND auto_add = true
+	`, userSegmentsTable)
+
+	rows, err := tx.Query(ctx, querySelectAutoAddedUsers, segment.Slug)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.trimAutoAddedUsers - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+
+		err = rows.Scan(&userID)
+		if err != nil {
+			return fmt.Errorf("SegmentRepo.trimAutoAddedUsers - rows.Scan: %w", err)
+		}
+
+		if segment.Bucket(userID) >= segment.Percentage {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	queryDeleteUserSegments := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE segment_slug = $1 AND user_id = ANY($2)
+	`, userSegmentsTable)
+
+	_, err = tx.Exec(ctx, queryDeleteUserSegments, segment.Slug, userIDs)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.trimAutoAddedUsers - tx.Exec: %w", err)
+	}
+
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, true, $5)
+	`, operationsTable)
+
+	for _, userID := range userIDs {
+		_, err = tx.Exec(ctx, queryInsertOperation, userID, segment.Slug, now, "delete", models.OperationSourceSegmentUpdate)
+		if err != nil {
+			return fmt.Errorf("SegmentRepo.trimAutoAddedUsers - tx.Exec: %w", err)
+		}
+	}
+
+	return deleteChildUserSegments(ctx, tx, []string{segment.Slug}, userIDs, now)
+}
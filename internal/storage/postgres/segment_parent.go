@@ -0,0 +1,121 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"time"
+)
+
+// checkSegmentParent returns an error when the segment has a parent which the user won't have after the update:
+// the user doesn't have the parent and doesn't get it in the same update or the parent is deleted in it.
+func checkSegmentParent(ctx context.Context, tx pgx.Tx, segment string, userID int, segmentsToAdd []models.UserSegment, segmentsToDelete []string) error {
+	query := fmt.Sprintf(`
+		SELECT s.parent_slug, EXISTS (
+			SELECT 1
+			FROM %s us
+			WHERE us.user_id = $2 AND us.segment_slug = s.parent_slug
+		)
+		FROM %s s
+		WHERE s.slug = $1 AND s.parent_slug IS NOT NULL
+	`, userSegmentsTable, segmentsTable)
+
+	var (
+		parent    string
+		hasParent bool
+	)
+
+	err := tx.QueryRow(ctx, query, segment, userID).Scan(&parent, &hasParent)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("SegmentRepo.checkSegmentParent - tx.QueryRow.Scan: %w", err)
+	}
+
+	for _, slug := range segmentsToDelete {
+		if slug == parent {
+			hasParent = false
+		}
+	}
+	for _, added := range segmentsToAdd {
+		if added.Slug == parent {
+			hasParent = true
+		}
+	}
+
+	if !hasParent {
+		return custom_error.CustomError{
+			Field:   "segments_to_add",
+			Message: parentMissingMessage(userID, segment, parent),
+		}
+	}
+
+	return nil
+}
+
+// selectSegmentParents returns parents of the segments which have them.
+func selectSegmentParents(ctx context.Context, db PgxPool, slugs []string) (map[string]string, error) {
+	query := fmt.Sprintf(`
+		SELECT slug, parent_slug
+		FROM %s
+		WHERE slug = ANY($1) AND parent_slug IS NOT NULL
+	`, segmentsTable)
+
+	rows, err := db.Query(ctx, query, slugs)
+	if err != nil {
+		return nil, fmt.Errorf("SegmentRepo.selectSegmentParents - db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	parents := make(map[string]string)
+	for rows.Next() {
+		var slug, parent string
+
+		err = rows.Scan(&slug, &parent)
+		if err != nil {
+			return nil, fmt.Errorf("SegmentRepo.selectSegmentParents - rows.Scan: %w", err)
+		}
+
+		parents[slug] = parent
+	}
+
+	return parents, nil
+}
+
+// deleteChildUserSegments removes children of the segments at any depth from the users, who have just lost the segments,
+// and records the removals as delete operations.
+func deleteChildUserSegments(ctx context.Context, tx pgx.Tx, segments []string, userIDs []int, now time.Time) error {
+	query := fmt.Sprintf(`
+		WITH RECURSIVE children AS (
+			SELECT slug
+			FROM %s
+			WHERE parent_slug = ANY($1)
+			UNION
+			SELECT s.slug
+			FROM %s s
+			JOIN children c ON s.parent_slug = c.slug
+		), deleted AS (
+			DELETE FROM %s
+			WHERE user_id = ANY($2) AND segment_slug IN (SELECT slug FROM children)
+			RETURNING user_id, segment_slug
+		)
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		SELECT user_id, segment_slug, $3, 'delete', false, $4
+		FROM deleted
+	`, segmentsTable, segmentsTable, userSegmentsTable, operationsTable)
+
+	_, err := tx.Exec(ctx, query, segments, userIDs, now, models.OperationSourceParentDelete)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.deleteChildUserSegments - tx.Exec: %w", err)
+	}
+
+	return nil
+}
+
+func parentMissingMessage(userID int, segment, parent string) string {
+	return fmt.Sprintf("User (%d) cannot have %s without parent segment %s", userID, segment, parent)
+}
@@ -0,0 +1,233 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v2"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+)
+
+var (
+	queryCheckSegmentParent = fmt.Sprintf(`
+		SELECT s.parent_slug, EXISTS (
+			SELECT 1
+			FROM %s us
+			WHERE us.user_id = $2 AND us.segment_slug = s.parent_slug
+		)
+		FROM %s s
+		WHERE s.slug = $1 AND s.parent_slug IS NOT NULL
+	`, userSegmentsTable, segmentsTable)
+
+	querySelectSegmentParents = fmt.Sprintf(`
+		SELECT slug, parent_slug
+		FROM %s
+		WHERE slug = ANY($1) AND parent_slug IS NOT NULL
+	`, segmentsTable)
+
+	queryDeleteChildUserSegments = fmt.Sprintf(`
+		WITH RECURSIVE children AS (
+			SELECT slug
+			FROM %s
+			WHERE parent_slug = ANY($1)
+			UNION
+			SELECT s.slug
+			FROM %s s
+			JOIN children c ON s.parent_slug = c.slug
+		), deleted AS (
+			DELETE FROM %s
+			WHERE user_id = ANY($2) AND segment_slug IN (SELECT slug FROM children)
+			RETURNING user_id, segment_slug
+		)
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		SELECT user_id, segment_slug, $3, 'delete', false, $4
+		FROM deleted
+	`, segmentsTable, segmentsTable, userSegmentsTable, operationsTable)
+)
+
+func TestCheckSegmentParent(t *testing.T) {
+	testCases := []struct {
+		name             string
+		hasParent        bool
+		segmentsToAdd    []models.UserSegment
+		segmentsToDelete []string
+		expectedError    error
+	}{
+		{
+			name:      "user has parent",
+			hasParent: true,
+		},
+		{
+			name:          "parent is added in the same update",
+			segmentsToAdd: []models.UserSegment{{Slug: "VOICE_MESSAGES_BETA"}, {Slug: "BETA_TESTERS"}},
+		},
+		{
+			name: "user doesn't have parent",
+			expectedError: custom_error.CustomError{
+				Field:   "segments_to_add",
+				Message: "User (1) cannot have VOICE_MESSAGES_BETA without parent segment BETA_TESTERS",
+			},
+		},
+		{
+			name:             "parent is deleted in the same update",
+			hasParent:        true,
+			segmentsToDelete: []string{"BETA_TESTERS"},
+			expectedError: custom_error.CustomError{
+				Field:   "segments_to_add",
+				Message: "User (1) cannot have VOICE_MESSAGES_BETA without parent segment BETA_TESTERS",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			require.NoError(t, err)
+			defer mock.Close()
+
+			ctx := context.Background()
+
+			mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegmentParent)).WithArgs("VOICE_MESSAGES_BETA", 1).
+				WillReturnRows(pgxmock.NewRows([]string{"parent_slug", "exists"}).AddRow("BETA_TESTERS", tc.hasParent))
+
+			err = checkSegmentParent(ctx, mock, "VOICE_MESSAGES_BETA", 1, tc.segmentsToAdd, tc.segmentsToDelete)
+			require.ErrorIs(t, err, tc.expectedError)
+
+			require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+		})
+	}
+}
+
+func TestAutoSegments(t *testing.T) {
+	segments := []models.Segment{
+		{Slug: "VOICE_MESSAGES_BETA", Percentage: 100, Parent: "BETA_TESTERS"},
+		{Slug: "DARK_THEME_BETA", Percentage: 100, Parent: "DARK_THEME"},
+		{Slug: "BANNER_A", Percentage: 100},
+		{Slug: "BANNER_B", Percentage: 100},
+	}
+	experiments := []models.Experiment{
+		{Slug: "BETA", Variants: []models.ExperimentVariant{{Slug: "BETA_TESTERS", Weight: 100}}},
+		{Slug: "CHECKOUT", Variants: []models.ExperimentVariant{
+			{Slug: "CHECKOUT_A", Weight: 50},
+			{Slug: "CHECKOUT_CONTROL", Weight: 50},
+		}},
+	}
+	exclusions := exclusions{
+		"BANNER_A": {"BANNER_B": "BANNERS"},
+		"BANNER_B": {"BANNER_A": "BANNERS"},
+	}
+	assigned := map[string]struct{}{"CHECKOUT_A": {}}
+
+	result := autoSegments(1, segments, experiments, exclusions, assigned)
+	require.Equal(t, []string{"BANNER_A", "BETA_TESTERS", "VOICE_MESSAGES_BETA"}, result)
+	require.Equal(t, map[string]struct{}{
+		"CHECKOUT_A":          {},
+		"BANNER_A":            {},
+		"BETA_TESTERS":        {},
+		"VOICE_MESSAGES_BETA": {},
+	}, assigned)
+}
+
+func TestStorage_BulkUpdateUserSegmentsParentDeleted(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	queryCheckSegments := fmt.Sprintf(`
+		SELECT slug
+		FROM %s
+		WHERE slug = ANY($1)
+	`, segmentsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegments)).WithArgs([]string{"VOICE_MESSAGES_BETA", "BETA_TESTERS"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug"}).AddRow("VOICE_MESSAGES_BETA").AddRow("BETA_TESTERS"))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperimentVariants)).WithArgs([]string{"VOICE_MESSAGES_BETA"}).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "experiment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusions)).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug", "segment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentParents)).WithArgs([]string{"VOICE_MESSAGES_BETA"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "parent_slug"}).AddRow("VOICE_MESSAGES_BETA", "BETA_TESTERS"))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.BulkUpdateUserSegments(ctx, []models.UserSegment{{Slug: "VOICE_MESSAGES_BETA"}}, []string{"BETA_TESTERS"}, []int{1})
+	require.ErrorIs(t, err, custom_error.CustomError{
+		Field:   "segments_to_add",
+		Message: "VOICE_MESSAGES_BETA cannot be added while its parent segment BETA_TESTERS is deleted",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_BulkUpdateUserSegmentsWithoutParent(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserIDs := []int{1, 2}
+
+	queryCheckSegments := fmt.Sprintf(`
+		SELECT slug
+		FROM %s
+		WHERE slug = ANY($1)
+	`, segmentsTable)
+
+	querySelectUserSegments := fmt.Sprintf(`
+		SELECT user_id, segment_slug
+		FROM %s
+		WHERE user_id = ANY($1) AND segment_slug = ANY($2)
+	`, userSegmentsTable)
+
+	queryRegisterUsers := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		SELECT unnest($1::integer[]), $2
+		ON CONFLICT (id) DO NOTHING
+		RETURNING id
+	`, usersTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegments)).WithArgs([]string{"VOICE_MESSAGES_BETA"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug"}).AddRow("VOICE_MESSAGES_BETA"))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperimentVariants)).WithArgs([]string{"VOICE_MESSAGES_BETA"}).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "experiment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusions)).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug", "segment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentParents)).WithArgs([]string{"VOICE_MESSAGES_BETA"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "parent_slug"}).AddRow("VOICE_MESSAGES_BETA", "BETA_TESTERS"))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectUserSegments)).
+		WithArgs(expectedUserIDs, []string{"VOICE_MESSAGES_BETA", "BETA_TESTERS"}).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_slug"}).AddRow(1, "BETA_TESTERS"))
+	mock.ExpectQuery(regexp.QuoteMeta(queryRegisterUsers)).WithArgs([]int{1}, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectCopyFrom(pgx.Identifier{userSegmentsTable},
+		[]string{"user_id", "segment_slug", "expires_at", "auto_add", "added_at"}).
+		WillReturnResult(1)
+	mock.ExpectCopyFrom(pgx.Identifier{operationsTable},
+		[]string{"user_id", "segment_slug", "date", "action", "auto_add", "source"}).
+		WillReturnResult(1)
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	results, err := storage.BulkUpdateUserSegments(ctx, []models.UserSegment{{Slug: "VOICE_MESSAGES_BETA"}}, []string{}, expectedUserIDs)
+	require.NoError(t, err)
+
+	require.Equal(t, []models.BulkUserResult{
+		{UserID: 1, Added: []string{"VOICE_MESSAGES_BETA"}},
+		{UserID: 2, Error: "User (2) cannot have VOICE_MESSAGES_BETA without parent segment BETA_TESTERS"},
+	}, results)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
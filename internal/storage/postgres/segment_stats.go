@@ -0,0 +1,246 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"time"
+)
+
+// GetSegmentStats returns the current number of users in the segment and its changes per day (UTC) made in [from, to).
+// Days which are not rolled up yet are aggregated from operations, days without changes are skipped.
+func (s *Storage) GetSegmentStats(ctx context.Context, slug string, from, to time.Time) (models.SegmentStats, error) {
+	querySelectUsers := fmt.Sprintf(`
+		SELECT COUNT(us.user_id), COUNT(us.user_id) FILTER (WHERE us.auto_add)
+		FROM %s s
+		LEFT JOIN %s us ON us.segment_slug = s.slug
+		WHERE s.slug = $1
+		GROUP BY s.slug
+	`, segmentsTable, userSegmentsTable)
+
+	stats := models.SegmentStats{Slug: slug}
+
+	err := s.db.QueryRow(ctx, querySelectUsers, slug).Scan(&stats.Users, &stats.AutoAddedUsers)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.SegmentStats{}, custom_error.NotFoundError{
+				Field:   "slug",
+				Message: slug + " doesn't exist",
+			}
+		}
+		return models.SegmentStats{}, fmt.Errorf("SegmentStatsRepo.GetSegmentStats - s.db.QueryRow.Scan: %w", err)
+	}
+
+	querySelectDays := fmt.Sprintf(`
+		WITH rollup AS (
+    		SELECT COALESCE(rolled_until, '-infinity'::date) AS rolled_until
+    		FROM %s
+		)
+		SELECT day, manual_adds, auto_adds, deletes
+		FROM %s, rollup
+		WHERE segment_slug = $1
+			AND day >= ($2::timestamptz AT TIME ZONE 'UTC')::date
+			AND day < ($3::timestamptz AT TIME ZONE 'UTC')::date
+			AND day < rollup.rolled_until
+		UNION ALL
+		SELECT
+    		(o.date AT TIME ZONE 'UTC')::date AS day,
+    		COUNT(*) FILTER (WHERE o.action = 'add' AND NOT o.auto_add),
+    		COUNT(*) FILTER (WHERE o.action = 'add' AND o.auto_add),
+    		COUNT(*) FILTER (WHERE o.action = 'delete')
+		FROM %s o, rollup
+		WHERE o.segment_slug = $1
+			AND o.date >= $2::timestamptz
+			AND o.date < $3::timestamptz
+			AND o.date >= (rollup.rolled_until::timestamp AT TIME ZONE 'UTC')
+		GROUP BY 1
+		ORDER BY day
+	`, statsRollupTable, segmentStatsTable, operationsTable)
+
+	rows, err := s.db.Query(ctx, querySelectDays, slug, from, to)
+	if err != nil {
+		return models.SegmentStats{}, fmt.Errorf("SegmentStatsRepo.GetSegmentStats - s.db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day models.SegmentDayStats
+
+		err = rows.Scan(&day.Day, &day.ManualAdds, &day.AutoAdds, &day.Deletes)
+		if err != nil {
+			return models.SegmentStats{}, fmt.Errorf("SegmentStatsRepo.GetSegmentStats - rows.Scan: %w", err)
+		}
+
+		stats.Days = append(stats.Days, day)
+	}
+
+	if err = rows.Err(); err != nil {
+		return models.SegmentStats{}, fmt.Errorf("SegmentStatsRepo.GetSegmentStats - rows.Err: %w", err)
+	}
+
+	return stats, nil
+}
+
+// RollupSegmentStats aggregates operations of every day (UTC) after the last rolled up day and before until
+// into daily stats of segments. Rolled up days which got operations committed after the previous rollup
+// are aggregated again. It returns the number of rolled up days. Nothing is rolled up when another
+// instance runs the job (see tryJobLock).
+func (s *Storage) RollupSegmentStats(ctx context.Context, until time.Time) (int, error) {
+	// every query of the job sees the same operations, the rollup keeps them as visible for the next one
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	if err != nil {
+		return 0, fmt.Errorf("SegmentStatsRepo.RollupSegmentStats - s.db.BeginTx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	locked, err := tryJobLock(ctx, tx, statsRollupLockKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if !locked {
+		return 0, nil
+	}
+
+	until = truncateToDay(until)
+
+	// operation dates are taken before they are committed, so a rolled up day can get operations later
+	querySelectLateDays := fmt.Sprintf(`
+		SELECT DISTINCT (o.date AT TIME ZONE 'UTC')::date
+		FROM %s o, %s r
+		WHERE o.xid >= pg_snapshot_xmin(r.visible)
+			AND NOT pg_visible_in_snapshot(o.xid, r.visible)
+			AND o.date < (r.rolled_until::timestamp AT TIME ZONE 'UTC')
+		ORDER BY 1
+	`, operationsTable, statsRollupTable)
+
+	rows, err := tx.Query(ctx, querySelectLateDays)
+	if err != nil {
+		return 0, fmt.Errorf("SegmentStatsRepo.RollupSegmentStats - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var lateDays []time.Time
+	for rows.Next() {
+		var day time.Time
+
+		err = rows.Scan(&day)
+		if err != nil {
+			return 0, fmt.Errorf("SegmentStatsRepo.RollupSegmentStats - rows.Scan: %w", err)
+		}
+
+		lateDays = append(lateDays, day)
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("SegmentStatsRepo.RollupSegmentStats - rows.Err: %w", err)
+	}
+
+	for _, day := range lateDays {
+		err = rollupDays(ctx, tx, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	querySelectRolledUntil := fmt.Sprintf(`
+		SELECT rolled_until
+		FROM %s
+	`, statsRollupTable)
+
+	var from *time.Time
+
+	err = tx.QueryRow(ctx, querySelectRolledUntil).Scan(&from)
+	if err != nil {
+		return 0, fmt.Errorf("SegmentStatsRepo.RollupSegmentStats - tx.QueryRow.Scan: %w", err)
+	}
+
+	// the first rollup starts from the day of the first operation
+	if from == nil {
+		querySelectFirstOperation := fmt.Sprintf(`
+			SELECT MIN(date)
+			FROM %s
+		`, operationsTable)
+
+		err = tx.QueryRow(ctx, querySelectFirstOperation).Scan(&from)
+		if err != nil {
+			return 0, fmt.Errorf("SegmentStatsRepo.RollupSegmentStats - tx.QueryRow.Scan: %w", err)
+		}
+	}
+
+	if from == nil {
+		from = &until
+	}
+	start := truncateToDay(*from)
+
+	rolledUntil := start
+	if start.Before(until) {
+		err = rollupDays(ctx, tx, start, until)
+		if err != nil {
+			return 0, err
+		}
+
+		rolledUntil = until
+	}
+
+	queryUpdateRollup := fmt.Sprintf(`
+		UPDATE %s
+		SET rolled_until = $1, visible = pg_current_snapshot()
+	`, statsRollupTable)
+
+	_, err = tx.Exec(ctx, queryUpdateRollup, rolledUntil)
+	if err != nil {
+		return 0, fmt.Errorf("SegmentStatsRepo.RollupSegmentStats - tx.Exec: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("SegmentStatsRepo.RollupSegmentStats - tx.Commit: %w", err)
+	}
+
+	return len(lateDays) + int(rolledUntil.Sub(start)/(24*time.Hour)), nil
+}
+
+// rollupDays replaces daily stats of segments for days in [from, until) with aggregated operations of these days.
+func rollupDays(ctx context.Context, tx pgx.Tx, from, until time.Time) error {
+	queryDeleteDays := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE day >= $1 AND day < $2
+	`, segmentStatsTable)
+
+	_, err := tx.Exec(ctx, queryDeleteDays, from, until)
+	if err != nil {
+		return fmt.Errorf("SegmentStatsRepo.rollupDays - tx.Exec: %w", err)
+	}
+
+	queryInsertDays := fmt.Sprintf(`
+		INSERT INTO %s (segment_slug, day, manual_adds, auto_adds, deletes)
+		SELECT
+    		segment_slug,
+    		(date AT TIME ZONE 'UTC')::date,
+    		COUNT(*) FILTER (WHERE action = 'add' AND NOT auto_add),
+    		COUNT(*) FILTER (WHERE action = 'add' AND auto_add),
+    		COUNT(*) FILTER (WHERE action = 'delete')
+		FROM %s
+		WHERE date >= $1 AND date < $2
+		GROUP BY 1, 2
+	`, segmentStatsTable, operationsTable)
+
+	_, err = tx.Exec(ctx, queryInsertDays, from, until)
+	if err != nil {
+		return fmt.Errorf("SegmentStatsRepo.rollupDays - tx.Exec: %w", err)
+	}
+
+	return nil
+}
+
+// truncateToDay returns the start of the day (UTC) of the moment.
+func truncateToDay(moment time.Time) time.Time {
+	year, month, day := moment.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
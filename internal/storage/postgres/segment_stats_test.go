@@ -0,0 +1,298 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v2"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var (
+	querySelectSegmentStatsUsers = fmt.Sprintf(`
+		SELECT COUNT(us.user_id), COUNT(us.user_id) FILTER (WHERE us.auto_add)
+		FROM %s s
+		LEFT JOIN %s us ON us.segment_slug = s.slug
+		WHERE s.slug = $1
+		GROUP BY s.slug
+	`, segmentsTable, userSegmentsTable)
+
+	querySelectSegmentStatsDays = fmt.Sprintf(`
+		WITH rollup AS (
+    		SELECT COALESCE(rolled_until, '-infinity'::date) AS rolled_until
+    		FROM %s
+		)
+		SELECT day, manual_adds, auto_adds, deletes
+		FROM %s, rollup
+		WHERE segment_slug = $1
+			AND day >= ($2::timestamptz AT TIME ZONE 'UTC')::date
+			AND day < ($3::timestamptz AT TIME ZONE 'UTC')::date
+			AND day < rollup.rolled_until
+		UNION ALL
+		SELECT
+    		(o.date AT TIME ZONE 'UTC')::date AS day,
+    		COUNT(*) FILTER (WHERE o.action = 'add' AND NOT o.auto_add),
+    		COUNT(*) FILTER (WHERE o.action = 'add' AND o.auto_add),
+    		COUNT(*) FILTER (WHERE o.action = 'delete')
+		FROM %s o, rollup
+		WHERE o.segment_slug = $1
+			AND o.date >= $2::timestamptz
+			AND o.date < $3::timestamptz
+			AND o.date >= (rollup.rolled_until::timestamp AT TIME ZONE 'UTC')
+		GROUP BY 1
+		ORDER BY day
+	`, statsRollupTable, segmentStatsTable, operationsTable)
+
+	querySelectLateDays = fmt.Sprintf(`
+		SELECT DISTINCT (o.date AT TIME ZONE 'UTC')::date
+		FROM %s o, %s r
+		WHERE o.xid >= pg_snapshot_xmin(r.visible)
+			AND NOT pg_visible_in_snapshot(o.xid, r.visible)
+			AND o.date < (r.rolled_until::timestamp AT TIME ZONE 'UTC')
+		ORDER BY 1
+	`, operationsTable, statsRollupTable)
+
+	querySelectRolledUntil = fmt.Sprintf(`
+		SELECT rolled_until
+		FROM %s
+	`, statsRollupTable)
+
+	querySelectFirstOperation = fmt.Sprintf(`
+			SELECT MIN(date)
+			FROM %s
+		`, operationsTable)
+
+	queryDeleteSegmentStatsDays = fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE day >= $1 AND day < $2
+	`, segmentStatsTable)
+
+	queryInsertSegmentStatsDays = fmt.Sprintf(`
+		INSERT INTO %s (segment_slug, day, manual_adds, auto_adds, deletes)
+		SELECT
+    		segment_slug,
+    		(date AT TIME ZONE 'UTC')::date,
+    		COUNT(*) FILTER (WHERE action = 'add' AND NOT auto_add),
+    		COUNT(*) FILTER (WHERE action = 'add' AND auto_add),
+    		COUNT(*) FILTER (WHERE action = 'delete')
+		FROM %s
+		WHERE date >= $1 AND date < $2
+		GROUP BY 1, 2
+	`, segmentStatsTable, operationsTable)
+
+	queryUpdateRollup = fmt.Sprintf(`
+		UPDATE %s
+		SET rolled_until = $1, visible = pg_current_snapshot()
+	`, statsRollupTable)
+)
+
+func TestStorage_GetSegmentStats(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	slug := "AVITO_TEST"
+	from := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 8, 4, 0, 0, 0, 0, time.UTC)
+
+	expectedStats := models.SegmentStats{
+		Slug:           slug,
+		Users:          10,
+		AutoAddedUsers: 4,
+		Days: []models.SegmentDayStats{
+			{Day: from, ManualAdds: 3, AutoAdds: 1, Deletes: 0},
+			{Day: from.AddDate(0, 0, 2), ManualAdds: 0, AutoAdds: 2, Deletes: 1},
+		},
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentStatsUsers)).WithArgs(slug).
+		WillReturnRows(pgxmock.NewRows([]string{"count", "count"}).AddRow(10, 4))
+
+	rows := pgxmock.NewRows([]string{"day", "manual_adds", "auto_adds", "deletes"})
+	for _, day := range expectedStats.Days {
+		rows.AddRow(day.Day, day.ManualAdds, day.AutoAdds, day.Deletes)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentStatsDays)).WithArgs(slug, from, to).
+		WillReturnRows(rows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	stats, err := storage.GetSegmentStats(ctx, slug, from, to)
+	require.NoError(t, err)
+	require.Equal(t, expectedStats, stats)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetSegmentStatsSegmentNotFound(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	slug := "AVITO_TEST"
+	from := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 8, 4, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentStatsUsers)).WithArgs(slug).
+		WillReturnRows(pgxmock.NewRows([]string{"count", "count"}))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.GetSegmentStats(ctx, slug, from, to)
+	require.ErrorIs(t, err, custom_error.NotFoundError{
+		Field:   "slug",
+		Message: slug + " doesn't exist",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_RollupSegmentStatsFirstRun(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	firstOperation := time.Date(2023, 8, 1, 15, 30, 0, 0, time.UTC)
+	from := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2023, 8, 4, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectBeginTx(pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_xact_lock(hashtext($1))")).
+		WithArgs(statsRollupLockKey).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectLateDays)).
+		WillReturnRows(pgxmock.NewRows([]string{"date"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectRolledUntil)).
+		WillReturnRows(pgxmock.NewRows([]string{"rolled_until"}).AddRow(nil))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectFirstOperation)).
+		WillReturnRows(pgxmock.NewRows([]string{"min"}).AddRow(&firstOperation))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteSegmentStatsDays)).WithArgs(from, until).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertSegmentStatsDays)).WithArgs(from, until).
+		WillReturnResult(pgxmock.NewResult("INSERT", 5))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateRollup)).WithArgs(until).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	rolledUp, err := storage.RollupSegmentStats(ctx, until.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 3, rolledUp)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_RollupSegmentStatsUpToDate(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	until := time.Date(2023, 8, 4, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectBeginTx(pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_xact_lock(hashtext($1))")).
+		WithArgs(statsRollupLockKey).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectLateDays)).
+		WillReturnRows(pgxmock.NewRows([]string{"date"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectRolledUntil)).
+		WillReturnRows(pgxmock.NewRows([]string{"rolled_until"}).AddRow(&until))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateRollup)).WithArgs(until).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	rolledUp, err := storage.RollupSegmentStats(ctx, until.Add(23*time.Hour))
+	require.NoError(t, err)
+	require.Zero(t, rolledUp)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+// TestStorage_RollupSegmentStatsLateOperation checks a rolled up day which got an operation committed
+// after the previous rollup: the day is aggregated again.
+func TestStorage_RollupSegmentStatsLateOperation(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	lateDay := time.Date(2023, 8, 2, 0, 0, 0, 0, time.UTC)
+	rolledUntil := time.Date(2023, 8, 4, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2023, 8, 5, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectBeginTx(pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_xact_lock(hashtext($1))")).
+		WithArgs(statsRollupLockKey).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectLateDays)).
+		WillReturnRows(pgxmock.NewRows([]string{"date"}).AddRow(lateDay))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteSegmentStatsDays)).WithArgs(lateDay, lateDay.AddDate(0, 0, 1)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 2))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertSegmentStatsDays)).WithArgs(lateDay, lateDay.AddDate(0, 0, 1)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 2))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectRolledUntil)).
+		WillReturnRows(pgxmock.NewRows([]string{"rolled_until"}).AddRow(&rolledUntil))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteSegmentStatsDays)).WithArgs(rolledUntil, until).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertSegmentStatsDays)).WithArgs(rolledUntil, until).
+		WillReturnResult(pgxmock.NewResult("INSERT", 3))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateRollup)).WithArgs(until).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	rolledUp, err := storage.RollupSegmentStats(ctx, until.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 2, rolledUp)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_RollupSegmentStatsLocked(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	mock.ExpectBeginTx(pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_xact_lock(hashtext($1))")).
+		WithArgs(statsRollupLockKey).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(false))
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	rolledUp, err := storage.RollupSegmentStats(ctx, time.Date(2023, 8, 4, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Zero(t, rolledUp)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
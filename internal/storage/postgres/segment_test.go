@@ -3,6 +3,7 @@ package postgres
 import (
 	"context"
 	"fmt"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/pashagolub/pgxmock/v2"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
@@ -10,6 +11,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"regexp"
 	"testing"
+	"time"
 )
 
 func TestStorage_CreateSegment(t *testing.T) {
@@ -22,14 +24,16 @@ func TestStorage_CreateSegment(t *testing.T) {
 	expectedSegment := models.Segment{
 		Slug:       "AVITO_TEST",
 		Percentage: 10,
+		Salt:       "5e1a3bd8-7a8c-4a55-9d3c-1c2b8f3f4b6e",
 	}
 
 	query := fmt.Sprintf(`
-		INSERT INTO %s (slug, auto_add_percentage) 
-		VALUES ($1, $2)
+		INSERT INTO %s (slug, auto_add_percentage, salt, parent_slug, rule, starts_at, ends_at, window_open)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8)
 	`, segmentsTable)
 
-	mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs(expectedSegment.Slug, expectedSegment.Percentage).
+	mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs(expectedSegment.Slug, expectedSegment.Percentage, expectedSegment.Salt, expectedSegment.Parent, expectedSegment.Rule,
+		expectedSegment.StartsAt, expectedSegment.EndsAt, true).
 		WillReturnResult(pgxmock.NewResult("insert", 1))
 
 	storage := NewStoragePostgres()
@@ -51,6 +55,7 @@ func TestStorage_CreateSegmentExists(t *testing.T) {
 	expectedSegment := models.Segment{
 		Slug:       "AVITO_TEST",
 		Percentage: 10,
+		Salt:       "5e1a3bd8-7a8c-4a55-9d3c-1c2b8f3f4b6e",
 	}
 	expectedError := custom_error.CustomError{
 		Field:   "slug",
@@ -58,15 +63,16 @@ func TestStorage_CreateSegmentExists(t *testing.T) {
 	}
 
 	query := fmt.Sprintf(`
-		INSERT INTO %s (slug, auto_add_percentage)
-		VALUES ($1, $2)
+		INSERT INTO %s (slug, auto_add_percentage, salt, parent_slug, rule, starts_at, ends_at, window_open)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8)
 	`, segmentsTable)
 
 	returnError := &pgconn.PgError{
 		Code: "23505",
 	}
 
-	mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs(expectedSegment.Slug, expectedSegment.Percentage).
+	mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs(expectedSegment.Slug, expectedSegment.Percentage, expectedSegment.Salt, expectedSegment.Parent, expectedSegment.Rule,
+		expectedSegment.StartsAt, expectedSegment.EndsAt, true).
 		WillReturnError(returnError)
 
 	storage := NewStoragePostgres()
@@ -135,8 +141,8 @@ func TestStorage_DeleteSegmentInSegmentsTableAndUserSegmentsTable(t *testing.T)
 	`, segmentsTable)
 
 	queryAddOperations := fmt.Sprintf(`
-		INSERT INTO %s (user_id, segment_slug, date, action, auto_add) 
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source) 
+		VALUES ($1, $2, $3, $4, $5, $6)
 	`, operationsTable)
 
 	mock.ExpectBegin()
@@ -145,7 +151,7 @@ func TestStorage_DeleteSegmentInSegmentsTableAndUserSegmentsTable(t *testing.T)
 	mock.ExpectExec(regexp.QuoteMeta(queryDeleteFromSegments)).WithArgs(expectedSlug).
 		WillReturnResult(pgxmock.NewResult("delete", 1))
 	mock.ExpectExec(regexp.QuoteMeta(queryAddOperations)).
-		WithArgs(1, expectedSlug, pgxmock.AnyArg(), "delete", false).
+		WithArgs(1, expectedSlug, pgxmock.AnyArg(), "delete", false, models.OperationSourceSegmentDelete).
 		WillReturnResult(pgxmock.NewResult("insert", 1))
 	mock.ExpectCommit()
 
@@ -197,3 +203,400 @@ func TestStorage_DeleteSegmentNotExist(t *testing.T) {
 
 	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
 }
+
+func TestStorage_GetSegments(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedPrefix := "AVITO"
+	expectedLimit := 20
+	expectedOffset := 0
+	expectedSegments := []models.Segment{
+		{
+			Slug:       "AVITO_TEST1",
+			Percentage: 10,
+			CreatedAt:  time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+			UsersCount: 5,
+		},
+		{
+			Slug:       "AVITO_TEST2",
+			Percentage: 0,
+			Parent:     "AVITO_TEST1",
+			CreatedAt:  time.Date(2023, 8, 2, 0, 0, 0, 0, time.UTC),
+			UsersCount: 0,
+		},
+	}
+
+	query := fmt.Sprintf(`
+		SELECT s.slug, s.auto_add_percentage, COALESCE(s.parent_slug, ''), COALESCE(s.rule, ''), s.starts_at, s.ends_at, s.description, s.owner, s.created_at, COUNT(us.user_id)
+		FROM %s s
+		LEFT JOIN %s us ON us.segment_slug = s.slug
+		WHERE starts_with(s.slug, $1)
+		GROUP BY s.slug
+		ORDER BY s.slug
+		LIMIT $2 OFFSET $3
+	`, segmentsTable, userSegmentsTable)
+
+	rows := pgxmock.NewRows([]string{"slug", "auto_add_percentage", "parent_slug", "rule", "starts_at", "ends_at", "description", "owner", "created_at", "count"})
+	for _, segment := range expectedSegments {
+		rows.AddRow(segment.Slug, segment.Percentage, segment.Parent, segment.Rule, segment.StartsAt, segment.EndsAt, segment.Description, segment.Owner, segment.CreatedAt, segment.UsersCount)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(expectedPrefix, expectedLimit, expectedOffset).
+		WillReturnRows(rows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	segments, err := storage.GetSegments(ctx, expectedPrefix, expectedLimit, expectedOffset)
+	require.NoError(t, err)
+	require.Equal(t, expectedSegments, segments)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetSegment(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSegment := models.Segment{
+		Slug:        "AVITO_TEST",
+		Percentage:  10,
+		Description: "test segment",
+		Owner:       "team",
+		CreatedAt:   time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+		UsersCount:  5,
+	}
+
+	query := fmt.Sprintf(`
+		SELECT s.slug, s.auto_add_percentage, COALESCE(s.parent_slug, ''), COALESCE(s.rule, ''), s.starts_at, s.ends_at, s.description, s.owner, s.created_at, COUNT(us.user_id)
+		FROM %s s
+		LEFT JOIN %s us ON us.segment_slug = s.slug
+		WHERE s.slug = $1
+		GROUP BY s.slug
+	`, segmentsTable, userSegmentsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(expectedSegment.Slug).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "auto_add_percentage", "parent_slug", "rule", "starts_at", "ends_at", "description", "owner", "created_at", "count"}).
+			AddRow(expectedSegment.Slug, expectedSegment.Percentage, expectedSegment.Parent, expectedSegment.Rule, expectedSegment.StartsAt, expectedSegment.EndsAt, expectedSegment.Description, expectedSegment.Owner,
+				expectedSegment.CreatedAt, expectedSegment.UsersCount))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	segment, err := storage.GetSegment(ctx, expectedSegment.Slug)
+	require.NoError(t, err)
+	require.Equal(t, expectedSegment, segment)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetSegmentNotExist(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSlug := "AVITO_TEST"
+	expectedError := custom_error.NotFoundError{
+		Field:   "slug",
+		Message: expectedSlug + " doesn't exist",
+	}
+
+	query := fmt.Sprintf(`
+		SELECT s.slug, s.auto_add_percentage, COALESCE(s.parent_slug, ''), COALESCE(s.rule, ''), s.starts_at, s.ends_at, s.description, s.owner, s.created_at, COUNT(us.user_id)
+		FROM %s s
+		LEFT JOIN %s us ON us.segment_slug = s.slug
+		WHERE s.slug = $1
+		GROUP BY s.slug
+	`, segmentsTable, userSegmentsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(expectedSlug).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "auto_add_percentage", "parent_slug", "rule", "starts_at", "ends_at", "description", "owner", "created_at", "count"}))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.GetSegment(ctx, expectedSlug)
+	require.ErrorIs(t, err, expectedError)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_UpdateSegment(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSlug := "AVITO_TEST"
+	expectedPercentage := 20
+	expectedDescription := "test segment"
+	expectedUpdate := models.SegmentUpdate{
+		Percentage:  &expectedPercentage,
+		Description: &expectedDescription,
+	}
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT auto_add_percentage, salt, COALESCE(rule, '')
+		FROM %s
+		WHERE slug = $1
+		FOR UPDATE
+	`, segmentsTable)
+
+	queryUpdateSegment := fmt.Sprintf(`
+		UPDATE %s
+		SET auto_add_percentage = COALESCE($2, auto_add_percentage),
+		    description = COALESCE($3, description),
+		    owner = COALESCE($4, owner)
+		WHERE slug = $1
+	`, segmentsTable)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegment)).WithArgs(expectedSlug).
+		WillReturnRows(pgxmock.NewRows([]string{"auto_add_percentage", "salt", "rule"}).AddRow(10, "salt", ""))
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckNotExperimentVariant)).WithArgs(expectedSlug).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateSegment)).
+		WithArgs(expectedSlug, expectedUpdate.Percentage, expectedUpdate.Description, expectedUpdate.Owner).
+		WillReturnResult(pgxmock.NewResult("update", 1))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.UpdateSegment(ctx, expectedSlug, expectedUpdate)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_UpdateSegmentTrimAutoAdded(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	segment := models.Segment{
+		Slug:       "AVITO_TEST",
+		Percentage: 50,
+		Salt:       "salt",
+	}
+	expectedPercentage := 0
+	expectedUpdate := models.SegmentUpdate{
+		Percentage:    &expectedPercentage,
+		TrimAutoAdded: true,
+	}
+	expectedUserIDs := []int{1, 2}
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT auto_add_percentage, salt, COALESCE(rule, '')
+		FROM %s
+		WHERE slug = $1
+		FOR UPDATE
+	`, segmentsTable)
+
+	queryUpdateSegment := fmt.Sprintf(`
+		UPDATE %s
+		SET auto_add_percentage = COALESCE($2, auto_add_percentage),
+		    description = COALESCE($3, description),
+		    owner = COALESCE($4, owner)
+		WHERE slug = $1
+	`, segmentsTable)
+
+	querySelectAutoAddedUsers := fmt.Sprintf(`
+		SELECT user_id
+		FROM %s
+		WHERE segment_slug = $1 AND auto_add = true
+	`, userSegmentsTable)
+
+	queryDeleteUserSegments := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE segment_slug = $1 AND user_id = ANY($2)
+	`, userSegmentsTable)
+
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, true, $5)
+	`, operationsTable)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegment)).WithArgs(segment.Slug).
+		WillReturnRows(pgxmock.NewRows([]string{"auto_add_percentage", "salt", "rule"}).AddRow(segment.Percentage, segment.Salt, segment.Rule))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateSegment)).
+		WithArgs(segment.Slug, expectedUpdate.Percentage, expectedUpdate.Description, expectedUpdate.Owner).
+		WillReturnResult(pgxmock.NewResult("update", 1))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectAutoAddedUsers)).WithArgs(segment.Slug).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteUserSegments)).WithArgs(segment.Slug, expectedUserIDs).
+		WillReturnResult(pgxmock.NewResult("delete", 2))
+	for _, userID := range expectedUserIDs {
+		mock.ExpectExec(regexp.QuoteMeta(queryInsertOperation)).
+			WithArgs(userID, segment.Slug, pgxmock.AnyArg(), "delete", models.OperationSourceSegmentUpdate).
+			WillReturnResult(pgxmock.NewResult("insert", 1))
+	}
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteChildUserSegments)).
+		WithArgs([]string{segment.Slug}, expectedUserIDs, pgxmock.AnyArg(), models.OperationSourceParentDelete).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.UpdateSegment(ctx, segment.Slug, expectedUpdate)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_UpdateSegmentNotExist(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSlug := "AVITO_TEST"
+	expectedDescription := "test segment"
+	expectedError := custom_error.NotFoundError{
+		Field:   "slug",
+		Message: expectedSlug + " doesn't exist",
+	}
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT auto_add_percentage, salt, COALESCE(rule, '')
+		FROM %s
+		WHERE slug = $1
+		FOR UPDATE
+	`, segmentsTable)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegment)).WithArgs(expectedSlug).
+		WillReturnRows(pgxmock.NewRows([]string{"auto_add_percentage", "salt", "rule"}))
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.UpdateSegment(ctx, expectedSlug, models.SegmentUpdate{Description: &expectedDescription})
+	require.ErrorIs(t, err, expectedError)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_UpdateSegmentRulePercentage(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSlug := "ADULTS"
+	percentage := 10
+	expectedError := custom_error.CustomError{
+		Field:   "auto_add_percentage",
+		Message: expectedSlug + " is assigned by rule and cannot have auto add percentage",
+	}
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT auto_add_percentage, salt, COALESCE(rule, '')
+		FROM %s
+		WHERE slug = $1
+		FOR UPDATE
+	`, segmentsTable)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegment)).WithArgs(expectedSlug).
+		WillReturnRows(pgxmock.NewRows([]string{"auto_add_percentage", "salt", "rule"}).AddRow(0, "salt", "age >= 18"))
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.UpdateSegment(ctx, expectedSlug, models.SegmentUpdate{Percentage: &percentage})
+	require.ErrorIs(t, err, expectedError)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_CreateSegmentParentNotExist(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSegment := models.Segment{
+		Slug:   "VOICE_MESSAGES_BETA",
+		Salt:   "5e1a3bd8-7a8c-4a55-9d3c-1c2b8f3f4b6e",
+		Parent: "BETA_TESTERS",
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (slug, auto_add_percentage, salt, parent_slug, rule, starts_at, ends_at, window_open)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8)
+	`, segmentsTable)
+
+	mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs(expectedSegment.Slug, expectedSegment.Percentage, expectedSegment.Salt, expectedSegment.Parent, expectedSegment.Rule,
+		expectedSegment.StartsAt, expectedSegment.EndsAt, true).
+		WillReturnError(&pgconn.PgError{Code: "23503"})
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.CreateSegment(ctx, expectedSegment)
+	require.ErrorIs(t, err, custom_error.CustomError{
+		Field:   "parent",
+		Message: "BETA_TESTERS doesn't exist",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_DeleteSegmentWithChildren(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSlug := "BETA_TESTERS"
+
+	queryDeleteFromUserSegments := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE segment_slug = $1
+		RETURNING user_id
+	`, userSegmentsTable)
+
+	queryDeleteFromSegments := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE slug = $1
+	`, segmentsTable)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(queryDeleteFromUserSegments)).WithArgs(expectedSlug).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteFromSegments)).WithArgs(expectedSlug).
+		WillReturnError(&pgconn.PgError{Code: "23503"})
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.DeleteSegment(ctx, expectedSlug)
+	require.ErrorIs(t, err, custom_error.CustomError{
+		Field:   "slug",
+		Message: "BETA_TESTERS is a parent of other segments",
+	})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
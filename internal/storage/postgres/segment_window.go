@@ -0,0 +1,136 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"time"
+)
+
+// ApplySegmentWindows records an open or close event for each segment whose window opened or closed since
+// the previous run. User segments and their operations are kept as is, the window only changes the visibility
+// of the segment, so stats, snapshots and reports aren't affected. It returns the number of segments whose window changed.
+func (s *Storage) ApplySegmentWindows(ctx context.Context, now time.Time) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("SegmentRepo.ApplySegmentWindows - s.db.Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	// the row lock of the update lets only one instance record a change of a window
+	queryUpdateWindows := fmt.Sprintf(`
+		UPDATE %s
+		SET window_open = NOT window_open
+		WHERE window_open <> ((starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1))
+		RETURNING slug, window_open
+	`, segmentsTable)
+
+	rows, err := tx.Query(ctx, queryUpdateWindows, now)
+	if err != nil {
+		return 0, fmt.Errorf("SegmentRepo.ApplySegmentWindows - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var opened, closed []string
+	for rows.Next() {
+		var (
+			slug       string
+			windowOpen bool
+		)
+
+		err = rows.Scan(&slug, &windowOpen)
+		if err != nil {
+			return 0, fmt.Errorf("SegmentRepo.ApplySegmentWindows - rows.Scan: %w", err)
+		}
+
+		if windowOpen {
+			opened = append(opened, slug)
+		} else {
+			closed = append(closed, slug)
+		}
+	}
+
+	queryInsertEvents := fmt.Sprintf(`
+		INSERT INTO %s (segment_slug, action, date)
+		SELECT unnest($1::varchar[]), $2, $3
+	`, segmentWindowEventsTable)
+
+	if len(opened) > 0 {
+		_, err = tx.Exec(ctx, queryInsertEvents, opened, "open", now)
+		if err != nil {
+			return 0, fmt.Errorf("SegmentRepo.ApplySegmentWindows - tx.Exec: %w", err)
+		}
+	}
+
+	if len(closed) > 0 {
+		_, err = tx.Exec(ctx, queryInsertEvents, closed, "close", now)
+		if err != nil {
+			return 0, fmt.Errorf("SegmentRepo.ApplySegmentWindows - tx.Exec: %w", err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("SegmentRepo.ApplySegmentWindows - tx.Commit: %w", err)
+	}
+
+	return len(opened) + len(closed), nil
+}
+
+// GetSegmentWindowEvents returns openings and closings of the window of the segment, the earliest first.
+func (s *Storage) GetSegmentWindowEvents(ctx context.Context, slug string) ([]models.SegmentWindowEvent, error) {
+	var existFlag bool
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT true
+		FROM %s
+		WHERE slug = $1
+	`, segmentsTable)
+
+	err := s.db.QueryRow(ctx, querySelectSegment, slug).Scan(&existFlag)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, custom_error.NotFoundError{
+				Field:   "slug",
+				Message: slug + " doesn't exist",
+			}
+		}
+		return nil, fmt.Errorf("SegmentRepo.GetSegmentWindowEvents - s.db.QueryRow.Scan: %w", err)
+	}
+
+	querySelectEvents := fmt.Sprintf(`
+		SELECT action, date
+		FROM %s
+		WHERE segment_slug = $1
+		ORDER BY date, id
+	`, segmentWindowEventsTable)
+
+	rows, err := s.db.Query(ctx, querySelectEvents, slug)
+	if err != nil {
+		return nil, fmt.Errorf("SegmentRepo.GetSegmentWindowEvents - s.db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var events []models.SegmentWindowEvent
+	for rows.Next() {
+		var event models.SegmentWindowEvent
+
+		err = rows.Scan(&event.Action, &event.Date)
+		if err != nil {
+			return nil, fmt.Errorf("SegmentRepo.GetSegmentWindowEvents - rows.Scan: %w", err)
+		}
+
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("SegmentRepo.GetSegmentWindowEvents - rows.Err: %w", err)
+	}
+
+	return events, nil
+}
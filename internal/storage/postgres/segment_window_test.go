@@ -0,0 +1,275 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v2"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var (
+	queryUpdateSegmentWindows = fmt.Sprintf(`
+		UPDATE %s
+		SET window_open = NOT window_open
+		WHERE window_open <> ((starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1))
+		RETURNING slug, window_open
+	`, segmentsTable)
+
+	queryInsertSegmentWindowEvents = fmt.Sprintf(`
+		INSERT INTO %s (segment_slug, action, date)
+		SELECT unnest($1::varchar[]), $2, $3
+	`, segmentWindowEventsTable)
+
+	querySelectSegmentWindowEvents = fmt.Sprintf(`
+		SELECT action, date
+		FROM %s
+		WHERE segment_slug = $1
+		ORDER BY date, id
+	`, segmentWindowEventsTable)
+)
+
+func TestStorage_ApplySegmentWindows(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	now := time.Date(2023, 11, 24, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(queryUpdateSegmentWindows)).WithArgs(now).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "window_open"}).
+			AddRow("BLACK_FRIDAY", true).
+			AddRow("CYBER_MONDAY", true).
+			AddRow("HALLOWEEN", false))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertSegmentWindowEvents)).
+		WithArgs([]string{"BLACK_FRIDAY", "CYBER_MONDAY"}, "open", now).
+		WillReturnResult(pgxmock.NewResult("insert", 2))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertSegmentWindowEvents)).
+		WithArgs([]string{"HALLOWEEN"}, "close", now).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	changed, err := storage.ApplySegmentWindows(ctx, now)
+	require.NoError(t, err)
+	require.Equal(t, 3, changed)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_ApplySegmentWindowsKeepsStats(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	opensAt := time.Date(2023, 11, 24, 0, 0, 0, 0, time.UTC)
+	closesAt := opensAt.Add(72 * time.Hour)
+	statsDay := opensAt.AddDate(0, 0, -1)
+
+	slug := "BLACK_FRIDAY"
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	// stats are read from user segments and operations, the window mustn't write to either of them
+	expectStats := func(from, to time.Time) {
+		mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentStatsUsers)).WithArgs(slug).
+			WillReturnRows(pgxmock.NewRows([]string{"count", "auto_add_count"}).AddRow(5, 2))
+		mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentStatsDays)).WithArgs(slug, from, to).
+			WillReturnRows(pgxmock.NewRows([]string{"day", "manual_adds", "auto_adds", "deletes"}).
+				AddRow(statsDay, 3, 2, 1))
+	}
+
+	expectStats(statsDay, closesAt)
+	before, err := storage.GetSegmentStats(ctx, slug, statsDay, closesAt)
+	require.NoError(t, err)
+
+	for _, run := range []struct {
+		now        time.Time
+		windowOpen bool
+		action     string
+	}{
+		{now: opensAt, windowOpen: true, action: "open"},
+		{now: closesAt, windowOpen: false, action: "close"},
+	} {
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(queryUpdateSegmentWindows)).WithArgs(run.now).
+			WillReturnRows(pgxmock.NewRows([]string{"slug", "window_open"}).AddRow(slug, run.windowOpen))
+		mock.ExpectExec(regexp.QuoteMeta(queryInsertSegmentWindowEvents)).
+			WithArgs([]string{slug}, run.action, run.now).
+			WillReturnResult(pgxmock.NewResult("insert", 1))
+		mock.ExpectCommit()
+
+		changed, err := storage.ApplySegmentWindows(ctx, run.now)
+		require.NoError(t, err)
+		require.Equal(t, 1, changed)
+	}
+
+	expectStats(statsDay, closesAt)
+	after, err := storage.GetSegmentStats(ctx, slug, statsDay, closesAt)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_ApplySegmentWindowsNoChanges(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	now := time.Date(2023, 11, 24, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(queryUpdateSegmentWindows)).WithArgs(now).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "window_open"}))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	changed, err := storage.ApplySegmentWindows(ctx, now)
+	require.NoError(t, err)
+	require.Zero(t, changed)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_ApplySegmentWindowsError(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	now := time.Date(2023, 11, 24, 0, 0, 0, 0, time.UTC)
+	expectedError := errors.New("connection lost")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(queryUpdateSegmentWindows)).WithArgs(now).
+		WillReturnError(expectedError)
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.ApplySegmentWindows(ctx, now)
+	require.ErrorIs(t, err, expectedError)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_CreateSegmentWindowNotOpen(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	startsAt := time.Now().UTC().Add(24 * time.Hour)
+	endsAt := startsAt.Add(72 * time.Hour)
+	expectedSegment := models.Segment{
+		Slug:     "BLACK_FRIDAY",
+		Salt:     "salt",
+		StartsAt: &startsAt,
+		EndsAt:   &endsAt,
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (slug, auto_add_percentage, salt, parent_slug, rule, starts_at, ends_at, window_open)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8)
+	`, segmentsTable)
+
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs(expectedSegment.Slug, 0, expectedSegment.Salt, "", "", &startsAt, &endsAt, false).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.CreateSegment(ctx, expectedSegment)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetSegmentWindowEvents(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	slug := "BLACK_FRIDAY"
+	opensAt := time.Date(2023, 11, 24, 0, 0, 0, 0, time.UTC)
+	closesAt := opensAt.Add(72 * time.Hour)
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT true
+		FROM %s
+		WHERE slug = $1
+	`, segmentsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegment)).WithArgs(slug).
+		WillReturnRows(pgxmock.NewRows([]string{"bool"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentWindowEvents)).WithArgs(slug).
+		WillReturnRows(pgxmock.NewRows([]string{"action", "date"}).
+			AddRow("open", opensAt).
+			AddRow("close", closesAt))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	events, err := storage.GetSegmentWindowEvents(ctx, slug)
+	require.NoError(t, err)
+	require.Equal(t, []models.SegmentWindowEvent{
+		{Action: "open", Date: opensAt},
+		{Action: "close", Date: closesAt},
+	}, events)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetSegmentWindowEventsSegmentNotFound(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	slug := "BLACK_FRIDAY"
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT true
+		FROM %s
+		WHERE slug = $1
+	`, segmentsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegment)).WithArgs(slug).
+		WillReturnError(pgx.ErrNoRows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.GetSegmentWindowEvents(ctx, slug)
+	var notFoundError custom_error.NotFoundError
+	require.ErrorAs(t, err, &notFoundError)
+	require.Equal(t, "slug", notFoundError.Field)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
@@ -0,0 +1,213 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"sort"
+	"time"
+)
+
+// GetUserSegmentsAt returns segments the user had at the moment, sorted by slug. They are rebuilt
+// from the latest snapshot taken at or before the moment and operations made after the snapshot.
+func (s *Storage) GetUserSegmentsAt(ctx context.Context, userID int, at time.Time) ([]string, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SnapshotRepo.GetUserSegmentsAt - s.db.Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	segments, err := userSegmentsAt(ctx, tx, userID, at)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SnapshotRepo.GetUserSegmentsAt - tx.Commit: %w", err)
+	}
+
+	return segments, nil
+}
+
+// CreateUserSegmentsSnapshots takes snapshots at the moment for up to limit users, which have at least
+// minOperations operations made after their latest snapshot and not later than the moment.
+// Snapshots missing operations committed after they were taken are deleted before, so they are taken again.
+// No snapshots are taken when another instance runs the job (see tryJobLock).
+func (s *Storage) CreateUserSegmentsSnapshots(ctx context.Context, at time.Time, minOperations, limit int) (int, error) {
+	// every query of the job sees the same operations, which are stored with the snapshots as visible
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	if err != nil {
+		return 0, fmt.Errorf("SnapshotRepo.CreateUserSegmentsSnapshots - s.db.BeginTx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	locked, err := tryJobLock(ctx, tx, snapshotLockKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if !locked {
+		return 0, nil
+	}
+
+	queryDeleteStaleSnapshots := fmt.Sprintf(`
+		DELETE FROM %s s
+		WHERE %s
+	`, snapshotsTable, snapshotStaleCondition)
+
+	_, err = tx.Exec(ctx, queryDeleteStaleSnapshots)
+	if err != nil {
+		return 0, fmt.Errorf("SnapshotRepo.CreateUserSegmentsSnapshots - tx.Exec: %w", err)
+	}
+
+	querySelectUsers := fmt.Sprintf(`
+		SELECT o.user_id
+		FROM %s o
+		LEFT JOIN (
+    		SELECT user_id, max(taken_at) AS taken_at
+    		FROM %s
+    		GROUP BY user_id
+		) s ON s.user_id = o.user_id
+		WHERE o.date <= $1 AND (s.taken_at IS NULL OR o.date > s.taken_at)
+		GROUP BY o.user_id
+		HAVING count(*) >= $2
+		LIMIT $3
+	`, operationsTable, snapshotsTable)
+
+	rows, err := tx.Query(ctx, querySelectUsers, at, minOperations, limit)
+	if err != nil {
+		return 0, fmt.Errorf("SnapshotRepo.CreateUserSegmentsSnapshots - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+
+		err = rows.Scan(&userID)
+		if err != nil {
+			return 0, fmt.Errorf("SnapshotRepo.CreateUserSegmentsSnapshots - rows.Scan: %w", err)
+		}
+
+		userIDs = append(userIDs, userID)
+	}
+
+	queryInsertSnapshot := fmt.Sprintf(`
+		INSERT INTO %s (user_id, taken_at, segments, visible)
+		VALUES ($1, $2, $3, pg_current_snapshot())
+		ON CONFLICT (user_id, taken_at) DO NOTHING
+	`, snapshotsTable)
+
+	for _, userID := range userIDs {
+		segments, err := userSegmentsAt(ctx, tx, userID, at)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.Exec(ctx, queryInsertSnapshot, userID, at, segments)
+		if err != nil {
+			return 0, fmt.Errorf("SnapshotRepo.CreateUserSegmentsSnapshots - tx.Exec: %w", err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("SnapshotRepo.CreateUserSegmentsSnapshots - tx.Commit: %w", err)
+	}
+
+	return len(userIDs), nil
+}
+
+// snapshotStaleCondition holds for a snapshot s when an operation of the user made at or before
+// the snapshot was not visible when it was taken. Operation dates are taken before they are committed,
+// so an operation can be committed after a snapshot of a later moment.
+var snapshotStaleCondition = fmt.Sprintf(`
+	EXISTS (
+		SELECT 1
+		FROM %s o
+		WHERE o.user_id = s.user_id
+			AND o.xid >= pg_snapshot_xmin(s.visible)
+			AND NOT pg_visible_in_snapshot(o.xid, s.visible)
+			AND o.date <= s.taken_at
+	)
+`, operationsTable)
+
+// userSegmentsAt replays operations of the user made at or before the moment on top of the latest snapshot,
+// which is not stale (see snapshotStaleCondition).
+func userSegmentsAt(ctx context.Context, tx pgx.Tx, userID int, at time.Time) ([]string, error) {
+	querySelectSnapshot := fmt.Sprintf(`
+		SELECT s.taken_at, s.segments
+		FROM %s s
+		WHERE s.user_id = $1 AND s.taken_at <= $2 AND NOT %s
+		ORDER BY s.taken_at DESC
+		LIMIT 1
+	`, snapshotsTable, snapshotStaleCondition)
+
+	var (
+		takenAt          time.Time
+		snapshotSegments []string
+	)
+
+	err := tx.QueryRow(ctx, querySelectSnapshot, userID, at).Scan(&takenAt, &snapshotSegments)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("SnapshotRepo.userSegmentsAt - tx.QueryRow.Scan: %w", err)
+	}
+
+	segments := make(map[string]struct{}, len(snapshotSegments))
+	for _, segment := range snapshotSegments {
+		segments[segment] = struct{}{}
+	}
+
+	// without a snapshot the whole history of the user is replayed
+	querySelectOperations := fmt.Sprintf(`
+		SELECT segment_slug, action
+		FROM %s
+		WHERE user_id = $1 AND date > $2 AND date <= $3
+		ORDER BY date, id
+	`, operationsTable)
+
+	from := pgtype.Timestamptz{Time: takenAt, Valid: true}
+	if takenAt.IsZero() {
+		from = pgtype.Timestamptz{InfinityModifier: pgtype.NegativeInfinity, Valid: true}
+	}
+
+	rows, err := tx.Query(ctx, querySelectOperations, userID, from, at)
+	if err != nil {
+		return nil, fmt.Errorf("SnapshotRepo.userSegmentsAt - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var segment, action string
+
+		err = rows.Scan(&segment, &action)
+		if err != nil {
+			return nil, fmt.Errorf("SnapshotRepo.userSegmentsAt - rows.Scan: %w", err)
+		}
+
+		if action == "add" {
+			segments[segment] = struct{}{}
+		} else {
+			delete(segments, segment)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("SnapshotRepo.userSegmentsAt - rows.Err: %w", err)
+	}
+
+	result := make([]string, 0, len(segments))
+	for segment := range segments {
+		result = append(result, segment)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
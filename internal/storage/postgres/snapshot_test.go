@@ -0,0 +1,265 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/pashagolub/pgxmock/v2"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var (
+	queryStaleSnapshot = fmt.Sprintf(`
+	EXISTS (
+		SELECT 1
+		FROM %s o
+		WHERE o.user_id = s.user_id
+			AND o.xid >= pg_snapshot_xmin(s.visible)
+			AND NOT pg_visible_in_snapshot(o.xid, s.visible)
+			AND o.date <= s.taken_at
+	)
+`, operationsTable)
+
+	querySelectSnapshot = fmt.Sprintf(`
+		SELECT s.taken_at, s.segments
+		FROM %s s
+		WHERE s.user_id = $1 AND s.taken_at <= $2 AND NOT %s
+		ORDER BY s.taken_at DESC
+		LIMIT 1
+	`, snapshotsTable, queryStaleSnapshot)
+
+	queryDeleteStaleSnapshots = fmt.Sprintf(`
+		DELETE FROM %s s
+		WHERE %s
+	`, snapshotsTable, queryStaleSnapshot)
+
+	querySelectSnapshotUsers = fmt.Sprintf(`
+		SELECT o.user_id
+		FROM %s o
+		LEFT JOIN (
+    		SELECT user_id, max(taken_at) AS taken_at
+    		FROM %s
+    		GROUP BY user_id
+		) s ON s.user_id = o.user_id
+		WHERE o.date <= $1 AND (s.taken_at IS NULL OR o.date > s.taken_at)
+		GROUP BY o.user_id
+		HAVING count(*) >= $2
+		LIMIT $3
+	`, operationsTable, snapshotsTable)
+
+	queryInsertSnapshot = fmt.Sprintf(`
+		INSERT INTO %s (user_id, taken_at, segments, visible)
+		VALUES ($1, $2, $3, pg_current_snapshot())
+		ON CONFLICT (user_id, taken_at) DO NOTHING
+	`, snapshotsTable)
+
+	querySelectReplayedOperations = fmt.Sprintf(`
+		SELECT segment_slug, action
+		FROM %s
+		WHERE user_id = $1 AND date > $2 AND date <= $3
+		ORDER BY date, id
+	`, operationsTable)
+)
+
+func TestStorage_GetUserSegmentsAt(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1000
+	at := time.Date(2023, 8, 15, 12, 0, 0, 0, time.UTC)
+	takenAt := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSnapshot)).WithArgs(expectedUserID, at).
+		WillReturnRows(pgxmock.NewRows([]string{"taken_at", "segments"}).
+			AddRow(takenAt, []string{"AVITO_VOICE", "AVITO_TEST"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectReplayedOperations)).
+		WithArgs(expectedUserID, pgtype.Timestamptz{Time: takenAt, Valid: true}, at).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "action"}).
+			AddRow("AVITO_TEST", "delete").
+			AddRow("AVITO_DISCOUNT", "add").
+			AddRow("AVITO_PROMO", "add").
+			AddRow("AVITO_PROMO", "delete"))
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	segments, err := storage.GetUserSegmentsAt(ctx, expectedUserID, at)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT", "AVITO_VOICE"}, segments)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetUserSegmentsAtWithoutSnapshot(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1000
+	at := time.Date(2023, 8, 15, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSnapshot)).WithArgs(expectedUserID, at).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectReplayedOperations)).
+		WithArgs(expectedUserID, pgtype.Timestamptz{InfinityModifier: pgtype.NegativeInfinity, Valid: true}, at).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "action"}))
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	segments, err := storage.GetUserSegmentsAt(ctx, expectedUserID, at)
+	require.NoError(t, err)
+	require.Empty(t, segments)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+// TestStorage_GetUserSegmentsAtLateOperation checks an operation dated before the latest snapshot
+// but committed after it: the stale snapshot is skipped and the operation is replayed on top of an older one.
+func TestStorage_GetUserSegmentsAtLateOperation(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1000
+	at := time.Date(2023, 8, 15, 12, 0, 0, 0, time.UTC)
+	olderTakenAt := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSnapshot)).WithArgs(expectedUserID, at).
+		WillReturnRows(pgxmock.NewRows([]string{"taken_at", "segments"}).
+			AddRow(olderTakenAt, []string{"AVITO_VOICE"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectReplayedOperations)).
+		WithArgs(expectedUserID, pgtype.Timestamptz{Time: olderTakenAt, Valid: true}, at).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "action"}).
+			AddRow("AVITO_LATE", "add"))
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	segments, err := storage.GetUserSegmentsAt(ctx, expectedUserID, at)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_LATE", "AVITO_VOICE"}, segments)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_CreateUserSegmentsSnapshots(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	at := time.Date(2023, 8, 15, 12, 0, 0, 0, time.UTC)
+	minOperations := 100
+	limit := 1000
+
+	mock.ExpectBeginTx(pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_xact_lock(hashtext($1))")).WithArgs(snapshotLockKey).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteStaleSnapshots)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSnapshotUsers)).WithArgs(at, minOperations, limit).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSnapshot)).WithArgs(1, at).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectReplayedOperations)).WithArgs(1, pgxmock.AnyArg(), at).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "action"}).AddRow("AVITO_TEST", "add"))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertSnapshot)).WithArgs(1, at, []string{"AVITO_TEST"}).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	taken, err := storage.CreateUserSegmentsSnapshots(ctx, at, minOperations, limit)
+	require.NoError(t, err)
+	require.Equal(t, 1, taken)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_CreateUserSegmentsSnapshotsLocked(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	mock.ExpectBeginTx(pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_xact_lock(hashtext($1))")).WithArgs(snapshotLockKey).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(false))
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	taken, err := storage.CreateUserSegmentsSnapshots(ctx, time.Now(), 100, 1000)
+	require.NoError(t, err)
+	require.Zero(t, taken)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+// TestStorage_CreateUserSegmentsSnapshotsLateOperation checks a snapshot which missed an operation committed
+// after it was taken: the job deletes it and takes the snapshot again with the operation.
+func TestStorage_CreateUserSegmentsSnapshotsLateOperation(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	at := time.Date(2023, 8, 15, 12, 0, 0, 0, time.UTC)
+	minOperations := 100
+	limit := 1000
+
+	mock.ExpectBeginTx(pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_xact_lock(hashtext($1))")).WithArgs(snapshotLockKey).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteStaleSnapshots)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSnapshotUsers)).WithArgs(at, minOperations, limit).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSnapshot)).WithArgs(1, at).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectReplayedOperations)).
+		WithArgs(1, pgtype.Timestamptz{InfinityModifier: pgtype.NegativeInfinity, Valid: true}, at).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "action"}).
+			AddRow("AVITO_TEST", "add").
+			AddRow("AVITO_LATE", "add"))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertSnapshot)).WithArgs(1, at, []string{"AVITO_LATE", "AVITO_TEST"}).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	taken, err := storage.CreateUserSegmentsSnapshots(ctx, at, minOperations, limit)
+	require.NoError(t, err)
+	require.Equal(t, 1, taken)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
@@ -10,9 +10,20 @@ import (
 )
 
 const (
-	segmentsTable     = "segments"
-	userSegmentsTable = "user_segments"
-	operationsTable   = "operations"
+	segmentsTable               = "segments"
+	userSegmentsTable           = "user_segments"
+	operationsTable             = "operations"
+	usersTable                  = "users"
+	reportsTable                = "reports"
+	snapshotsTable              = "user_segments_snapshots"
+	segmentStatsTable           = "segment_daily_stats"
+	statsRollupTable            = "segment_stats_rollup"
+	experimentsTable            = "experiments"
+	experimentVariantsTable     = "experiment_variants"
+	exclusionGroupsTable        = "exclusion_groups"
+	exclusionGroupSegmentsTable = "exclusion_group_segments"
+	userAttributesTable         = "user_attributes"
+	segmentWindowEventsTable    = "segment_window_events"
 )
 
 type PgxPool interface {
@@ -8,79 +8,937 @@ import (
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
-	"math"
 	"time"
 )
 
-var ErrUserAlreadyHasSegment = errors.New("user alredy has segment")
+const (
+	// bulkChunkSize is the number of users updated in one transaction by BulkUpdateUserSegments.
+	bulkChunkSize = 1000
+	// autoAddPageSize is the number of candidate users read at once when a percentage segment is added to users.
+	autoAddPageSize = 1000
+)
+
+// CreateUser registers the user and assigns the user's percentage segments in the same transaction.
+func (s *Storage) CreateUser(ctx context.Context, userID int) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.CreateUser - s.db.Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	now := time.Now().UTC()
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+	`, usersTable)
+
+	_, err = tx.Exec(ctx, query, userID, now)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.Code == "23505" {
+				return custom_error.CustomError{
+					Field:   "user_id",
+					Message: fmt.Sprintf("User (%d) already exists", userID),
+				}
+			}
+		}
+		return fmt.Errorf("UserRepo.CreateUser - tx.Exec: %w", err)
+	}
+
+	err = assignPercentageSegments(ctx, tx, userID, make(map[string]struct{}), now)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.CreateUser - tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteUser deletes the user and its segments, every removed segment is recorded as a delete operation.
+func (s *Storage) DeleteUser(ctx context.Context, userID int) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.DeleteUser - s.db.Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	queryDeleteUserSegments := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE user_id = $1
+		RETURNING segment_slug
+	`, userSegmentsTable)
+
+	rows, err := tx.Query(ctx, queryDeleteUserSegments, userID)
+	if err != nil {
+		return fmt.Errorf("UserRepo.DeleteUser - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var segments []string
+	for rows.Next() {
+		var segment string
+
+		err = rows.Scan(&segment)
+		if err != nil {
+			return fmt.Errorf("UserRepo.DeleteUser - rows.Scan: %w", err)
+		}
+
+		segments = append(segments, segment)
+	}
+
+	queryDeleteUser := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE id = $1
+	`, usersTable)
+
+	ct, err := tx.Exec(ctx, queryDeleteUser, userID)
+	if err != nil {
+		return fmt.Errorf("UserRepo.DeleteUser - tx.Exec: %w", err)
+	}
+
+	if ct.RowsAffected() == 0 {
+		return custom_error.NotFoundError{
+			Field:   "id",
+			Message: fmt.Sprintf("User (%d) doesn't exist", userID),
+		}
+	}
+
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, false, $5)
+	`, operationsTable)
+
+	now := time.Now().UTC()
+
+	for _, segment := range segments {
+		_, err = tx.Exec(ctx, queryInsertOperation, userID, segment, now, "delete", models.OperationSourceUserDelete)
+		if err != nil {
+			return fmt.Errorf("UserRepo.DeleteUser - tx.Exec: %w", err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.DeleteUser - tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+// registerUser adds the user to the users table unless it is already registered
+// and returns whether the user is newly registered.
+func registerUser(ctx context.Context, tx pgx.Tx, userID int, now time.Time) (bool, error) {
+	query := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
+
+	ct, err := tx.Exec(ctx, query, userID, now)
+	if err != nil {
+		return false, fmt.Errorf("UserRepo.registerUser - tx.Exec: %w", err)
+	}
+
+	return ct.RowsAffected() > 0, nil
+}
+
+// assignPercentageSegments adds to the user every segment with auto add percentage
+// whose bucket the user falls into and the variant of every experiment,
+// the same rule as the auto add job uses. Segments in assigned are the ones the user already has.
+func assignPercentageSegments(ctx context.Context, tx pgx.Tx, userID int, assigned map[string]struct{}, now time.Time) error {
+	segments, err := selectPercentageSegments(ctx, tx, now)
+	if err != nil {
+		return err
+	}
+
+	experiments, err := selectExperiments(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	exclusions, err := selectExclusions(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	for _, slug := range autoSegments(userID, segments, experiments, exclusions, assigned) {
+		err = addUserSegment(ctx, tx, slug, userID, true, nil, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// autoSegments returns percentage segments and variants of experiments which the user falls into.
+// Assigned segments and experiments with an assigned variant are skipped, so are segments which are
+// in an exclusion group with an assigned one and segments whose parent isn't assigned.
+// Returned segments are put into assigned.
+func autoSegments(userID int, segments []models.Segment, experiments []models.Experiment, exclusions exclusions, assigned map[string]struct{}) []string {
+	var candidates []models.Segment
+	for _, segment := range segments {
+		if segment.Bucket(userID) < segment.Percentage {
+			candidates = append(candidates, segment)
+		}
+	}
+	for _, experiment := range experiments {
+		if hasAssignedVariant(experiment, assigned) {
+			continue
+		}
+		if variant, ok := experiment.Variant(userID); ok {
+			candidates = append(candidates, models.Segment{Slug: variant})
+		}
+	}
+
+	var result []string
+	// a child waits for the next pass when its parent may still be assigned later in this one
+	for len(candidates) > 0 {
+		var waiting []models.Segment
+
+		for _, candidate := range candidates {
+			if _, ok := assigned[candidate.Slug]; ok {
+				continue
+			}
+			if _, ok := assigned[candidate.Parent]; candidate.Parent != "" && !ok {
+				waiting = append(waiting, candidate)
+				continue
+			}
+			if _, _, ok := exclusions.conflict(candidate.Slug, assigned); ok {
+				continue
+			}
+			assigned[candidate.Slug] = struct{}{}
+			result = append(result, candidate.Slug)
+		}
+
+		if len(waiting) == len(candidates) {
+			break
+		}
+		candidates = waiting
+	}
+
+	return result
+}
+
+func hasAssignedVariant(experiment models.Experiment, assigned map[string]struct{}) bool {
+	for _, variant := range experiment.Variants {
+		if _, ok := assigned[variant.Slug]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectPercentageSegments returns segments with auto add percentage whose window is open at the moment.
+func selectPercentageSegments(ctx context.Context, tx pgx.Tx, now time.Time) ([]models.Segment, error) {
+	query := fmt.Sprintf(`
+		SELECT slug, auto_add_percentage, salt, COALESCE(parent_slug, '')
+		FROM %s
+		WHERE auto_add_percentage > 0
+		  AND (starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1)
+	`, segmentsTable)
+
+	rows, err := tx.Query(ctx, query, now)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.selectPercentageSegments - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var segments []models.Segment
+	for rows.Next() {
+		var segment models.Segment
+
+		err = rows.Scan(&segment.Slug, &segment.Percentage, &segment.Salt, &segment.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.selectPercentageSegments - rows.Scan: %w", err)
+		}
+
+		segments = append(segments, segment)
+	}
+
+	return segments, nil
+}
+
+// UpdateUserSegments adds and deletes segments of the user, a segment the user already has
+// gets the expiration of the new add. A user seen for the first time is registered and gets its
+// percentage segments after the manual ones, so auto segments skip conflicts with them.
+func (s *Storage) UpdateUserSegments(ctx context.Context, segmentsToAdd []models.UserSegment, segmentsToDelete []string, userID int) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.UpdateUserSegments - s.db.Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	now := time.Now().UTC()
+
+	registered, err := registerUser(ctx, tx, userID, now)
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segmentsToAdd {
+		hasSegment, err := updateUserSegmentExpiry(ctx, tx, segment.Slug, userID, segment.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		if hasSegment {
+			continue
+		}
+		err = checkSegmentParent(ctx, tx, segment.Slug, userID, segmentsToAdd, segmentsToDelete)
+		if err != nil {
+			return err
+		}
+		err = checkExperimentVariant(ctx, tx, segment.Slug, userID, segmentsToDelete)
+		if err != nil {
+			return err
+		}
+		err = checkExclusionGroups(ctx, tx, segment.Slug, userID, segmentsToDelete)
+		if err != nil {
+			return err
+		}
+		err = addUserSegment(ctx, tx, segment.Slug, userID, false, segment.ExpiresAt, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, segment := range segmentsToDelete {
+		err = deleteUserSegment(ctx, tx, segment, userID, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(segmentsToDelete) > 0 {
+		err = deleteChildUserSegments(ctx, tx, segmentsToDelete, []int{userID}, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if registered {
+		// a new user has no segments but the manual ones
+		assigned := make(map[string]struct{}, len(segmentsToAdd))
+		for _, segment := range segmentsToAdd {
+			assigned[segment.Slug] = struct{}{}
+		}
+
+		err = assignPercentageSegments(ctx, tx, userID, assigned, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.UpdateUserSegments - tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+// BulkUpdateUserSegments adds and deletes segments of many users in chunks of bulkChunkSize users,
+// each chunk is written in its own transaction with COPY. A user whose changes cannot be applied
+// (e.g. a segment to delete is missing, the user is in another variant of the experiment of a segment to add
+// or doesn't have the parent of a segment to add)
+// or whose chunk failed gets an error in the result, the other users are updated anyway.
+func (s *Storage) BulkUpdateUserSegments(ctx context.Context, segmentsToAdd []models.UserSegment, segmentsToDelete []string, userIDs []int) ([]models.BulkUserResult, error) {
+	slugs := make([]string, 0, len(segmentsToAdd)+len(segmentsToDelete))
+	for _, segment := range segmentsToAdd {
+		slugs = append(slugs, segment.Slug)
+	}
+	slugs = append(slugs, segmentsToDelete...)
+
+	err := checkSegmentsExist(ctx, s.db, slugs)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		variants   map[string]string
+		exclusions exclusions
+		parents    map[string]string
+	)
+	if len(segmentsToAdd) > 0 {
+		variants, err = selectBulkExperimentVariants(ctx, s.db, segmentsToAdd)
+		if err != nil {
+			return nil, err
+		}
+
+		exclusions, err = selectBulkExclusions(ctx, s.db, segmentsToAdd)
+		if err != nil {
+			return nil, err
+		}
+
+		parents, err = selectBulkSegmentParents(ctx, s.db, segmentsToAdd, segmentsToDelete)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]models.BulkUserResult, 0, len(userIDs))
+
+	for start := 0; start < len(userIDs); start += bulkChunkSize {
+		end := start + bulkChunkSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+		chunk := userIDs[start:end]
+
+		chunkResults, err := s.bulkUpdateUserSegmentsChunk(ctx, segmentsToAdd, segmentsToDelete, variants, exclusions, parents, chunk)
+		if err != nil {
+			for _, userID := range chunk {
+				results = append(results, models.BulkUserResult{
+					UserID: userID,
+					Error:  err.Error(),
+				})
+			}
+			continue
+		}
+
+		results = append(results, chunkResults...)
+	}
+
+	return results, nil
+}
+
+func checkSegmentsExist(ctx context.Context, db PgxPool, slugs []string) error {
+	query := fmt.Sprintf(`
+		SELECT slug
+		FROM %s
+		WHERE slug = ANY($1)
+	`, segmentsTable)
+
+	rows, err := db.Query(ctx, query, slugs)
+	if err != nil {
+		return fmt.Errorf("UserRepo.checkSegmentsExist - db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	existing := make(map[string]struct{}, len(slugs))
+	for rows.Next() {
+		var slug string
+
+		err = rows.Scan(&slug)
+		if err != nil {
+			return fmt.Errorf("UserRepo.checkSegmentsExist - rows.Scan: %w", err)
+		}
+
+		existing[slug] = struct{}{}
+	}
+
+	for _, slug := range slugs {
+		if _, ok := existing[slug]; !ok {
+			return custom_error.CustomError{
+				Field:   "segments",
+				Message: slug + " doesn't exist",
+			}
+		}
+	}
+
+	return nil
+}
+
+// selectBulkExperimentVariants returns variants of experiments of the segments to add mapped to their experiments.
+// Adding two variants of one experiment at once is an error.
+func selectBulkExperimentVariants(ctx context.Context, db PgxPool, segmentsToAdd []models.UserSegment) (map[string]string, error) {
+	slugs := make([]string, 0, len(segmentsToAdd))
+	for _, segment := range segmentsToAdd {
+		slugs = append(slugs, segment.Slug)
+	}
+
+	variants, err := selectExperimentVariants(ctx, db, slugs)
+	if err != nil {
+		return nil, err
+	}
+
+	addedVariants := make(map[string]string, len(segmentsToAdd))
+	for _, segment := range segmentsToAdd {
+		experiment, ok := variants[segment.Slug]
+		if !ok {
+			continue
+		}
+
+		if variant, ok := addedVariants[experiment]; ok && variant != segment.Slug {
+			return nil, custom_error.CustomError{
+				Field:   "segments_to_add",
+				Message: fmt.Sprintf("%s and %s are variants of the same experiment %s", variant, segment.Slug, experiment),
+			}
+		}
+		addedVariants[experiment] = segment.Slug
+	}
+
+	return variants, nil
+}
+
+// selectBulkExclusions returns exclusion groups of segments. Adding two segments of one group at once is an error.
+func selectBulkExclusions(ctx context.Context, db PgxPool, segmentsToAdd []models.UserSegment) (exclusions, error) {
+	exclusions, err := selectExclusions(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	added := make(map[string]struct{}, len(segmentsToAdd))
+	for _, segment := range segmentsToAdd {
+		if other, group, ok := exclusions.conflict(segment.Slug, added); ok {
+			return nil, custom_error.CustomError{
+				Field:   "segments_to_add",
+				Message: fmt.Sprintf("%s and %s are in the same exclusion group %s", other, segment.Slug, group),
+			}
+		}
+		added[segment.Slug] = struct{}{}
+	}
+
+	return exclusions, nil
+}
+
+// selectBulkSegmentParents returns parents of the segments to add which have them.
+// Adding a segment whose parent is deleted in the same update is an error.
+func selectBulkSegmentParents(ctx context.Context, db PgxPool, segmentsToAdd []models.UserSegment, segmentsToDelete []string) (map[string]string, error) {
+	slugs := make([]string, 0, len(segmentsToAdd))
+	for _, segment := range segmentsToAdd {
+		slugs = append(slugs, segment.Slug)
+	}
+
+	parents, err := selectSegmentParents(ctx, db, slugs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, segment := range segmentsToAdd {
+		parent, ok := parents[segment.Slug]
+		if !ok {
+			continue
+		}
+
+		for _, deleted := range segmentsToDelete {
+			if deleted == parent {
+				return nil, custom_error.CustomError{
+					Field:   "segments_to_add",
+					Message: fmt.Sprintf("%s cannot be added while its parent segment %s is deleted", segment.Slug, parent),
+				}
+			}
+		}
+	}
+
+	return parents, nil
+}
+
+func (s *Storage) bulkUpdateUserSegmentsChunk(ctx context.Context, segmentsToAdd []models.UserSegment, segmentsToDelete []string, variants map[string]string, exclusions exclusions, parents map[string]string, userIDs []int) ([]models.BulkUserResult, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.bulkUpdateUserSegmentsChunk - s.db.Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	now := time.Now().UTC()
+
+	slugs := make([]string, 0, len(segmentsToAdd)+len(segmentsToDelete))
+	for _, segment := range segmentsToAdd {
+		slugs = append(slugs, segment.Slug)
+	}
+	slugs = append(slugs, segmentsToDelete...)
+
+	// the other variants of experiments and segments of exclusion groups of segments to add
+	// are read to check the user doesn't have them, parents are read to check the user has them
+	requestedSlugs := make(map[string]struct{}, len(slugs))
+	for _, slug := range slugs {
+		requestedSlugs[slug] = struct{}{}
+	}
+	for variant := range variants {
+		if _, ok := requestedSlugs[variant]; !ok {
+			slugs = append(slugs, variant)
+			requestedSlugs[variant] = struct{}{}
+		}
+	}
+	for _, segment := range segmentsToAdd {
+		for other := range exclusions[segment.Slug] {
+			if _, ok := requestedSlugs[other]; !ok {
+				slugs = append(slugs, other)
+				requestedSlugs[other] = struct{}{}
+			}
+		}
+	}
+	for _, parent := range parents {
+		if _, ok := requestedSlugs[parent]; !ok {
+			slugs = append(slugs, parent)
+			requestedSlugs[parent] = struct{}{}
+		}
+	}
+
+	querySelectUserSegments := fmt.Sprintf(`
+		SELECT user_id, segment_slug
+		FROM %s
+		WHERE user_id = ANY($1) AND segment_slug = ANY($2)
+	`, userSegmentsTable)
+
+	rows, err := tx.Query(ctx, querySelectUserSegments, userIDs, slugs)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.bulkUpdateUserSegmentsChunk - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	userSegments := make(map[int]map[string]struct{}, len(userIDs))
+	for rows.Next() {
+		var (
+			userID  int
+			segment string
+		)
+
+		err = rows.Scan(&userID, &segment)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.bulkUpdateUserSegmentsChunk - rows.Scan: %w", err)
+		}
+
+		if userSegments[userID] == nil {
+			userSegments[userID] = make(map[string]struct{})
+		}
+		userSegments[userID][segment] = struct{}{}
+	}
+
+	var (
+		results         = make([]models.BulkUserResult, 0, len(userIDs))
+		userSegmentRows [][]any
+		operationRows   [][]any
+		usersToDelete   = make(map[string][]int, len(segmentsToDelete))
+		usersToExtend   = make(map[string][]int, len(segmentsToAdd))
+		deletingUsers   []int
+		registeredUsers = make([]int, 0, len(userIDs))
+	)
+
+	for _, userID := range userIDs {
+		result := models.BulkUserResult{UserID: userID}
+
+		for _, segment := range segmentsToDelete {
+			if _, ok := userSegments[userID][segment]; !ok {
+				result.Error = fmt.Sprintf("User (%d) doesn't have segment %s", userID, segment)
+				break
+			}
+		}
+
+		if result.Error == "" {
+			result.Error = checkBulkExperimentVariants(userID, userSegments[userID], segmentsToAdd, segmentsToDelete, variants)
+		}
+
+		if result.Error == "" {
+			result.Error = checkBulkExclusions(userID, userSegments[userID], segmentsToAdd, segmentsToDelete, exclusions)
+		}
+
+		if result.Error == "" {
+			result.Error = checkBulkParents(userID, userSegments[userID], segmentsToAdd, parents)
+		}
+
+		if result.Error != "" {
+			results = append(results, result)
+			continue
+		}
+
+		for _, segment := range segmentsToAdd {
+			if _, ok := userSegments[userID][segment.Slug]; ok {
+				usersToExtend[segment.Slug] = append(usersToExtend[segment.Slug], userID)
+				continue
+			}
+			userSegmentRows = append(userSegmentRows, []any{userID, segment.Slug, segment.ExpiresAt, false, now})
+			operationRows = append(operationRows, []any{userID, segment.Slug, now, "add", false, models.OperationSourceManual})
+			result.Added = append(result.Added, segment.Slug)
+
+			// the queued segment counts as the user's, so a segment passed twice isn't queued again
+			if userSegments[userID] == nil {
+				userSegments[userID] = make(map[string]struct{})
+			}
+			userSegments[userID][segment.Slug] = struct{}{}
+		}
+
+		for _, segment := range segmentsToDelete {
+			usersToDelete[segment] = append(usersToDelete[segment], userID)
+			operationRows = append(operationRows, []any{userID, segment, now, "delete", false, models.OperationSourceManual})
+			result.Deleted = append(result.Deleted, segment)
+		}
+		if len(segmentsToDelete) > 0 {
+			deletingUsers = append(deletingUsers, userID)
+		}
+
+		results = append(results, result)
+		registeredUsers = append(registeredUsers, userID)
+	}
+
+	if len(registeredUsers) > 0 {
+		newUserIDs, err := registerUsers(ctx, tx, registeredUsers, now)
+		if err != nil {
+			return nil, err
+		}
 
-func (s *Storage) UpdateUserSegments(ctx context.Context, segmentsToAdd, segmentsToDelete []string, userID int) error {
-	tx, err := s.db.Begin(ctx)
-	if err != nil {
-		return fmt.Errorf("UserRepo.UpdateUserSegments - s.db.Begin: %w", err)
+		if len(newUserIDs) > 0 {
+			segments, err := selectPercentageSegments(ctx, tx, now)
+			if err != nil {
+				return nil, err
+			}
+
+			experiments, err := selectExperiments(ctx, tx)
+			if err != nil {
+				return nil, err
+			}
+
+			// exclusion groups are read before the chunks only when there are segments to add
+			if exclusions == nil {
+				exclusions, err = selectExclusions(ctx, tx)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			for _, userID := range newUserIDs {
+				// new users have no segments but the manual ones
+				assigned := make(map[string]struct{}, len(segmentsToAdd))
+				for _, segment := range segmentsToAdd {
+					assigned[segment.Slug] = struct{}{}
+				}
+
+				for _, slug := range autoSegments(userID, segments, experiments, exclusions, assigned) {
+					userSegmentRows = append(userSegmentRows, []any{userID, slug, (*time.Time)(nil), true, now})
+					operationRows = append(operationRows, []any{userID, slug, now, "add", true, models.OperationSourceAutoAdd})
+				}
+			}
+		}
 	}
-	defer func() {
-		_ = tx.Rollback(ctx)
-	}()
 
-	now := time.Now().UTC()
+	if len(userSegmentRows) > 0 {
+		_, err = tx.CopyFrom(ctx,
+			pgx.Identifier{userSegmentsTable},
+			[]string{"user_id", "segment_slug", "expires_at", "auto_add", "added_at"},
+			pgx.CopyFromRows(userSegmentRows),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.bulkUpdateUserSegmentsChunk - tx.CopyFrom: %w", err)
+		}
+	}
+
+	// users who already have a segment to add get its new expiration as a single user does
+	queryUpdateExpiry := fmt.Sprintf(`
+		UPDATE %s
+		SET expires_at = $3
+		WHERE segment_slug = $1 AND user_id = ANY($2)
+	`, userSegmentsTable)
 
 	for _, segment := range segmentsToAdd {
-		err = checkUserSegment(ctx, tx, segment, userID)
-		if err != nil {
-			if errors.Is(err, ErrUserAlreadyHasSegment) {
-				continue
-			}
-			return err
+		if len(usersToExtend[segment.Slug]) == 0 {
+			continue
 		}
-		err = addUserSegment(ctx, tx, segment, userID, false, now)
+
+		_, err = tx.Exec(ctx, queryUpdateExpiry, segment.Slug, usersToExtend[segment.Slug], segment.ExpiresAt)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("UserRepo.bulkUpdateUserSegmentsChunk - tx.Exec: %w", err)
 		}
+		delete(usersToExtend, segment.Slug)
 	}
 
+	queryDeleteUserSegments := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE segment_slug = $1 AND user_id = ANY($2)
+	`, userSegmentsTable)
+
 	for _, segment := range segmentsToDelete {
-		err = deleteUserSegment(ctx, tx, segment, userID, now)
+		if len(usersToDelete[segment]) == 0 {
+			continue
+		}
+
+		_, err = tx.Exec(ctx, queryDeleteUserSegments, segment, usersToDelete[segment])
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("UserRepo.bulkUpdateUserSegmentsChunk - tx.Exec: %w", err)
+		}
+	}
+
+	if len(deletingUsers) > 0 {
+		err = deleteChildUserSegments(ctx, tx, segmentsToDelete, deletingUsers, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(operationRows) > 0 {
+		_, err = tx.CopyFrom(ctx,
+			pgx.Identifier{operationsTable},
+			[]string{"user_id", "segment_slug", "date", "action", "auto_add", "source"},
+			pgx.CopyFromRows(operationRows),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.bulkUpdateUserSegmentsChunk - tx.CopyFrom: %w", err)
 		}
 	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
-		return fmt.Errorf("UserRepo.UpdateUserSegments - tx.Commit: %w", err)
+		return nil, fmt.Errorf("UserRepo.bulkUpdateUserSegmentsChunk - tx.Commit: %w", err)
 	}
 
-	return nil
+	return results, nil
 }
 
-func checkUserSegment(ctx context.Context, tx pgx.Tx, segment string, userID int) error {
-	var existFlag bool
+// checkBulkExperimentVariants returns the error of the user which would be in two variants of an experiment
+// after the update, variants deleted in the same update are not counted.
+func checkBulkExperimentVariants(userID int, userSegments map[string]struct{}, segmentsToAdd []models.UserSegment, segmentsToDelete []string, variants map[string]string) string {
+	if len(variants) == 0 {
+		return ""
+	}
+
+	deleted := make(map[string]struct{}, len(segmentsToDelete))
+	for _, segment := range segmentsToDelete {
+		deleted[segment] = struct{}{}
+	}
+
+	for _, segment := range segmentsToAdd {
+		experiment, ok := variants[segment.Slug]
+		if !ok {
+			continue
+		}
+
+		for variant := range userSegments {
+			if _, ok := deleted[variant]; ok || variant == segment.Slug || variants[variant] != experiment {
+				continue
+			}
+			return fmt.Sprintf("User (%d) is already in variant %s of experiment %s", userID, variant, experiment)
+		}
+	}
+
+	return ""
+}
+
+// checkBulkExclusions returns the error of the user which would have two segments of an exclusion group
+// after the update, segments deleted in the same update are not counted.
+func checkBulkExclusions(userID int, userSegments map[string]struct{}, segmentsToAdd []models.UserSegment, segmentsToDelete []string, exclusions exclusions) string {
+	if len(exclusions) == 0 {
+		return ""
+	}
+
+	remaining := make(map[string]struct{}, len(userSegments))
+	for segment := range userSegments {
+		remaining[segment] = struct{}{}
+	}
+	for _, segment := range segmentsToDelete {
+		delete(remaining, segment)
+	}
+
+	for _, segment := range segmentsToAdd {
+		if other, group, ok := exclusions.conflict(segment.Slug, remaining); ok {
+			return exclusionConflictMessage(userID, segment.Slug, other, group)
+		}
+	}
+
+	return ""
+}
+
+// checkBulkParents returns the error of the user who doesn't have the parent of a segment to add
+// and doesn't get it in the same update.
+func checkBulkParents(userID int, userSegments map[string]struct{}, segmentsToAdd []models.UserSegment, parents map[string]string) string {
+	if len(parents) == 0 {
+		return ""
+	}
+
+	added := make(map[string]struct{}, len(segmentsToAdd))
+	for _, segment := range segmentsToAdd {
+		added[segment.Slug] = struct{}{}
+	}
+
+	for _, segment := range segmentsToAdd {
+		parent, ok := parents[segment.Slug]
+		if !ok {
+			continue
+		}
+		if _, ok := userSegments[parent]; ok {
+			continue
+		}
+		if _, ok := added[parent]; ok {
+			continue
+		}
+		return parentMissingMessage(userID, segment.Slug, parent)
+	}
 
+	return ""
+}
+
+// registerUsers adds not registered users to the users table and returns ids of the newly registered ones.
+func registerUsers(ctx context.Context, tx pgx.Tx, userIDs []int, now time.Time) ([]int, error) {
 	query := fmt.Sprintf(`
-		SELECT true
-		FROM %s
+		INSERT INTO %s (id, created_at)
+		SELECT unnest($1::integer[]), $2
+		ON CONFLICT (id) DO NOTHING
+		RETURNING id
+	`, usersTable)
+
+	rows, err := tx.Query(ctx, query, userIDs, now)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.registerUsers - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var newUserIDs []int
+	for rows.Next() {
+		var userID int
+
+		err = rows.Scan(&userID)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.registerUsers - rows.Scan: %w", err)
+		}
+
+		newUserIDs = append(newUserIDs, userID)
+	}
+
+	return newUserIDs, nil
+}
+
+// updateUserSegmentExpiry sets the expiration of the segment the user already has to the one of the new add,
+// so adding it again extends (or removes) its expiration. It returns whether the user has the segment.
+func updateUserSegmentExpiry(ctx context.Context, tx pgx.Tx, segment string, userID int, expiresAt *time.Time) (bool, error) {
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET expires_at = $3
 		WHERE user_id = $1 AND segment_slug = $2
 	`, userSegmentsTable)
 
-	err := tx.QueryRow(ctx, query, userID, segment).Scan(&existFlag)
+	ct, err := tx.Exec(ctx, query, userID, segment, expiresAt)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil
-		}
-		return fmt.Errorf("UserRepo.checkUserSegment - tx.QueryRow.Scan: %w", err)
+		return false, fmt.Errorf("UserRepo.updateUserSegmentExpiry - tx.Exec: %w", err)
 	}
 
-	return ErrUserAlreadyHasSegment
+	return ct.RowsAffected() > 0, nil
 }
 
-func addUserSegment(ctx context.Context, tx pgx.Tx, segment string, userID int, autoAdd bool, now time.Time) error {
+// addUserSegment adds the segment to the user and records a manual or an auto add (see insertUserSegment).
+// Callers check exclusion groups of the segment before.
+func addUserSegment(ctx context.Context, tx pgx.Tx, segment string, userID int, autoAdd bool, expiresAt *time.Time, now time.Time) error {
+	source := models.OperationSourceManual
+	if autoAdd {
+		source = models.OperationSourceAutoAdd
+	}
+
+	return insertUserSegment(ctx, tx, segment, userID, autoAdd, expiresAt, source, now)
+}
+
+// insertUserSegment adds the segment to the user and records the add operation with the source.
+// Nothing is recorded when the user already has the segment, e.g. a concurrent transaction added it.
+func insertUserSegment(ctx context.Context, tx pgx.Tx, segment string, userID int, autoAdd bool, expiresAt *time.Time, source string, now time.Time) error {
 	queryInsertUserSegment := fmt.Sprintf(`
-		INSERT INTO %s (user_id, segment_slug)
-		VALUES ($1, $2)
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
 	`, userSegmentsTable)
 
-	_, err := tx.Exec(ctx, queryInsertUserSegment, userID, segment)
+	ct, err := tx.Exec(ctx, queryInsertUserSegment, userID, segment, expiresAt, autoAdd, now)
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
@@ -91,17 +949,21 @@ func addUserSegment(ctx context.Context, tx pgx.Tx, segment string, userID int,
 				}
 			}
 		}
-		return fmt.Errorf("UserRepo.addUserSegment - tx.Exec: %w", err)
+		return fmt.Errorf("UserRepo.insertUserSegment - tx.Exec: %w", err)
+	}
+
+	if ct.RowsAffected() == 0 {
+		return nil
 	}
 
 	queryInsertOperation := fmt.Sprintf(`
-		INSERT INTO %s (user_id, segment_slug, date, action, auto_add)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, $5, $6)
 	`, operationsTable)
 
-	_, err = tx.Exec(ctx, queryInsertOperation, userID, segment, now, "add", autoAdd)
+	_, err = tx.Exec(ctx, queryInsertOperation, userID, segment, now, "add", autoAdd, source)
 	if err != nil {
-		return fmt.Errorf("UserRepo.addUserSegment - tx.Exec: %w", err)
+		return fmt.Errorf("UserRepo.insertUserSegment - tx.Exec: %w", err)
 	}
 
 	return nil
@@ -126,11 +988,11 @@ func deleteUserSegment(ctx context.Context, tx pgx.Tx, segment string, userID in
 	}
 
 	queryInsertOperation := fmt.Sprintf(`
-		INSERT INTO %s (user_id, segment_slug, date, action, auto_add)
-		VALUES ($1, $2, $3, $4, false)
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, false, $5)
 	`, operationsTable)
 
-	_, err = tx.Exec(ctx, queryInsertOperation, userID, segment, now, "delete")
+	_, err = tx.Exec(ctx, queryInsertOperation, userID, segment, now, "delete", models.OperationSourceManual)
 	if err != nil {
 		return fmt.Errorf("UserRepo.deleteUserSegment - tx.Exec: %w", err)
 	}
@@ -138,16 +1000,43 @@ func deleteUserSegment(ctx context.Context, tx pgx.Tx, segment string, userID in
 	return nil
 }
 
+// GetActiveSegments returns segments of the user whose window is open and which haven't expired yet,
+// so expiration holds before the expired segments are deleted. A user seen for the first time is registered
+// and gets its percentage segments before they are read.
 func (s *Storage) GetActiveSegments(ctx context.Context, userID int) ([]string, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetActiveSegments - s.db.Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	now := time.Now().UTC()
+
+	registered, err := registerUser(ctx, tx, userID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if registered {
+		err = assignPercentageSegments(ctx, tx, userID, make(map[string]struct{}), now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	query := fmt.Sprintf(`
-		SELECT segment_slug
-		FROM %s
-		WHERE user_id = $1
-	`, userSegmentsTable)
+		SELECT us.segment_slug
+		FROM %s us
+		JOIN %s s ON s.slug = us.segment_slug
+		WHERE us.user_id = $1 AND (us.expires_at IS NULL OR us.expires_at > $2)
+		  AND (s.starts_at IS NULL OR s.starts_at <= $2) AND (s.ends_at IS NULL OR s.ends_at > $2)
+	`, userSegmentsTable, segmentsTable)
 
-	rows, err := s.db.Query(ctx, query, userID)
+	rows, err := tx.Query(ctx, query, userID, now)
 	if err != nil {
-		return nil, fmt.Errorf("UserRepo.GetActiveSegments - s.db.Query: %w", err)
+		return nil, fmt.Errorf("UserRepo.GetActiveSegments - tx.Query: %w", err)
 	}
 	defer rows.Close()
 
@@ -163,142 +1052,269 @@ func (s *Storage) GetActiveSegments(ctx context.Context, userID int) ([]string,
 		segments = append(segments, segment)
 	}
 
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetActiveSegments - tx.Commit: %w", err)
+	}
+
 	return segments, nil
 }
 
-func (s *Storage) AutoAddUserSegments(ctx context.Context) error {
+// AutoAddUserSegments adds percentage segments and variants of experiments to users and applies rule segments
+// to users with attributes, segments whose window is closed are skipped. False is returned when another instance
+// runs the job (see tryJobLock).
+func (s *Storage) AutoAddUserSegments(ctx context.Context) (bool, error) {
 	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("UserRepo.AutoAddUserSegments - s.db.Begin: %w", err)
+		return false, fmt.Errorf("UserRepo.AutoAddUserSegments - s.db.Begin: %w", err)
 	}
 	defer func() {
 		_ = tx.Rollback(ctx)
 	}()
 
+	locked, err := tryJobLock(ctx, tx, autoAddLockKey)
+	if err != nil {
+		return false, err
+	}
+
+	if !locked {
+		return false, nil
+	}
+
 	now := time.Now().UTC()
 
-	count, err := countUsers(ctx, tx)
+	segments, err := selectPercentageSegments(ctx, tx, now)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	querySelectSegments := fmt.Sprintf(`
-		SELECT slug, auto_add_percentage
-		FROM %s
-		WHERE auto_add_percentage > 0
-	`, segmentsTable)
+	for _, segment := range segments {
+		err = addSegmentToUsers(ctx, tx, segment, now)
+		if err != nil {
+			return false, err
+		}
+	}
 
-	rows, err := tx.Query(ctx, querySelectSegments)
+	experiments, err := selectExperiments(ctx, tx)
 	if err != nil {
-		return fmt.Errorf("UserRepo.AutoAddUserSegments - tx.Query: %w", err)
+		return false, err
 	}
-	defer rows.Close()
 
-	var segments []models.Segment
-	for rows.Next() {
-		var segment models.Segment
-
-		err = rows.Scan(&segment.Slug, &segment.Percentage)
+	for _, experiment := range experiments {
+		err = addExperimentToUsers(ctx, tx, experiment, now)
 		if err != nil {
-			return fmt.Errorf("UserRepo.AutoAddUserSegments - rows.Scan: %w", err)
+			return false, err
 		}
+	}
 
-		segments = append(segments, segment)
+	ruleSegments, err := selectRuleSegments(ctx, tx, now)
+	if err != nil {
+		return false, err
 	}
 
-	for _, segment := range segments {
-		numUsersToAdd := math.Floor(float64(count) * float64(segment.Percentage) / 100)
-		err = addSegmentToUsers(ctx, tx, segment.Slug, int(numUsersToAdd), now)
+	for _, segment := range ruleSegments {
+		err = applyRuleSegment(ctx, tx, segment, 0, now)
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
-		return fmt.Errorf("UserRepo.AutoAddUserSegments - tx.Commit: %w", err)
+		return false, fmt.Errorf("UserRepo.AutoAddUserSegments - tx.Commit: %w", err)
 	}
 
-	return nil
+	return true, nil
 }
 
-func countUsers(ctx context.Context, tx pgx.Tx) (int, error) {
-	var count int
-
-	query := fmt.Sprintf(`
-		SELECT COUNT(DISTINCT user_id)
+func addSegmentToUsers(ctx context.Context, tx pgx.Tx, segment models.Segment, now time.Time) error {
+	// users get the segment only when their bucket is within the percentage,
+	// so the membership is reproducible and raising the percentage only ever adds users.
+	// Users with a segment of an exclusion group of the segment are skipped.
+	// A child segment is added only to users of its parent, so the percentage applies within the parent.
+	querySelectUsersWithoutCertainSegment := fmt.Sprintf(`
+		SELECT id
 		FROM %s
-	`, userSegmentsTable)
+		WHERE id NOT IN (
+    		SELECT user_id
+    		FROM %s
+    		WHERE segment_slug = $1
+		) AND id NOT IN (
+    		SELECT us.user_id
+    		FROM %s us
+    		JOIN %s other ON other.segment_slug = us.segment_slug
+    		JOIN %s g ON g.group_slug = other.group_slug
+    		WHERE g.segment_slug = $1 AND other.segment_slug <> $1
+		) AND ($2 = '' OR id IN (
+    		SELECT user_id
+    		FROM %s
+    		WHERE segment_slug = $2
+		)) AND id > $3
+		ORDER BY id
+		LIMIT $4
+	`, usersTable, userSegmentsTable, userSegmentsTable, exclusionGroupSegmentsTable, exclusionGroupSegmentsTable, userSegmentsTable)
 
-	err := tx.QueryRow(ctx, query).Scan(&count)
-	if err != nil {
-		if !errors.Is(err, pgx.ErrNoRows) {
-			return 0, fmt.Errorf("UserRepo.countUsers - tx.QueryRow.Scan: %w", err)
+	// candidates are read in pages by id, so all users are never loaded at once
+	lastUserID := 0
+	for {
+		rows, err := tx.Query(ctx, querySelectUsersWithoutCertainSegment, segment.Slug, segment.Parent, lastUserID, autoAddPageSize)
+		if err != nil {
+			return fmt.Errorf("UserRepo.addSegmentToUsers - tx.Query: %w", err)
 		}
-	}
 
-	return count, nil
-}
+		var userIDs []int
+		for rows.Next() {
+			var userID int
 
-func addSegmentToUsers(ctx context.Context, tx pgx.Tx, segment string, amount int, now time.Time) error {
-	// select num of users that already have such a segment, if that num >= percentage of segment then do nothing
-	var num int
+			err = rows.Scan(&userID)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("UserRepo.addSegmentToUsers - rows.Scan: %w", err)
+			}
 
-	querySelectUsers := fmt.Sprintf(`
-		SELECT COUNT(DISTINCT user_id)
-		FROM %s
-		WHERE segment_slug = $1
-	`, userSegmentsTable)
+			userIDs = append(userIDs, userID)
+		}
+		rows.Close()
 
-	err := tx.QueryRow(ctx, querySelectUsers, segment).Scan(&num)
-	if err != nil {
-		if !errors.Is(err, pgx.ErrNoRows) {
-			return fmt.Errorf("UserRepo.addSegmentToUsers - tx.QueryRow.Scan: %w", err)
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("UserRepo.addSegmentToUsers - rows.Err: %w", err)
+		}
+
+		for _, userID := range userIDs {
+			if segment.Bucket(userID) >= segment.Percentage {
+				continue
+			}
+
+			err = addUserSegment(ctx, tx, segment.Slug, userID, true, nil, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(userIDs) < autoAddPageSize {
+			return nil
 		}
+		lastUserID = userIDs[len(userIDs)-1]
 	}
+}
 
-	if num >= amount {
-		return nil
+func (s *Storage) DeleteExpiredUserSegments(ctx context.Context) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.DeleteExpiredUserSegments - s.db.Begin: %w", err)
 	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
 
-	// calculate remaining num of users that have to be with such a segment
-	remainToAdd := amount - num
+	now := time.Now().UTC()
 
-	querySelectUsersWithoutCertainSegment := fmt.Sprintf(`
-		SELECT DISTINCT user_id
-		FROM %s
-		WHERE user_id NOT IN (
-    		SELECT DISTINCT user_id
-    		FROM %s
-    		WHERE segment_slug = $1
-		)
-		LIMIT $2
-	`, userSegmentsTable, userSegmentsTable)
+	queryDeleteExpired := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE expires_at <= $1
+		RETURNING user_id, segment_slug
+	`, userSegmentsTable)
 
-	rows, err := tx.Query(ctx, querySelectUsersWithoutCertainSegment, segment, remainToAdd)
+	rows, err := tx.Query(ctx, queryDeleteExpired, now)
 	if err != nil {
-		return fmt.Errorf("UserRepo.addSegmentToUsers - tx.Query: %w", err)
+		return fmt.Errorf("UserRepo.DeleteExpiredUserSegments - tx.Query: %w", err)
 	}
 	defer rows.Close()
 
-	var userIDs []int
+	var operations []models.Operation
 	for rows.Next() {
-		var userID int
+		var operation models.Operation
 
-		err = rows.Scan(&userID)
+		err = rows.Scan(&operation.UserID, &operation.SegmentSlug)
 		if err != nil {
-			return fmt.Errorf("UserRepo.addSegmentToUsers - rows.Scan: %w", err)
+			return fmt.Errorf("UserRepo.DeleteExpiredUserSegments - rows.Scan: %w", err)
 		}
 
-		userIDs = append(userIDs, userID)
+		operations = append(operations, operation)
 	}
 
-	for _, userID := range userIDs {
-		err = addUserSegment(ctx, tx, segment, userID, true, now)
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, false, $5)
+	`, operationsTable)
+
+	var (
+		expiredSegments []string
+		expiredUsers    = make(map[string][]int)
+	)
+	for _, operation := range operations {
+		_, err = tx.Exec(ctx, queryInsertOperation, operation.UserID, operation.SegmentSlug, now, "delete", models.OperationSourceExpire)
+		if err != nil {
+			return fmt.Errorf("UserRepo.DeleteExpiredUserSegments - tx.Exec: %w", err)
+		}
+
+		if _, ok := expiredUsers[operation.SegmentSlug]; !ok {
+			expiredSegments = append(expiredSegments, operation.SegmentSlug)
+		}
+		expiredUsers[operation.SegmentSlug] = append(expiredUsers[operation.SegmentSlug], operation.UserID)
+	}
+
+	// users who lost a parent segment lose its children too
+	for _, segment := range expiredSegments {
+		err = deleteChildUserSegments(ctx, tx, []string{segment}, expiredUsers[segment], now)
 		if err != nil {
 			return err
 		}
 	}
 
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.DeleteExpiredUserSegments - tx.Commit: %w", err)
+	}
+
 	return nil
 }
+
+func (s *Storage) GetSegmentUsers(ctx context.Context, slug string, afterUserID, limit int) ([]models.UserSegment, error) {
+	var existFlag bool
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT true
+		FROM %s
+		WHERE slug = $1
+	`, segmentsTable)
+
+	err := s.db.QueryRow(ctx, querySelectSegment, slug).Scan(&existFlag)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, custom_error.NotFoundError{
+				Field:   "slug",
+				Message: slug + " doesn't exist",
+			}
+		}
+		return nil, fmt.Errorf("UserRepo.GetSegmentUsers - s.db.QueryRow.Scan: %w", err)
+	}
+
+	querySelectUsers := fmt.Sprintf(`
+		SELECT user_id, auto_add, added_at, expires_at
+		FROM %s
+		WHERE segment_slug = $1 AND user_id > $2
+		ORDER BY user_id
+		LIMIT $3
+	`, userSegmentsTable)
+
+	rows, err := s.db.Query(ctx, querySelectUsers, slug, afterUserID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetSegmentUsers - s.db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var users []models.UserSegment
+	for rows.Next() {
+		user := models.UserSegment{Slug: slug}
+
+		err = rows.Scan(&user.UserID, &user.AutoAdd, &user.AddedAt, &user.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.GetSegmentUsers - rows.Scan: %w", err)
+		}
+
+		users = append(users, user)
+	}
+
+	return users, nil
+}
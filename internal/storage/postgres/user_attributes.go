@@ -0,0 +1,186 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/segment_rule"
+	"time"
+)
+
+// SetUserAttributes replaces attributes of the user, a user seen for the first time is registered.
+// Rule segments whose window is open are applied to the user right away: the user gets segments whose rule
+// the attributes match and loses rule added segments whose rule they don't match anymore.
+func (s *Storage) SetUserAttributes(ctx context.Context, userID int, attributes map[string]any) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.SetUserAttributes - s.db.Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	now := time.Now().UTC()
+
+	registered, err := registerUser(ctx, tx, userID, now)
+	if err != nil {
+		return err
+	}
+
+	if registered {
+		err = assignPercentageSegments(ctx, tx, userID, make(map[string]struct{}), now)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (user_id, attributes, updated_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET attributes = EXCLUDED.attributes, updated_at = EXCLUDED.updated_at
+	`, userAttributesTable)
+
+	_, err = tx.Exec(ctx, query, userID, attributes, now)
+	if err != nil {
+		return fmt.Errorf("UserRepo.SetUserAttributes - tx.Exec: %w", err)
+	}
+
+	segments, err := selectRuleSegments(ctx, tx, now)
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		err = applyRuleSegment(ctx, tx, segment, userID, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.SetUserAttributes - tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+// selectRuleSegments returns segments with a rule whose window is open at the moment.
+func selectRuleSegments(ctx context.Context, tx pgx.Tx, now time.Time) ([]models.Segment, error) {
+	query := fmt.Sprintf(`
+		SELECT slug, rule
+		FROM %s
+		WHERE rule IS NOT NULL
+		  AND (starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1)
+		ORDER BY slug
+	`, segmentsTable)
+
+	rows, err := tx.Query(ctx, query, now)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.selectRuleSegments - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var segments []models.Segment
+	for rows.Next() {
+		var segment models.Segment
+
+		err = rows.Scan(&segment.Slug, &segment.Rule)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.selectRuleSegments - rows.Scan: %w", err)
+		}
+
+		segments = append(segments, segment)
+	}
+
+	return segments, nil
+}
+
+// applyRuleSegment adds the rule segment to users with attributes matching its rule, users with a segment of
+// an exclusion group of the segment are skipped. Auto added users whose attributes don't match the rule anymore
+// lose the segment and its children, manually added users keep it. Zero userID applies the segment to all users.
+func applyRuleSegment(ctx context.Context, tx pgx.Tx, segment models.Segment, userID int, now time.Time) error {
+	rule, err := segment_rule.Parse(segment.Rule)
+	if err != nil {
+		return fmt.Errorf("UserRepo.applyRuleSegment - segment_rule.Parse: %w", err)
+	}
+
+	querySelectUsers := fmt.Sprintf(`
+		SELECT ua.user_id, ua.attributes, us.auto_add, EXISTS (
+			SELECT 1
+			FROM %s other
+			JOIN %s og ON og.segment_slug = other.segment_slug
+			JOIN %s g ON g.group_slug = og.group_slug
+			WHERE other.user_id = ua.user_id AND g.segment_slug = $1 AND other.segment_slug <> $1
+		)
+		FROM %s ua
+		LEFT JOIN %s us ON us.user_id = ua.user_id AND us.segment_slug = $1
+		WHERE $2 = 0 OR ua.user_id = $2
+	`, userSegmentsTable, exclusionGroupSegmentsTable, exclusionGroupSegmentsTable, userAttributesTable, userSegmentsTable)
+
+	rows, err := tx.Query(ctx, querySelectUsers, segment.Slug, userID)
+	if err != nil {
+		return fmt.Errorf("UserRepo.applyRuleSegment - tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var usersToAdd, usersToDelete []int
+	for rows.Next() {
+		var (
+			id         int
+			attributes map[string]any
+			autoAdd    *bool
+			excluded   bool
+		)
+
+		err = rows.Scan(&id, &attributes, &autoAdd, &excluded)
+		if err != nil {
+			return fmt.Errorf("UserRepo.applyRuleSegment - rows.Scan: %w", err)
+		}
+
+		matched := rule.Match(attributes)
+		switch {
+		case matched && autoAdd == nil && !excluded:
+			usersToAdd = append(usersToAdd, id)
+		case !matched && autoAdd != nil && *autoAdd:
+			usersToDelete = append(usersToDelete, id)
+		}
+	}
+
+	for _, id := range usersToAdd {
+		err = insertUserSegment(ctx, tx, segment.Slug, id, true, nil, models.OperationSourceRule, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(usersToDelete) == 0 {
+		return nil
+	}
+
+	queryDeleteUserSegments := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE segment_slug = $1 AND user_id = ANY($2)
+	`, userSegmentsTable)
+
+	_, err = tx.Exec(ctx, queryDeleteUserSegments, segment.Slug, usersToDelete)
+	if err != nil {
+		return fmt.Errorf("UserRepo.applyRuleSegment - tx.Exec: %w", err)
+	}
+
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, true, $5)
+	`, operationsTable)
+
+	for _, id := range usersToDelete {
+		_, err = tx.Exec(ctx, queryInsertOperation, id, segment.Slug, now, "delete", models.OperationSourceRule)
+		if err != nil {
+			return fmt.Errorf("UserRepo.applyRuleSegment - tx.Exec: %w", err)
+		}
+	}
+
+	return deleteChildUserSegments(ctx, tx, []string{segment.Slug}, usersToDelete, now)
+}
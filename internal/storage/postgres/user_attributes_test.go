@@ -0,0 +1,167 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/pashagolub/pgxmock/v2"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var (
+	queryUpsertUserAttributes = fmt.Sprintf(`
+		INSERT INTO %s (user_id, attributes, updated_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET attributes = EXCLUDED.attributes, updated_at = EXCLUDED.updated_at
+	`, userAttributesTable)
+
+	querySelectRuleSegments = fmt.Sprintf(`
+		SELECT slug, rule
+		FROM %s
+		WHERE rule IS NOT NULL
+		  AND (starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1)
+		ORDER BY slug
+	`, segmentsTable)
+
+	querySelectRuleSegmentUsers = fmt.Sprintf(`
+		SELECT ua.user_id, ua.attributes, us.auto_add, EXISTS (
+			SELECT 1
+			FROM %s other
+			JOIN %s og ON og.segment_slug = other.segment_slug
+			JOIN %s g ON g.group_slug = og.group_slug
+			WHERE other.user_id = ua.user_id AND g.segment_slug = $1 AND other.segment_slug <> $1
+		)
+		FROM %s ua
+		LEFT JOIN %s us ON us.user_id = ua.user_id AND us.segment_slug = $1
+		WHERE $2 = 0 OR ua.user_id = $2
+	`, userSegmentsTable, exclusionGroupSegmentsTable, exclusionGroupSegmentsTable, userAttributesTable, userSegmentsTable)
+
+	queryDeleteRuleUserSegments = fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE segment_slug = $1 AND user_id = ANY($2)
+	`, userSegmentsTable)
+
+	queryInsertRuleDeleteOperation = fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, true, $5)
+	`, operationsTable)
+
+	queryInsertRuleUserSegment = fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
+	`, userSegmentsTable)
+
+	queryInsertRuleAddOperation = fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, operationsTable)
+)
+
+func TestStorage_SetUserAttributes(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	userID := 1
+	attributes := map[string]any{"age": float64(20), "platform": "android"}
+
+	queryRegisterUser := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
+
+	userRow := func(autoAdd *bool) *pgxmock.Rows {
+		return pgxmock.NewRows([]string{"user_id", "attributes", "auto_add", "exists"}).
+			AddRow(userID, attributes, autoAdd, false)
+	}
+	autoAdded := true
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryRegisterUser)).WithArgs(userID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpsertUserAttributes)).WithArgs(userID, attributes, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectRuleSegments)).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "rule"}).
+			AddRow("ADULTS", "age >= 18").
+			AddRow("IOS", `platform == "ios"`))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectRuleSegmentUsers)).WithArgs("ADULTS", userID).
+		WillReturnRows(userRow(nil))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertRuleUserSegment)).
+		WithArgs(userID, "ADULTS", (*time.Time)(nil), true, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertRuleAddOperation)).
+		WithArgs(userID, "ADULTS", pgxmock.AnyArg(), "add", true, models.OperationSourceRule).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectRuleSegmentUsers)).WithArgs("IOS", userID).
+		WillReturnRows(userRow(&autoAdded))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteRuleUserSegments)).WithArgs("IOS", []int{userID}).
+		WillReturnResult(pgxmock.NewResult("delete", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertRuleDeleteOperation)).
+		WithArgs(userID, "IOS", pgxmock.AnyArg(), "delete", models.OperationSourceRule).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteChildUserSegments)).
+		WithArgs([]string{"IOS"}, []int{userID}, pgxmock.AnyArg(), models.OperationSourceParentDelete).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.SetUserAttributes(ctx, userID, attributes)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestApplyRuleSegment(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	segment := models.Segment{Slug: "RU", Rule: `country == "RU"`}
+	manual, autoAdded := false, true
+
+	// user 1 matches but has a segment of an exclusion group of the segment, user 2 is manually added
+	// and keeps the segment, user 3 is auto added and still matches, user 4 matches and gets the segment
+	rows := pgxmock.NewRows([]string{"user_id", "attributes", "auto_add", "exists"}).
+		AddRow(1, map[string]any{"country": "RU"}, nil, true).
+		AddRow(2, map[string]any{"country": "US"}, &manual, false).
+		AddRow(3, map[string]any{"country": "RU"}, &autoAdded, false).
+		AddRow(4, map[string]any{"country": "RU"}, nil, false)
+
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectRuleSegmentUsers)).WithArgs(segment.Slug, 0).
+		WillReturnRows(rows)
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertRuleUserSegment)).
+		WithArgs(4, segment.Slug, (*time.Time)(nil), true, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertRuleAddOperation)).
+		WithArgs(4, segment.Slug, pgxmock.AnyArg(), "add", true, models.OperationSourceRule).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+
+	err = applyRuleSegment(ctx, mock, segment, 0, time.Now().UTC())
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestApplyRuleSegmentInvalidRule(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	err = applyRuleSegment(context.Background(), mock, models.Segment{Slug: "RU", Rule: "country =="}, 0, time.Now().UTC())
+	require.EqualError(t, err, "UserRepo.applyRuleSegment - segment_rule.Parse: unexpected end of rule")
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
@@ -7,11 +7,19 @@ import (
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/pashagolub/pgxmock/v2"
 	"github.com/romandnk/dynamic-user-segmentation-service/internal/custom_error"
+	"github.com/romandnk/dynamic-user-segmentation-service/internal/models"
 	"github.com/stretchr/testify/require"
 	"regexp"
 	"testing"
+	"time"
 )
 
+var queryUpdateUserSegmentExpiry = fmt.Sprintf(`
+	UPDATE %s
+	SET expires_at = $3
+	WHERE user_id = $1 AND segment_slug = $2
+`, userSegmentsTable)
+
 func TestStorage_UpdateUserSegments(t *testing.T) {
 	mock, err := pgxmock.NewPool()
 	require.NoError(t, err)
@@ -19,24 +27,25 @@ func TestStorage_UpdateUserSegments(t *testing.T) {
 
 	ctx := context.Background()
 
-	expectedSegmentsToAdd := []string{"AVITO_ADD"}
+	expectedSegmentsToAdd := []models.UserSegment{{Slug: "AVITO_ADD"}}
 	expectedSegmentsToDelete := []string{"AVITO_DELETE"}
 	expectedUserID := 1
 
-	queryCheck := fmt.Sprintf(`
-		SELECT true
-		FROM %s
-		WHERE user_id = $1 AND segment_slug = $2
-	`, userSegmentsTable)
+	queryRegisterUser := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
 
 	queryInsertUserSegment := fmt.Sprintf(`
-		INSERT INTO %s (user_id, segment_slug)
-		VALUES ($1, $2)
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
 	`, userSegmentsTable)
 
 	queryInsertForAddOperation := fmt.Sprintf(`
-		INSERT INTO %s (user_id, segment_slug, date, action, auto_add)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, $5, $6)
 	`, operationsTable)
 
 	queryDeleteUserSegment := fmt.Sprintf(`
@@ -45,23 +54,38 @@ func TestStorage_UpdateUserSegments(t *testing.T) {
 	`, userSegmentsTable)
 
 	queryInsertForDeleteOperation := fmt.Sprintf(`
-		INSERT INTO %s (user_id, segment_slug, date, action, auto_add)
-		VALUES ($1, $2, $3, $4, false)
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, false, $5)
 	`, operationsTable)
 
 	mock.ExpectBegin()
-	mock.ExpectQuery(regexp.QuoteMeta(queryCheck)).WithArgs(expectedUserID, expectedSegmentsToAdd[0]).
+	mock.ExpectExec(regexp.QuoteMeta(queryRegisterUser)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateUserSegmentExpiry)).
+		WithArgs(expectedUserID, expectedSegmentsToAdd[0].Slug, expectedSegmentsToAdd[0].ExpiresAt).
+		WillReturnResult(pgxmock.NewResult("update", 0))
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegmentParent)).WithArgs(expectedSegmentsToAdd[0].Slug, expectedUserID).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckExperimentVariant)).
+		WithArgs(expectedSegmentsToAdd[0].Slug, expectedUserID, expectedSegmentsToDelete).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(queryFindExclusionConflict)).
+		WithArgs(expectedSegmentsToAdd[0].Slug, expectedUserID, expectedSegmentsToDelete).
 		WillReturnError(pgx.ErrNoRows)
-	mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).WithArgs(expectedUserID, expectedSegmentsToAdd[0]).
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).
+		WithArgs(expectedUserID, expectedSegmentsToAdd[0].Slug, expectedSegmentsToAdd[0].ExpiresAt, false, pgxmock.AnyArg()).
 		WillReturnResult(pgxmock.NewResult("insert", 1))
 	mock.ExpectExec(regexp.QuoteMeta(queryInsertForAddOperation)).
-		WithArgs(expectedUserID, expectedSegmentsToAdd[0], pgxmock.AnyArg(), "add", false).
+		WithArgs(expectedUserID, expectedSegmentsToAdd[0].Slug, pgxmock.AnyArg(), "add", false, models.OperationSourceManual).
 		WillReturnResult(pgxmock.NewResult("insert", 1))
 	mock.ExpectExec(regexp.QuoteMeta(queryDeleteUserSegment)).WithArgs(expectedUserID, expectedSegmentsToDelete[0]).
 		WillReturnResult(pgxmock.NewResult("delete", 1))
 	mock.ExpectExec(regexp.QuoteMeta(queryInsertForDeleteOperation)).
-		WithArgs(expectedUserID, expectedSegmentsToDelete[0], pgxmock.AnyArg(), "delete").
+		WithArgs(expectedUserID, expectedSegmentsToDelete[0], pgxmock.AnyArg(), "delete", models.OperationSourceManual).
 		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteChildUserSegments)).
+		WithArgs(expectedSegmentsToDelete, []int{expectedUserID}, pgxmock.AnyArg(), models.OperationSourceParentDelete).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
 	mock.ExpectCommit()
 
 	storage := NewStoragePostgres()
@@ -80,23 +104,24 @@ func TestStorage_UpdateUserSegmentsSegmentNotExistWhileAdding(t *testing.T) {
 
 	ctx := context.Background()
 
-	expectedSegmentsToAdd := []string{"AVITO_ADD"}
+	expectedSegmentsToAdd := []models.UserSegment{{Slug: "AVITO_ADD"}}
 	expectedSegmentsToDelete := []string{"AVITO_DELETE"}
 	expectedUserID := 1
 	expectedError := custom_error.CustomError{
 		Field:   "segments_to_add",
-		Message: expectedSegmentsToAdd[0] + " doesn't exist",
+		Message: expectedSegmentsToAdd[0].Slug + " doesn't exist",
 	}
 
-	queryCheck := fmt.Sprintf(`
-		SELECT true
-		FROM %s
-		WHERE user_id = $1 AND segment_slug = $2
-	`, userSegmentsTable)
+	queryRegisterUser := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
 
 	queryInsertUserSegment := fmt.Sprintf(`
-		INSERT INTO %s (user_id, segment_slug)
-		VALUES ($1, $2)
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
 	`, userSegmentsTable)
 
 	returnError := &pgconn.PgError{
@@ -104,9 +129,21 @@ func TestStorage_UpdateUserSegmentsSegmentNotExistWhileAdding(t *testing.T) {
 	}
 
 	mock.ExpectBegin()
-	mock.ExpectQuery(regexp.QuoteMeta(queryCheck)).WithArgs(expectedUserID, expectedSegmentsToAdd[0]).
+	mock.ExpectExec(regexp.QuoteMeta(queryRegisterUser)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateUserSegmentExpiry)).
+		WithArgs(expectedUserID, expectedSegmentsToAdd[0].Slug, expectedSegmentsToAdd[0].ExpiresAt).
+		WillReturnResult(pgxmock.NewResult("update", 0))
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegmentParent)).WithArgs(expectedSegmentsToAdd[0].Slug, expectedUserID).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckExperimentVariant)).
+		WithArgs(expectedSegmentsToAdd[0].Slug, expectedUserID, expectedSegmentsToDelete).
 		WillReturnError(pgx.ErrNoRows)
-	mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).WithArgs(expectedUserID, expectedSegmentsToAdd[0]).
+	mock.ExpectQuery(regexp.QuoteMeta(queryFindExclusionConflict)).
+		WithArgs(expectedSegmentsToAdd[0].Slug, expectedUserID, expectedSegmentsToDelete).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).
+		WithArgs(expectedUserID, expectedSegmentsToAdd[0].Slug, expectedSegmentsToAdd[0].ExpiresAt, false, pgxmock.AnyArg()).
 		WillReturnError(returnError)
 	mock.ExpectRollback()
 
@@ -126,7 +163,7 @@ func TestStorage_UpdateUserSegmentsUserNotHaveSegmentWhileDeleting(t *testing.T)
 
 	ctx := context.Background()
 
-	expectedSegmentsToAdd := []string{}
+	expectedSegmentsToAdd := []models.UserSegment{}
 	expectedSegmentsToDelete := []string{"AVITO_DELETE"}
 	expectedUserID := 1
 	expectedError := custom_error.CustomError{
@@ -134,12 +171,20 @@ func TestStorage_UpdateUserSegmentsUserNotHaveSegmentWhileDeleting(t *testing.T)
 		Message: fmt.Sprintf("User (%d) doesn't have segment %s", expectedUserID, expectedSegmentsToDelete[0]),
 	}
 
+	queryRegisterUser := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
+
 	queryDeleteUserSegment := fmt.Sprintf(`
 		DELETE FROM %s
 		WHERE user_id = $1 AND segment_slug = $2
 	`, userSegmentsTable)
 
 	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryRegisterUser)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
 	mock.ExpectExec(regexp.QuoteMeta(queryDeleteUserSegment)).WithArgs(expectedUserID, expectedSegmentsToDelete[0]).
 		WillReturnResult(pgxmock.NewResult("insert", 0))
 	mock.ExpectRollback()
@@ -153,27 +198,143 @@ func TestStorage_UpdateUserSegmentsUserNotHaveSegmentWhileDeleting(t *testing.T)
 	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
 }
 
-func TestCheckUserSegment(t *testing.T) {
+func TestStorage_UpdateUserSegmentsExtendExpiry(t *testing.T) {
 	mock, err := pgxmock.NewPool()
 	require.NoError(t, err)
 	defer mock.Close()
 
 	ctx := context.Background()
 
-	expectedSegment := "AVITO_TEST"
+	expiresAt := time.Now().UTC().Add(72 * time.Hour)
+	expectedSegmentsToAdd := []models.UserSegment{{Slug: "AVITO_PROMO", ExpiresAt: &expiresAt}}
 	expectedUserID := 1
 
-	query := fmt.Sprintf(`
-		SELECT true
+	queryRegisterUser := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
+
+	// the user already has the segment, so only its expiration changes and no operation is recorded
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryRegisterUser)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateUserSegmentExpiry)).
+		WithArgs(expectedUserID, expectedSegmentsToAdd[0].Slug, &expiresAt).
+		WillReturnResult(pgxmock.NewResult("update", 1))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.UpdateUserSegments(ctx, expectedSegmentsToAdd, nil, expectedUserID)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_UpdateUserSegmentsNewUser(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSegmentsToAdd := []models.UserSegment{{Slug: "BANNER_B"}}
+	expectedUserID := 1
+
+	queryRegisterUser := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
+
+	querySelectSegments := fmt.Sprintf(`
+		SELECT slug, auto_add_percentage, salt, COALESCE(parent_slug, '')
 		FROM %s
-		WHERE user_id = $1 AND segment_slug = $2
+		WHERE auto_add_percentage > 0
+		  AND (starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1)
+	`, segmentsTable)
+
+	queryInsertUserSegment := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
 	`, userSegmentsTable)
 
-	mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(expectedUserID, expectedSegment).
-		WillReturnRows(pgxmock.NewRows([]string{"true"}).AddRow(true))
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, operationsTable)
+
+	// the manual segment is added first, so the auto segment in its exclusion group is skipped
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryRegisterUser)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateUserSegmentExpiry)).
+		WithArgs(expectedUserID, "BANNER_B", expectedSegmentsToAdd[0].ExpiresAt).
+		WillReturnResult(pgxmock.NewResult("update", 0))
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegmentParent)).WithArgs("BANNER_B", expectedUserID).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckExperimentVariant)).
+		WithArgs("BANNER_B", expectedUserID, []string{}).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(queryFindExclusionConflict)).
+		WithArgs("BANNER_B", expectedUserID, []string{}).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).
+		WithArgs(expectedUserID, "BANNER_B", expectedSegmentsToAdd[0].ExpiresAt, false, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertOperation)).
+		WithArgs(expectedUserID, "BANNER_B", pgxmock.AnyArg(), "add", false, models.OperationSourceManual).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegments)).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "auto_add_percentage", "salt", "parent_slug"}).
+			AddRow("BANNER_A", 100, "salt", "").
+			AddRow("TEST_ALL", 100, "salt", ""))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperiments)).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "salt", "segment_slug", "weight"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusions)).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug", "segment_slug"}).
+			AddRow("BANNERS", "BANNER_A", "BANNER_B").
+			AddRow("BANNERS", "BANNER_B", "BANNER_A"))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).
+		WithArgs(expectedUserID, "TEST_ALL", (*time.Time)(nil), true, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertOperation)).
+		WithArgs(expectedUserID, "TEST_ALL", pgxmock.AnyArg(), "add", true, models.OperationSourceAutoAdd).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.UpdateUserSegments(ctx, expectedSegmentsToAdd, nil, expectedUserID)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestInsertUserSegmentAlreadyAdded(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
+	`, userSegmentsTable)
+
+	// a concurrent transaction added the segment first, so no operation is recorded
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs(1, "AVITO_TEST", (*time.Time)(nil), true, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
 
-	err = checkUserSegment(ctx, mock, expectedSegment, expectedUserID)
-	require.ErrorIs(t, err, ErrUserAlreadyHasSegment)
+	err = insertUserSegment(ctx, mock, "AVITO_TEST", 1, true, nil, models.OperationSourceAutoAdd, time.Now().UTC())
+	require.NoError(t, err)
 
 	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
 }
@@ -188,16 +349,28 @@ func TestStorage_GetActiveSegments(t *testing.T) {
 	expectedUserID := 1
 	expectedUserSegments := []string{"TEST1", "TEST2"}
 
+	queryRegisterUser := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
+
 	query := fmt.Sprintf(`
-		SELECT segment_slug
-		FROM %s
-		WHERE user_id = $1
-	`, userSegmentsTable)
+		SELECT us.segment_slug
+		FROM %s us
+		JOIN %s s ON s.slug = us.segment_slug
+		WHERE us.user_id = $1 AND (us.expires_at IS NULL OR us.expires_at > $2)
+		  AND (s.starts_at IS NULL OR s.starts_at <= $2) AND (s.ends_at IS NULL OR s.ends_at > $2)
+	`, userSegmentsTable, segmentsTable)
 
-	mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(expectedUserID).
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryRegisterUser)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(expectedUserID, pgxmock.AnyArg()).
 		WillReturnRows(pgxmock.NewRows([]string{"segment_slug"}).
 			AddRow(expectedUserSegments[0]).
 			AddRow(expectedUserSegments[1]))
+	mock.ExpectCommit()
 
 	storage := NewStoragePostgres()
 	storage.db = mock
@@ -216,72 +389,936 @@ func TestStorage_AutoAddUserSegments(t *testing.T) {
 
 	ctx := context.Background()
 
-	queryCount := fmt.Sprintf(`
-		SELECT COUNT(DISTINCT user_id)
-		FROM %s
-	`, userSegmentsTable)
+	segment := models.Segment{
+		Slug:       "TEST",
+		Percentage: 50,
+		Salt:       "salt",
+	}
+
+	var (
+		candidates    []int
+		expectedUsers []int
+	)
+	for userID := 1; userID <= 10; userID++ {
+		candidates = append(candidates, userID)
+		if segment.Bucket(userID) < segment.Percentage {
+			expectedUsers = append(expectedUsers, userID)
+		}
+	}
 
 	querySelectSegments := fmt.Sprintf(`
-		SELECT slug, auto_add_percentage
+		SELECT slug, auto_add_percentage, salt, COALESCE(parent_slug, '')
 		FROM %s
 		WHERE auto_add_percentage > 0
+		  AND (starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1)
 	`, segmentsTable)
 
-	querySelectUsers := fmt.Sprintf(`
-		SELECT COUNT(DISTINCT user_id)
+	querySelectUsersWithoutCertainSegment := fmt.Sprintf(`
+		SELECT id
 		FROM %s
-		WHERE segment_slug = $1
+		WHERE id NOT IN (
+    		SELECT user_id
+    		FROM %s
+    		WHERE segment_slug = $1
+		) AND id NOT IN (
+    		SELECT us.user_id
+    		FROM %s us
+    		JOIN %s other ON other.segment_slug = us.segment_slug
+    		JOIN %s g ON g.group_slug = other.group_slug
+    		WHERE g.segment_slug = $1 AND other.segment_slug <> $1
+		) AND ($2 = '' OR id IN (
+    		SELECT user_id
+    		FROM %s
+    		WHERE segment_slug = $2
+		)) AND id > $3
+		ORDER BY id
+		LIMIT $4
+	`, usersTable, userSegmentsTable, userSegmentsTable, exclusionGroupSegmentsTable, exclusionGroupSegmentsTable, userSegmentsTable)
+
+	queryInsertUserSegment := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
 	`, userSegmentsTable)
 
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, operationsTable)
+
+	candidateRows := pgxmock.NewRows([]string{"id"})
+	for _, userID := range candidates {
+		candidateRows.AddRow(userID)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_xact_lock(hashtext($1))")).WithArgs(autoAddLockKey).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegments)).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "auto_add_percentage", "salt", "parent_slug"}).
+			AddRow(segment.Slug, segment.Percentage, segment.Salt, segment.Parent))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectUsersWithoutCertainSegment)).WithArgs(segment.Slug, segment.Parent, 0, autoAddPageSize).
+		WillReturnRows(candidateRows)
+	for _, userID := range expectedUsers {
+		mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).
+			WithArgs(userID, segment.Slug, (*time.Time)(nil), true, pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("insert", 1))
+		mock.ExpectExec(regexp.QuoteMeta(queryInsertOperation)).
+			WithArgs(userID, segment.Slug, pgxmock.AnyArg(), "add", true, models.OperationSourceAutoAdd).
+			WillReturnResult(pgxmock.NewResult("insert", 1))
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperiments)).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "salt", "segment_slug", "weight"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectRuleSegments)).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "rule"}))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	ran, err := storage.AutoAddUserSegments(ctx)
+	require.NoError(t, err)
+	require.True(t, ran)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+// TestAddSegmentToUsersPages checks candidates are read page by page after the last read user.
+func TestAddSegmentToUsersPages(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	segment := models.Segment{
+		Slug:       "AVITO_PERCENT",
+		Percentage: 2,
+		Salt:       "salt",
+	}
+	now := time.Date(2023, 8, 15, 12, 0, 0, 0, time.UTC)
+
 	querySelectUsersWithoutCertainSegment := fmt.Sprintf(`
-		SELECT DISTINCT user_id
+		SELECT id
 		FROM %s
-		WHERE user_id NOT IN (
-    		SELECT DISTINCT user_id
+		WHERE id NOT IN (
+    		SELECT user_id
     		FROM %s
     		WHERE segment_slug = $1
-		)
-		LIMIT $2
-	`, userSegmentsTable, userSegmentsTable)
+		) AND id NOT IN (
+    		SELECT us.user_id
+    		FROM %s us
+    		JOIN %s other ON other.segment_slug = us.segment_slug
+    		JOIN %s g ON g.group_slug = other.group_slug
+    		WHERE g.segment_slug = $1 AND other.segment_slug <> $1
+		) AND ($2 = '' OR id IN (
+    		SELECT user_id
+    		FROM %s
+    		WHERE segment_slug = $2
+		)) AND id > $3
+		ORDER BY id
+		LIMIT $4
+	`, usersTable, userSegmentsTable, userSegmentsTable, exclusionGroupSegmentsTable, exclusionGroupSegmentsTable, userSegmentsTable)
 
 	queryInsertUserSegment := fmt.Sprintf(`
-		INSERT INTO %s (user_id, segment_slug)
-		VALUES ($1, $2)
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
 	`, userSegmentsTable)
 
 	queryInsertOperation := fmt.Sprintf(`
-		INSERT INTO %s (user_id, segment_slug, date, action, auto_add)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, operationsTable)
+
+	expectPage := func(lastUserID int, userIDs []int) {
+		pageRows := pgxmock.NewRows([]string{"id"})
+		for _, userID := range userIDs {
+			pageRows.AddRow(userID)
+		}
+
+		mock.ExpectQuery(regexp.QuoteMeta(querySelectUsersWithoutCertainSegment)).
+			WithArgs(segment.Slug, segment.Parent, lastUserID, autoAddPageSize).
+			WillReturnRows(pageRows)
+		for _, userID := range userIDs {
+			if segment.Bucket(userID) >= segment.Percentage {
+				continue
+			}
+
+			mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).
+				WithArgs(userID, segment.Slug, (*time.Time)(nil), true, now).
+				WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			mock.ExpectExec(regexp.QuoteMeta(queryInsertOperation)).
+				WithArgs(userID, segment.Slug, now, "add", true, models.OperationSourceAutoAdd).
+				WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		}
+	}
+
+	var firstPage []int
+	for userID := 1; userID <= autoAddPageSize; userID++ {
+		firstPage = append(firstPage, userID)
+	}
+
+	expectPage(0, firstPage)
+	expectPage(autoAddPageSize, []int{autoAddPageSize + 1})
+
+	err = addSegmentToUsers(ctx, mock, segment, now)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_AutoAddUserSegmentsLockTaken(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_xact_lock(hashtext($1))")).WithArgs(autoAddLockKey).
+		WillReturnRows(pgxmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(false))
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	ran, err := storage.AutoAddUserSegments(ctx)
+	require.NoError(t, err)
+	require.False(t, ran)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_DeleteExpiredUserSegments(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	queryDeleteExpired := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE expires_at <= $1
+		RETURNING user_id, segment_slug
+	`, userSegmentsTable)
+
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, false, $5)
 	`, operationsTable)
 
 	mock.ExpectBegin()
-	mock.ExpectQuery(regexp.QuoteMeta(queryCount)).
-		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(4))
-	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegments)).
-		WillReturnRows(pgxmock.NewRows([]string{"slug", "auto_add_percentage"}).AddRow("TEST", 100))
-	mock.ExpectQuery(regexp.QuoteMeta(querySelectUsers)).
-		WithArgs("TEST").
-		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(1))
-	mock.ExpectQuery(regexp.QuoteMeta(querySelectUsersWithoutCertainSegment)).WithArgs("TEST", 3).
-		WillReturnRows(pgxmock.NewRows([]string{"user_id"}).
-			AddRow(1).
-			AddRow(2).
-			AddRow(3))
-	for i := 1; i <= 3; i++ {
-		mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).
-			WithArgs(i, "TEST").
-			WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectQuery(regexp.QuoteMeta(queryDeleteExpired)).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_slug"}).
+			AddRow(1, "PROMO").
+			AddRow(2, "PROMO"))
+	for i := 1; i <= 2; i++ {
 		mock.ExpectExec(regexp.QuoteMeta(queryInsertOperation)).
-			WithArgs(i, "TEST", pgxmock.AnyArg(), "add", true).
+			WithArgs(i, "PROMO", pgxmock.AnyArg(), "delete", models.OperationSourceExpire).
 			WillReturnResult(pgxmock.NewResult("insert", 1))
 	}
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteChildUserSegments)).
+		WithArgs([]string{"PROMO"}, []int{1, 2}, pgxmock.AnyArg(), models.OperationSourceParentDelete).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
 	mock.ExpectCommit()
 
 	storage := NewStoragePostgres()
 	storage.db = mock
 
-	err = storage.AutoAddUserSegments(ctx)
+	err = storage.DeleteExpiredUserSegments(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetSegmentUsers(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSlug := "AVITO_TEST"
+	expectedAfterUserID := 10
+	expectedLimit := 2
+	expiresAt := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	expectedUsers := []models.UserSegment{
+		{
+			UserID:  11,
+			Slug:    expectedSlug,
+			AutoAdd: true,
+			AddedAt: time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			UserID:    15,
+			Slug:      expectedSlug,
+			AutoAdd:   false,
+			AddedAt:   time.Date(2023, 8, 2, 0, 0, 0, 0, time.UTC),
+			ExpiresAt: &expiresAt,
+		},
+	}
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT true
+		FROM %s
+		WHERE slug = $1
+	`, segmentsTable)
+
+	querySelectUsers := fmt.Sprintf(`
+		SELECT user_id, auto_add, added_at, expires_at
+		FROM %s
+		WHERE segment_slug = $1 AND user_id > $2
+		ORDER BY user_id
+		LIMIT $3
+	`, userSegmentsTable)
+
+	rows := pgxmock.NewRows([]string{"user_id", "auto_add", "added_at", "expires_at"})
+	for _, user := range expectedUsers {
+		rows.AddRow(user.UserID, user.AutoAdd, user.AddedAt, user.ExpiresAt)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegment)).WithArgs(expectedSlug).
+		WillReturnRows(pgxmock.NewRows([]string{"true"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectUsers)).WithArgs(expectedSlug, expectedAfterUserID, expectedLimit).
+		WillReturnRows(rows)
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	users, err := storage.GetSegmentUsers(ctx, expectedSlug, expectedAfterUserID, expectedLimit)
+	require.NoError(t, err)
+	require.Equal(t, expectedUsers, users)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetSegmentUsersSegmentNotExist(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSlug := "AVITO_TEST"
+	expectedError := custom_error.NotFoundError{
+		Field:   "slug",
+		Message: expectedSlug + " doesn't exist",
+	}
+
+	querySelectSegment := fmt.Sprintf(`
+		SELECT true
+		FROM %s
+		WHERE slug = $1
+	`, segmentsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegment)).WithArgs(expectedSlug).
+		WillReturnRows(pgxmock.NewRows([]string{"true"}))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.GetSegmentUsers(ctx, expectedSlug, 0, 100)
+	require.ErrorIs(t, err, expectedError)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_BulkUpdateUserSegments(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSegmentsToAdd := []models.UserSegment{{Slug: "AVITO_ADD"}}
+	expectedSegmentsToDelete := []string{"AVITO_DELETE"}
+	expectedUserIDs := []int{1, 2}
+	expectedSlugs := []string{"AVITO_ADD", "AVITO_DELETE"}
+
+	queryCheckSegments := fmt.Sprintf(`
+		SELECT slug
+		FROM %s
+		WHERE slug = ANY($1)
+	`, segmentsTable)
+
+	querySelectUserSegments := fmt.Sprintf(`
+		SELECT user_id, segment_slug
+		FROM %s
+		WHERE user_id = ANY($1) AND segment_slug = ANY($2)
+	`, userSegmentsTable)
+
+	queryRegisterUsers := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		SELECT unnest($1::integer[]), $2
+		ON CONFLICT (id) DO NOTHING
+		RETURNING id
+	`, usersTable)
+
+	queryDeleteUserSegments := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE segment_slug = $1 AND user_id = ANY($2)
+	`, userSegmentsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegments)).WithArgs(expectedSlugs).
+		WillReturnRows(pgxmock.NewRows([]string{"slug"}).AddRow("AVITO_ADD").AddRow("AVITO_DELETE"))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperimentVariants)).WithArgs([]string{"AVITO_ADD"}).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "experiment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusions)).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug", "segment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentParents)).WithArgs([]string{"AVITO_ADD"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "parent_slug"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectUserSegments)).WithArgs(expectedUserIDs, expectedSlugs).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_slug"}).AddRow(1, "AVITO_DELETE"))
+	mock.ExpectQuery(regexp.QuoteMeta(queryRegisterUsers)).WithArgs([]int{1}, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectCopyFrom(pgx.Identifier{userSegmentsTable},
+		[]string{"user_id", "segment_slug", "expires_at", "auto_add", "added_at"}).
+		WillReturnResult(1)
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteUserSegments)).WithArgs("AVITO_DELETE", []int{1}).
+		WillReturnResult(pgxmock.NewResult("delete", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteChildUserSegments)).
+		WithArgs(expectedSegmentsToDelete, []int{1}, pgxmock.AnyArg(), models.OperationSourceParentDelete).
+		WillReturnResult(pgxmock.NewResult("insert", 0))
+	mock.ExpectCopyFrom(pgx.Identifier{operationsTable},
+		[]string{"user_id", "segment_slug", "date", "action", "auto_add", "source"}).
+		WillReturnResult(2)
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	results, err := storage.BulkUpdateUserSegments(ctx, expectedSegmentsToAdd, expectedSegmentsToDelete, expectedUserIDs)
+	require.NoError(t, err)
+
+	require.Equal(t, []models.BulkUserResult{
+		{UserID: 1, Added: []string{"AVITO_ADD"}, Deleted: []string{"AVITO_DELETE"}},
+		{UserID: 2, Error: "User (2) doesn't have segment AVITO_DELETE"},
+	}, results)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_BulkUpdateUserSegmentsExtendExpiry(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expiresAt := time.Now().UTC().Add(72 * time.Hour)
+	expectedSegmentsToAdd := []models.UserSegment{{Slug: "AVITO_PROMO", ExpiresAt: &expiresAt}}
+	expectedUserIDs := []int{1, 2}
+
+	queryCheckSegments := fmt.Sprintf(`
+		SELECT slug
+		FROM %s
+		WHERE slug = ANY($1)
+	`, segmentsTable)
+
+	querySelectUserSegments := fmt.Sprintf(`
+		SELECT user_id, segment_slug
+		FROM %s
+		WHERE user_id = ANY($1) AND segment_slug = ANY($2)
+	`, userSegmentsTable)
+
+	queryRegisterUsers := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		SELECT unnest($1::integer[]), $2
+		ON CONFLICT (id) DO NOTHING
+		RETURNING id
+	`, usersTable)
+
+	queryUpdateExpiry := fmt.Sprintf(`
+		UPDATE %s
+		SET expires_at = $3
+		WHERE segment_slug = $1 AND user_id = ANY($2)
+	`, userSegmentsTable)
+
+	// user 1 already has the segment and gets the new expiration, user 2 gets the segment
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegments)).WithArgs([]string{"AVITO_PROMO"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug"}).AddRow("AVITO_PROMO"))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperimentVariants)).WithArgs([]string{"AVITO_PROMO"}).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "experiment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusions)).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug", "segment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentParents)).WithArgs([]string{"AVITO_PROMO"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "parent_slug"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectUserSegments)).WithArgs(expectedUserIDs, []string{"AVITO_PROMO"}).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_slug"}).AddRow(1, "AVITO_PROMO"))
+	mock.ExpectQuery(regexp.QuoteMeta(queryRegisterUsers)).WithArgs(expectedUserIDs, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectCopyFrom(pgx.Identifier{userSegmentsTable},
+		[]string{"user_id", "segment_slug", "expires_at", "auto_add", "added_at"}).
+		WillReturnResult(1)
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateExpiry)).WithArgs("AVITO_PROMO", []int{1}, &expiresAt).
+		WillReturnResult(pgxmock.NewResult("update", 1))
+	mock.ExpectCopyFrom(pgx.Identifier{operationsTable},
+		[]string{"user_id", "segment_slug", "date", "action", "auto_add", "source"}).
+		WillReturnResult(1)
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	results, err := storage.BulkUpdateUserSegments(ctx, expectedSegmentsToAdd, nil, expectedUserIDs)
+	require.NoError(t, err)
+
+	require.Equal(t, []models.BulkUserResult{
+		{UserID: 1},
+		{UserID: 2, Added: []string{"AVITO_PROMO"}},
+	}, results)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_BulkUpdateUserSegmentsDuplicateSegment(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSegmentsToAdd := []models.UserSegment{{Slug: "AVITO_ADD"}, {Slug: "AVITO_ADD"}}
+	expectedUserIDs := []int{1}
+	expectedSlugs := []string{"AVITO_ADD", "AVITO_ADD"}
+
+	queryCheckSegments := fmt.Sprintf(`
+		SELECT slug
+		FROM %s
+		WHERE slug = ANY($1)
+	`, segmentsTable)
+
+	querySelectUserSegments := fmt.Sprintf(`
+		SELECT user_id, segment_slug
+		FROM %s
+		WHERE user_id = ANY($1) AND segment_slug = ANY($2)
+	`, userSegmentsTable)
+
+	queryRegisterUsers := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		SELECT unnest($1::integer[]), $2
+		ON CONFLICT (id) DO NOTHING
+		RETURNING id
+	`, usersTable)
+
+	queryUpdateExpiry := fmt.Sprintf(`
+		UPDATE %s
+		SET expires_at = $3
+		WHERE segment_slug = $1 AND user_id = ANY($2)
+	`, userSegmentsTable)
+
+	// the segment is queued once, its second add only sets the expiration of the queued one
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegments)).WithArgs(expectedSlugs).
+		WillReturnRows(pgxmock.NewRows([]string{"slug"}).AddRow("AVITO_ADD"))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperimentVariants)).WithArgs(expectedSlugs).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "experiment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusions)).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug", "segment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentParents)).WithArgs(expectedSlugs).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "parent_slug"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectUserSegments)).WithArgs(expectedUserIDs, expectedSlugs).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(queryRegisterUsers)).WithArgs(expectedUserIDs, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}))
+	mock.ExpectCopyFrom(pgx.Identifier{userSegmentsTable},
+		[]string{"user_id", "segment_slug", "expires_at", "auto_add", "added_at"}).
+		WillReturnResult(1)
+	mock.ExpectExec(regexp.QuoteMeta(queryUpdateExpiry)).WithArgs("AVITO_ADD", []int{1}, (*time.Time)(nil)).
+		WillReturnResult(pgxmock.NewResult("update", 1))
+	mock.ExpectCopyFrom(pgx.Identifier{operationsTable},
+		[]string{"user_id", "segment_slug", "date", "action", "auto_add", "source"}).
+		WillReturnResult(1)
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	results, err := storage.BulkUpdateUserSegments(ctx, expectedSegmentsToAdd, nil, expectedUserIDs)
+	require.NoError(t, err)
+
+	require.Equal(t, []models.BulkUserResult{
+		{UserID: 1, Added: []string{"AVITO_ADD"}},
+	}, results)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_BulkUpdateUserSegmentsSegmentNotExist(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	queryCheckSegments := fmt.Sprintf(`
+		SELECT slug
+		FROM %s
+		WHERE slug = ANY($1)
+	`, segmentsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegments)).WithArgs([]string{"AVITO_ADD"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug"}))
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	_, err = storage.BulkUpdateUserSegments(ctx, []models.UserSegment{{Slug: "AVITO_ADD"}}, []string{}, []int{1})
+	require.ErrorIs(t, err, custom_error.CustomError{Field: "segments", Message: "AVITO_ADD doesn't exist"})
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_CreateUser(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1
+
+	segment := models.Segment{
+		Slug:       "TEST",
+		Percentage: 100,
+		Salt:       "salt",
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+	`, usersTable)
+
+	querySelectSegments := fmt.Sprintf(`
+		SELECT slug, auto_add_percentage, salt, COALESCE(parent_slug, '')
+		FROM %s
+		WHERE auto_add_percentage > 0
+		  AND (starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1)
+	`, segmentsTable)
+
+	queryInsertUserSegment := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
+	`, userSegmentsTable)
+
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, operationsTable)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegments)).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "auto_add_percentage", "salt", "parent_slug"}).
+			AddRow(segment.Slug, segment.Percentage, segment.Salt, segment.Parent))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperiments)).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "salt", "segment_slug", "weight"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusions)).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug", "segment_slug"}))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).
+		WithArgs(expectedUserID, segment.Slug, (*time.Time)(nil), true, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertOperation)).
+		WithArgs(expectedUserID, segment.Slug, pgxmock.AnyArg(), "add", true, models.OperationSourceAutoAdd).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.CreateUser(ctx, expectedUserID)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_CreateUserAlreadyExists(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1
+	expectedError := custom_error.CustomError{
+		Field:   "user_id",
+		Message: "User (1) already exists",
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+	`, usersTable)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnError(&pgconn.PgError{Code: "23505"})
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.CreateUser(ctx, expectedUserID)
+	require.ErrorIs(t, err, expectedError)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_DeleteUser(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1
+	expectedSegments := []string{"AVITO_TEST1", "AVITO_TEST2"}
+
+	queryDeleteUserSegments := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE user_id = $1
+		RETURNING segment_slug
+	`, userSegmentsTable)
+
+	queryDeleteUser := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE id = $1
+	`, usersTable)
+
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, false, $5)
+	`, operationsTable)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(queryDeleteUserSegments)).WithArgs(expectedUserID).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug"}).
+			AddRow(expectedSegments[0]).
+			AddRow(expectedSegments[1]))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteUser)).WithArgs(expectedUserID).
+		WillReturnResult(pgxmock.NewResult("delete", 1))
+	for _, segment := range expectedSegments {
+		mock.ExpectExec(regexp.QuoteMeta(queryInsertOperation)).
+			WithArgs(expectedUserID, segment, pgxmock.AnyArg(), "delete", models.OperationSourceUserDelete).
+			WillReturnResult(pgxmock.NewResult("insert", 1))
+	}
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.DeleteUser(ctx, expectedUserID)
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_DeleteUserNotExist(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1
+	expectedError := custom_error.NotFoundError{
+		Field:   "id",
+		Message: "User (1) doesn't exist",
+	}
+
+	queryDeleteUserSegments := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE user_id = $1
+		RETURNING segment_slug
+	`, userSegmentsTable)
+
+	queryDeleteUser := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE id = $1
+	`, usersTable)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(queryDeleteUserSegments)).WithArgs(expectedUserID).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug"}))
+	mock.ExpectExec(regexp.QuoteMeta(queryDeleteUser)).WithArgs(expectedUserID).
+		WillReturnResult(pgxmock.NewResult("delete", 0))
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	err = storage.DeleteUser(ctx, expectedUserID)
+	require.ErrorIs(t, err, expectedError)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_BulkUpdateUserSegmentsNewUsers(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedSegmentsToAdd := []models.UserSegment{{Slug: "AVITO_ADD"}}
+	expectedUserIDs := []int{1, 2}
+
+	segment := models.Segment{
+		Slug:       "AVITO_PERCENTAGE",
+		Percentage: 100,
+		Salt:       "salt",
+	}
+
+	queryCheckSegments := fmt.Sprintf(`
+		SELECT slug
+		FROM %s
+		WHERE slug = ANY($1)
+	`, segmentsTable)
+
+	querySelectUserSegments := fmt.Sprintf(`
+		SELECT user_id, segment_slug
+		FROM %s
+		WHERE user_id = ANY($1) AND segment_slug = ANY($2)
+	`, userSegmentsTable)
+
+	queryRegisterUsers := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		SELECT unnest($1::integer[]), $2
+		ON CONFLICT (id) DO NOTHING
+		RETURNING id
+	`, usersTable)
+
+	querySelectSegments := fmt.Sprintf(`
+		SELECT slug, auto_add_percentage, salt, COALESCE(parent_slug, '')
+		FROM %s
+		WHERE auto_add_percentage > 0
+		  AND (starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1)
+	`, segmentsTable)
+
+	mock.ExpectQuery(regexp.QuoteMeta(queryCheckSegments)).WithArgs([]string{"AVITO_ADD"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug"}).AddRow("AVITO_ADD"))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperimentVariants)).WithArgs([]string{"AVITO_ADD"}).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug", "experiment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusions)).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug", "segment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegmentParents)).WithArgs([]string{"AVITO_ADD"}).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "parent_slug"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectUserSegments)).WithArgs(expectedUserIDs, []string{"AVITO_ADD"}).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_slug"}))
+	mock.ExpectQuery(regexp.QuoteMeta(queryRegisterUsers)).WithArgs(expectedUserIDs, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegments)).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "auto_add_percentage", "salt", "parent_slug"}).
+			AddRow(segment.Slug, segment.Percentage, segment.Salt, segment.Parent))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperiments)).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "salt", "segment_slug", "weight"}))
+	mock.ExpectCopyFrom(pgx.Identifier{userSegmentsTable},
+		[]string{"user_id", "segment_slug", "expires_at", "auto_add", "added_at"}).
+		WillReturnResult(3)
+	mock.ExpectCopyFrom(pgx.Identifier{operationsTable},
+		[]string{"user_id", "segment_slug", "date", "action", "auto_add", "source"}).
+		WillReturnResult(3)
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	results, err := storage.BulkUpdateUserSegments(ctx, expectedSegmentsToAdd, []string{}, expectedUserIDs)
+	require.NoError(t, err)
+
+	require.Equal(t, []models.BulkUserResult{
+		{UserID: 1, Added: []string{"AVITO_ADD"}},
+		{UserID: 2, Added: []string{"AVITO_ADD"}},
+	}, results)
+
+	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
+}
+
+func TestStorage_GetActiveSegmentsNewUser(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+
+	expectedUserID := 1
+
+	segments := []models.Segment{
+		{Slug: "TEST_ALL", Percentage: 100, Salt: "salt"},
+		{Slug: "TEST_NONE", Percentage: 0, Salt: "salt"},
+	}
+
+	queryRegisterUser := fmt.Sprintf(`
+		INSERT INTO %s (id, created_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, usersTable)
+
+	querySelectSegments := fmt.Sprintf(`
+		SELECT slug, auto_add_percentage, salt, COALESCE(parent_slug, '')
+		FROM %s
+		WHERE auto_add_percentage > 0
+		  AND (starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1)
+	`, segmentsTable)
+
+	queryInsertUserSegment := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, expires_at, auto_add, added_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (segment_slug, user_id) DO NOTHING
+	`, userSegmentsTable)
+
+	queryInsertOperation := fmt.Sprintf(`
+		INSERT INTO %s (user_id, segment_slug, date, action, auto_add, source)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, operationsTable)
+
+	query := fmt.Sprintf(`
+		SELECT us.segment_slug
+		FROM %s us
+		JOIN %s s ON s.slug = us.segment_slug
+		WHERE us.user_id = $1 AND (us.expires_at IS NULL OR us.expires_at > $2)
+		  AND (s.starts_at IS NULL OR s.starts_at <= $2) AND (s.ends_at IS NULL OR s.ends_at > $2)
+	`, userSegmentsTable, segmentsTable)
+
+	segmentRows := pgxmock.NewRows([]string{"slug", "auto_add_percentage", "salt", "parent_slug"})
+	for _, segment := range segments {
+		segmentRows.AddRow(segment.Slug, segment.Percentage, segment.Salt, segment.Parent)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(queryRegisterUser)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectSegments)).WithArgs(pgxmock.AnyArg()).WillReturnRows(segmentRows)
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExperiments)).
+		WillReturnRows(pgxmock.NewRows([]string{"slug", "salt", "segment_slug", "weight"}))
+	mock.ExpectQuery(regexp.QuoteMeta(querySelectExclusions)).
+		WillReturnRows(pgxmock.NewRows([]string{"group_slug", "segment_slug", "segment_slug"}))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertUserSegment)).
+		WithArgs(expectedUserID, "TEST_ALL", (*time.Time)(nil), true, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectExec(regexp.QuoteMeta(queryInsertOperation)).
+		WithArgs(expectedUserID, "TEST_ALL", pgxmock.AnyArg(), "add", true, models.OperationSourceAutoAdd).
+		WillReturnResult(pgxmock.NewResult("insert", 1))
+	mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(expectedUserID, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_slug"}).AddRow("TEST_ALL"))
+	mock.ExpectCommit()
+
+	storage := NewStoragePostgres()
+	storage.db = mock
+
+	userSegments, err := storage.GetActiveSegments(ctx, expectedUserID)
 	require.NoError(t, err)
+	require.Equal(t, []string{"TEST_ALL"}, userSegments)
 
 	require.NoError(t, mock.ExpectationsWereMet(), "there was unexpected result")
 }
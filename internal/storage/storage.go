@@ -9,20 +9,64 @@ import (
 type SegmentStorage interface {
 	CreateSegment(ctx context.Context, segment models.Segment) error
 	DeleteSegment(ctx context.Context, slug string) error
+	GetSegments(ctx context.Context, prefix string, limit, offset int) ([]models.Segment, error)
+	GetSegment(ctx context.Context, slug string) (models.Segment, error)
+	UpdateSegment(ctx context.Context, slug string, update models.SegmentUpdate) error
+	GetSegmentStats(ctx context.Context, slug string, from, to time.Time) (models.SegmentStats, error)
+	RollupSegmentStats(ctx context.Context, until time.Time) (int, error)
+	ApplySegmentWindows(ctx context.Context, now time.Time) (int, error)
+	GetSegmentWindowEvents(ctx context.Context, slug string) ([]models.SegmentWindowEvent, error)
+}
+
+type ExperimentStorage interface {
+	CreateExperiment(ctx context.Context, experiment models.Experiment) error
+	GetExperiment(ctx context.Context, slug string) (models.Experiment, error)
+	DeleteExperiment(ctx context.Context, slug string) error
+}
+
+type ExclusionGroupStorage interface {
+	CreateExclusionGroup(ctx context.Context, group models.ExclusionGroup) error
+	GetExclusionGroup(ctx context.Context, slug string) (models.ExclusionGroup, error)
+	DeleteExclusionGroup(ctx context.Context, slug string) error
 }
 
 type UserStorage interface {
-	UpdateUserSegments(ctx context.Context, segmentsToAdd, segmentsToDelete []string, userID int) error
+	CreateUser(ctx context.Context, userID int) error
+	DeleteUser(ctx context.Context, userID int) error
+	UpdateUserSegments(ctx context.Context, segmentsToAdd []models.UserSegment, segmentsToDelete []string, userID int) error
+	BulkUpdateUserSegments(ctx context.Context, segmentsToAdd []models.UserSegment, segmentsToDelete []string, userIDs []int) ([]models.BulkUserResult, error)
 	GetActiveSegments(ctx context.Context, userID int) ([]string, error)
-	AutoAddUserSegments(ctx context.Context) error
+	AutoAddUserSegments(ctx context.Context) (bool, error)
+	DeleteExpiredUserSegments(ctx context.Context) error
+	GetSegmentUsers(ctx context.Context, slug string, afterUserID, limit int) ([]models.UserSegment, error)
+	SetUserAttributes(ctx context.Context, userID int, attributes map[string]any) error
 }
 
 type OperationStorage interface {
-	GetOperations(ctx context.Context, date time.Time) ([]models.Operation, error)
+	ForEachOperation(ctx context.Context, filter models.OperationFilter, fn func(operation models.Operation) error) error
+	GetUserOperations(ctx context.Context, userID int, filter models.UserHistoryFilter) ([]models.Operation, error)
+	GetUserSegmentsAt(ctx context.Context, userID int, at time.Time) ([]string, error)
+	CreateUserSegmentsSnapshots(ctx context.Context, at time.Time, minOperations, limit int) (int, error)
+}
+
+type ReportStorage interface {
+	CreateReport(ctx context.Context, report models.Report) error
+	ClaimReport(ctx context.Context) (*models.Report, error)
+	FinishReport(ctx context.Context, id string, rows, size int64) (bool, error)
+	FailReport(ctx context.Context, id string, message string) (bool, error)
+	FailStaleReports(ctx context.Context, staleBefore time.Time, message string) (int, error)
+	GetReport(ctx context.Context, id string) (models.Report, error)
+	DeleteReport(ctx context.Context, id string) (models.Report, error)
+	SetMissingReportsExpiry(ctx context.Context, retention time.Duration) (int, error)
+	GetExpiredReports(ctx context.Context, now time.Time, limit int) ([]models.Report, error)
+	GetExistingReportIDs(ctx context.Context, ids []string) ([]string, error)
 }
 
 type Storage interface {
 	SegmentStorage
+	ExperimentStorage
+	ExclusionGroupStorage
 	UserStorage
 	OperationStorage
+	ReportStorage
 }
@@ -0,0 +1,3 @@
+DROP INDEX idx_user_segments_expires_at;
+
+ALTER TABLE user_segments DROP COLUMN expires_at;
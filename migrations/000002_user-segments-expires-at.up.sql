@@ -0,0 +1,3 @@
+ALTER TABLE user_segments ADD COLUMN expires_at TIMESTAMPTZ;
+
+CREATE INDEX idx_user_segments_expires_at ON user_segments (expires_at) WHERE expires_at IS NOT NULL;
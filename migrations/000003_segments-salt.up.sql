@@ -0,0 +1 @@
+ALTER TABLE segments ADD COLUMN salt VARCHAR(36) NOT NULL DEFAULT md5(random()::text);
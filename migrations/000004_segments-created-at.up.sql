@@ -0,0 +1 @@
+ALTER TABLE segments ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
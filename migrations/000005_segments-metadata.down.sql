@@ -0,0 +1,5 @@
+ALTER TABLE user_segments DROP COLUMN added_at;
+ALTER TABLE user_segments DROP COLUMN auto_add;
+
+ALTER TABLE segments DROP COLUMN owner;
+ALTER TABLE segments DROP COLUMN description;
@@ -0,0 +1,15 @@
+ALTER TABLE segments ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE segments ADD COLUMN owner VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE user_segments ADD COLUMN auto_add BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE user_segments ADD COLUMN added_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+UPDATE user_segments us
+SET auto_add = o.auto_add, added_at = o.date
+FROM (
+    SELECT DISTINCT ON (user_id, segment_slug) user_id, segment_slug, auto_add, date
+    FROM operations
+    WHERE action = 'add'
+    ORDER BY user_id, segment_slug, date DESC
+) o
+WHERE us.user_id = o.user_id AND us.segment_slug = o.segment_slug;
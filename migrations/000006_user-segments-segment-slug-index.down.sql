@@ -0,0 +1 @@
+DROP INDEX idx_user_segments_segment_slug_user_id;
@@ -0,0 +1,3 @@
+ALTER TABLE user_segments DROP CONSTRAINT fk_user_segments_user_id;
+
+DROP TABLE users;
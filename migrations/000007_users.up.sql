@@ -0,0 +1,17 @@
+CREATE TABLE users (
+    id INTEGER PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO users (id, created_at)
+SELECT user_id, min(date)
+FROM operations
+GROUP BY user_id;
+
+INSERT INTO users (id)
+SELECT DISTINCT user_id
+FROM user_segments
+ON CONFLICT (id) DO NOTHING;
+
+ALTER TABLE user_segments
+    ADD CONSTRAINT fk_user_segments_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE NO ACTION;
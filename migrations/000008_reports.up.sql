@@ -0,0 +1,12 @@
+CREATE TABLE reports (
+    id UUID PRIMARY KEY,
+    status VARCHAR(16) NOT NULL,
+    params JSONB NOT NULL,
+    rows_count BIGINT NOT NULL DEFAULT 0,
+    size BIGINT NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_reports_status_created_at ON reports (status, created_at);
@@ -0,0 +1 @@
+ALTER TABLE reports ADD COLUMN gzip BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1 @@
+ALTER TABLE reports ADD COLUMN format VARCHAR(16) NOT NULL DEFAULT 'csv';
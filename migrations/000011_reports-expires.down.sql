@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_reports_expires_at;
+
+ALTER TABLE reports DROP COLUMN expires_at;
@@ -0,0 +1,6 @@
+ALTER TABLE reports ADD COLUMN expires_at TIMESTAMPTZ;
+
+-- reports created before retention expire after the default retention period
+UPDATE reports SET expires_at = created_at + INTERVAL '7 days';
+
+CREATE INDEX idx_reports_expires_at ON reports (expires_at);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_operations_user_id_id;
+CREATE INDEX idx_operations_user_id ON operations (user_id);
+
+ALTER TABLE operations DROP COLUMN source;
+ALTER TABLE operations DROP COLUMN id;
@@ -0,0 +1,11 @@
+ALTER TABLE operations ADD COLUMN id BIGSERIAL PRIMARY KEY;
+ALTER TABLE operations ADD COLUMN source VARCHAR(16);
+
+-- the source of older operations is only known for auto added segments, the rest are recorded as manual
+UPDATE operations
+SET source = CASE WHEN auto_add THEN 'auto_add' ELSE 'manual' END;
+
+ALTER TABLE operations ALTER COLUMN source SET NOT NULL;
+
+DROP INDEX IF EXISTS idx_operations_user_id;
+CREATE INDEX idx_operations_user_id_id ON operations (user_id, id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_operations_user_id_date;
+
+DROP TABLE IF EXISTS user_segments_snapshots;
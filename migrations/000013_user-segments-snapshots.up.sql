@@ -0,0 +1,9 @@
+-- a snapshot is the set of segments of the user after all operations made at or before taken_at
+CREATE TABLE user_segments_snapshots (
+    user_id INTEGER NOT NULL,
+    taken_at TIMESTAMPTZ NOT NULL,
+    segments VARCHAR(255)[] NOT NULL,
+    PRIMARY KEY (user_id, taken_at)
+);
+
+CREATE INDEX idx_operations_user_id_date ON operations (user_id, date);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_operations_segment_slug_date;
+
+DROP TABLE IF EXISTS segment_stats_rollup;
+DROP TABLE IF EXISTS segment_daily_stats;
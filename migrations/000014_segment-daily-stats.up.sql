@@ -0,0 +1,18 @@
+CREATE TABLE segment_daily_stats (
+    segment_slug VARCHAR(255) NOT NULL,
+    day DATE NOT NULL,
+    manual_adds INTEGER NOT NULL,
+    auto_adds INTEGER NOT NULL,
+    deletes INTEGER NOT NULL,
+    PRIMARY KEY (segment_slug, day)
+);
+
+-- days before rolled_until (UTC) are aggregated into segment_daily_stats, later days are read from operations
+CREATE TABLE segment_stats_rollup (
+    id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    rolled_until DATE
+);
+
+INSERT INTO segment_stats_rollup (rolled_until) VALUES (NULL);
+
+CREATE INDEX idx_operations_segment_slug_date ON operations (segment_slug, date);
@@ -0,0 +1,14 @@
+CREATE TABLE experiments (
+    slug VARCHAR(255) PRIMARY KEY,
+    salt VARCHAR(36) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- a variant is a segment of the experiment, a segment is a variant of one experiment at most
+CREATE TABLE experiment_variants (
+    segment_slug VARCHAR(255) PRIMARY KEY REFERENCES segments (slug) ON DELETE CASCADE,
+    experiment_slug VARCHAR(255) NOT NULL REFERENCES experiments (slug) ON DELETE CASCADE,
+    weight SMALLINT NOT NULL
+);
+
+CREATE INDEX idx_experiment_variants_experiment_slug ON experiment_variants (experiment_slug);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS exclusion_group_segments;
+DROP TABLE IF EXISTS exclusion_groups;
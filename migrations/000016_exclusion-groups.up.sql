@@ -0,0 +1,13 @@
+CREATE TABLE exclusion_groups (
+    slug VARCHAR(255) PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- a user can have one segment of a group at most, a segment can be in several groups
+CREATE TABLE exclusion_group_segments (
+    group_slug VARCHAR(255) NOT NULL REFERENCES exclusion_groups (slug) ON DELETE CASCADE,
+    segment_slug VARCHAR(255) NOT NULL REFERENCES segments (slug) ON DELETE CASCADE,
+    PRIMARY KEY (group_slug, segment_slug)
+);
+
+CREATE INDEX idx_exclusion_group_segments_segment_slug ON exclusion_group_segments (segment_slug);
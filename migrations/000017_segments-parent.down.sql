@@ -0,0 +1,3 @@
+DROP INDEX idx_segments_parent_slug;
+
+ALTER TABLE segments DROP COLUMN parent_slug;
@@ -0,0 +1,4 @@
+-- a child segment can only be assigned to users who are in its parent segment
+ALTER TABLE segments ADD COLUMN parent_slug VARCHAR(255) REFERENCES segments (slug) ON DELETE RESTRICT;
+
+CREATE INDEX idx_segments_parent_slug ON segments (parent_slug) WHERE parent_slug IS NOT NULL;
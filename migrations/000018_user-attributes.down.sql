@@ -0,0 +1,3 @@
+ALTER TABLE segments DROP COLUMN rule;
+
+DROP TABLE IF EXISTS user_attributes;
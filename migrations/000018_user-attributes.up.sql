@@ -0,0 +1,9 @@
+-- attributes of a user, rule segments are assigned by them
+CREATE TABLE user_attributes (
+    user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    attributes JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+-- a segment with a rule is assigned to users whose attributes match it
+ALTER TABLE segments ADD COLUMN rule TEXT;
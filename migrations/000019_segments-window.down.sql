@@ -0,0 +1,3 @@
+ALTER TABLE segments DROP COLUMN window_open;
+ALTER TABLE segments DROP COLUMN ends_at;
+ALTER TABLE segments DROP COLUMN starts_at;
@@ -0,0 +1,5 @@
+-- a segment with a window takes effect only from starts_at to ends_at, missing bounds are open
+ALTER TABLE segments ADD COLUMN starts_at TIMESTAMPTZ;
+ALTER TABLE segments ADD COLUMN ends_at TIMESTAMPTZ;
+-- whether the window was open at the last run of the scheduler, which records operations when it opens or closes
+ALTER TABLE segments ADD COLUMN window_open BOOLEAN NOT NULL DEFAULT true;
@@ -0,0 +1,9 @@
+-- changes of segment windows, they aren't membership operations, so stats, snapshots and reports don't see them
+CREATE TABLE segment_window_events (
+    id BIGSERIAL PRIMARY KEY,
+    segment_slug VARCHAR(255) NOT NULL REFERENCES segments (slug) ON DELETE CASCADE,
+    action VARCHAR(5) NOT NULL,
+    date TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_segment_window_events_segment_slug ON segment_window_events (segment_slug);
@@ -0,0 +1,2 @@
+DROP INDEX idx_user_segments_segment_slug_user_id;
+CREATE INDEX idx_user_segments_segment_slug_user_id ON user_segments (segment_slug, user_id);
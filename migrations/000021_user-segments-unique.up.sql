@@ -0,0 +1,9 @@
+-- concurrent adds could give the user the same segment twice, the earliest add is kept
+DELETE FROM user_segments a
+USING user_segments b
+WHERE a.user_id = b.user_id
+  AND a.segment_slug = b.segment_slug
+  AND (a.added_at, a.ctid) > (b.added_at, b.ctid);
+
+DROP INDEX idx_user_segments_segment_slug_user_id;
+CREATE UNIQUE INDEX idx_user_segments_segment_slug_user_id ON user_segments (segment_slug, user_id);
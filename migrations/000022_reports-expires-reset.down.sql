@@ -0,0 +1 @@
+-- expiries reset by the up migration are set from the configured retention at startup, there is nothing to restore
@@ -0,0 +1,3 @@
+-- 000011 gave existing reports a fixed expiry of 7 days, the service sets the expiry of reports without one
+-- from the configured retention at startup. Reports created with a 7 days retention get the same expiry back.
+UPDATE reports SET expires_at = NULL WHERE expires_at = created_at + INTERVAL '7 days';
@@ -0,0 +1,5 @@
+ALTER TABLE user_segments_snapshots DROP COLUMN visible;
+
+DROP INDEX idx_operations_user_id_xid;
+
+ALTER TABLE operations DROP COLUMN xid;
@@ -0,0 +1,11 @@
+-- an operation is stamped with the transaction that made it. A snapshot keeps the transactions visible
+-- when it was taken, so an operation dated at or before the snapshot but committed later is detected
+-- and the snapshot is not used anymore
+ALTER TABLE operations ADD COLUMN xid xid8 NOT NULL DEFAULT pg_current_xact_id();
+
+CREATE INDEX idx_operations_user_id_xid ON operations (user_id, xid);
+
+-- existing snapshots cannot be checked, they are taken again by the snapshot job
+DELETE FROM user_segments_snapshots;
+
+ALTER TABLE user_segments_snapshots ADD COLUMN visible pg_snapshot NOT NULL;
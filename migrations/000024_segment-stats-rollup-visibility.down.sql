@@ -0,0 +1,3 @@
+DROP INDEX idx_operations_xid;
+
+ALTER TABLE segment_stats_rollup DROP COLUMN visible;
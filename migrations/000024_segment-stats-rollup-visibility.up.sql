@@ -0,0 +1,8 @@
+-- the rollup keeps the transactions visible when it ran, so rolled up days which got operations
+-- committed later are aggregated again
+ALTER TABLE segment_stats_rollup ADD COLUMN visible pg_snapshot;
+
+CREATE INDEX idx_operations_xid ON operations (xid);
+
+-- days rolled up before could miss operations committed after them, they are aggregated again
+UPDATE segment_stats_rollup SET rolled_until = NULL;